@@ -0,0 +1,109 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/cmd/cdc/exporter"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	remoteDbAddress string
+	chaindata       string
+	outputDir       string
+	rotateSize      int64
+	httpAddress     string
+	pollInterval    time.Duration
+)
+
+func init() {
+	rootCmd.Flags().StringVar(&remoteDbAddress, "remote-db-addr", "", "address of remote DB listener of a turbo-geth node")
+	rootCmd.Flags().StringVar(&chaindata, "chaindata", "", "path to the database")
+	rootCmd.Flags().StringVar(&outputDir, "output", "cdc", "directory of the files with the state diffs")
+	rootCmd.Flags().Int64Var(&rotateSize, "rotate-size", 256*1024*1024, "size of the file after which the next file is started")
+	rootCmd.Flags().StringVar(&httpAddress, "http.addr", "localhost:8547", "address of the HTTP endpoint to follow the diffs, empty to disable")
+	rootCmd.Flags().DurationVar(&pollInterval, "poll", 5*time.Second, "how often the new blocks are looked for")
+}
+
+var rootCmd = &cobra.Command{
+	Use:   "cdc",
+	Short: "cdc exports the state diffs of the executed blocks into JSONL files, and serves them over HTTP",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return run(cmd.Context())
+	},
+}
+
+func run(ctx context.Context) error {
+	var db ethdb.KV
+	var err error
+	if remoteDbAddress != "" {
+		db, err = ethdb.NewRemote().Path(remoteDbAddress).Open()
+	} else if chaindata != "" {
+		database, errOpen := ethdb.Open(chaindata)
+		if errOpen != nil {
+			return errOpen
+		}
+		defer database.Close()
+		db = database.KV()
+	} else {
+		err = fmt.Errorf("either remote db or local db must be specified")
+	}
+	if err != nil {
+		return err
+	}
+
+	e, err := exporter.New(db, outputDir, rotateSize)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := e.Close(); err != nil {
+			log.Error("Closing CDC files", "err", err)
+		}
+	}()
+
+	if httpAddress != "" {
+		srv := &http.Server{Addr: httpAddress, Handler: e.Handler()}
+		go func() {
+			log.Info("CDC HTTP endpoint opened", "url", "http://"+httpAddress+"/events")
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Error("CDC HTTP endpoint", "err", err)
+			}
+		}()
+		defer srv.Close()
+	}
+	return e.Run(ctx, pollInterval)
+}
+
+func Execute() {
+	if err := rootCmd.ExecuteContext(rootContext()); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func rootContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(ch)
+
+		select {
+		case <-ch:
+			log.Info("Got interrupt, shutting down...")
+		case <-ctx.Done():
+		}
+
+		cancel()
+	}()
+	return ctx
+}
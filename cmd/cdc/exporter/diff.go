@@ -0,0 +1,171 @@
+package exporter
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/changeset"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/common/hexutil"
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+var emptyCodeHash = crypto.Keccak256Hash(nil)
+
+const (
+	EventBlock  = "block"
+	EventUnwind = "unwind"
+)
+
+// Event - one line of the CDC stream.
+// "block" event carries the state diff of the block, "unwind" event means that all blocks above Number
+// (which has hash Hash) are not canonical anymore and their diffs have to be reverted by the consumer
+type Event struct {
+	Seq      uint64           `json:"seq"`
+	Type     string           `json:"type"`
+	Number   uint64           `json:"number"`
+	Hash     common.Hash      `json:"hash"`
+	Accounts []AccountDiff    `json:"accounts,omitempty"`
+	Storage  []StorageDiff    `json:"storage,omitempty"`
+	Codes    []CodeDeployment `json:"codes,omitempty"`
+}
+
+// AccountDiff - Old is nil if the account is created in the block, New is nil if it's deleted
+type AccountDiff struct {
+	Address common.Address `json:"address"`
+	Old     *Account       `json:"old"`
+	New     *Account       `json:"new"`
+}
+
+type Account struct {
+	Nonce       uint64       `json:"nonce"`
+	Balance     *hexutil.Big `json:"balance"`
+	CodeHash    common.Hash  `json:"codeHash"`
+	Incarnation uint64       `json:"incarnation"`
+}
+
+type StorageDiff struct {
+	Address     common.Address `json:"address"`
+	Incarnation uint64         `json:"incarnation"`
+	Location    common.Hash    `json:"location"`
+	Old         common.Hash    `json:"old"`
+	New         common.Hash    `json:"new"`
+}
+
+// CodeDeployment - code of the contract created in the block
+type CodeDeployment struct {
+	Address  common.Address `json:"address"`
+	CodeHash common.Hash    `json:"codeHash"`
+	Code     hexutil.Bytes  `json:"code"`
+}
+
+// readBlockDiff builds the diff of the block from the plain changesets, which keep the values before the block.
+// The values after the block are the values before the next change of the same key, found by the history
+func readBlockDiff(tx ethdb.Tx, number uint64, hash common.Hash) (*Event, error) {
+	event := &Event{Type: EventBlock, Number: number, Hash: hash}
+	csKey := dbutils.EncodeTimestamp(number)
+
+	accountCS, _ := tx.Bucket(dbutils.PlainAccountChangeSetBucket).Get(csKey)
+	if len(accountCS) > 0 {
+		if err := changeset.AccountChangeSetPlainBytes(accountCS).Walk(func(k, v []byte) error {
+			diff := AccountDiff{Address: common.BytesToAddress(k)}
+			var err error
+			if diff.Old, err = decodeAccount(tx, k, v); err != nil {
+				return fmt.Errorf("old value of %x: %w", k, err)
+			}
+			newV, err := valueAfter(tx, false, k, number)
+			if err != nil {
+				return fmt.Errorf("new value of %x: %w", k, err)
+			}
+			if diff.New, err = decodeAccount(tx, k, newV); err != nil {
+				return fmt.Errorf("new value of %x: %w", k, err)
+			}
+			event.Accounts = append(event.Accounts, diff)
+
+			if code, err := deployedCode(tx, diff); err != nil {
+				return err
+			} else if code != nil {
+				event.Codes = append(event.Codes, *code)
+			}
+			return nil
+		}); err != nil {
+			return nil, fmt.Errorf("account changes of block %d: %w", number, err)
+		}
+	}
+
+	storageCS, _ := tx.Bucket(dbutils.PlainStorageChangeSetBucket).Get(csKey)
+	if len(storageCS) > 0 {
+		if err := changeset.StorageChangeSetPlainBytes(storageCS).Walk(func(k, v []byte) error {
+			newV, err := valueAfter(tx, true, k, number)
+			if err != nil {
+				return fmt.Errorf("new value of %x: %w", k, err)
+			}
+			event.Storage = append(event.Storage, StorageDiff{
+				Address:     common.BytesToAddress(k[:common.AddressLength]),
+				Incarnation: dbutils.DecodeIncarnation(k[common.AddressLength : common.AddressLength+common.IncarnationLength]),
+				Location:    common.BytesToHash(k[common.AddressLength+common.IncarnationLength:]),
+				Old:         common.BytesToHash(v),
+				New:         common.BytesToHash(newV),
+			})
+			return nil
+		}); err != nil {
+			return nil, fmt.Errorf("storage changes of block %d: %w", number, err)
+		}
+	}
+	return event, nil
+}
+
+// valueAfter returns the value of the key after the block, nil if the key doesn't exist
+func valueAfter(tx ethdb.Tx, storage bool, key []byte, number uint64) ([]byte, error) {
+	v, err := state.FindByHistory(tx, true, storage, key, number+1)
+	if err == nil {
+		return v, nil
+	}
+	if !errors.Is(err, ethdb.ErrKeyNotFound) {
+		return nil, err
+	}
+	v, _ = tx.Bucket(dbutils.PlainStateBucket).Get(key)
+	return v, nil
+}
+
+func decodeAccount(tx ethdb.Tx, address []byte, enc []byte) (*Account, error) {
+	if len(enc) == 0 {
+		return nil, nil
+	}
+	var acc accounts.Account
+	if err := acc.DecodeForStorage(enc); err != nil {
+		return nil, err
+	}
+	// changesets don't keep the code hash of the contracts, same as FindByHistory restore it by the incarnation
+	if acc.Incarnation > 0 && acc.IsEmptyCodeHash() {
+		codeHash, _ := tx.Bucket(dbutils.PlainContractCodeBucket).Get(dbutils.PlainGenerateStoragePrefix(address, acc.Incarnation))
+		if len(codeHash) > 0 {
+			acc.CodeHash = common.BytesToHash(codeHash)
+		}
+	}
+	return &Account{
+		Nonce:       acc.Nonce,
+		Balance:     (*hexutil.Big)(acc.Balance.ToBig()),
+		CodeHash:    acc.CodeHash,
+		Incarnation: acc.Incarnation,
+	}, nil
+}
+
+// deployedCode returns the code of the contract if the diff creates it
+func deployedCode(tx ethdb.Tx, diff AccountDiff) (*CodeDeployment, error) {
+	if diff.New == nil || diff.New.Incarnation == 0 || diff.New.CodeHash == (common.Hash{}) || diff.New.CodeHash == emptyCodeHash {
+		return nil, nil
+	}
+	if diff.Old != nil && diff.Old.Incarnation == diff.New.Incarnation && diff.Old.CodeHash == diff.New.CodeHash {
+		return nil, nil
+	}
+	code, _ := tx.Bucket(dbutils.CodeBucket).Get(diff.New.CodeHash[:])
+	if code == nil {
+		return nil, fmt.Errorf("code %x of contract %x not found", diff.New.CodeHash, diff.Address)
+	}
+	return &CodeDeployment{Address: diff.Address, CodeHash: diff.New.CodeHash, Code: common.CopyBytes(code)}, nil
+}
@@ -0,0 +1,281 @@
+package exporter
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+)
+
+const (
+	// MaxReorgDepth - number of the last exported blocks whose hashes are kept to find the common ancestor on reorg
+	MaxReorgDepth = 1024
+
+	flushEvery = 1000 // blocks
+)
+
+// Exporter tails the plain changesets written by the Execution stage, once they are indexed by the history index stages, and writes the state diffs of the blocks
+// into the files. When the exported blocks are not canonical anymore, or Execution is unwound below them,
+// an unwind event is written before the diffs of the new blocks
+type Exporter struct {
+	db ethdb.KV
+	fw *fileWriter
+
+	next    uint64                 // next block to export
+	hashes  map[uint64]common.Hash // hashes of the last exported blocks
+	lastSeq uint64
+
+	lock      sync.Mutex
+	published uint64        // sequence number of the last flushed event
+	notify    chan struct{} // closed when new events are flushed
+}
+
+func New(db ethdb.KV, dir string, rotateSize int64) (*Exporter, error) {
+	fw, events, err := openFileWriter(dir, rotateSize)
+	if err != nil {
+		return nil, err
+	}
+	e := &Exporter{db: db, fw: fw, hashes: map[uint64]common.Hash{}, notify: make(chan struct{})}
+	for i := range events {
+		e.apply(&events[i])
+	}
+	e.published = e.lastSeq
+	if len(events) > 0 {
+		log.Info("CDC exporter resumed", "seq", e.lastSeq, "block", e.next)
+	}
+	return e, nil
+}
+
+// apply updates the state of the exporter by the written event
+func (e *Exporter) apply(event *Event) {
+	e.lastSeq = event.Seq
+	switch event.Type {
+	case EventBlock:
+		e.hashes[event.Number] = event.Hash
+		e.next = event.Number + 1
+		delete(e.hashes, event.Number-MaxReorgDepth)
+	case EventUnwind:
+		for n := event.Number + 1; n < e.next; n++ {
+			delete(e.hashes, n)
+		}
+		e.next = event.Number + 1
+	}
+}
+
+func (e *Exporter) write(event *Event) error {
+	event.Seq = e.lastSeq + 1
+	if err := e.fw.write(event); err != nil {
+		return err
+	}
+	e.apply(event)
+	return nil
+}
+
+func (e *Exporter) flush() error {
+	if err := e.fw.flush(); err != nil {
+		return err
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.published != e.lastSeq {
+		e.published = e.lastSeq
+		close(e.notify)
+		e.notify = make(chan struct{})
+	}
+	return nil
+}
+
+func (e *Exporter) Close() error {
+	return e.fw.close()
+}
+
+// Run exports the new blocks every interval until the context is cancelled
+func (e *Exporter) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := e.Sync(ctx); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sync exports all blocks executed so far
+func (e *Exporter) Sync(ctx context.Context) error {
+	var target uint64
+	var ok bool
+	if err := e.db.View(ctx, func(tx ethdb.Tx) error {
+		var err error
+		target, ok, err = exportTarget(tx)
+		if err != nil || !ok {
+			return err
+		}
+		return e.unwindIfNeeded(tx, target)
+	}); err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+	for e.next <= target {
+		to := e.next + flushEvery
+		if to > target+1 {
+			to = target + 1
+		}
+		if err := e.db.View(ctx, func(tx ethdb.Tx) error {
+			for e.next < to {
+				hash, err := canonicalHash(tx, e.next)
+				if err != nil {
+					return err
+				}
+				event, err := readBlockDiff(tx, e.next, hash)
+				if err != nil {
+					return err
+				}
+				// advances e.next
+				if err := e.write(event); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if err := e.flush(); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-logEvery.C:
+			log.Info("CDC export", "block", e.next-1, "target", target, "seq", e.lastSeq)
+		default:
+		}
+	}
+	return e.flush()
+}
+
+// unwindIfNeeded writes the unwind event if some of the exported blocks are not canonical or not executed anymore
+func (e *Exporter) unwindIfNeeded(tx ethdb.Tx, target uint64) error {
+	if len(e.hashes) == 0 {
+		return nil
+	}
+	last := e.next - 1
+	n := last
+	if n > target {
+		n = target
+	}
+	for ; ; n-- {
+		exported, ok := e.hashes[n]
+		if !ok {
+			return fmt.Errorf("reorg deeper than %d blocks, exported block %d is not canonical", MaxReorgDepth, last)
+		}
+		canonical, err := canonicalHash(tx, n)
+		if err != nil {
+			return err
+		}
+		if canonical == exported {
+			break
+		}
+		if n == 0 {
+			return fmt.Errorf("exported genesis %x is not canonical", exported)
+		}
+	}
+	if n == last {
+		return nil
+	}
+	log.Warn("CDC unwind", "from", last, "to", n)
+	if err := e.write(&Event{Type: EventUnwind, Number: n, Hash: e.hashes[n]}); err != nil {
+		return err
+	}
+	return e.flush()
+}
+
+// exportTarget returns the last block executed and indexed, and not going to be unwound, or false if
+// the stages have not made any progress yet.
+// New values of the keys are found by the history index, so the blocks not indexed yet can't be exported
+func exportTarget(tx ethdb.Tx) (uint64, bool, error) {
+	progress := tx.Bucket(dbutils.SyncStageProgress)
+	target := ^uint64(0)
+	for _, stage := range []stages.SyncStage{stages.Execution, stages.AccountHistoryIndex, stages.StorageHistoryIndex} {
+		v, err := progress.Get([]byte{byte(stage)})
+		if err != nil && err != ethdb.ErrKeyNotFound {
+			return 0, false, err
+		}
+		if len(v) < 8 {
+			return 0, false, nil
+		}
+		if p := binary.BigEndian.Uint64(v[:8]); p < target {
+			target = p
+		}
+	}
+	v, err := tx.Bucket(dbutils.SyncStageUnwind).Get([]byte{byte(stages.Execution)})
+	if err != nil && err != ethdb.ErrKeyNotFound {
+		return 0, false, err
+	}
+	if len(v) >= 8 {
+		if unwindPoint := binary.BigEndian.Uint64(v[:8]); unwindPoint > 0 && unwindPoint < target {
+			target = unwindPoint
+		}
+	}
+	return target, true, nil
+}
+
+func canonicalHash(tx ethdb.Tx, number uint64) (common.Hash, error) {
+	v, err := tx.Bucket(dbutils.HeaderPrefix).Get(dbutils.HeaderHashKey(number))
+	if err != nil && err != ethdb.ErrKeyNotFound {
+		return common.Hash{}, err
+	}
+	if len(v) != common.HashLength {
+		return common.Hash{}, fmt.Errorf("canonical hash of block %d not found", number)
+	}
+	return common.BytesToHash(v), nil
+}
+
+// LastSeq returns the sequence number of the last event available to the readers
+func (e *Exporter) LastSeq() uint64 {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.published
+}
+
+// Wait returns the channel closed when the events after seq are available, or nil if they are available already
+func (e *Exporter) Wait(seq uint64) <-chan struct{} {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.published > seq {
+		return nil
+	}
+	return e.notify
+}
+
+// Read returns at most limit events starting from the sequence number from
+func (e *Exporter) Read(from uint64, limit int) ([]json.RawMessage, error) {
+	last := e.LastSeq()
+	if from > last {
+		return nil, nil
+	}
+	if uint64(limit) > last-from+1 {
+		limit = int(last - from + 1)
+	}
+	return e.fw.read(from, limit)
+}
@@ -0,0 +1,215 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+var (
+	addrA = common.HexToAddress("0xa")
+	addrC = common.HexToAddress("0xc")
+	code  = []byte{0x60, 0x00}
+	slot  = common.HexToHash("0x1")
+)
+
+func account(balance uint64, incarnation uint64) *accounts.Account {
+	acc := accounts.NewAccount()
+	acc.Initialised = true
+	acc.Balance.SetUint64(balance)
+	acc.Incarnation = incarnation
+	if incarnation > 0 {
+		acc.CodeHash = crypto.Keccak256Hash(code)
+	}
+	return &acc
+}
+
+// writeBlock executes a fake block: applies the changes via the plain state writer and moves the Execution and history index stages
+func writeBlock(t *testing.T, db ethdb.Database, number uint64, hash common.Hash, f func(w *state.PlainStateWriter)) {
+	w := state.NewPlainStateWriter(db, number)
+	f(w)
+	require.NoError(t, w.WriteChangeSets())
+	require.NoError(t, w.WriteHistory())
+	rawdb.WriteCanonicalHash(db, hash, number)
+	for _, stage := range []stages.SyncStage{stages.Execution, stages.AccountHistoryIndex, stages.StorageHistoryIndex} {
+		require.NoError(t, stages.SaveStageProgress(db, stage, number, nil))
+	}
+}
+
+func TestExporter(t *testing.T) {
+	ctx := context.Background()
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	dir, err := ioutil.TempDir("", "cdc")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	empty := accounts.NewAccount()
+	writeBlock(t, db, 0, common.HexToHash("0x100"), func(w *state.PlainStateWriter) {
+		require.NoError(t, w.UpdateAccountData(ctx, addrA, &empty, account(1, 0)))
+	})
+	writeBlock(t, db, 1, common.HexToHash("0x101"), func(w *state.PlainStateWriter) {
+		require.NoError(t, w.UpdateAccountData(ctx, addrA, account(1, 0), account(2, 0)))
+		require.NoError(t, w.CreateContract(addrC))
+		require.NoError(t, w.UpdateAccountCode(addrC, 1, crypto.Keccak256Hash(code), code))
+		require.NoError(t, w.WriteAccountStorage(ctx, addrC, 1, &slot, uint256.NewInt(), uint256.NewInt().SetUint64(5)))
+		require.NoError(t, w.UpdateAccountData(ctx, addrC, &empty, account(0, 1)))
+	})
+	writeBlock(t, db, 2, common.HexToHash("0x102"), func(w *state.PlainStateWriter) {
+		require.NoError(t, w.WriteAccountStorage(ctx, addrC, 1, &slot, uint256.NewInt().SetUint64(5), uint256.NewInt().SetUint64(6)))
+	})
+
+	e, err := New(db.KV(), dir, 1024)
+	require.NoError(t, err)
+	require.NoError(t, e.Sync(ctx))
+	require.Equal(t, uint64(3), e.LastSeq())
+
+	events := readAll(t, e)
+	require.Len(t, events, 3)
+	assert.Equal(t, EventBlock, events[0].Type)
+	require.Len(t, events[0].Accounts, 1)
+	assert.Nil(t, events[0].Accounts[0].Old)
+	assert.Equal(t, uint64(1), events[0].Accounts[0].New.Balance.ToInt().Uint64())
+
+	block1 := events[1]
+	assert.Equal(t, uint64(1), block1.Number)
+	assert.Equal(t, common.HexToHash("0x101"), block1.Hash)
+	require.Len(t, block1.Accounts, 2)
+	assert.Equal(t, addrA, block1.Accounts[0].Address)
+	assert.Equal(t, uint64(1), block1.Accounts[0].Old.Balance.ToInt().Uint64())
+	assert.Equal(t, uint64(2), block1.Accounts[0].New.Balance.ToInt().Uint64())
+	assert.Equal(t, addrC, block1.Accounts[1].Address)
+	assert.Nil(t, block1.Accounts[1].Old)
+	assert.Equal(t, crypto.Keccak256Hash(code), block1.Accounts[1].New.CodeHash)
+	require.Len(t, block1.Codes, 1)
+	assert.Equal(t, code, []byte(block1.Codes[0].Code))
+	require.Len(t, block1.Storage, 1)
+	assert.Equal(t, StorageDiff{Address: addrC, Incarnation: 1, Location: slot, Old: common.Hash{}, New: common.BigToHash(uint256.NewInt().SetUint64(5).ToBig())}, block1.Storage[0])
+
+	require.Len(t, events[2].Storage, 1)
+	assert.Equal(t, common.BigToHash(uint256.NewInt().SetUint64(6).ToBig()), events[2].Storage[0].New)
+
+	// reorg of the block 2
+	writeBlock(t, db, 2, common.HexToHash("0x202"), func(w *state.PlainStateWriter) {})
+	require.NoError(t, e.Sync(ctx))
+	events = readAll(t, e)
+	require.Len(t, events, 5)
+	assert.Equal(t, Event{Seq: 4, Type: EventUnwind, Number: 1, Hash: common.HexToHash("0x101")}, events[3])
+	assert.Equal(t, common.HexToHash("0x202"), events[4].Hash)
+	require.NoError(t, e.Close())
+
+	// restart
+	e, err = New(db.KV(), dir, 1024)
+	require.NoError(t, err)
+	defer e.Close()
+	require.NoError(t, e.Sync(ctx))
+	assert.Equal(t, uint64(5), e.LastSeq())
+
+	srv := httptest.NewServer(e.Handler())
+	defer srv.Close()
+	assert.Len(t, get(t, srv.URL+"/events?from=2&limit=2"), 2)
+	assert.Len(t, get(t, srv.URL+"/events?from=6&timeout=10ms"), 0)
+
+	polled := make(chan []Event)
+	go func() {
+		polled <- get(t, srv.URL+"/events?from=6&timeout=1m")
+	}()
+	writeBlock(t, db, 3, common.HexToHash("0x203"), func(w *state.PlainStateWriter) {
+		require.NoError(t, w.UpdateAccountData(ctx, addrA, account(2, 0), account(3, 0)))
+	})
+	require.NoError(t, e.Sync(ctx))
+	events = <-polled
+	require.Len(t, events, 1)
+	assert.Equal(t, uint64(3), events[0].Number)
+}
+
+func readAll(t *testing.T, e *Exporter) []Event {
+	raw, err := e.Read(1, 100)
+	require.NoError(t, err)
+	events := make([]Event, len(raw))
+	for i := range raw {
+		require.NoError(t, json.Unmarshal(raw[i], &events[i]))
+	}
+	return events
+}
+
+func get(t *testing.T, url string) []Event {
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var events []Event
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&events))
+	return events
+}
+
+func TestExporterNoProgress(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	dir, err := ioutil.TempDir("", "cdc")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	e, err := New(db.KV(), dir, 1024)
+	require.NoError(t, err)
+	defer e.Close()
+	require.NoError(t, e.Sync(context.Background()))
+	assert.Equal(t, uint64(0), e.LastSeq())
+}
+
+func TestFileWriterRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cdc")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	const count = 3*indexStep + 10
+	fw, _, err := openFileWriter(dir, 16*1024)
+	require.NoError(t, err)
+	for seq := uint64(1); seq <= count; seq++ {
+		require.NoError(t, fw.write(&Event{Seq: seq, Type: EventBlock, Number: seq - 1}))
+	}
+	require.NoError(t, fw.flush())
+	require.True(t, len(fw.files) > 1, "events are expected to span several files")
+
+	check := func(fw *fileWriter) {
+		for _, from := range []uint64{1, 2, indexStep, indexStep + 1, 2*indexStep + 3, count - 1} {
+			raw, err := fw.read(from, 5)
+			require.NoError(t, err)
+			expected := 5
+			if from+5 > count+1 {
+				expected = int(count + 1 - from)
+			}
+			require.Len(t, raw, expected)
+			for i := range raw {
+				var event Event
+				require.NoError(t, json.Unmarshal(raw[i], &event))
+				assert.Equal(t, from+uint64(i), event.Seq)
+			}
+		}
+	}
+	check(fw)
+	require.NoError(t, fw.close())
+
+	// the older files are indexed on the first read after the restart
+	fw, events, err := openFileWriter(dir, 16*1024)
+	require.NoError(t, err)
+	defer fw.close()
+	require.Equal(t, uint64(count), events[len(events)-1].Seq)
+	check(fw)
+}
@@ -0,0 +1,96 @@
+package exporter
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/log"
+)
+
+const (
+	defaultLimit   = 100
+	maxLimit       = 10000
+	defaultTimeout = 30 * time.Second
+	maxTimeout     = 5 * time.Minute
+)
+
+// Handler serves the stream of the events over HTTP:
+//
+//	GET /events?from=<seq>&limit=<n>&timeout=<duration>
+//
+// returns the JSON array of at most limit events starting from the sequence number from (1 by default).
+// If there are no such events yet, the request waits for them until the timeout and returns an empty array.
+// The consumer follows the stream by requesting from=<seq of the last received event + 1>
+//
+//	GET /status
+//
+// returns the sequence number of the last event
+func (e *Exporter) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", e.serveEvents)
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]uint64{"lastSeq": e.LastSeq()})
+	})
+	return mux
+}
+
+func (e *Exporter) serveEvents(w http.ResponseWriter, r *http.Request) {
+	from, limit, timeout := uint64(1), defaultLimit, defaultTimeout
+	q := r.URL.Query()
+	var err error
+	if v := q.Get("from"); v != "" {
+		if from, err = strconv.ParseUint(v, 10, 64); err != nil || from == 0 {
+			http.Error(w, "invalid from", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		if limit > maxLimit {
+			limit = maxLimit
+		}
+	}
+	if v := q.Get("timeout"); v != "" {
+		if timeout, err = time.ParseDuration(v); err != nil || timeout < 0 {
+			http.Error(w, "invalid timeout", http.StatusBadRequest)
+			return
+		}
+		if timeout > maxTimeout {
+			timeout = maxTimeout
+		}
+	}
+
+	if wait := e.Wait(from - 1); wait != nil {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-wait:
+		case <-timer.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	events, err := e.Read(from, limit)
+	if err != nil {
+		log.Error("Reading CDC events", "from", from, "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if events == nil {
+		events = []json.RawMessage{}
+	}
+	writeJSON(w, events)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warn("Writing CDC response", "err", err)
+	}
+}
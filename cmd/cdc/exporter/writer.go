@@ -0,0 +1,262 @@
+package exporter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	filePrefix = "diffs-"
+	fileSuffix = ".jsonl"
+
+	// indexStep - the offset of every indexStep-th event of a file is kept, so the readers don't scan the file from the start
+	indexStep = 256
+)
+
+// fileWriter appends the events to JSONL files in the directory. A new file is started when the current one
+// grows over rotateSize, files are named by the sequence number of their first event
+type fileWriter struct {
+	dir        string
+	rotateSize int64
+
+	lock    sync.RWMutex
+	files   []uint64           // first sequence numbers of the files, ascending
+	offsets map[uint64][]int64 // offsets of the events first+k*indexStep by the first sequence number of the file
+
+	f     *os.File
+	w     *bufio.Writer
+	first uint64 // first sequence number of the current file
+	size  int64
+}
+
+func fileName(dir string, firstSeq uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%020d%s", filePrefix, firstSeq, fileSuffix))
+}
+
+// openFileWriter lists the files in the directory and returns the events of the last two of them,
+// which are enough to restore the state of the exporter. Incomplete last line, left by a crash, is truncated
+func openFileWriter(dir string, rotateSize int64) (*fileWriter, []Event, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	fw := &fileWriter{dir: dir, rotateSize: rotateSize, offsets: map[uint64][]int64{}}
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, filePrefix) || !strings.HasSuffix(name, fileSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, filePrefix), fileSuffix), 10, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unexpected file %s: %w", name, err)
+		}
+		fw.files = append(fw.files, seq)
+	}
+	sort.Slice(fw.files, func(i, j int) bool { return fw.files[i] < fw.files[j] })
+
+	var events []Event
+	for i := len(fw.files) - 2; i < len(fw.files); i++ {
+		if i < 0 {
+			continue
+		}
+		first := fw.files[i]
+		name := fileName(dir, first)
+		var offsets []int64
+		validSize, err := readEvents(name, 0, 0, -1, func(seq uint64, offset int64, line []byte) error {
+			var event Event
+			if err := json.Unmarshal(line, &event); err != nil {
+				return err
+			}
+			events = append(events, event)
+			if (seq-first)%indexStep == 0 {
+				offsets = append(offsets, offset)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading %s: %w", name, err)
+		}
+		fw.offsets[first] = offsets
+		if i == len(fw.files)-1 {
+			if fw.f, err = os.OpenFile(name, os.O_RDWR, 0644); err != nil {
+				return nil, nil, err
+			}
+			if err = fw.f.Truncate(validSize); err != nil {
+				return nil, nil, err
+			}
+			if _, err = fw.f.Seek(validSize, io.SeekStart); err != nil {
+				return nil, nil, err
+			}
+			fw.w = bufio.NewWriter(fw.f)
+			fw.first, fw.size = first, validSize
+		}
+	}
+	return fw, events, nil
+}
+
+// readEvents calls f for the complete lines of the file after the offset with the sequence number not lower than from,
+// at most limit of them (no limit if negative). Returns the end offset of the complete lines
+func readEvents(name string, offset int64, from uint64, limit int, f func(seq uint64, offset int64, line []byte) error) (int64, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	r := bufio.NewReader(file)
+	size := offset
+	var seq struct {
+		Seq uint64 `json:"seq"`
+	}
+	for limit != 0 {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return size, nil
+		}
+		if err != nil {
+			return size, err
+		}
+		lineOffset := size
+		size += int64(len(line))
+		line = bytes.TrimSuffix(line, []byte{'\n'})
+		if err := json.Unmarshal(line, &seq); err != nil {
+			return size, err
+		}
+		if seq.Seq < from {
+			continue
+		}
+		if err := f(seq.Seq, lineOffset, line); err != nil {
+			return size, err
+		}
+		limit--
+	}
+	return size, nil
+}
+
+func (fw *fileWriter) write(event *Event) error {
+	if fw.f == nil {
+		f, err := os.OpenFile(fileName(fw.dir, event.Seq), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		fw.f, fw.w, fw.first, fw.size = f, bufio.NewWriter(f), event.Seq, 0
+		fw.lock.Lock()
+		fw.files = append(fw.files, event.Seq)
+		fw.offsets[event.Seq] = nil
+		fw.lock.Unlock()
+	}
+	if (event.Seq-fw.first)%indexStep == 0 {
+		fw.lock.Lock()
+		fw.offsets[fw.first] = append(fw.offsets[fw.first], fw.size)
+		fw.lock.Unlock()
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if _, err := fw.w.Write(line); err != nil {
+		return err
+	}
+	fw.size += int64(len(line))
+	if fw.size >= fw.rotateSize {
+		if err := fw.flush(); err != nil {
+			return err
+		}
+		if err := fw.f.Close(); err != nil {
+			return err
+		}
+		fw.f, fw.w = nil, nil
+	}
+	return nil
+}
+
+// flush makes the written events durable and visible to the readers
+func (fw *fileWriter) flush() error {
+	if fw.f == nil {
+		return nil
+	}
+	if err := fw.w.Flush(); err != nil {
+		return err
+	}
+	return fw.f.Sync()
+}
+
+func (fw *fileWriter) close() error {
+	if fw.f == nil {
+		return nil
+	}
+	if err := fw.flush(); err != nil {
+		return err
+	}
+	return fw.f.Close()
+}
+
+// read returns at most limit flushed events starting from the sequence number from
+func (fw *fileWriter) read(from uint64, limit int) ([]json.RawMessage, error) {
+	fw.lock.RLock()
+	files := fw.files
+	fw.lock.RUnlock()
+	i := sort.Search(len(files), func(i int) bool { return files[i] > from })
+	if i > 0 {
+		i--
+	}
+	var res []json.RawMessage
+	for ; i < len(files) && len(res) < limit; i++ {
+		offset, err := fw.offset(files[i], from)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := readEvents(fileName(fw.dir, files[i]), offset, from, limit-len(res), func(_ uint64, _ int64, line []byte) error {
+			res = append(res, json.RawMessage(line))
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// offset returns the offset of the last indexed event of the file not after the sequence number seq.
+// The files written before the restart are indexed on the first read
+func (fw *fileWriter) offset(first, seq uint64) (int64, error) {
+	fw.lock.RLock()
+	offsets, ok := fw.offsets[first]
+	fw.lock.RUnlock()
+	if !ok {
+		if _, err := readEvents(fileName(fw.dir, first), 0, 0, -1, func(seq uint64, offset int64, _ []byte) error {
+			if (seq-first)%indexStep == 0 {
+				offsets = append(offsets, offset)
+			}
+			return nil
+		}); err != nil {
+			return 0, err
+		}
+		fw.lock.Lock()
+		fw.offsets[first] = offsets
+		fw.lock.Unlock()
+	}
+	if seq <= first || len(offsets) == 0 {
+		return 0, nil
+	}
+	k := int((seq - first) / indexStep)
+	if k >= len(offsets) {
+		k = len(offsets) - 1
+	}
+	return offsets[k], nil
+}
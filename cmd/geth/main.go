@@ -93,6 +93,8 @@ var (
 		utils.TxPoolLifetimeFlag,
 		utils.SyncModeFlag,
 		utils.StagedSyncPlainExecFlag,
+		utils.StagedSyncParallelExecFlag,
+		utils.StagedSyncVerifyParallelExecFlag,
 		utils.ExitWhenSyncedFlag,
 		utils.TxLookupLimitFlag,
 		utils.LightServeFlag,
@@ -114,7 +116,10 @@ var (
 		utils.DownloadOnlyFlag,
 		utils.StorageModeFlag,
 		utils.ArchiveSyncInterval,
+		utils.TrieSnapshotFlag,
 		utils.DatabaseFlag,
+		utils.DatabaseCompressionFlag,
+		utils.DatabaseTraceFlag,
 		utils.RemoteDbListenAddress,
 		utils.CacheNoPrefetchFlag,
 		utils.ListenPortFlag,
@@ -161,6 +166,7 @@ var (
 		utils.EWASMInterpreterFlag,
 		utils.EVMInterpreterFlag,
 		utils.DebugProtocolFlag,
+		utils.FirehoseSyncFlag,
 		configFileFlag,
 	}
 
@@ -78,6 +78,8 @@ var AppHelpFlagGroups = []flagGroup{
 			utils.RopstenFlag,
 			utils.SyncModeFlag,
 			utils.StagedSyncPlainExecFlag,
+			utils.StagedSyncParallelExecFlag,
+			utils.StagedSyncVerifyParallelExecFlag,
 			utils.ExitWhenSyncedFlag,
 			//utils.GCModePruningFlag,
 			utils.GCModeLimitFlag,
@@ -90,6 +92,7 @@ var AppHelpFlagGroups = []flagGroup{
 			utils.DownloadOnlyFlag,
 			utils.StorageModeFlag,
 			utils.ArchiveSyncInterval,
+			utils.TrieSnapshotFlag,
 		},
 	},
 	{
@@ -150,6 +153,8 @@ var AppHelpFlagGroups = []flagGroup{
 			utils.CacheNoPrefetchFlag,
 			utils.TrieCacheGenFlag,
 			utils.DatabaseFlag,
+			utils.DatabaseCompressionFlag,
+			utils.DatabaseTraceFlag,
 		},
 	},
 	{
@@ -188,6 +193,7 @@ var AppHelpFlagGroups = []flagGroup{
 			utils.PreloadJSFlag,
 			utils.RemoteDbListenAddress,
 			utils.DebugProtocolFlag,
+			utils.FirehoseSyncFlag,
 		},
 	},
 	{
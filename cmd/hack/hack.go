@@ -1846,7 +1846,8 @@ func fixStages(chaindata string) error {
 	var err error
 	var progress uint64
 	var list []uint64
-	for stage := stages.SyncStage(0); stage < stages.Finish; stage++ {
+	// FirehoseState is the last one, it comes after Finish to keep the keys of the other stages
+	for stage := stages.SyncStage(0); stage <= stages.FirehoseState; stage++ {
 		if progress, _, err = stages.GetStageProgress(db, stage); err != nil {
 			return err
 		}
@@ -0,0 +1,461 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/changeset"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+	"github.com/spf13/cobra"
+)
+
+var cmdCheckDB = &cobra.Command{
+	Use:   "check_db",
+	Short: "verify invariants between the buckets and print the report as JSON",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := rootContext()
+		report, err := checkDB(ctx, chaindata)
+		if err != nil {
+			log.Error(err.Error())
+			return err
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+		if !report.OK {
+			return errors.New("database is inconsistent")
+		}
+		return nil
+	},
+}
+
+func init() {
+	withChaindata(cmdCheckDB)
+
+	rootCmd.AddCommand(cmdCheckDB)
+}
+
+// only first issues of each check are reported, the rest are counted
+const maxReportedIssues = 100
+
+type dbCheckReport struct {
+	OK     bool              `json:"ok"`
+	Stages map[string]uint64 `json:"stages"`
+	Checks []*dbCheck        `json:"checks"`
+}
+
+type dbCheck struct {
+	Name       string   `json:"name"`
+	Checked    uint64   `json:"checked"`
+	IssueCount uint64   `json:"issueCount"`
+	Issues     []string `json:"issues,omitempty"`
+	Skipped    string   `json:"skipped,omitempty"`
+}
+
+func (c *dbCheck) issue(format string, args ...interface{}) {
+	c.IssueCount++
+	if len(c.Issues) < maxReportedIssues {
+		c.Issues = append(c.Issues, fmt.Sprintf(format, args...))
+	}
+}
+
+func checkDB(ctx context.Context, chaindata string) (*dbCheckReport, error) {
+	db := ethdb.MustOpen(chaindata)
+	defer db.Close()
+
+	progress := make(map[stages.SyncStage]uint64)
+	report := &dbCheckReport{Stages: make(map[string]uint64)}
+	for stage := range stageNames {
+		p, _, err := stages.GetStageProgress(db, stage)
+		if err != nil {
+			return nil, err
+		}
+		progress[stage] = p
+		report.Stages[stageNames[stage]] = p
+	}
+
+	report.Checks = append(report.Checks, checkStageProgress(progress))
+	for _, f := range []func(context.Context, *ethdb.ObjectDatabase, map[stages.SyncStage]uint64) (*dbCheck, error){
+		checkCanonicalChain,
+		checkTxLookup,
+		checkHashedState,
+	} {
+		check, err := f(ctx, db, progress)
+		if err != nil {
+			return nil, err
+		}
+		report.Checks = append(report.Checks, check)
+	}
+	for _, storage := range []bool{false, true} {
+		checks, err := checkHistoryIndex(ctx, db, progress, storage)
+		if err != nil {
+			return nil, err
+		}
+		report.Checks = append(report.Checks, checks...)
+	}
+
+	report.OK = true
+	for _, check := range report.Checks {
+		log.Info("Check done", "name", check.Name, "checked", check.Checked, "issues", check.IssueCount)
+		if check.IssueCount > 0 {
+			report.OK = false
+		}
+	}
+	return report, nil
+}
+
+var stageNames = map[stages.SyncStage]string{
+	stages.Headers:             "Headers",
+	stages.Bodies:              "Bodies",
+	stages.Senders:             "Senders",
+	stages.Execution:           "Execution",
+	stages.IntermediateHashes:  "IntermediateHashes",
+	stages.HashState:           "HashState",
+	stages.AccountHistoryIndex: "AccountHistoryIndex",
+	stages.StorageHistoryIndex: "StorageHistoryIndex",
+	stages.TxLookup:            "TxLookup",
+	stages.TxPool:              "TxPool",
+	stages.FirehoseState:       "FirehoseState",
+}
+
+// checkStageProgress verifies that no stage is ahead of the stage it takes the data from
+func checkStageProgress(progress map[stages.SyncStage]uint64) *dbCheck {
+	check := &dbCheck{Name: "stage_progress"}
+	for _, dep := range [][2]stages.SyncStage{
+		{stages.Bodies, stages.Headers},
+		{stages.Senders, stages.Bodies},
+		{stages.Execution, stages.Senders},
+		{stages.IntermediateHashes, stages.Execution},
+		{stages.HashState, stages.Execution},
+		{stages.AccountHistoryIndex, stages.Execution},
+		{stages.StorageHistoryIndex, stages.Execution},
+		{stages.TxLookup, stages.Bodies},
+	} {
+		check.Checked++
+		if progress[dep[0]] > progress[dep[1]] {
+			check.issue("stage %s is at %d, ahead of stage %s at %d", stageNames[dep[0]], progress[dep[0]], stageNames[dep[1]], progress[dep[1]])
+		}
+	}
+	return check
+}
+
+// checkCanonicalChain verifies that every canonical block up to the Headers stage has a header linked to its parent,
+// and the body and the senders up to the progress of the corresponding stages
+func checkCanonicalChain(ctx context.Context, db *ethdb.ObjectDatabase, progress map[stages.SyncStage]uint64) (*dbCheck, error) {
+	check := &dbCheck{Name: "canonical_chain"}
+	var parentHash common.Hash
+	for number := uint64(0); number <= progress[stages.Headers]; number++ {
+		if number%100_000 == 0 {
+			if err := common.Stopped(ctx.Done()); err != nil {
+				return nil, err
+			}
+			log.Info("Checking canonical chain", "number", number)
+		}
+		check.Checked++
+		hash := rawdb.ReadCanonicalHash(db, number)
+		if hash == (common.Hash{}) {
+			check.issue("block %d: no canonical hash", number)
+			parentHash = common.Hash{}
+			continue
+		}
+		header := rawdb.ReadHeader(db, hash, number)
+		if header == nil {
+			check.issue("block %d: no header for canonical hash %x", number, hash)
+		} else if number > 0 && parentHash != (common.Hash{}) && header.ParentHash != parentHash {
+			check.issue("block %d: parent hash %x doesn't match canonical hash %x of the previous block", number, header.ParentHash, parentHash)
+		}
+		parentHash = hash
+
+		if number > progress[stages.Bodies] {
+			continue
+		}
+		body := rawdb.ReadBody(db, hash, number)
+		if body == nil {
+			check.issue("block %d: no body for canonical hash %x", number, hash)
+			continue
+		}
+		if number > progress[stages.Senders] {
+			continue
+		}
+		senders, err := db.Get(dbutils.Senders, dbutils.BlockBodyKey(number, hash))
+		if err != nil && !errors.Is(err, ethdb.ErrKeyNotFound) {
+			return nil, err
+		}
+		if len(senders) != len(body.Transactions)*common.AddressLength {
+			check.issue("block %d: %d bytes of senders for %d transactions", number, len(senders), len(body.Transactions))
+		}
+	}
+	return check, nil
+}
+
+// checkTxLookup verifies that every lookup entry points to a canonical block containing the transaction,
+// and every transaction up to the TxLookup stage has the entry
+func checkTxLookup(ctx context.Context, db *ethdb.ObjectDatabase, progress map[stages.SyncStage]uint64) (*dbCheck, error) {
+	check := &dbCheck{Name: "tx_lookup"}
+	if err := db.Walk(dbutils.TxLookupPrefix, nil, 0, func(k, v []byte) (bool, error) {
+		check.Checked++
+		if check.Checked%1_000_000 == 0 {
+			if err := common.Stopped(ctx.Done()); err != nil {
+				return false, err
+			}
+			log.Info("Checking tx lookup", "entries", check.Checked)
+		}
+		number := new(big.Int).SetBytes(v).Uint64()
+		hash := rawdb.ReadCanonicalHash(db, number)
+		if hash == (common.Hash{}) {
+			check.issue("tx %x: block %d is not canonical", k, number)
+			return true, nil
+		}
+		body := rawdb.ReadBody(db, hash, number)
+		if body == nil {
+			check.issue("tx %x: no body of block %d", k, number)
+			return true, nil
+		}
+		for _, tx := range body.Transactions {
+			if bytes.Equal(tx.Hash().Bytes(), k) {
+				return true, nil
+			}
+		}
+		check.issue("tx %x: not found in block %d", k, number)
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+
+	for number := uint64(1); number <= progress[stages.TxLookup]; number++ {
+		if number%100_000 == 0 {
+			if err := common.Stopped(ctx.Done()); err != nil {
+				return nil, err
+			}
+		}
+		hash := rawdb.ReadCanonicalHash(db, number)
+		body := rawdb.ReadBody(db, hash, number)
+		if body == nil {
+			continue // reported by canonical_chain
+		}
+		for _, tx := range body.Transactions {
+			check.Checked++
+			if entry := rawdb.ReadTxLookupEntry(db, tx.Hash()); entry == nil {
+				check.issue("block %d: no lookup entry for tx %x", number, tx.Hash())
+			}
+		}
+	}
+	return check, nil
+}
+
+// checkHashedState verifies that CurrentStateBucket and ContractCodeBucket are the hashed copies of
+// PlainStateBucket and PlainContractCodeBucket. Only done when the HashState stage has caught up with the Execution
+func checkHashedState(ctx context.Context, db *ethdb.ObjectDatabase, progress map[stages.SyncStage]uint64) (*dbCheck, error) {
+	check := &dbCheck{Name: "hashed_state"}
+	if progress[stages.HashState] == 0 {
+		check.Skipped = "HashState stage didn't run"
+		return check, nil
+	}
+	if progress[stages.HashState] != progress[stages.Execution] {
+		check.Skipped = fmt.Sprintf("HashState stage at %d is not at the Execution stage at %d", progress[stages.HashState], progress[stages.Execution])
+		return check, nil
+	}
+
+	for _, buckets := range [][2][]byte{
+		{dbutils.PlainStateBucket, dbutils.CurrentStateBucket},
+		{dbutils.PlainContractCodeBucket, dbutils.ContractCodeBucket},
+	} {
+		plainBucket, hashedBucket := buckets[0], buckets[1]
+		var plainCount, hashedCount uint64
+		if err := db.Walk(plainBucket, nil, 0, func(k, v []byte) (bool, error) {
+			plainCount++
+			check.Checked++
+			if check.Checked%1_000_000 == 0 {
+				if err := common.Stopped(ctx.Done()); err != nil {
+					return false, err
+				}
+				log.Info("Checking hashed state", "bucket", string(plainBucket), "entries", plainCount)
+			}
+			hashedKey, err := hashPlainKey(k)
+			if err != nil {
+				check.issue("%s %x: %v", plainBucket, k, err)
+				return true, nil
+			}
+			hashedV, err := db.Get(hashedBucket, hashedKey)
+			if err != nil && !errors.Is(err, ethdb.ErrKeyNotFound) {
+				return false, err
+			}
+			if hashedV == nil {
+				check.issue("%s %x: no entry %x in %s", plainBucket, k, hashedKey, hashedBucket)
+			} else if !bytes.Equal(v, hashedV) {
+				check.issue("%s %x: value [%x] differs from [%x] of entry %x in %s", plainBucket, k, v, hashedV, hashedKey, hashedBucket)
+			}
+			return true, nil
+		}); err != nil {
+			return nil, err
+		}
+		if err := db.Walk(hashedBucket, nil, 0, func(k, v []byte) (bool, error) {
+			hashedCount++
+			return true, nil
+		}); err != nil {
+			return nil, err
+		}
+		if plainCount != hashedCount {
+			check.issue("%s has %d entries, %s has %d", plainBucket, plainCount, hashedBucket, hashedCount)
+		}
+	}
+	return check, nil
+}
+
+// hashPlainKey converts the keys of PlainStateBucket and PlainContractCodeBucket into the keys of the hashed buckets
+func hashPlainKey(key []byte) ([]byte, error) {
+	switch len(key) {
+	case common.AddressLength:
+		hash, err := common.HashData(key)
+		return hash[:], err
+	case common.AddressLength + common.IncarnationLength:
+		address, incarnation := dbutils.PlainParseStoragePrefix(key)
+		addrHash, err := common.HashData(address[:])
+		if err != nil {
+			return nil, err
+		}
+		return dbutils.GenerateStoragePrefix(addrHash[:], incarnation), nil
+	case common.AddressLength + common.IncarnationLength + common.HashLength:
+		address, incarnation, key := dbutils.PlainParseCompositeStorageKey(key)
+		addrHash, err := common.HashData(address[:])
+		if err != nil {
+			return nil, err
+		}
+		secKey, err := common.HashData(key[:])
+		if err != nil {
+			return nil, err
+		}
+		return dbutils.GenerateCompositeStorageKey(addrHash, incarnation, secKey), nil
+	default:
+		return nil, fmt.Errorf("unexpected key length %d", len(key))
+	}
+}
+
+// changeSetFinder - all the changeset encodings can find a key, storage ones ignoring the incarnation
+type changeSetFinder interface {
+	Find(k []byte) ([]byte, error)
+}
+
+// checkHistoryIndex verifies that every key of the changesets up to the progress of the index stage is in
+// the index chunk covering the block, and every block of every index chunk has the key in its changeset
+func checkHistoryIndex(ctx context.Context, db *ethdb.ObjectDatabase, progress map[stages.SyncStage]uint64, storage bool) ([]*dbCheck, error) {
+	indexBucket, stage := dbutils.AccountsHistoryBucket, stages.AccountHistoryIndex
+	if storage {
+		indexBucket, stage = dbutils.StorageHistoryBucket, stages.StorageHistoryIndex
+	}
+
+	// the index is built either from the plain or from the hashed changesets, which is seen by the length of the keys
+	plain := true
+	if err := db.Walk(indexBucket, nil, 0, func(k, _ []byte) (bool, error) {
+		plain = len(k) == common.AddressLength+8 || len(k) == common.AddressLength+common.HashLength+8
+		return false, nil
+	}); err != nil {
+		return nil, err
+	}
+	csBucket := dbutils.ChangeSetByIndexBucket(plain, storage)
+	mapper := changeset.Mapper[string(csBucket)]
+	indexKeySize := mapper.KeySize
+	if storage {
+		indexKeySize -= common.IncarnationLength
+	}
+
+	forward := &dbCheck{Name: fmt.Sprintf("changesets_in_index:%s", csBucket)}
+	if progress[stage] == 0 {
+		forward.Skipped = fmt.Sprintf("%s stage didn't run", stageNames[stage])
+	} else if err := db.Walk(csBucket, nil, 0, func(k, v []byte) (bool, error) {
+		blockNum, _ := dbutils.DecodeTimestamp(k)
+		if blockNum > progress[stage] {
+			return true, nil
+		}
+		if blockNum%100_000 == 0 {
+			if err := common.Stopped(ctx.Done()); err != nil {
+				return false, err
+			}
+			log.Info("Checking changesets", "bucket", string(csBucket), "number", blockNum)
+		}
+		return true, mapper.WalkerAdapter(v).Walk(func(key, _ []byte) error {
+			forward.Checked++
+			chunk, err := db.GetIndexChunk(indexBucket, key, blockNum)
+			if errors.Is(err, ethdb.ErrKeyNotFound) {
+				forward.issue("block %d: key %x has no index chunk", blockNum, key)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			found, _, ok, err := dbutils.WrapHistoryIndex(chunk).Search(blockNum)
+			if err != nil {
+				forward.issue("block %d: index chunk of key %x: %v", blockNum, key, err)
+				return nil
+			}
+			if !ok || found != blockNum {
+				forward.issue("block %d: key %x is missing in the index chunk", blockNum, key)
+			}
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+
+	backward := &dbCheck{Name: fmt.Sprintf("index_in_changesets:%s", indexBucket)}
+	if err := db.Walk(indexBucket, nil, 0, func(k, v []byte) (bool, error) {
+		if len(k) != indexKeySize+8 {
+			backward.issue("chunk %x: unexpected key length %d", k, len(k))
+			return true, nil
+		}
+		key, chunkNum := k[:indexKeySize], binary.BigEndian.Uint64(k[indexKeySize:])
+		numbers, _, err := dbutils.WrapHistoryIndex(v).Decode()
+		if err != nil {
+			backward.issue("chunk %x: %v", k, err)
+			return true, nil
+		}
+		if len(numbers) == 0 {
+			backward.issue("chunk %x: empty", k)
+			return true, nil
+		}
+		if last := numbers[len(numbers)-1]; chunkNum != ^uint64(0) && chunkNum != last {
+			backward.issue("chunk %x: last block %d doesn't match the key", k, last)
+		}
+		for _, blockNum := range numbers {
+			backward.Checked++
+			if backward.Checked%1_000_000 == 0 {
+				if err := common.Stopped(ctx.Done()); err != nil {
+					return false, err
+				}
+				log.Info("Checking index", "bucket", string(indexBucket), "entries", backward.Checked)
+			}
+			if blockNum > progress[stage] {
+				backward.issue("chunk %x: block %d is above the stage progress %d", k, blockNum, progress[stage])
+				continue
+			}
+			cs, err := db.Get(csBucket, dbutils.EncodeTimestamp(blockNum))
+			if err != nil && !errors.Is(err, ethdb.ErrKeyNotFound) {
+				return false, err
+			}
+			if cs == nil {
+				backward.issue("chunk %x: no changeset for block %d", k, blockNum)
+				continue
+			}
+			if _, err := mapper.WalkerAdapter(cs).(changeSetFinder).Find(key); err != nil {
+				backward.issue("chunk %x: key is missing in the changeset of block %d: %v", k, blockNum, err)
+			}
+		}
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+	return []*dbCheck{forward, backward}, nil
+}
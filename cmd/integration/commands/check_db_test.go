@@ -0,0 +1,146 @@
+package commands
+
+import (
+	"context"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/consensus/ethash"
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/params"
+	"github.com/stretchr/testify/require"
+)
+
+const checkDBBlocks = 3
+
+// makeCheckDB writes the chain of the blocks with a transaction each, their senders and lookups, the state changed
+// at every block with its changesets and history index, the hashed copy of the state, and the progress of the stages
+func makeCheckDB(t *testing.T, dbPath string) []*types.Block {
+	ctx := context.Background()
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	sender, slot := crypto.PubkeyToAddress(key.PublicKey), common.Hash{0x1}
+	gspec := &core.Genesis{Config: params.TestChainConfig}
+	signer := types.MakeSigner(gspec.Config, big.NewInt(1))
+
+	genDb := ethdb.NewMemDatabase()
+	defer genDb.Close()
+	blocks, _, err := core.GenerateChain(gspec.Config, gspec.MustCommit(genDb), ethash.NewFaker(), genDb, checkDBBlocks, func(i int, block *core.BlockGen) {
+		// the transactions are not executed by the test, only their senders and lookups are checked
+		tx, err := types.SignTx(types.NewTransaction(uint64(i), common.Address{0x1}, uint256.NewInt(), 21000, uint256.NewInt(), nil), signer, key)
+		require.NoError(t, err)
+		block.AddTxWithChain(nil, tx)
+	}, false /* intermediateHashes */)
+	require.NoError(t, err)
+
+	db, err := ethdb.Open(dbPath)
+	require.NoError(t, err)
+	defer db.Close()
+	gspec.MustCommit(db)
+	for _, block := range blocks {
+		n := block.NumberU64()
+		rawdb.WriteBlock(ctx, db, block)
+		rawdb.WriteCanonicalHash(db, block.Hash(), n)
+		rawdb.WriteSenders(ctx, db, block.Hash(), n, []common.Address{sender})
+		rawdb.WriteTxLookupEntries(db, block)
+
+		original, account := accounts.NewAccount(), accounts.NewAccount()
+		original.Initialised, account.Initialised = true, true
+		original.Balance.SetUint64(n - 1)
+		account.Balance.SetUint64(n)
+		w := state.NewPlainStateWriter(db, n)
+		require.NoError(t, w.UpdateAccountData(ctx, sender, &original, &account))
+		require.NoError(t, w.WriteAccountStorage(ctx, sender, 1, &slot, uint256.NewInt().SetUint64(n-1), uint256.NewInt().SetUint64(n)))
+		require.NoError(t, w.WriteChangeSets())
+		require.NoError(t, w.WriteHistory())
+	}
+	addrHash := crypto.Keccak256Hash(sender.Bytes())
+	for plainKey, hashedKey := range map[string][]byte{
+		string(sender.Bytes()): addrHash.Bytes(),
+		string(dbutils.PlainGenerateCompositeStorageKey(sender, 1, slot)): dbutils.GenerateCompositeStorageKey(addrHash, 1, crypto.Keccak256Hash(slot.Bytes())),
+	} {
+		v, err := db.Get(dbutils.PlainStateBucket, []byte(plainKey))
+		require.NoError(t, err)
+		require.NoError(t, db.Put(dbutils.CurrentStateBucket, hashedKey, v))
+	}
+
+	for stage := range stageNames {
+		if stage != stages.IntermediateHashes && stage != stages.TxPool && stage != stages.FirehoseState {
+			require.NoError(t, stages.SaveStageProgress(db, stage, checkDBBlocks, nil))
+		}
+	}
+	return blocks
+}
+
+func checkDBTestPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "check_db")
+	require.NoError(t, err)
+	return path.Join(dir, "chaindata"), func() { os.RemoveAll(dir) }
+}
+
+func TestCheckDBClean(t *testing.T) {
+	dbPath, cleanup := checkDBTestPath(t)
+	defer cleanup()
+	makeCheckDB(t, dbPath)
+
+	report, err := checkDB(context.Background(), dbPath)
+	require.NoError(t, err)
+	for _, check := range report.Checks {
+		require.Zero(t, check.IssueCount, "%s: %v", check.Name, check.Issues)
+		require.Empty(t, check.Skipped, check.Name)
+		require.NotZero(t, check.Checked, check.Name)
+	}
+	require.True(t, report.OK)
+	require.Equal(t, uint64(checkDBBlocks), report.Stages["Execution"])
+}
+
+func TestCheckDBCorrupted(t *testing.T) {
+	dbPath, cleanup := checkDBTestPath(t)
+	defer cleanup()
+	blocks := makeCheckDB(t, dbPath)
+
+	db, err := ethdb.Open(dbPath)
+	require.NoError(t, err)
+	// lookup entry of the transaction is lost
+	require.NoError(t, rawdb.DeleteTxLookupEntry(db, blocks[1].Transactions()[0].Hash()))
+	// senders of the block are truncated
+	require.NoError(t, db.Put(dbutils.Senders, dbutils.BlockBodyKey(2, blocks[1].Hash()), []byte{1}))
+	// hashed state differs from the plain one
+	require.NoError(t, db.Put(dbutils.CurrentStateBucket, crypto.Keccak256([]byte{0x2}), []byte{1}))
+	// changeset of the indexed block is lost
+	require.NoError(t, db.Delete(dbutils.PlainAccountChangeSetBucket, dbutils.EncodeTimestamp(3)))
+	// the stage is ahead of the one it depends on
+	require.NoError(t, stages.SaveStageProgress(db, stages.TxLookup, checkDBBlocks+1, nil))
+	db.Close()
+
+	report, err := checkDB(context.Background(), dbPath)
+	require.NoError(t, err)
+	require.False(t, report.OK)
+	issues := make(map[string]uint64)
+	for _, check := range report.Checks {
+		issues[check.Name] = check.IssueCount
+	}
+	require.Equal(t, map[string]uint64{
+		"stage_progress":                1,
+		"canonical_chain":               1,
+		"tx_lookup":                     1,
+		"hashed_state":                  1,
+		"changesets_in_index:PLAIN-ACS": 0,
+		"index_in_changesets:hAT":       1,
+		"changesets_in_index:PLAIN-SCS": 0,
+		"index_in_changesets:hST":       0,
+	}, issues)
+}
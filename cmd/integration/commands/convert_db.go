@@ -0,0 +1,207 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/sha3"
+)
+
+var cmdConvertDB = &cobra.Command{
+	Use:   "convert_db",
+	Short: "copy all buckets of '--chaindata' into '--to_chaindata', database types are set by '--backend' and '--to_backend' or chosen by the path suffix (_bolt, _badger, _lmdb)",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := rootContext()
+		err := convertDB(ctx, chaindata, backend, toChaindata, toBackend)
+		if err != nil {
+			log.Error(err.Error())
+			return err
+		}
+		return nil
+	},
+}
+
+func init() {
+	withChaindata(cmdConvertDB)
+	withToChaindata(cmdConvertDB)
+	withBackends(cmdConvertDB)
+
+	rootCmd.AddCommand(cmdConvertDB)
+}
+
+func convertDB(ctx context.Context, chaindata, backend, toChaindata, toBackend string) error {
+	from, err := openKV(chaindata, backend)
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+
+	to, err := openKV(toChaindata, toBackend)
+	if err != nil {
+		return err
+	}
+	defer to.Close()
+
+	fromCfg, toCfg := from.AllBuckets(), to.AllBuckets()
+	for _, name := range dbutils.Buckets {
+		if fromCfg[string(name)].Flags != toCfg[string(name)].Flags {
+			return fmt.Errorf("bucket %s has different flags in the databases: %d != %d", name, fromCfg[string(name)].Flags, toCfg[string(name)].Flags)
+		}
+	}
+
+	for _, name := range dbutils.Buckets {
+		if err := copyBucket(ctx, from, to, name); err != nil {
+			return fmt.Errorf("copying bucket %s: %w", name, err)
+		}
+	}
+
+	log.Info("Copying done, verifying")
+	for _, name := range dbutils.Buckets {
+		count, hash, err := bucketDigest(ctx, from, name)
+		if err != nil {
+			return err
+		}
+		toCount, toHash, err := bucketDigest(ctx, to, name)
+		if err != nil {
+			return err
+		}
+		if count != toCount || hash != toHash {
+			return fmt.Errorf("bucket %s differs: %d records (hash %x) in the source, %d records (hash %x) in the destination", name, count, hash, toCount, toHash)
+		}
+		fmt.Printf("Bucket: %s, records: %d, hash: %x\n", name, count, hash)
+	}
+	return nil
+}
+
+// openKV opens the db of the given type, or of the type chosen by the path suffix if the type is empty
+func openKV(path, backend string) (ethdb.KV, error) {
+	switch backend {
+	case "":
+		db, err := ethdb.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		return db.KV(), nil
+	case "lmdb":
+		return ethdb.NewLMDB().Path(path).Open()
+	case "bolt":
+		return ethdb.NewBolt().Path(path).Open()
+	case "badger":
+		return ethdb.NewBadger().Path(path).Open()
+	default:
+		return nil, fmt.Errorf("unknown db type %q, expected lmdb, bolt or badger", backend)
+	}
+}
+
+// copyBucket appends the records of the bucket to the same bucket of the destination database.
+// Copying resumes from the last key already present in the destination, which makes the conversion restartable.
+// Buckets with dbutils.DupSort flag are copied by Put, because Append doesn't accept duplicates,
+// and the last key is copied again, because only some of its values may have been copied before
+func copyBucket(ctx context.Context, from, to ethdb.KV, name []byte) error {
+	isDupSort := from.AllBuckets()[string(name)].Flags&dbutils.DupSort != 0
+
+	var lastKey []byte
+	if err := to.View(ctx, func(tx ethdb.Tx) error {
+		k, _, err := tx.Bucket(name).Cursor().Last()
+		lastKey = common.CopyBytes(k)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	fromTx, err := from.Begin(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer fromTx.Rollback()
+
+	c := fromTx.Bucket(name).Cursor()
+	var k, v []byte
+	if lastKey == nil {
+		k, v, err = c.First()
+	} else {
+		log.Info("Resuming", "bucket", string(name), "from", fmt.Sprintf("%x", lastKey))
+		k, v, err = c.Seek(lastKey)
+		if err == nil && !isDupSort && bytes.Equal(k, lastKey) {
+			k, v, err = c.Next()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if k == nil {
+		return nil
+	}
+
+	batchSize := to.IdealBatchSize()
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+
+	var count uint64
+	for k != nil {
+		if err = to.Update(ctx, func(tx ethdb.Tx) error {
+			toC := tx.Bucket(name).Cursor()
+			size := 0
+			for ; k != nil && size < batchSize; k, v, err = c.Next() {
+				if err != nil {
+					return err
+				}
+				if isDupSort {
+					err = toC.Put(k, v)
+				} else {
+					err = toC.Append(k, v)
+				}
+				if err != nil {
+					return err
+				}
+				size += len(k) + len(v)
+				count++
+			}
+			return err
+		}); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-logEvery.C:
+			log.Info("Progress", "bucket", string(name), "records", count, "key", fmt.Sprintf("%x", k))
+		default:
+		}
+	}
+	log.Info("Copied", "bucket", string(name), "records", count)
+	return nil
+}
+
+// bucketDigest returns the number of records in the bucket and the hash of all its keys and values
+func bucketDigest(ctx context.Context, db ethdb.KV, name []byte) (uint64, common.Hash, error) {
+	var count uint64
+	var hash common.Hash
+	h := sha3.NewLegacyKeccak256()
+	lenBuf := make([]byte, 4)
+	if err := db.View(ctx, func(tx ethdb.Tx) error {
+		return tx.Bucket(name).Cursor().Walk(func(k, v []byte) (bool, error) {
+			binary.BigEndian.PutUint32(lenBuf, uint32(len(k)))
+			h.Write(lenBuf)
+			h.Write(k)
+			binary.BigEndian.PutUint32(lenBuf, uint32(len(v)))
+			h.Write(lenBuf)
+			h.Write(v)
+			count++
+			return true, nil
+		})
+	}); err != nil {
+		return 0, hash, err
+	}
+	h.Sum(hash[:0])
+	return count, hash, nil
+}
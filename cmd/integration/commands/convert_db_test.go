@@ -0,0 +1,63 @@
+package commands
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertDBRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "convert_db")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	// the paths have no suffixes, the types are set explicitly
+	boltPath, lmdbPath, bolt2Path := path.Join(dir, "source"), path.Join(dir, "converted"), path.Join(dir, "back")
+
+	source, err := ethdb.NewBolt().Path(boltPath).Open()
+	require.NoError(t, err)
+	require.NoError(t, source.Update(ctx, func(tx ethdb.Tx) error {
+		for i := 0; i < 1000; i++ {
+			if err := tx.Bucket(dbutils.PlainStateBucket).Put([]byte{byte(i >> 8), byte(i)}, []byte{byte(i)}); err != nil {
+				return err
+			}
+		}
+		if err := tx.Bucket(dbutils.HeaderPrefix).Put([]byte{1}, []byte("header")); err != nil {
+			return err
+		}
+		return tx.Bucket(dbutils.HeaderPrefix).Put([]byte{2}, []byte{})
+	}))
+	source.Close()
+
+	require.NoError(t, convertDB(ctx, boltPath, "bolt", lmdbPath, "lmdb"))
+	// interrupted conversion resumes from the last copied key
+	require.NoError(t, convertDB(ctx, boltPath, "bolt", lmdbPath, "lmdb"))
+	require.NoError(t, convertDB(ctx, lmdbPath, "lmdb", bolt2Path, "bolt"))
+
+	from, err := openKV(boltPath, "bolt")
+	require.NoError(t, err)
+	defer from.Close()
+	to, err := openKV(bolt2Path, "bolt")
+	require.NoError(t, err)
+	defer to.Close()
+	for _, name := range dbutils.Buckets {
+		count, hash, err := bucketDigest(ctx, from, name)
+		require.NoError(t, err)
+		toCount, toHash, err := bucketDigest(ctx, to, name)
+		require.NoError(t, err)
+		require.Equal(t, count, toCount, "bucket %s", name)
+		require.Equal(t, hash, toHash, "bucket %s", name)
+	}
+	count, _, err := bucketDigest(ctx, to, dbutils.PlainStateBucket)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1000), count)
+
+	_, err = openKV(path.Join(dir, "unknown"), "leveldb")
+	require.Error(t, err)
+}
@@ -5,11 +5,18 @@ import "github.com/spf13/cobra"
 var (
 	chaindata          string
 	referenceChaindata string
+	toChaindata        string
+	backend            string
+	toBackend          string
 	block              uint64
 	unwind             uint64
 	unwindEvery        uint64
 	reset              bool
 	bucket             string
+	dryRun             bool
+	traceKV            string
+	parallelExec       bool
+	verifyParallelExec bool
 )
 
 func must(err error) {
@@ -29,6 +36,17 @@ func withReferenceChaindata(cmd *cobra.Command) {
 	must(cmd.MarkFlagDirname("reference_chaindata"))
 }
 
+func withToChaindata(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&toChaindata, "to_chaindata", "", "path to the destination db")
+	must(cmd.MarkFlagDirname("to_chaindata"))
+	must(cmd.MarkFlagRequired("to_chaindata"))
+}
+
+func withBackends(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&backend, "backend", "", "type of the db: lmdb, bolt or badger, chosen by the path suffix if not set")
+	cmd.Flags().StringVar(&toBackend, "to_backend", "", "type of the destination db: lmdb, bolt or badger, chosen by the path suffix if not set")
+}
+
 func withBlock(cmd *cobra.Command) {
 	cmd.Flags().Uint64Var(&block, "block", 0, "block test at this block")
 }
@@ -48,3 +66,16 @@ func withReset(cmd *cobra.Command) {
 func withBucket(cmd *cobra.Command) {
 	cmd.Flags().StringVar(&bucket, "bucket", "", "reset given stage")
 }
+
+func withDryRun(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "keep all changes in memory and discard them on exit, the db is opened read-only")
+}
+
+func withTraceKV(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&traceKV, "trace-kv", "", "record all operations with the db into the file, to replay them by replay_kv")
+}
+
+func withParallelExec(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&parallelExec, "parallel-exec", false, "execute the transactions of a block speculatively in parallel")
+	cmd.Flags().BoolVar(&verifyParallelExec, "parallel-exec.verify", false, "check that the parallel execution makes the same changesets as the sequential one")
+}
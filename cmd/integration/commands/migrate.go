@@ -0,0 +1,68 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/log"
+	"github.com/ledgerwatch/turbo-geth/migrations"
+	"github.com/spf13/cobra"
+)
+
+var rollbackTo string
+
+var cmdMigrate = &cobra.Command{
+	Use:   "migrate",
+	Short: "apply pending migrations of the db, or roll back the applied ones with --rollback",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := rootContext()
+		err := migrate(ctx)
+		if err != nil {
+			log.Error(err.Error())
+			return err
+		}
+		return nil
+	},
+}
+
+func init() {
+	withChaindata(cmdMigrate)
+	// the same flag as withDryRun, the db is opened read-only and only the pending migrations are listed
+	cmdMigrate.Flags().BoolVar(&dryRun, "dry-run", false, "list the pending migrations and their progress, don't apply anything, the db is opened read-only")
+	cmdMigrate.Flags().StringVar(&rollbackTo, "rollback", "", "roll back the given migration and all migrations applied after it")
+
+	rootCmd.AddCommand(cmdMigrate)
+}
+
+func migrate(_ context.Context) error {
+	db, closeDB := openDatabase(chaindata)
+	defer closeDB()
+
+	migrator := migrations.NewMigrator()
+	if dryRun {
+		pending, err := migrator.PendingMigrations(db)
+		if err != nil {
+			return err
+		}
+		if len(pending) == 0 {
+			fmt.Printf("No pending migrations\n")
+		}
+		for _, m := range pending {
+			progress, _, err := migrator.Progress(db, m.Name)
+			if err != nil {
+				return err
+			}
+			if progress != nil {
+				fmt.Printf("%s (interrupted at %x)\n", m.Name, progress)
+			} else {
+				fmt.Printf("%s\n", m.Name)
+			}
+		}
+		return nil
+	}
+
+	if rollbackTo != "" {
+		return migrator.Rollback(db, "", rollbackTo)
+	}
+	return migrator.Apply(db, "")
+}
@@ -0,0 +1,58 @@
+package commands
+
+import (
+	"context"
+	"os"
+
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb/kvreplay"
+	"github.com/ledgerwatch/turbo-geth/log"
+	"github.com/spf13/cobra"
+)
+
+var tracePath string
+
+var cmdReplayKV = &cobra.Command{
+	Use:   "replay_kv",
+	Short: "replay the trace recorded by --trace-kv, or by geth --database.trace, against the '--chaindata' (a copy of the recorded db, the backend is chosen by the path suffix) and print latencies per bucket. Without --chaindata prints the recorded latencies",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := rootContext()
+		err := replayKV(ctx, tracePath, chaindata)
+		if err != nil {
+			log.Error(err.Error())
+			return err
+		}
+		return nil
+	},
+}
+
+func init() {
+	cmdReplayKV.Flags().StringVar(&chaindata, "chaindata", "", "path to the db")
+	must(cmdReplayKV.MarkFlagDirname("chaindata"))
+	cmdReplayKV.Flags().StringVar(&tracePath, "trace", "", "path to the trace")
+	must(cmdReplayKV.MarkFlagRequired("trace"))
+
+	rootCmd.AddCommand(cmdReplayKV)
+}
+
+func replayKV(ctx context.Context, tracePath string, chaindata string) error {
+	f, err := os.Open(tracePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var report *kvreplay.Report
+	if chaindata == "" {
+		report, err = kvreplay.Recorded(f)
+	} else {
+		db := ethdb.MustOpen(chaindata)
+		defer db.Close()
+		log.Info("Replaying", "trace", tracePath, "db", chaindata)
+		report, err = kvreplay.Replay(ctx, f, db.KV())
+	}
+	if err != nil {
+		return err
+	}
+	return report.Print(os.Stdout)
+}
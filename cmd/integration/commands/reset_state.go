@@ -14,7 +14,7 @@ import (
 
 var cmdResetState = &cobra.Command{
 	Use:   "reset_state",
-	Short: "Reset StateStages (4,5,6,7,8,9) and buckets",
+	Short: "Reset StateStages (4,5,6,7,8,9), FirehoseState and buckets",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		ctx := rootContext()
 		err := resetState(ctx)
@@ -28,13 +28,14 @@ var cmdResetState = &cobra.Command{
 
 func init() {
 	withChaindata(cmdResetState)
+	withDryRun(cmdResetState)
 
 	rootCmd.AddCommand(cmdResetState)
 }
 
 func resetState(_ context.Context) error {
-	db := ethdb.MustOpen(chaindata)
-	defer db.Close()
+	db, closeDB := openDatabase(chaindata)
+	defer closeDB()
 	fmt.Printf("Before reset: \n")
 	if err := printStages(db); err != nil {
 		return err
@@ -54,6 +55,9 @@ func resetState(_ context.Context) error {
 	if err := resetTxLookup(db); err != nil {
 		return err
 	}
+	if err := resetFirehoseState(db); err != nil {
+		return err
+	}
 
 	// set genesis after reset all buckets
 	if _, _, err := core.DefaultGenesisBlock().CommitGenesisState(db, false); err != nil {
@@ -167,10 +171,23 @@ func resetTxLookup(db *ethdb.ObjectDatabase) error {
 
 	return nil
 }
+
+// resetFirehoseState lets the state be downloaded again, the stage is skipped once it has any progress
+func resetFirehoseState(db *ethdb.ObjectDatabase) error {
+	if err := stages.SaveStageProgress(db, stages.FirehoseState, 0, nil); err != nil {
+		return err
+	}
+	if err := stages.SaveStageUnwind(db, stages.FirehoseState, 0, nil); err != nil {
+		return err
+	}
+	return nil
+}
+
 func printStages(db *ethdb.ObjectDatabase) error {
 	var err error
 	var progress uint64
-	for stage := stages.SyncStage(0); stage < stages.Finish; stage++ {
+	// FirehoseState is the last one, it comes after Finish to keep the keys of the other stages
+	for stage := stages.SyncStage(0); stage <= stages.FirehoseState; stage++ {
 		if progress, _, err = stages.GetStageProgress(db, stage); err != nil {
 			return err
 		}
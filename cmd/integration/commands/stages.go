@@ -2,6 +2,7 @@ package commands
 
 import (
 	"context"
+	"os"
 	"runtime"
 	"time"
 
@@ -114,6 +115,8 @@ func init() {
 	withReset(cmdStage3)
 	withBlock(cmdStage3)
 	withUnwind(cmdStage3)
+	withDryRun(cmdStage3)
+	withTraceKV(cmdStage3)
 
 	rootCmd.AddCommand(cmdStage3)
 
@@ -121,6 +124,9 @@ func init() {
 	withReset(cmdStage4)
 	withBlock(cmdStage4)
 	withUnwind(cmdStage4)
+	withDryRun(cmdStage4)
+	withTraceKV(cmdStage4)
+	withParallelExec(cmdStage4)
 
 	rootCmd.AddCommand(cmdStage4)
 
@@ -128,6 +134,8 @@ func init() {
 	withReset(cmdStage5)
 	withBlock(cmdStage5)
 	withUnwind(cmdStage5)
+	withDryRun(cmdStage5)
+	withTraceKV(cmdStage5)
 
 	rootCmd.AddCommand(cmdStage5)
 
@@ -135,6 +143,8 @@ func init() {
 	withReset(cmdStage6)
 	withBlock(cmdStage6)
 	withUnwind(cmdStage6)
+	withDryRun(cmdStage6)
+	withTraceKV(cmdStage6)
 
 	rootCmd.AddCommand(cmdStage6)
 
@@ -142,6 +152,8 @@ func init() {
 	withReset(cmdStage78)
 	withBlock(cmdStage78)
 	withUnwind(cmdStage78)
+	withDryRun(cmdStage78)
+	withTraceKV(cmdStage78)
 
 	rootCmd.AddCommand(cmdStage78)
 
@@ -149,13 +161,15 @@ func init() {
 	withReset(cmdStage9)
 	withBlock(cmdStage9)
 	withUnwind(cmdStage9)
+	withDryRun(cmdStage9)
+	withTraceKV(cmdStage9)
 
 	rootCmd.AddCommand(cmdStage9)
 }
 
 func stage3(ctx context.Context) error {
-	db := ethdb.MustOpen(chaindata)
-	defer db.Close()
+	db, closeDB := openDatabase(chaindata)
+	defer closeDB()
 
 	bc, _, progress := newSync(ctx.Done(), db, nil)
 	defer bc.Stop()
@@ -193,9 +207,11 @@ func stage3(ctx context.Context) error {
 
 func stage4(ctx context.Context) error {
 	core.UsePlainStateExecution = true
+	core.ParallelExecution = parallelExec
+	core.VerifyParallelExecution = verifyParallelExec
 
-	db := ethdb.MustOpen(chaindata)
-	defer db.Close()
+	db, closeDB := openDatabase(chaindata)
+	defer closeDB()
 
 	bc, _, progress := newSync(ctx.Done(), db, nil)
 	defer bc.Stop()
@@ -222,8 +238,8 @@ func stage4(ctx context.Context) error {
 func stage5(ctx context.Context) error {
 	core.UsePlainStateExecution = true
 
-	db := ethdb.MustOpen(chaindata)
-	defer db.Close()
+	db, closeDB := openDatabase(chaindata)
+	defer closeDB()
 
 	bc, _, progress := newSync(ctx.Done(), db, nil)
 	defer bc.Stop()
@@ -250,8 +266,8 @@ func stage5(ctx context.Context) error {
 func stage6(ctx context.Context) error {
 	core.UsePlainStateExecution = true
 
-	db := ethdb.MustOpen(chaindata)
-	defer db.Close()
+	db, closeDB := openDatabase(chaindata)
+	defer closeDB()
 
 	bc, _, progress := newSync(ctx.Done(), db, nil)
 	defer bc.Stop()
@@ -277,8 +293,8 @@ func stage6(ctx context.Context) error {
 func stage78(ctx context.Context) error {
 	core.UsePlainStateExecution = true
 
-	db := ethdb.MustOpen(chaindata)
-	defer db.Close()
+	db, closeDB := openDatabase(chaindata)
+	defer closeDB()
 
 	bc, _, progress := newSync(ctx.Done(), db, nil)
 	defer bc.Stop()
@@ -312,8 +328,8 @@ func stage78(ctx context.Context) error {
 func stage9(ctx context.Context) error {
 	core.UsePlainStateExecution = true
 
-	db := ethdb.MustOpen(chaindata)
-	defer db.Close()
+	db, closeDB := openDatabase(chaindata)
+	defer closeDB()
 
 	bc, _, progress := newSync(ctx.Done(), db, nil)
 	defer bc.Stop()
@@ -337,12 +353,53 @@ func stage9(ctx context.Context) error {
 }
 
 func printAllStages(_ context.Context) error {
-	db := ethdb.MustOpen(chaindata)
-	defer db.Close()
+	db, closeDB := openDatabase(chaindata)
+	defer closeDB()
 
 	return printStages(db)
 }
 
+// openDatabase opens the db at the path. With --dry-run the db is opened read-only and wrapped into the overlay,
+// which keeps all the changes in memory and drops them on close. With --trace-kv all operations with the db
+// are recorded into the file
+func openDatabase(path string) (*ethdb.ObjectDatabase, func()) {
+	var db *ethdb.ObjectDatabase
+	if dryRun {
+		var err error
+		if db, err = ethdb.OpenReadOnly(path); err != nil {
+			panic(err)
+		}
+	} else {
+		db = ethdb.MustOpen(path)
+	}
+	if !dryRun && traceKV == "" {
+		return db, db.Close
+	}
+
+	kv := db.KV()
+	if dryRun {
+		kv = ethdb.NewOverlay(kv)
+	}
+	if traceKV != "" {
+		f, err := os.Create(traceKV)
+		if err != nil {
+			db.Close()
+			panic(err)
+		}
+		log.Info("Recording KV trace", "file", traceKV)
+		kv = ethdb.NewRecorder(kv, f)
+	}
+	wrapped := ethdb.NewObjectDatabase(kv)
+	return wrapped, func() {
+		// closes the overlay and the recorder, the recorder closes the db if there is no overlay
+		wrapped.Close()
+		if dryRun {
+			db.Close()
+			log.Info("Dry run, changes are discarded")
+		}
+	}
+}
+
 type progressFunc func(stage stages.SyncStage) *stagedsync.StageState
 
 func newSync(quitCh <-chan struct{}, db ethdb.Database, hook stagedsync.ChangeSetHook) (*core.BlockChain, *stagedsync.State, progressFunc) {
@@ -351,7 +408,7 @@ func newSync(quitCh <-chan struct{}, db ethdb.Database, hook stagedsync.ChangeSe
 		panic(err)
 	}
 
-	st, err := stagedsync.PrepareStagedSync(nil, chainConfig, bc, db, "integration_test", ethdb.DefaultStorageMode, "", quitCh, nil, bc.DestsCache, nil, hook)
+	st, err := stagedsync.PrepareStagedSync(nil, chainConfig, bc, db, "integration_test", ethdb.DefaultStorageMode, "", quitCh, nil, bc.DestsCache, nil, nil, hook)
 	if err != nil {
 		panic(err)
 	}
@@ -45,6 +45,7 @@ var stateStags = &cobra.Command{
 
 func init() {
 	withChaindata(stateStags)
+	withDryRun(stateStags)
 	withReferenceChaindata(stateStags)
 	withUnwind(stateStags)
 	withUnwindEvery(stateStags)
@@ -55,8 +56,8 @@ func init() {
 
 func syncBySmallSteps(ctx context.Context, chaindata string) error {
 	core.UsePlainStateExecution = true
-	db := ethdb.MustOpen(chaindata)
-	defer db.Close()
+	db, closeDB := openDatabase(chaindata)
+	defer closeDB()
 	chainConfig, blockchain, chainErr := newBlockChain(db)
 	if chainErr != nil {
 		return chainErr
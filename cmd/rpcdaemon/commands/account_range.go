@@ -0,0 +1,92 @@
+package commands
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/hexutil"
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+// AccountRangeMaxResults is the maximum number of results to be returned per call
+const AccountRangeMaxResults = 256
+
+// AccountRangeResult is the result of a debug_accountRange API call.
+type AccountRangeResult struct {
+	state.IteratorDump
+	Proof []hexutil.Bytes `json:"proof,omitempty"` // range proof from start up to next (exclusive), only for the current state
+}
+
+// accountRangeBounds returns the boundaries of the range of account hashes covered by the page:
+// from the start (inclusive) to the start of the next page (exclusive). The pages may start in the middle
+// of the storage of an account, the account itself then belongs to the previous page
+func accountRangeBounds(start []byte, next []byte) ([]byte, []byte) {
+	first := make([]byte, common.HashLength)
+	copy(first, start)
+	if len(start) > common.HashLength {
+		// Increment to skip the account of the previous page
+		for i := len(first) - 1; i >= 0; i-- {
+			first[i]++
+			if first[i] != 0 {
+				break
+			}
+		}
+	}
+	if next == nil {
+		return first, bytes.Repeat([]byte{0xff}, common.HashLength)
+	}
+	last := make([]byte, common.HashLength)
+	copy(last, next)
+	if len(next) > common.HashLength {
+		// The account of the storage key is the last one of the page
+		return first, last
+	}
+	// Decrement to get the inclusive boundary
+	for i := len(last) - 1; i >= 0; i-- {
+		last[i]--
+		if last[i] != 0xff {
+			break
+		}
+	}
+	return first, last
+}
+
+// isProvable tells if the range proofs can be made for the state of the given block. They need the hashed state
+// and the intermediate hashes, which are only available for the current state once both stages have reached it
+func isProvable(db ethdb.Getter, blockNumber uint64) (bool, error) {
+	for _, stage := range []stages.SyncStage{stages.HashState, stages.IntermediateHashes} {
+		progress, _, err := stages.GetStageProgress(db, stage)
+		if err != nil {
+			return false, err
+		}
+		if progress != blockNumber {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// AccountRangeProof loads the boundaries of the account range from the current state and proves the range
+// against the given state root, which needs to be the root of the current state
+func AccountRangeProof(db ethdb.Database, root common.Hash, first, last []byte) ([][]byte, error) {
+	rl := trie.NewRetainList(0)
+	rl.AddKey(first)
+	rl.AddKey(last)
+	loader := trie.NewFlatDbSubTrieLoader()
+	if err := loader.Reset(db, rl, rl, nil /* hashCollector */, [][]byte{nil}, []int{0}, false); err != nil {
+		return nil, err
+	}
+	subTries, err := loader.LoadSubTries()
+	if err != nil {
+		return nil, err
+	}
+	tr := trie.New(root)
+	if err = tr.HookSubTries(subTries, [][]byte{nil}); err != nil {
+		return nil, fmt.Errorf("loading state trie for the proof: %v", err)
+	}
+	return tr.ProveRange(first, last, 0, false /* storage */)
+}
@@ -0,0 +1,54 @@
+package commands
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+func TestAccountRangeBounds(t *testing.T) {
+	tr := trie.New(common.Hash{})
+	var keys [][]byte
+	values := make(map[string][]byte)
+	for i := 0; i < 4; i++ {
+		key := crypto.Keccak256([]byte{byte(i)})
+		acc := accounts.NewAccount()
+		acc.Balance = *uint256.NewInt().SetUint64(uint64(i + 1))
+		tr.UpdateAccount(key, &acc)
+		value := make([]byte, acc.EncodingLengthForHashing())
+		acc.EncodeForHashing(value)
+		keys = append(keys, key)
+		values[string(key)] = value
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+
+	// checkPage verifies the proof of the page against the accounts which are expected in it
+	checkPage := func(start, next []byte, expected [][]byte) {
+		first, last := accountRangeBounds(start, next)
+		proof, err := tr.ProveRange(first, last, 0, false /* storage */)
+		require.NoError(t, err)
+		pageValues := make([][]byte, len(expected))
+		for i, key := range expected {
+			pageValues[i] = values[string(key)]
+		}
+		_, err = trie.VerifyRangeProof(tr.Hash(), first, last, expected, pageValues, proof)
+		require.NoError(t, err, "page from %x to %x", start, next)
+	}
+
+	// Pages ending at an account
+	checkPage(nil, keys[2], keys[:2])
+	checkPage(keys[2], nil, keys[2:])
+	// Pages ending in the middle of the storage of the last account
+	storageKey := dbutils.GenerateCompositeStorageKey(common.BytesToHash(keys[1]), 1, common.Hash{1})
+	checkPage(nil, storageKey, keys[:2])
+	checkPage(storageKey, nil, keys[2:])
+}
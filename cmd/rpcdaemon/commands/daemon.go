@@ -14,6 +14,7 @@ import (
 	"github.com/ledgerwatch/turbo-geth/core/state"
 	"github.com/ledgerwatch/turbo-geth/core/types"
 	"github.com/ledgerwatch/turbo-geth/eth"
+	"github.com/ledgerwatch/turbo-geth/eth/tracers"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
 	"github.com/ledgerwatch/turbo-geth/ethdb/remote/remotechain"
 	"github.com/ledgerwatch/turbo-geth/internal/ethapi"
@@ -50,7 +51,16 @@ type APIImpl struct {
 // PrivateDebugAPI
 type PrivateDebugAPI interface {
 	StorageRangeAt(ctx context.Context, blockHash common.Hash, txIndex uint64, contractAddress common.Address, keyStart hexutil.Bytes, maxResult int) (StorageRangeResult, error)
+	AccountRange(ctx context.Context, blockNrOrHash rpc.BlockNumberOrHash, start []byte, maxResults int, nocode, nostorage, incompletes bool) (AccountRangeResult, error)
 	TraceTransaction(ctx context.Context, hash common.Hash, config *eth.TraceConfig) (interface{}, error)
+	SimulateBundle(ctx context.Context, calls []ethapi.CallArgs, blockNrOrHash rpc.BlockNumberOrHash, overrides *ethapi.StateOverride) (*ethapi.BundleResult, error)
+	StartSession(ctx context.Context, hash common.Hash) (*tracers.DebugSessionStart, error)
+	Step(id string) (*tracers.DebugState, error)
+	Continue(id string) (*tracers.DebugState, error)
+	Breakpoint(id string, bp tracers.Breakpoint) (int, error)
+	ClearBreakpoints(id string) error
+	Inspect(id string, what string) (interface{}, error)
+	StopSession(id string) error
 }
 
 // APIImpl is implementation of the EthAPI interface based on remote Db access
@@ -58,6 +68,7 @@ type PrivateDebugAPIImpl struct {
 	db           ethdb.KV
 	dbReader     ethdb.Getter
 	chainContext core.ChainContext
+	sessions     *tracers.DebugSessions
 }
 
 // NewAPI returns APIImpl instance
@@ -75,6 +86,7 @@ func NewPrivateDebugAPI(db ethdb.KV, dbReader ethdb.Getter, chainContext core.Ch
 		db:           db,
 		dbReader:     dbReader,
 		chainContext: chainContext,
+		sessions:     tracers.NewDebugSessions(),
 	}
 }
 
@@ -219,6 +231,77 @@ func (api *PrivateDebugAPIImpl) StorageRangeAt(ctx context.Context, blockHash co
 	return StorageRangeAt(stateReader, contractAddress, keyStart, maxResult)
 }
 
+// AccountRange re-implementation of eth/api.go:AccountRange
+// For the current state, the result also contains the proof of the range against the state root
+func (api *PrivateDebugAPIImpl) AccountRange(ctx context.Context, blockNrOrHash rpc.BlockNumberOrHash, start []byte, maxResults int, nocode, nostorage, incompletes bool) (AccountRangeResult, error) {
+	blockNumber, _, err := api.blockNumber(ctx, blockNrOrHash, "accountRange")
+	if err != nil {
+		return AccountRangeResult{}, err
+	}
+
+	if maxResults > AccountRangeMaxResults || maxResults <= 0 {
+		maxResults = AccountRangeMaxResults
+	}
+	dumper := state.NewDumper(api.db, blockNumber)
+	dump, err := dumper.IteratorDump(nocode, nostorage, incompletes, start, maxResults)
+	if err != nil {
+		return AccountRangeResult{}, err
+	}
+	result := AccountRangeResult{IteratorDump: dump}
+	// The proof is omitted while the intermediate hashes are not computed for the block
+	if provable, err := isProvable(api.dbReader, blockNumber); err != nil {
+		return AccountRangeResult{}, err
+	} else if !provable {
+		return result, nil
+	}
+	header := rawdb.ReadHeader(api.dbReader, rawdb.ReadCanonicalHash(api.dbReader, blockNumber), blockNumber)
+	if header == nil {
+		return AccountRangeResult{}, fmt.Errorf("header for block %d not found", blockNumber)
+	}
+	first, last := accountRangeBounds(start, dump.Next)
+	proof, err := AccountRangeProof(ethdb.NewObjectDatabase(api.db), header.Root, first, last)
+	if err != nil {
+		return AccountRangeResult{}, err
+	}
+	result.Root = fmt.Sprintf("%x", header.Root)
+	result.Proof = make([]hexutil.Bytes, len(proof))
+	for i, p := range proof {
+		result.Proof[i] = p
+	}
+	return result, nil
+}
+
+// blockNumber resolves the block number or hash into the block number, it also returns the number of the last block
+func (api *PrivateDebugAPIImpl) blockNumber(ctx context.Context, blockNrOrHash rpc.BlockNumberOrHash, method string) (uint64, uint64, error) {
+	var lastBlockNumber uint64
+	if err := api.db.View(ctx, func(tx ethdb.Tx) error {
+		var err error
+		lastBlockNumber, err = remotechain.ReadLastBlockNumber(tx)
+		return err
+	}); err != nil {
+		return 0, 0, err
+	}
+
+	var blockNumber uint64
+	if number, ok := blockNrOrHash.Number(); ok {
+		switch number {
+		case rpc.PendingBlockNumber:
+			return 0, 0, fmt.Errorf("%s for pending block not supported", method)
+		case rpc.LatestBlockNumber:
+			blockNumber = lastBlockNumber
+		default:
+			blockNumber = uint64(number)
+		}
+	} else if hash, ok := blockNrOrHash.Hash(); ok {
+		n := rawdb.ReadHeaderNumber(api.dbReader, hash)
+		if n == nil {
+			return 0, 0, fmt.Errorf("block %s not found", hash.Hex())
+		}
+		blockNumber = *n
+	}
+	return blockNumber, lastBlockNumber, nil
+}
+
 // computeIntraBlockState retrieves the state database associated with a certain block.
 // If no state is locally available for the given block, a number of blocks are
 // attempted to be reexecuted to generate the desired state.
@@ -243,24 +326,27 @@ func (api *APIImpl) rpcMarshalBlock(b *types.Block, inclTx bool, fullTx bool, ad
 	return fields, err
 }
 
+// openDB connects to the remote database of the node, or opens the local one
+func openDB(cfg Config) (ethdb.KV, error) {
+	if cfg.remoteDbAddress != "" {
+		return ethdb.NewRemote().Path(cfg.remoteDbAddress).Open()
+	}
+	if cfg.chaindata != "" {
+		database, err := ethdb.Open(cfg.chaindata)
+		if err != nil {
+			return nil, err
+		}
+		return database.KV(), nil
+	}
+	return nil, fmt.Errorf("either remote db or bolt db must be specified")
+}
+
 func daemon(cmd *cobra.Command, cfg Config) {
 	vhosts := splitAndTrim(cfg.rpcVirtualHost)
 	cors := splitAndTrim(cfg.rpcCORSDomain)
 	enabledApis := splitAndTrim(cfg.rpcAPI)
 
-	var db ethdb.KV
-	var err error
-	if cfg.remoteDbAddress != "" {
-		db, err = ethdb.NewRemote().Path(cfg.remoteDbAddress).Open()
-	} else if cfg.chaindata != "" {
-		if database, errOpen := ethdb.Open(cfg.chaindata); errOpen == nil {
-			db = database.KV()
-		} else {
-			err = errOpen
-		}
-	} else {
-		err = fmt.Errorf("either remote db or bolt db must be specified")
-	}
+	db, err := openDB(cfg)
 	if err != nil {
 		log.Error("Could not connect to remoteDb", "error", err)
 		return
@@ -0,0 +1,59 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/eth/tracers"
+	"github.com/ledgerwatch/turbo-geth/params"
+)
+
+// StartSession re-implementation of eth/api_debugger.go:StartSession
+func (api *PrivateDebugAPIImpl) StartSession(ctx context.Context, hash common.Hash) (*tracers.DebugSessionStart, error) {
+	tx, blockHash, _, txIndex := rawdb.ReadTransaction(api.dbReader, hash)
+	if tx == nil {
+		return nil, fmt.Errorf("transaction %#x not found", hash)
+	}
+	msg, vmctx, ibs, _, err := ComputeTxEnv(ctx, &blockGetter{api.dbReader}, params.MainnetChainConfig, &chainContext{db: api.dbReader}, api.db, blockHash, txIndex, nil)
+	if err != nil {
+		return nil, err
+	}
+	return api.sessions.Start(func(tracer vm.Tracer) (*core.ExecutionResult, error) {
+		vmenv := vm.NewEVM(vmctx, ibs, params.MainnetChainConfig, vm.Config{Debug: true, Tracer: tracer}, nil /* jumpDest cache */)
+		return core.ApplyMessage(vmenv, msg, new(core.GasPool).AddGas(msg.Gas()))
+	})
+}
+
+// Step re-implementation of eth/api_debugger.go:Step
+func (api *PrivateDebugAPIImpl) Step(id string) (*tracers.DebugState, error) {
+	return api.sessions.Step(id)
+}
+
+// Continue re-implementation of eth/api_debugger.go:Continue
+func (api *PrivateDebugAPIImpl) Continue(id string) (*tracers.DebugState, error) {
+	return api.sessions.Continue(id)
+}
+
+// Breakpoint re-implementation of eth/api_debugger.go:Breakpoint
+func (api *PrivateDebugAPIImpl) Breakpoint(id string, bp tracers.Breakpoint) (int, error) {
+	return api.sessions.Breakpoint(id, bp)
+}
+
+// ClearBreakpoints re-implementation of eth/api_debugger.go:ClearBreakpoints
+func (api *PrivateDebugAPIImpl) ClearBreakpoints(id string) error {
+	return api.sessions.ClearBreakpoints(id)
+}
+
+// Inspect re-implementation of eth/api_debugger.go:Inspect
+func (api *PrivateDebugAPIImpl) Inspect(id string, what string) (interface{}, error) {
+	return api.sessions.Inspect(id, what)
+}
+
+// StopSession re-implementation of eth/api_debugger.go:StopSession
+func (api *PrivateDebugAPIImpl) StopSession(id string) error {
+	return api.sessions.Stop(id)
+}
@@ -38,8 +38,8 @@ var (
 func init() {
 	rootCmd.PersistentFlags().StringVar(&cpuprofile, "cpuprofile", "", "write cpu profile `file`")
 	rootCmd.PersistentFlags().StringVar(&memprofile, "memprofile", "", "write memory profile `file`")
-	rootCmd.Flags().StringVar(&cfg.remoteDbAddress, "remote-db-addr", "", "address of remote DB listener of a turbo-geth node")
-	rootCmd.Flags().StringVar(&cfg.chaindata, "chaindata", "", "path to the database")
+	rootCmd.PersistentFlags().StringVar(&cfg.remoteDbAddress, "remote-db-addr", "", "address of remote DB listener of a turbo-geth node")
+	rootCmd.PersistentFlags().StringVar(&cfg.chaindata, "chaindata", "", "path to the database")
 	rootCmd.Flags().StringVar(&cfg.rpcListenAddress, "rpcaddr", node.DefaultHTTPHost, "HTTP-RPC server listening interface")
 	rootCmd.Flags().IntVar(&cfg.rpcPort, "rpcport", node.DefaultHTTPPort, "HTTP-RPC server listening port")
 	rootCmd.Flags().StringVar(&cfg.rpcCORSDomain, "rpccorsdomain", "", "Comma separated list of domains from which to accept cross origin requests (browser enforced)")
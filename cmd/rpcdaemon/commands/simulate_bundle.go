@@ -0,0 +1,31 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/internal/ethapi"
+	"github.com/ledgerwatch/turbo-geth/params"
+	"github.com/ledgerwatch/turbo-geth/rpc"
+)
+
+// SimulateBundle re-implementation of internal/ethapi.PublicDebugAPI.SimulateBundle, on the historical state after the block
+func (api *PrivateDebugAPIImpl) SimulateBundle(ctx context.Context, calls []ethapi.CallArgs, blockNrOrHash rpc.BlockNumberOrHash, overrides *ethapi.StateOverride) (*ethapi.BundleResult, error) {
+	blockNumber, _, err := api.blockNumber(ctx, blockNrOrHash, "simulateBundle")
+	if err != nil {
+		return nil, err
+	}
+	block := rawdb.ReadBlock(api.dbReader, rawdb.ReadCanonicalHash(api.dbReader, blockNumber), blockNumber)
+	if block == nil {
+		return nil, fmt.Errorf("block %d not found", blockNumber)
+	}
+	ibs, _ := ComputeIntraBlockState(api.db, block)
+	getEVM := func(msg core.Message) (*vm.EVM, func() error, error) {
+		vmctx := core.NewEVMContext(msg, block.Header(), api.chainContext, nil)
+		return vm.NewEVM(vmctx, ibs, params.MainnetChainConfig, vm.Config{}, nil /* jumpDest cache */), func() error { return nil }, nil
+	}
+	return ethapi.SimulateBundle(ctx, ibs, calls, overrides, getEVM, defaultTraceTimeout, nil)
+}
@@ -0,0 +1,74 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/hexutil"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/internal/ethapi"
+	"github.com/ledgerwatch/turbo-geth/rpc"
+)
+
+func TestSimulateBundle(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	sender := makeTraceRangeChain(t, db, 4)
+	api := NewPrivateDebugAPI(db.KV(), db, NewChainContext(db))
+
+	var (
+		to    = common.HexToAddress("0x1000") // 3000 wei after block 2
+		other = common.HexToAddress("0x2000")
+		rich  = common.HexToAddress("0x3000")
+	)
+	transfer := func(from, to common.Address, value int64) ethapi.CallArgs {
+		return ethapi.CallArgs{From: &from, To: &to, Value: (*hexutil.Big)(big.NewInt(value))}
+	}
+	calls := []ethapi.CallArgs{
+		transfer(sender, to, 500),
+		// spends the value of the previous call
+		transfer(to, other, 3400),
+		transfer(rich, other, 1),
+	}
+	balance := (*hexutil.Big)(big.NewInt(1000000))
+	overrides := &ethapi.StateOverride{rich: {Balance: &balance}}
+	block := rpc.BlockNumberOrHashWithNumber(2)
+
+	res, err := api.SimulateBundle(context.Background(), calls, block, overrides)
+	require.NoError(t, err)
+	require.Len(t, res.Results, 3)
+	for _, r := range res.Results {
+		require.Equal(t, hexutil.Uint64(21000), r.GasUsed)
+		require.Empty(t, r.Error)
+		require.Empty(t, r.Logs)
+	}
+	require.Equal(t, hexutil.Uint64(3*21000), res.GasUsed)
+	require.Len(t, res.Results[1].StateDiff, 2)
+
+	var diff map[common.Address]map[string]interface{}
+	data, err := json.Marshal(res.StateDiff)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &diff))
+	require.Len(t, diff, 4)
+	change := func(from, to string) interface{} {
+		return map[string]interface{}{"*": map[string]interface{}{"from": from, "to": to}}
+	}
+	require.Equal(t, change("0x3", "0x4"), diff[sender]["nonce"])
+	require.Equal(t, change("0xbb8", "0x64"), diff[to]["balance"])
+	require.Equal(t, change("0x0", "0x1"), diff[to]["nonce"])
+	require.Equal(t, map[string]interface{}{"+": "0xd49"}, diff[other]["balance"])
+	// the overrides are the state before the bundle
+	require.Equal(t, change("0xf4240", "0xf423f"), diff[rich]["balance"])
+
+	// nothing is persisted, the bundle fails without the first call
+	_, err = api.SimulateBundle(context.Background(), calls[1:], block, nil)
+	require.Error(t, err)
+	again, err := api.SimulateBundle(context.Background(), calls, block, overrides)
+	require.NoError(t, err)
+	require.Equal(t, res, again)
+}
@@ -0,0 +1,276 @@
+package commands
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/eth"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+	"github.com/ledgerwatch/turbo-geth/params"
+)
+
+// traceRangeProgressFile keeps the last block of the contiguous range of the traced blocks
+const traceRangeProgressFile = "progress"
+
+var traceRange struct {
+	from, to uint64
+	tracer   string
+	timeout  string
+	workers  int
+	output   string
+}
+
+func init() {
+	traceRangeCmd.Flags().Uint64Var(&traceRange.from, "from", 1, "first block to trace")
+	traceRangeCmd.Flags().Uint64Var(&traceRange.to, "to", 0, "last block to trace")
+	traceRangeCmd.Flags().StringVar(&traceRange.tracer, "tracer", "callTracer", "name of the tracer or JavaScript code, the struct logger if empty")
+	traceRangeCmd.Flags().StringVar(&traceRange.timeout, "timeout", "", "timeout of tracing of one transaction, 5s by default")
+	traceRangeCmd.Flags().IntVar(&traceRange.workers, "workers", 4, "number of blocks traced in parallel")
+	traceRangeCmd.Flags().StringVar(&traceRange.output, "output", "traces", "directory of the results")
+	rootCmd.AddCommand(traceRangeCmd)
+}
+
+var traceRangeCmd = &cobra.Command{
+	Use:   "trace_range",
+	Short: "Traces the transactions of the range of blocks into gzipped JSONL files, one per block, resumes the previous run into the same output",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if traceRange.to < traceRange.from {
+			return fmt.Errorf("--to %d is before --from %d", traceRange.to, traceRange.from)
+		}
+		db, err := openDB(cfg)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		config := &eth.TraceConfig{}
+		if traceRange.tracer != "" {
+			config.Tracer = &traceRange.tracer
+		}
+		if traceRange.timeout != "" {
+			config.Timeout = &traceRange.timeout
+		}
+		dbReader := ethdb.NewRemoteBoltDatabase(db)
+		api := NewPrivateDebugAPI(db, dbReader, NewChainContext(dbReader))
+		return api.TraceRange(cmd.Context(), traceRange.from, traceRange.to, traceRange.workers, traceRange.output, config)
+	},
+}
+
+// traceRangeResult is a line of the output file of the block
+type traceRangeResult struct {
+	BlockNumber uint64      `json:"blockNumber"`
+	TxIndex     int         `json:"txIndex"`
+	TxHash      common.Hash `json:"txHash"`
+	Result      interface{} `json:"result,omitempty"`
+	Error       string      `json:"error,omitempty"`
+}
+
+// traceRangeFile returns the path of the output file of the block
+func traceRangeFile(dir string, blockNumber uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%09d.jsonl.gz", blockNumber))
+}
+
+// TraceRange traces the transactions of the blocks [from, to] by the workers in parallel and writes the results of
+// each block into the gzipped JSONL file of the block in dir. Each block is traced on the state of its parent.
+// The last block of the contiguous range of the finished blocks is kept in the progress file of dir, the next run
+// into the same dir continues after it and skips the blocks finished out of order.
+func (api *PrivateDebugAPIImpl) TraceRange(ctx context.Context, from, to uint64, workers int, dir string, config *eth.TraceConfig) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	done, err := readTraceRangeProgress(dir)
+	if err != nil {
+		return err
+	}
+	if from == 0 {
+		from = 1 // genesis has no transactions
+	}
+	if done >= from {
+		log.Info("Resuming the tracing", "from", done+1)
+		from = done + 1
+	}
+	if from > to {
+		return nil
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		blockNumber uint64
+		err         error
+	}
+	blocks := make(chan uint64)
+	results := make(chan result, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for blockNumber := range blocks {
+				results <- result{blockNumber, api.traceBlockToFile(ctx, blockNumber, dir, config)}
+			}
+		}()
+	}
+	go func() {
+		defer close(blocks)
+		for blockNumber := from; blockNumber <= to; blockNumber++ {
+			if _, err := os.Stat(traceRangeFile(dir, blockNumber)); err == nil {
+				// finished by the previous run
+				results <- result{blockNumber: blockNumber}
+				continue
+			}
+			select {
+			case blocks <- blockNumber:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// the results come out of order, the progress moves over the contiguous range only
+	finished := map[uint64]struct{}{}
+	next := from
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+	for res := range results {
+		if res.err != nil {
+			if err == nil {
+				err = fmt.Errorf("block %d: %w", res.blockNumber, res.err)
+				cancel()
+			}
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		finished[res.blockNumber] = struct{}{}
+		moved := false
+		for _, ok := finished[next]; ok; _, ok = finished[next] {
+			delete(finished, next)
+			next++
+			moved = true
+		}
+		if moved {
+			if err = writeTraceRangeProgress(dir, next-1); err != nil {
+				cancel()
+				continue
+			}
+		}
+		select {
+		case <-logEvery.C:
+			log.Info("Tracing", "block", next-1, "to", to, "out of order", len(finished))
+		default:
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	log.Info("Tracing finished", "from", from, "to", to, "output", dir)
+	return nil
+}
+
+// traceBlockToFile traces the transactions of the block on the historical state and writes their results, the file
+// appears only when all of them are written
+func (api *PrivateDebugAPIImpl) traceBlockToFile(ctx context.Context, blockNumber uint64, dir string, config *eth.TraceConfig) error {
+	block := rawdb.ReadBlock(api.dbReader, rawdb.ReadCanonicalHash(api.dbReader, blockNumber), blockNumber)
+	if block == nil {
+		return fmt.Errorf("block %d not found", blockNumber)
+	}
+	parent := rawdb.ReadBlock(api.dbReader, block.ParentHash(), blockNumber-1)
+	if parent == nil {
+		return fmt.Errorf("parent %x not found", block.ParentHash())
+	}
+
+	f, err := ioutil.TempFile(dir, fmt.Sprintf("%d-*.tmp", blockNumber))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	w := gzip.NewWriter(f)
+	enc := json.NewEncoder(w)
+
+	statedb, reader := ComputeIntraBlockState(api.db, parent)
+	signer := types.MakeSigner(params.MainnetChainConfig, block.Number())
+	chainCtx := params.MainnetChainConfig.WithEIPsFlags(context.Background(), block.Number())
+	for idx, tx := range block.Transactions() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		msg, err := tx.AsMessage(signer)
+		if err != nil {
+			return fmt.Errorf("transaction %x: %w", tx.Hash(), err)
+		}
+		vmctx := core.NewEVMContext(msg, block.Header(), api.chainContext, nil)
+		line := traceRangeResult{BlockNumber: blockNumber, TxIndex: idx, TxHash: tx.Hash()}
+		// errors of the tracers are the results of the transactions, the state moves on anyway
+		if line.Result, err = api.traceTx(ctx, msg, vmctx, statedb, config); err != nil {
+			line.Error = err.Error()
+		}
+		if err := enc.Encode(&line); err != nil {
+			return err
+		}
+		if err := statedb.FinalizeTx(chainCtx, reader); err != nil {
+			return err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), traceRangeFile(dir, blockNumber))
+}
+
+func readTraceRangeProgress(dir string) (uint64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, traceRangeProgressFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+func writeTraceRangeProgress(dir string, blockNumber uint64) error {
+	tmp := filepath.Join(dir, traceRangeProgressFile+".tmp")
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatUint(blockNumber, 10)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, traceRangeProgressFile))
+}
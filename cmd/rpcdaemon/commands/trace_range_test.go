@@ -0,0 +1,112 @@
+package commands
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/eth"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/internal/chaintest"
+	"github.com/ledgerwatch/turbo-geth/params"
+)
+
+// makeTraceRangeChain writes the chain of n blocks with plain state and its history, the way the staged sync does,
+// block i has i+1 transfers of 1000 wei from the returned address to 0x1000
+func makeTraceRangeChain(t *testing.T, db *ethdb.ObjectDatabase, n int) common.Address {
+	var (
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		to      = common.HexToAddress("0x1000")
+		gspec   = &core.Genesis{
+			Config: &params.ChainConfig{ChainID: big.NewInt(1)},
+			Alloc:  core.GenesisAlloc{address: {Balance: big.NewInt(1000000000)}},
+		}
+		signer = types.HomesteadSigner{}
+	)
+	_, err := chaintest.WritePlainStateChain(db, gspec, NewChainContext(db), n, func(i int, block *core.BlockGen) {
+		for j := 0; j <= i; j++ {
+			tx, err := types.SignTx(types.NewTransaction(block.TxNonce(address), to, uint256.NewInt().SetUint64(1000), 21000, new(uint256.Int), nil), signer, key)
+			require.NoError(t, err)
+			block.AddTx(tx)
+		}
+	})
+	require.NoError(t, err)
+	return address
+}
+
+func TestTraceRange(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	makeTraceRangeChain(t, db, 4)
+
+	dir, err := ioutil.TempDir("", "trace-range")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tracer := "callTracer"
+	config := &eth.TraceConfig{Tracer: &tracer}
+	api := NewPrivateDebugAPI(db.KV(), db, NewChainContext(db))
+	require.NoError(t, api.TraceRange(context.Background(), 1, 3, 2, dir, config))
+
+	progress, err := readTraceRangeProgress(dir)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), progress)
+	for blockNumber := uint64(1); blockNumber <= 3; blockNumber++ {
+		results := readTraceRangeFile(t, traceRangeFile(dir, blockNumber))
+		require.Len(t, results, int(blockNumber))
+		for i, res := range results {
+			require.Equal(t, blockNumber, res.BlockNumber)
+			require.Equal(t, i, res.TxIndex)
+			require.Empty(t, res.Error)
+			call := res.Result.(map[string]interface{})
+			require.Equal(t, "CALL", call["type"])
+			require.Equal(t, "0x3e8", call["value"])
+		}
+	}
+
+	// the next run continues after the traced blocks
+	require.NoError(t, os.Remove(traceRangeFile(dir, 2)))
+	require.NoError(t, api.TraceRange(context.Background(), 1, 4, 2, dir, config))
+	_, err = os.Stat(traceRangeFile(dir, 2))
+	require.True(t, os.IsNotExist(err))
+	require.Len(t, readTraceRangeFile(t, traceRangeFile(dir, 4)), 4)
+	progress, err = readTraceRangeProgress(dir)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), progress)
+
+	// missing blocks fail the job, the progress stays on the last contiguous block
+	require.Error(t, api.TraceRange(context.Background(), 5, 6, 2, dir, config))
+	progress, err = readTraceRangeProgress(dir)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), progress)
+}
+
+func readTraceRangeFile(t *testing.T, name string) []traceRangeResult {
+	f, err := os.Open(name)
+	require.NoError(t, err)
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	var results []traceRangeResult
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var res traceRangeResult
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &res))
+		results = append(results, res)
+	}
+	require.NoError(t, scanner.Err())
+	return results
+}
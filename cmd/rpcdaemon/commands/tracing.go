@@ -60,15 +60,18 @@ func (api *PrivateDebugAPIImpl) traceTx(ctx context.Context, message core.Messag
 				return nil, err
 			}
 		}
-		// Constuct the JavaScript tracer to execute with
-		if tracer, err = tracers.New(*config.Tracer); err != nil {
+		// Constuct the native or JavaScript tracer to execute with
+		if tracer, err = tracers.NewTracer(*config.Tracer); err != nil {
 			return nil, err
 		}
+		if t, ok := tracer.(tracers.StateTracer); ok {
+			t.SetState(ibs, params.MainnetChainConfig, vmctx.BlockNumber)
+		}
 		// Handle timeouts and RPC cancellations
 		deadlineCtx, cancel := context.WithTimeout(ctx, timeout)
 		go func() {
 			<-deadlineCtx.Done()
-			tracer.(*tracers.Tracer).Stop(errors.New("execution timeout"))
+			tracer.(tracers.ResultTracer).Stop(errors.New("execution timeout"))
 		}()
 		defer cancel()
 
@@ -95,7 +98,7 @@ func (api *PrivateDebugAPIImpl) traceTx(ctx context.Context, message core.Messag
 			StructLogs:  ethapi.FormatLogs(tracer.StructLogs()),
 		}, nil
 
-	case *tracers.Tracer:
+	case tracers.ResultTracer:
 		return tracer.GetResult()
 
 	default:
@@ -1,9 +1,92 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
+	"os"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/params"
+	"github.com/ledgerwatch/turbo-geth/semantics"
 )
 
+var chaindata = flag.String("chaindata", "chaindata", "path to the chaindata database file")
+var block = flag.Uint64("block", 1, "number of the block with the transaction")
+var txIndex = flag.Int("tx", -1, "index of the transaction in the block, -1 for all the transactions")
+var symbolicStorage = flag.Bool("symbolic-storage", false, "don't read the storage from the state before the block, cover any storage values")
+var concreteInput = flag.Bool("concrete-input", false, "analyse the calldata and the value of the transaction instead of all the inputs")
+
+// txAccessSet is the output for one transaction
+type txAccessSet struct {
+	Index int                  `json:"index"`
+	Hash  common.Hash          `json:"hash"`
+	Set   *semantics.AccessSet `json:"accessSet,omitempty"`
+	Error string               `json:"error,omitempty"`
+}
+
 func main() {
-	fmt.Printf("Hello, semantics!\n")
+	flag.Parse()
+	if err := analyse(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
+
+// analyse prints the accounts and the storage slots the transactions of the block can touch
+func analyse() error {
+	db := ethdb.MustOpen(*chaindata)
+	defer db.Close()
+
+	hash := rawdb.ReadCanonicalHash(db, *block)
+	b := rawdb.ReadBlock(db, hash, *block)
+	if b == nil {
+		return fmt.Errorf("block %d not found", *block)
+	}
+	if *txIndex >= len(b.Transactions()) {
+		return fmt.Errorf("block %d has %d transactions", *block, len(b.Transactions()))
+	}
+	chainConfig := rawdb.ReadChainConfig(db, rawdb.ReadCanonicalHash(db, 0))
+	if chainConfig == nil {
+		chainConfig = params.MainnetChainConfig
+	}
+	// The transactions are analysed against the state before the block
+	parent := rawdb.ReadHeader(db, b.ParentHash(), *block-1)
+	if parent == nil {
+		return fmt.Errorf("parent of block %d not found", *block)
+	}
+	st := state.New(state.NewPlainDBState(db.KV(), *block-1))
+	signer := types.MakeSigner(chainConfig, b.Number())
+
+	var results []txAccessSet
+	for i, tx := range b.Transactions() {
+		if *txIndex >= 0 && i != *txIndex {
+			continue
+		}
+		result := txAccessSet{Index: i, Hash: tx.Hash()}
+		msg, err := tx.AsMessage(signer)
+		if err != nil {
+			result.Error = err.Error()
+			results = append(results, result)
+			continue
+		}
+		cfg := semantics.Config{SymbolicStorage: *symbolicStorage}
+		if *concreteInput {
+			cfg.Input = append([]byte{}, tx.Data()...)
+		}
+		if result.Set, err = semantics.Analyse(st, parent.Root, chainConfig.ChainID, b.Header(), msg, cfg); err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	out, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", out)
+	return nil
 }
@@ -0,0 +1,27 @@
+package commands
+
+import (
+	"github.com/ledgerwatch/turbo-geth/cmd/state/stateless"
+	"github.com/spf13/cobra"
+)
+
+var (
+	evmcConfig   string
+	parityReport string
+)
+
+func init() {
+	withBlock(evmcParityCmd)
+	withChaindata(evmcParityCmd)
+	evmcParityCmd.Flags().StringVar(&evmcConfig, "vm.evm", "", "path to the EVMC module with its options, the same as --vm.evm of geth")
+	evmcParityCmd.Flags().StringVar(&parityReport, "report", "evmc_divergence.json", "path of the report of the first divergence")
+	rootCmd.AddCommand(evmcParityCmd)
+}
+
+var evmcParityCmd = &cobra.Command{
+	Use:   "evmcParity",
+	Short: "Re-executes historical blocks with both the built-in interpreter and the EVMC one and reports the first divergent transaction",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return stateless.EVMCParity(genesis, block, chaindata, evmcConfig, parityReport)
+	},
+}
@@ -0,0 +1,27 @@
+package commands
+
+import (
+	"github.com/ledgerwatch/turbo-geth/cmd/state/stateless"
+	"github.com/spf13/cobra"
+)
+
+var (
+	profileTo     uint64
+	profileOutput string
+)
+
+func init() {
+	withBlock(opcodeProfileCmd)
+	withChaindata(opcodeProfileCmd)
+	opcodeProfileCmd.Flags().Uint64Var(&profileTo, "to", 0, "last block of the range to replay, 0 - until the head of the chain")
+	opcodeProfileCmd.Flags().StringVar(&profileOutput, "output", "opcode_profile", "prefix of the paths of the CSV files and of the flame graph stacks")
+	rootCmd.AddCommand(opcodeProfileCmd)
+}
+
+var opcodeProfileCmd = &cobra.Command{
+	Use:   "opcodeProfile",
+	Short: "Replays a range of blocks and aggregates the count, gas and wall time of each opcode and precompile, per contract and per call stack",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return stateless.OpcodeProfile(genesis, block, profileTo, chaindata, profileOutput)
+	},
+}
@@ -21,6 +21,7 @@ var (
 	witnessDatabase   string
 	writeHistory      bool
 	blockSource       string
+	codeChunks        bool
 )
 
 func withBlocksource(cmd *cobra.Command) {
@@ -48,6 +49,7 @@ func init() {
 	statelessCmd.Flags().BoolVar(&statelessResolver, "statelessResolver", false, "use a witness DB instead of the state when resolving tries")
 	statelessCmd.Flags().StringVar(&witnessDatabase, "witnessDbFile", "", "optional path to a database where to store witnesses (empty string -- do not store witnesses")
 	statelessCmd.Flags().BoolVar(&writeHistory, "writeHistory", false, "write history buckets and changeset buckets into the statefile")
+	statelessCmd.Flags().BoolVar(&codeChunks, "codeChunks", false, "put only the touched chunks of contract codes (with proofs) into block witnesses")
 	if err := statelessCmd.MarkFlagFilename("witnessDbFile", ""); err != nil {
 		panic(err)
 	}
@@ -84,6 +86,7 @@ var statelessCmd = &cobra.Command{
 			statelessResolver,
 			witnessDatabase,
 			writeHistory,
+			codeChunks,
 		)
 
 		return nil
@@ -0,0 +1,36 @@
+package commands
+
+import (
+	"github.com/ledgerwatch/turbo-geth/cmd/state/stateless"
+	"github.com/spf13/cobra"
+)
+
+var (
+	visualPrefix string
+	visualLimit  int
+	visualOut    string
+)
+
+func init() {
+	withChaindata(visualTrieCmd)
+	withBlock(visualTrieCmd)
+
+	visualTrieCmd.Flags().StringVar(&visualPrefix, "prefix", "", "prefix of the hashes of account addresses, in hex digits (odd number of digits is allowed)")
+	visualTrieCmd.Flags().IntVar(&visualLimit, "limit", 1024, "maximum number of accounts to visualise")
+	visualTrieCmd.Flags().StringVar(&visualOut, "out", "trie.html", "path where to write the HTML page")
+	visualTrieCmd.Flags().StringVar(&witnessDatabase, "witnessDbFile", "", "optional path to the witness database produced by the 'stateless' command, to highlight the nodes touched by the block")
+	visualTrieCmd.Flags().Uint32Var(&triesize, "triesize", 4*1024*1024, "maximum size of a trie used when the witnesses were produced")
+	if err := visualTrieCmd.MarkFlagFilename("out", "html"); err != nil {
+		panic(err)
+	}
+
+	rootCmd.AddCommand(visualTrieCmd)
+}
+
+var visualTrieCmd = &cobra.Command{
+	Use:   "visualTrie",
+	Short: "Renders a subtree of the state as an interactive HTML page, highlighting the nodes touched by the witness of the block",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return stateless.VisualTrie(chaindata, block, visualPrefix, visualLimit, witnessDatabase, triesize, visualOut)
+	},
+}
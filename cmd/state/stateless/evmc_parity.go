@@ -0,0 +1,312 @@
+package stateless
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/changeset"
+	"github.com/ledgerwatch/turbo-geth/common/hexutil"
+	"github.com/ledgerwatch/turbo-geth/consensus/ethash"
+	"github.com/ledgerwatch/turbo-geth/consensus/misc"
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/eth/tracers"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/internal/ethapi"
+	"github.com/ledgerwatch/turbo-geth/log"
+	"github.com/ledgerwatch/turbo-geth/params"
+)
+
+// parityTxResult is the outcome of the transaction executed by one of the interpreters
+type parityTxResult struct {
+	GasUsed     uint64                                       `json:"gasUsed"`
+	Error       string                                       `json:"error,omitempty"`
+	ReturnValue hexutil.Bytes                                `json:"returnValue"`
+	Logs        []*types.Log                                 `json:"logs"`
+	StateDiff   map[common.Address]*tracers.StateDiffAccount `json:"stateDiff"`
+}
+
+// parityChange is an item of the changeset in the report
+type parityChange struct {
+	Key   hexutil.Bytes `json:"key"`
+	Value hexutil.Bytes `json:"value"`
+}
+
+// parityDivergence is the report of the first difference between the interpreters. The structured trace of the
+// transaction comes from the built-in interpreter, the EVMC modules are not traced.
+type parityDivergence struct {
+	BlockNumber uint64       `json:"blockNumber"`
+	TxIndex     int          `json:"txIndex"` // -1 when the transactions match but the changesets of the block don't
+	TxHash      *common.Hash `json:"txHash,omitempty"`
+	Field       string       `json:"field"`
+
+	BuiltIn    *parityTxResult           `json:"builtin,omitempty"`
+	EVMC       *parityTxResult           `json:"evmc,omitempty"`
+	StructLogs []ethapi.StructLogRes     `json:"structLogs,omitempty"`
+	ChangeSets map[string][]parityChange `json:"changeSets,omitempty"`
+}
+
+// EVMCParity re-executes historical blocks from blockNum with both the built-in interpreter and the EVMC one
+// configured the same way as --vm.evm, and compares gas used, return data, logs and state changes of each transaction
+// and the changesets of each block. The first divergence is written into reportFile as JSON, and stops the check.
+func EVMCParity(genesis *core.Genesis, blockNum uint64, chaindata string, evmcConfig string, reportFile string) error {
+	if evmcConfig == "" {
+		return fmt.Errorf("path to the EVMC module is not specified")
+	}
+	startTime := time.Now()
+	sigs := make(chan os.Signal, 1)
+	interruptCh := make(chan bool, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		<-sigs
+		interruptCh <- true
+	}()
+
+	chainDb := ethdb.MustOpen(chaindata)
+	defer chainDb.Close()
+
+	chainConfig := genesis.Config
+	txCacher := core.NewTxSenderCacher(runtime.NumCPU())
+	bc, err := core.NewBlockChain(chainDb, nil, chainConfig, ethash.NewFaker(), vm.Config{}, nil, nil, txCacher)
+	if err != nil {
+		return err
+	}
+	defer bc.Stop()
+
+	configs := [2]vm.Config{{}, {EVMInterpreter: evmcConfig}}
+	interrupt := false
+	for !interrupt {
+		block := bc.GetBlockByNumber(blockNum)
+		if block == nil {
+			break
+		}
+		divergence, err := compareInterpreters(chainDb.KV(), chainConfig, bc, block, configs)
+		if err != nil {
+			return err
+		}
+		if divergence != nil {
+			log.Warn("Interpreters diverged", "block", blockNum, "tx", divergence.TxIndex, "field", divergence.Field, "report", reportFile)
+			data, err := json.MarshalIndent(divergence, "", "  ")
+			if err != nil {
+				return err
+			}
+			return ioutil.WriteFile(reportFile, data, 0644)
+		}
+
+		blockNum++
+		if blockNum%1000 == 0 {
+			log.Info("Checked", "blocks", blockNum)
+		}
+
+		// Check for interrupts
+		select {
+		case interrupt = <-interruptCh:
+			fmt.Println("interrupted, please wait for cleanup...")
+		default:
+		}
+	}
+	log.Info("Checked", "blocks", blockNum, "next time specify --block", blockNum, "duration", time.Since(startTime))
+	return nil
+}
+
+// compareInterpreters executes the block on the historical state with each of the configs, transaction by
+// transaction, and returns the first divergence, or nil if there is none.
+func compareInterpreters(kv ethdb.KV, chainConfig *params.ChainConfig, bc core.ChainContext, block *types.Block, configs [2]vm.Config) (*parityDivergence, error) {
+	header := block.Header()
+	ctx := chainConfig.WithEIPsFlags(context.Background(), header.Number)
+	var (
+		ibs [2]*state.IntraBlockState
+		gp  [2]*core.GasPool
+		res [2]*parityTxResult
+	)
+	for k := range configs {
+		ibs[k] = state.New(state.NewPlainDBState(kv, block.NumberU64()-1))
+		gp[k] = new(core.GasPool).AddGas(block.GasLimit())
+		if chainConfig.DAOForkSupport && chainConfig.DAOForkBlock != nil && chainConfig.DAOForkBlock.Cmp(block.Number()) == 0 {
+			misc.ApplyDAOHardFork(ibs[k])
+		}
+	}
+
+	for i, tx := range block.Transactions() {
+		for k, cfg := range configs {
+			var err error
+			if res[k], err = parityExecuteTx(ctx, ibs[k], chainConfig, bc, header, tx, i, gp[k], cfg); err != nil {
+				return nil, fmt.Errorf("tx %x failed: %v", tx.Hash(), err)
+			}
+		}
+		field, err := compareTxResults(res[0], res[1])
+		if err != nil {
+			return nil, err
+		}
+		if field == "" {
+			continue
+		}
+		txHash := tx.Hash()
+		divergence := &parityDivergence{
+			BlockNumber: block.NumberU64(),
+			TxIndex:     i,
+			TxHash:      &txHash,
+			Field:       field,
+			BuiltIn:     res[0],
+			EVMC:        res[1],
+		}
+		if divergence.StructLogs, err = parityTraceTx(kv, chainConfig, bc, block, i); err != nil {
+			return nil, err
+		}
+		return divergence, nil
+	}
+
+	// The transactions match, the changesets of the block should too
+	var changeSets [2][2][]byte
+	for k := range configs {
+		ethash.NewFullFaker().Finalize(chainConfig, header, ibs[k], block.Transactions(), block.Uncles())
+		csw := state.NewChangeSetWriterPlain(block.NumberU64() - 1)
+		if err := ibs[k].CommitBlock(ctx, csw); err != nil {
+			return nil, fmt.Errorf("committing block %d failed: %v", block.NumberU64(), err)
+		}
+		accountChanges, err := csw.GetAccountChanges()
+		if err != nil {
+			return nil, err
+		}
+		if changeSets[k][0], err = changeset.EncodeAccountsPlain(accountChanges); err != nil {
+			return nil, err
+		}
+		storageChanges, err := csw.GetStorageChanges()
+		if err != nil {
+			return nil, err
+		}
+		if storageChanges.Len() > 0 {
+			if changeSets[k][1], err = changeset.EncodeStoragePlain(storageChanges); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for j, field := range []string{"accountChangeSet", "storageChangeSet"} {
+		if bytes.Equal(changeSets[0][j], changeSets[1][j]) {
+			continue
+		}
+		divergence := &parityDivergence{
+			BlockNumber: block.NumberU64(),
+			TxIndex:     -1,
+			Field:       field,
+			ChangeSets:  map[string][]parityChange{},
+		}
+		for k, name := range []string{"builtin", "evmc"} {
+			changes := []parityChange{}
+			walk := func(key, value []byte) error {
+				changes = append(changes, parityChange{common.CopyBytes(key), common.CopyBytes(value)})
+				return nil
+			}
+			var err error
+			if j == 0 {
+				err = changeset.AccountChangeSetPlainBytes(changeSets[k][j]).Walk(walk)
+			} else if len(changeSets[k][j]) > 0 {
+				err = changeset.StorageChangeSetPlainBytes(changeSets[k][j]).Walk(walk)
+			}
+			if err != nil {
+				return nil, err
+			}
+			divergence.ChangeSets[name] = changes
+		}
+		return divergence, nil
+	}
+	return nil, nil
+}
+
+// parityExecuteTx executes the transaction of the block on the state with the interpreter of the config
+func parityExecuteTx(ctx context.Context, ibs *state.IntraBlockState, chainConfig *params.ChainConfig, bc core.ChainContext,
+	header *types.Header, tx *types.Transaction, txIndex int, gp *core.GasPool, cfg vm.Config) (*parityTxResult, error) {
+	msg, err := tx.AsMessage(types.MakeSigner(chainConfig, header.Number))
+	if err != nil {
+		return nil, err
+	}
+	ibs.Prepare(tx.Hash(), header.Hash(), txIndex)
+	evm := vm.NewEVM(core.NewEVMContext(msg, header, bc, nil), ibs, chainConfig, cfg, nil)
+	result, err := core.ApplyMessage(evm, msg, gp)
+	if err != nil {
+		return nil, err
+	}
+	res := &parityTxResult{
+		GasUsed:     result.UsedGas,
+		ReturnValue: result.Return(),
+		Logs:        ibs.GetLogs(tx.Hash()),
+		StateDiff:   tracers.StateDiff(ibs.TxStateDiff(ctx)),
+	}
+	if result.Err != nil {
+		res.Error = result.Err.Error()
+		res.ReturnValue = result.Revert()
+	}
+	if res.Logs == nil {
+		res.Logs = []*types.Log{}
+	}
+	if err := ibs.FinalizeTx(ctx, state.NewNoopWriter()); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// compareTxResults returns the name of the first field of the results which differ, or the empty string
+func compareTxResults(a, b *parityTxResult) (string, error) {
+	if a.GasUsed != b.GasUsed {
+		return "gasUsed", nil
+	}
+	if a.Error != b.Error {
+		return "error", nil
+	}
+	if !bytes.Equal(a.ReturnValue, b.ReturnValue) {
+		return "returnValue", nil
+	}
+	for _, field := range []struct {
+		name string
+		a, b interface{}
+	}{{"logs", a.Logs, b.Logs}, {"stateDiff", a.StateDiff, b.StateDiff}} {
+		// Compare the encodings, they don't depend on the nil and empty slices
+		ja, err := json.Marshal(field.a)
+		if err != nil {
+			return "", err
+		}
+		jb, err := json.Marshal(field.b)
+		if err != nil {
+			return "", err
+		}
+		if !bytes.Equal(ja, jb) {
+			return field.name, nil
+		}
+	}
+	return "", nil
+}
+
+// parityTraceTx re-executes the block up to the transaction with the built-in interpreter and returns the structured
+// trace of the transaction
+func parityTraceTx(kv ethdb.KV, chainConfig *params.ChainConfig, bc core.ChainContext, block *types.Block, txIndex int) ([]ethapi.StructLogRes, error) {
+	header := block.Header()
+	ctx := chainConfig.WithEIPsFlags(context.Background(), header.Number)
+	ibs := state.New(state.NewPlainDBState(kv, block.NumberU64()-1))
+	gp := new(core.GasPool).AddGas(block.GasLimit())
+	if chainConfig.DAOForkSupport && chainConfig.DAOForkBlock != nil && chainConfig.DAOForkBlock.Cmp(block.Number()) == 0 {
+		misc.ApplyDAOHardFork(ibs)
+	}
+	logger := vm.NewStructLogger(nil)
+	for i, tx := range block.Transactions()[:txIndex+1] {
+		cfg := vm.Config{}
+		if i == txIndex {
+			cfg = vm.Config{Debug: true, Tracer: logger}
+		}
+		if _, err := parityExecuteTx(ctx, ibs, chainConfig, bc, header, tx, i, gp, cfg); err != nil {
+			return nil, fmt.Errorf("tx %x failed: %v", tx.Hash(), err)
+		}
+	}
+	return ethapi.FormatLogs(logger.StructLogs()), nil
+}
@@ -0,0 +1,122 @@
+package stateless
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/consensus"
+	"github.com/ledgerwatch/turbo-geth/consensus/ethash"
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/eth/tracers"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/internal/chaintest"
+	"github.com/ledgerwatch/turbo-geth/params"
+)
+
+type parityChainContext struct {
+	db ethdb.Database
+}
+
+func (c *parityChainContext) GetHeader(hash common.Hash, number uint64) *types.Header {
+	return rawdb.ReadHeader(c.db, hash, number)
+}
+
+func (c *parityChainContext) Engine() consensus.Engine {
+	return ethash.NewFaker()
+}
+
+func TestCompareInterpreters(t *testing.T) {
+	var (
+		key, _   = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address  = crypto.PubkeyToAddress(key.PublicKey)
+		contract = common.HexToAddress("0x1000")
+		// increments the slot 1 and logs its new value
+		code = []byte{
+			byte(vm.PUSH1), 1, byte(vm.SLOAD), byte(vm.PUSH1), 1, byte(vm.ADD), byte(vm.DUP1), byte(vm.PUSH1), 1, byte(vm.SSTORE),
+			byte(vm.PUSH1), 0, byte(vm.MSTORE), byte(vm.PUSH1), 32, byte(vm.PUSH1), 0, byte(vm.LOG0), byte(vm.STOP),
+		}
+		gspec = &core.Genesis{
+			Config: params.TestChainConfig,
+			Alloc: core.GenesisAlloc{
+				address:  {Balance: big.NewInt(1000000000)},
+				contract: {Code: code, Balance: big.NewInt(0)},
+			},
+		}
+		signer = types.MakeSigner(gspec.Config, big.NewInt(1))
+	)
+	// Plain state and its history, the way the staged sync writes them
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	chainContext := &parityChainContext{db}
+	blocks, err := chaintest.WritePlainStateChain(db, gspec, chainContext, 3, func(i int, block *core.BlockGen) {
+		for j := 0; j <= i; j++ {
+			tx, err := types.SignTx(types.NewTransaction(block.TxNonce(address), contract, uint256.NewInt(), 100000, new(uint256.Int), nil), signer, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			block.AddTx(tx)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same interpreter never diverges
+	for _, block := range blocks {
+		divergence, err := compareInterpreters(db.KV(), gspec.Config, chainContext, block, [2]vm.Config{{}, {}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if divergence != nil {
+			t.Fatalf("unexpected divergence in block %d: %+v", block.NumberU64(), divergence)
+		}
+	}
+
+	trace, err := parityTraceTx(db.KV(), gspec.Config, chainContext, blocks[2], 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trace) != 13 || trace[len(trace)-1].Op != "STOP" {
+		t.Fatalf("unexpected trace %+v", trace)
+	}
+}
+
+func TestCompareTxResults(t *testing.T) {
+	result := func() *parityTxResult {
+		return &parityTxResult{
+			GasUsed:     21000,
+			ReturnValue: []byte{1},
+			Logs:        []*types.Log{{Address: common.HexToAddress("0x1000"), Data: []byte{2}}},
+		}
+	}
+	for _, test := range []struct {
+		field  string
+		change func(r *parityTxResult)
+	}{
+		{"", func(r *parityTxResult) {}},
+		{"gasUsed", func(r *parityTxResult) { r.GasUsed++ }},
+		{"error", func(r *parityTxResult) { r.Error = "out of gas" }},
+		{"returnValue", func(r *parityTxResult) { r.ReturnValue = nil }},
+		{"logs", func(r *parityTxResult) { r.Logs[0].Data = []byte{3} }},
+		{"stateDiff", func(r *parityTxResult) {
+			r.StateDiff = map[common.Address]*tracers.StateDiffAccount{{}: {Balance: "="}}
+		}},
+	} {
+		a, b := result(), result()
+		test.change(b)
+		field, err := compareTxResults(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if field != test.field {
+			t.Errorf("expected %q divergence, got %q", test.field, field)
+		}
+	}
+}
@@ -0,0 +1,459 @@
+package stateless
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"math/big"
+	"os"
+	"os/signal"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/consensus/ethash"
+	"github.com/ledgerwatch/turbo-geth/consensus/misc"
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/core/vm/stack"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+	"github.com/ledgerwatch/turbo-geth/params"
+)
+
+// profileStat is the aggregated cost of an opcode or a precompile
+type profileStat struct {
+	count uint64
+	gas   uint64
+	time  time.Duration
+}
+
+func (s *profileStat) add(gas uint64, d time.Duration) {
+	s.count++
+	s.gas += gas
+	s.time += d
+}
+
+// profileHotSpot is the key of the per-contract statistics
+type profileHotSpot struct {
+	contract common.Address
+	name     string
+}
+
+// profileOp is the opcode or the precompile being executed in a frame
+type profileOp struct {
+	name       string
+	precompile bool
+	call       bool // CALL, CALLCODE, DELEGATECALL or STATICCALL, its cost includes the gas given to the callee
+	descended  bool // the callee of the call opcode got a frame, so it has some code to run
+	gasBefore  uint64
+	callee     *profileOp     // precompile called by the call opcode, it doesn't get a frame
+	calleeAddr common.Address // address of the precompile
+	gas        uint64
+	time       time.Duration
+}
+
+// profileFrame is the contract being executed at a depth
+type profileFrame struct {
+	contract common.Address
+	path     string // addresses of the contracts down to this one, separated by ';'
+	op       *profileOp
+}
+
+// OpcodeProfiler is a tracer aggregating the number of executions, the gas and the wall time of each opcode
+// and precompile, per contract and per call stack. The contract of an opcode is the one whose code is executed,
+// so the opcodes run by DELEGATECALL and CALLCODE are attributed to the callee. The time of an opcode is the time
+// until the next event of the tracer, so it includes the overhead of the tracing itself, the time of a call
+// opcode includes setting up the callee, and the time of the last opcode of the callee includes returning from it.
+// The time of a call opcode calling a precompile is the time of the precompile. The gas of a call opcode doesn't
+// include the gas given to the callee.
+type OpcodeProfiler struct {
+	ops         map[string]*profileStat
+	precompiles map[string]*profileStat
+	contracts   map[profileHotSpot]*profileStat
+	stacks      map[string]*profileStat
+
+	frames      []*profileFrame
+	current     *profileOp // receives the time since the last event
+	last        time.Time
+	precompiled map[common.Address]vm.PrecompiledContract // precompiles of the block being profiled, see SetBlock
+}
+
+func NewOpcodeProfiler() *OpcodeProfiler {
+	return &OpcodeProfiler{
+		ops:         make(map[string]*profileStat),
+		precompiles: make(map[string]*profileStat),
+		contracts:   make(map[profileHotSpot]*profileStat),
+		stacks:      make(map[string]*profileStat),
+	}
+}
+
+// SetBlock selects the precompiles active at the block, for the transactions calling a precompile directly,
+// the calls from the contracts use the rules of the EVM
+func (op *OpcodeProfiler) SetBlock(chainConfig *params.ChainConfig, blockNumber *big.Int) {
+	op.precompiled = activePrecompiles(chainConfig, blockNumber)
+}
+
+// activePrecompiles returns the precompiled contracts at the block, selected the same way as the EVM does
+func activePrecompiles(chainConfig *params.ChainConfig, blockNumber *big.Int) map[common.Address]vm.PrecompiledContract {
+	rules := chainConfig.Rules(blockNumber)
+	precompiles := vm.PrecompiledContractsHomestead
+	if rules.IsByzantium {
+		precompiles = vm.PrecompiledContractsByzantium
+	}
+	if rules.IsIstanbul {
+		precompiles = vm.PrecompiledContractsIstanbul
+	}
+	if rules.IsYoloV1 {
+		precompiles = vm.PrecompiledContractsYoloV1
+	}
+	return precompiles
+}
+
+// tick attributes the time since the previous event to the current opcode
+func (op *OpcodeProfiler) tick() {
+	now := time.Now()
+	if op.current != nil {
+		op.current.time += now.Sub(op.last)
+	}
+	op.last = now
+}
+
+func (op *OpcodeProfiler) add(o *profileOp, contract common.Address, path string) {
+	stats := op.ops
+	if o.precompile {
+		stats = op.precompiles
+	}
+	for _, s := range []struct {
+		m   map[string]*profileStat
+		key string
+	}{{stats, o.name}, {op.stacks, path + ";" + o.name}} {
+		stat, ok := s.m[s.key]
+		if !ok {
+			stat = &profileStat{}
+			s.m[s.key] = stat
+		}
+		stat.add(o.gas, o.time)
+	}
+	key := profileHotSpot{contract, o.name}
+	stat, ok := op.contracts[key]
+	if !ok {
+		stat = &profileStat{}
+		op.contracts[key] = stat
+	}
+	stat.add(o.gas, o.time)
+}
+
+// finish adds the finished opcode of the frame to the statistics. gas is the gas left after the opcode, if known,
+// it gives the gas of the call opcodes whose callees didn't get a frame: the precompiles and the accounts without code
+func (op *OpcodeProfiler) finish(frame *profileFrame, gas uint64, gasKnown bool) {
+	o := frame.op
+	if o == nil {
+		return
+	}
+	frame.op = nil
+	if o.call && !o.descended {
+		var calleeGas uint64
+		if o.callee != nil {
+			calleeGas = o.callee.gas
+			op.add(o.callee, o.calleeAddr, frame.path+";"+o.calleeAddr.Hex())
+		}
+		o.gas = 0
+		if gasKnown && o.gasBefore > gas+calleeGas {
+			o.gas = o.gasBefore - gas - calleeGas
+		}
+	}
+	op.add(o, frame.contract, frame.path)
+}
+
+// push adds the frame of the callee of the last opcode of the caller, given its initial gas
+func (op *OpcodeProfiler) push(contract common.Address, gas uint64) *profileFrame {
+	frame := &profileFrame{contract: contract, path: contract.Hex()}
+	if len(op.frames) > 0 {
+		caller := op.frames[len(op.frames)-1]
+		frame.path = caller.path + ";" + frame.path
+		if caller.op != nil && caller.op.call {
+			caller.op.descended = true
+			if caller.op.gas > gas {
+				caller.op.gas -= gas
+			} else {
+				caller.op.gas = 0
+			}
+		}
+	}
+	op.frames = append(op.frames, frame)
+	return frame
+}
+
+// pop removes the frame of the returned callee
+func (op *OpcodeProfiler) pop() {
+	op.finish(op.frames[len(op.frames)-1], 0, false)
+	op.frames = op.frames[:len(op.frames)-1]
+}
+
+// CaptureStart only tracks the start of the transaction, the frames of the calls are tracked by CaptureState,
+// because there is no CaptureStart for DELEGATECALL, CALLCODE and STATICCALL
+func (op *OpcodeProfiler) CaptureStart(depth int, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) error {
+	if depth != 0 {
+		return nil
+	}
+	op.tick()
+	op.frames = op.frames[:0]
+	frame := op.push(to, gas)
+	if p, ok := op.precompiled[to]; ok && !create {
+		frame.op = &profileOp{name: precompileName(p), precompile: true}
+		op.current = frame.op
+	}
+	return nil
+}
+
+func precompileName(p vm.PrecompiledContract) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", p), "*vm.")
+}
+
+func (op *OpcodeProfiler) CaptureState(env *vm.EVM, pc uint64, o vm.OpCode, gas, cost uint64, memory *vm.Memory, st *stack.Stack, rStack *stack.ReturnStack, contract *vm.Contract, depth int, err error) error {
+	op.tick()
+	if depth < 1 || depth > len(op.frames)+1 {
+		return nil
+	}
+	for len(op.frames) > depth {
+		op.pop()
+	}
+	if len(op.frames) < depth {
+		// The first opcode of the callee
+		codeAddr := contract.Address()
+		if contract.CodeAddr != nil {
+			codeAddr = *contract.CodeAddr
+		}
+		op.push(codeAddr, gas)
+	}
+	frame := op.frames[depth-1]
+	op.finish(frame, gas, true)
+	frame.op = &profileOp{name: o.String(), gas: cost}
+	op.current = frame.op
+	switch o {
+	case vm.CALL, vm.CALLCODE, vm.DELEGATECALL, vm.STATICCALL:
+		frame.op.call = true
+		frame.op.gasBefore = gas
+		to := common.Address(st.Back(1).Bytes20())
+		p, ok := activePrecompiles(env.ChainConfig(), env.BlockNumber)[to]
+		if !ok || err != nil {
+			break
+		}
+		in := 2
+		if o == vm.CALL || o == vm.CALLCODE {
+			in = 3
+		}
+		input := memory.GetPtr(st.Back(in).Uint64(), st.Back(in+1).Uint64())
+		frame.op.callee = &profileOp{name: precompileName(p), precompile: true, gas: p.RequiredGas(input)}
+		frame.op.calleeAddr = to
+		op.current = frame.op.callee
+	}
+	return nil
+}
+
+func (op *OpcodeProfiler) CaptureFault(env *vm.EVM, pc uint64, o vm.OpCode, gas, cost uint64, memory *vm.Memory, st *stack.Stack, rStack *stack.ReturnStack, contract *vm.Contract, depth int, err error) error {
+	return nil
+}
+
+// CaptureEnd finishes the transaction, the ends of the calls are seen by CaptureState when the depth decreases
+func (op *OpcodeProfiler) CaptureEnd(depth int, output []byte, gasUsed uint64, t time.Duration, err error) error {
+	if depth != 0 {
+		return nil
+	}
+	op.tick()
+	if len(op.frames) > 0 {
+		if root := op.frames[0]; root.op != nil && root.op.precompile {
+			root.op.gas = gasUsed
+		}
+	}
+	for len(op.frames) > 0 {
+		op.pop()
+	}
+	op.current = nil
+	return nil
+}
+
+func (op *OpcodeProfiler) CaptureCreate(creator common.Address, creation common.Address) error {
+	return nil
+}
+
+func (op *OpcodeProfiler) CaptureAccountRead(account common.Address) error {
+	return nil
+}
+
+func (op *OpcodeProfiler) CaptureAccountWrite(account common.Address) error {
+	return nil
+}
+
+// WriteCSV writes the statistics of the opcodes and the precompiles into opsFile, and the per-contract ones
+// into contractsFile, the most time consuming first.
+func (op *OpcodeProfiler) WriteCSV(opsFile, contractsFile string) error {
+	type row struct {
+		key  []string
+		stat *profileStat
+	}
+	write := func(fileName string, header []string, rows []row) error {
+		sort.Slice(rows, func(i, j int) bool { return rows[i].stat.time > rows[j].stat.time })
+		f, err := os.Create(fileName)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w := csv.NewWriter(f)
+		if err := w.Write(append(header, "count", "gas", "time_ns", "avg_time_ns")); err != nil {
+			return err
+		}
+		for _, r := range rows {
+			record := append(r.key,
+				strconv.FormatUint(r.stat.count, 10),
+				strconv.FormatUint(r.stat.gas, 10),
+				strconv.FormatInt(r.stat.time.Nanoseconds(), 10),
+				strconv.FormatInt(r.stat.time.Nanoseconds()/int64(r.stat.count), 10),
+			)
+			if err := w.Write(record); err != nil {
+				return err
+			}
+		}
+		w.Flush()
+		return w.Error()
+	}
+
+	rows := make([]row, 0, len(op.ops)+len(op.precompiles))
+	for name, stat := range op.ops {
+		rows = append(rows, row{[]string{"opcode", name}, stat})
+	}
+	for name, stat := range op.precompiles {
+		rows = append(rows, row{[]string{"precompile", name}, stat})
+	}
+	if err := write(opsFile, []string{"kind", "name"}, rows); err != nil {
+		return err
+	}
+	rows = make([]row, 0, len(op.contracts))
+	for key, stat := range op.contracts {
+		rows = append(rows, row{[]string{key.contract.Hex(), key.name}, stat})
+	}
+	return write(contractsFile, []string{"contract", "name"}, rows)
+}
+
+// WriteFolded writes the call stacks in the folded format of flamegraph.pl, one line per stack of contracts
+// ending with the opcode or the precompile, weighted by the wall time in nanoseconds, or by gas if byGas is set.
+func (op *OpcodeProfiler) WriteFolded(fileName string, byGas bool) error {
+	stacks := make([]string, 0, len(op.stacks))
+	for s := range op.stacks {
+		stacks = append(stacks, s)
+	}
+	sort.Strings(stacks)
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	for _, s := range stacks {
+		stat := op.stacks[s]
+		value := uint64(stat.time.Nanoseconds())
+		if byGas {
+			value = stat.gas
+		}
+		if _, err := fmt.Fprintf(w, "%s %d\n", s, value); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// OpcodeProfile replays the blocks from blockNum to toBlock inclusive (until the last one if toBlock is 0) on
+// the historical state with the profiling tracer, and writes the statistics into <output>_ops.csv,
+// <output>_contracts.csv, and the flame graph stacks into <output>_time.folded and <output>_gas.folded.
+func OpcodeProfile(genesis *core.Genesis, blockNum, toBlock uint64, chaindata string, output string) error {
+	startTime := time.Now()
+	sigs := make(chan os.Signal, 1)
+	interruptCh := make(chan bool, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		<-sigs
+		interruptCh <- true
+	}()
+
+	chainDb := ethdb.MustOpen(chaindata)
+	defer chainDb.Close()
+
+	chainConfig := genesis.Config
+	txCacher := core.NewTxSenderCacher(runtime.NumCPU())
+	bc, err := core.NewBlockChain(chainDb, nil, chainConfig, ethash.NewFaker(), vm.Config{}, nil, nil, txCacher)
+	if err != nil {
+		return err
+	}
+	defer bc.Stop()
+
+	profiler := NewOpcodeProfiler()
+	interrupt := false
+	for !interrupt && (toBlock == 0 || blockNum <= toBlock) {
+		block := bc.GetBlockByNumber(blockNum)
+		if block == nil {
+			break
+		}
+		if err := profileBlock(chainDb.KV(), chainConfig, bc, block, profiler); err != nil {
+			return err
+		}
+
+		blockNum++
+		if blockNum%1000 == 0 {
+			log.Info("Profiled", "blocks", blockNum)
+		}
+
+		// Check for interrupts
+		select {
+		case interrupt = <-interruptCh:
+			fmt.Println("interrupted, please wait for cleanup...")
+		default:
+		}
+	}
+	log.Info("Profiled", "blocks", blockNum, "next time specify --block", blockNum, "duration", time.Since(startTime))
+
+	if err := profiler.WriteCSV(output+"_ops.csv", output+"_contracts.csv"); err != nil {
+		return err
+	}
+	if err := profiler.WriteFolded(output+"_time.folded", false); err != nil {
+		return err
+	}
+	return profiler.WriteFolded(output+"_gas.folded", true)
+}
+
+// profileBlock executes the transactions of the block on the historical state with the profiler
+func profileBlock(kv ethdb.KV, chainConfig *params.ChainConfig, bc core.ChainContext, block *types.Block, profiler *OpcodeProfiler) error {
+	header := block.Header()
+	ctx := chainConfig.WithEIPsFlags(context.Background(), header.Number)
+	ibs := state.New(state.NewPlainDBState(kv, block.NumberU64()-1))
+	gp := new(core.GasPool).AddGas(block.GasLimit())
+	if chainConfig.DAOForkSupport && chainConfig.DAOForkBlock != nil && chainConfig.DAOForkBlock.Cmp(block.Number()) == 0 {
+		misc.ApplyDAOHardFork(ibs)
+	}
+	profiler.SetBlock(chainConfig, header.Number)
+	cfg := vm.Config{Debug: true, Tracer: profiler}
+	signer := types.MakeSigner(chainConfig, header.Number)
+	for i, tx := range block.Transactions() {
+		msg, err := tx.AsMessage(signer)
+		if err != nil {
+			return err
+		}
+		ibs.Prepare(tx.Hash(), header.Hash(), i)
+		evm := vm.NewEVM(core.NewEVMContext(msg, header, bc, nil), ibs, chainConfig, cfg, nil)
+		if _, err := core.ApplyMessage(evm, msg, gp); err != nil {
+			return fmt.Errorf("tx %x failed: %v", tx.Hash(), err)
+		}
+		if err := ibs.FinalizeTx(ctx, state.NewNoopWriter()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
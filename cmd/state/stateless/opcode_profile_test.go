@@ -0,0 +1,195 @@
+package stateless
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/core/vm/runtime"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/params"
+)
+
+func TestOpcodeProfiler(t *testing.T) {
+	// calls the sha256 precompile with all the gas and no input
+	code := []byte{
+		byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0,
+		byte(vm.PUSH1), 2, byte(vm.GAS), byte(vm.CALL), byte(vm.POP), byte(vm.STOP),
+	}
+	profiler := NewOpcodeProfiler()
+	if _, _, err := runtime.Execute(code, nil, &runtime.Config{EVMConfig: vm.Config{Debug: true, Tracer: profiler}}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		stats      map[string]*profileStat
+		name       string
+		count, gas uint64
+	}{
+		{profiler.ops, "PUSH1", 6, 18},
+		{profiler.ops, "GAS", 1, 2},
+		{profiler.ops, "CALL", 1, 700},
+		{profiler.ops, "POP", 1, 2},
+		{profiler.ops, "STOP", 1, 0},
+		{profiler.precompiles, "sha256hash", 1, 60},
+	} {
+		stat, ok := test.stats[test.name]
+		if !ok {
+			t.Fatalf("%s is not profiled", test.name)
+		}
+		if stat.count != test.count || stat.gas != test.gas {
+			t.Errorf("%s: count %d gas %d, expected count %d gas %d", test.name, stat.count, stat.gas, test.count, test.gas)
+		}
+	}
+	if len(profiler.ops) != 5 || len(profiler.precompiles) != 1 || len(profiler.frames) != 0 {
+		t.Fatalf("unexpected profile: ops %d precompiles %d frames %d", len(profiler.ops), len(profiler.precompiles), len(profiler.frames))
+	}
+	contract := common.BytesToAddress([]byte("contract"))
+	if stat := profiler.contracts[profileHotSpot{contract, "PUSH1"}]; stat == nil || stat.count != 6 {
+		t.Errorf("unexpected PUSH1 hot spot %+v", stat)
+	}
+	precompilePath := contract.Hex() + ";" + common.BytesToAddress([]byte{2}).Hex() + ";sha256hash"
+	if stat := profiler.stacks[precompilePath]; stat == nil || stat.gas != 60 {
+		t.Errorf("unexpected stack of the precompile %+v", stat)
+	}
+
+	dir, err := ioutil.TempDir("", "opcode-profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = profiler.WriteCSV(filepath.Join(dir, "ops.csv"), filepath.Join(dir, "contracts.csv")); err != nil {
+		t.Fatal(err)
+	}
+	ops, err := ioutil.ReadFile(filepath.Join(dir, "ops.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(ops)), "\n"); len(lines) != 7 || lines[0] != "kind,name,count,gas,time_ns,avg_time_ns" {
+		t.Errorf("unexpected ops.csv\n%s", ops)
+	}
+	if err = profiler.WriteFolded(filepath.Join(dir, "gas.folded"), true); err != nil {
+		t.Fatal(err)
+	}
+	folded, err := ioutil.ReadFile(filepath.Join(dir, "gas.folded"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(folded), precompilePath+" 60\n") || !strings.Contains(string(folded), contract.Hex()+";CALL 700\n") {
+		t.Errorf("unexpected gas.folded\n%s", folded)
+	}
+}
+
+func TestOpcodeProfilerDelegateAndStaticCall(t *testing.T) {
+	callee := common.BytesToAddress([]byte{0xca})
+	// delegates to the callee with all the gas
+	code := []byte{
+		byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0,
+		byte(vm.PUSH1), 0xca, byte(vm.GAS), byte(vm.DELEGATECALL), byte(vm.POP), byte(vm.STOP),
+	}
+	// calls the identity precompile via STATICCALL
+	calleeCode := []byte{
+		byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0,
+		byte(vm.PUSH1), 4, byte(vm.GAS), byte(vm.STATICCALL), byte(vm.POP), byte(vm.ADDRESS), byte(vm.POP), byte(vm.STOP),
+	}
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	ibs := state.New(state.NewTrieDbState(common.Hash{}, db, 0))
+	ibs.SetCode(callee, calleeCode)
+	profiler := NewOpcodeProfiler()
+	if _, _, err := runtime.Execute(code, nil, &runtime.Config{ChainConfig: params.TestChainConfig, State: ibs, EVMConfig: vm.Config{Debug: true, Tracer: profiler}}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	contract := common.BytesToAddress([]byte("contract"))
+	identity := common.BytesToAddress([]byte{4})
+	for _, test := range []struct {
+		contract   common.Address
+		name       string
+		count, gas uint64
+	}{
+		{contract, "PUSH1", 5, 15},
+		{contract, "DELEGATECALL", 1, 700},
+		{contract, "POP", 1, 2},
+		{callee, "PUSH1", 5, 15},
+		{callee, "STATICCALL", 1, 700},
+		{callee, "ADDRESS", 1, 2},
+		{callee, "STOP", 1, 0},
+		{identity, "dataCopy", 1, 15},
+	} {
+		stat := profiler.contracts[profileHotSpot{test.contract, test.name}]
+		if stat == nil {
+			t.Fatalf("%s of %s is not profiled", test.name, test.contract.Hex())
+		}
+		if stat.count != test.count || stat.gas != test.gas {
+			t.Errorf("%s of %s: count %d gas %d, expected count %d gas %d", test.name, test.contract.Hex(), stat.count, stat.gas, test.count, test.gas)
+		}
+	}
+	if stat := profiler.precompiles["dataCopy"]; stat == nil || stat.count != 1 {
+		t.Errorf("unexpected identity precompile profile %+v", stat)
+	}
+	if stat := profiler.stacks[contract.Hex()+";"+callee.Hex()+";"+identity.Hex()+";dataCopy"]; stat == nil || stat.gas != 15 {
+		t.Errorf("unexpected stack of the precompile %+v", stat)
+	}
+	if stat := profiler.stacks[contract.Hex()+";"+callee.Hex()+";ADDRESS"]; stat == nil || stat.count != 1 {
+		t.Errorf("unexpected stack of the delegated code %+v", stat)
+	}
+	if len(profiler.frames) != 0 {
+		t.Errorf("%d frames left", len(profiler.frames))
+	}
+}
+
+func TestOpcodeProfilerPrecompilesOfBlock(t *testing.T) {
+	// calls the bn256Add precompile with all the gas and no input
+	code := []byte{
+		byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0,
+		byte(vm.PUSH1), 6, byte(vm.GAS), byte(vm.CALL), byte(vm.POP), byte(vm.STOP),
+	}
+	byzantium := &params.ChainConfig{
+		ChainID:        big.NewInt(1),
+		HomesteadBlock: new(big.Int),
+		EIP150Block:    new(big.Int),
+		EIP155Block:    new(big.Int),
+		EIP158Block:    new(big.Int),
+		ByzantiumBlock: new(big.Int),
+		IstanbulBlock:  big.NewInt(10),
+	}
+	profile := func(blockNumber int64) *OpcodeProfiler {
+		profiler := NewOpcodeProfiler()
+		cfg := &runtime.Config{ChainConfig: byzantium, BlockNumber: big.NewInt(blockNumber), EVMConfig: vm.Config{Debug: true, Tracer: profiler}}
+		if _, _, err := runtime.Execute(code, nil, cfg, 0); err != nil {
+			t.Fatal(err)
+		}
+		return profiler
+	}
+
+	// Byzantium gas, not Istanbul one, is attributed to the precompile, the rest of the call gas to CALL
+	for blockNumber, expected := range map[int64]struct {
+		name string
+		gas  uint64
+	}{
+		1:  {"bn256AddByzantium", 500},
+		10: {"bn256AddIstanbul", 150},
+	} {
+		profiler := profile(blockNumber)
+		stat := profiler.precompiles[expected.name]
+		if len(profiler.precompiles) != 1 || stat == nil || stat.count != 1 || stat.gas != expected.gas {
+			t.Errorf("block %d: unexpected precompiles %v, expected %s with gas %d", blockNumber, profiler.precompiles, expected.name, expected.gas)
+		}
+		if stat := profiler.ops["CALL"]; stat == nil || stat.gas != 700 {
+			t.Errorf("block %d: unexpected CALL profile %+v", blockNumber, stat)
+		}
+	}
+
+	// Before Byzantium 0x6 is an empty account
+	byzantium.ByzantiumBlock, byzantium.IstanbulBlock = big.NewInt(10), nil
+	if profiler := profile(1); len(profiler.precompiles) != 0 {
+		t.Errorf("unexpected precompiles before Byzantium %v", profiler.precompiles)
+	}
+}
@@ -117,7 +117,7 @@ func loadSnapshot(db ethdb.Database, filename string, createDb CreateDbFunc) {
 
 	err = copyDatabase(diskDb, db)
 	check(err)
-	err = migrations.NewMigrator().Apply(diskDb, false, false, false, false)
+	err = migrations.NewMigrator().Apply(diskDb, "")
 	check(err)
 }
 
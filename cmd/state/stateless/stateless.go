@@ -40,10 +40,9 @@ var chartColors = []drawing.Color{
 }
 
 func runBlock(ibs *state.IntraBlockState, txnWriter state.StateWriter, blockWriter state.StateWriter,
-	chainConfig *params.ChainConfig, bcb core.ChainContext, block *types.Block,
+	chainConfig *params.ChainConfig, bcb core.ChainContext, block *types.Block, vmConfig vm.Config,
 ) (types.Receipts, error) {
 	header := block.Header()
-	vmConfig := vm.Config{}
 	engine := ethash.NewFullFaker()
 	gp := new(core.GasPool).AddGas(block.GasLimit())
 	usedGas := new(uint64)
@@ -151,6 +150,7 @@ func Stateless(
 	useStatelessResolver bool,
 	witnessDatabasePath string,
 	writeHistory bool,
+	codeChunks bool,
 ) {
 	state.MaxTrieCacheSize = uint64(triesize)
 	startTime := time.Now()
@@ -226,9 +226,15 @@ func Stateless(
 	tds := state.NewTrieDbState(preRoot, batch, blockNum-1)
 	tds.SetResolveReads(false)
 	tds.SetNoHistory(!writeHistory)
+	if codeChunks {
+		tds.EnableCodeChunks(true)
+		vmConfig.CodeAccessRecorder = tds
+	}
 	interrupt := false
 	var blockWitness []byte
 	var bw *trie.Witness
+	// Code merkle roots of the codes the stateless execution has seen in full, to verify the code chunks
+	codeRoots := make(trie.CodeRoots)
 
 	processed := 0
 	blockProcessingStartTime := time.Now()
@@ -381,7 +387,7 @@ func Stateless(
 				err = starkData(w, starkStatsBase, blockNum-1)
 				check(err)
 			}
-			s, err = state.NewStateless(preRoot, w, blockNum-1, trace, binary /* is binary */)
+			s, err = state.NewStateless(preRoot, w, blockNum-1, trace, binary /* is binary */, codeRoots)
 			if err != nil {
 				fmt.Printf("Error making stateless2 for block %d: %v\n", blockNum, err)
 				filename := fmt.Sprintf("right_%d.txt", blockNum-1)
@@ -399,9 +405,16 @@ func Stateless(
 			ibs := state.New(s)
 			ibs.SetTrace(trace)
 			s.SetBlockNr(blockNum)
-			if _, err = runBlock(ibs, s, s, chainConfig, blockProvider, block); err != nil {
+			statelessVmConfig := vm.Config{}
+			if codeChunks {
+				statelessVmConfig.CodeAccessRecorder = s
+			}
+			if _, err = runBlock(ibs, s, s, chainConfig, blockProvider, block, statelessVmConfig); err != nil {
 				fmt.Printf("Error running block %d through stateless2: %v\n", blockNum, err)
 				finalRootFail = true
+			} else if err = s.CodeAccessError(); err != nil {
+				fmt.Printf("Block %d through stateless2 executed the code missing from the witness: %v\n", blockNum, err)
+				finalRootFail = true
 			} else if !binary {
 				if err = s.CheckRoot(header.Root); err != nil {
 					fmt.Printf("Wrong block hash %x in block %d\n", block.Hash(), blockNum)
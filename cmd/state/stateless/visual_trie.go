@@ -0,0 +1,122 @@
+package stateless
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+// parseNibblePrefix turns a string of hex digits into the key prefix, odd number of digits is allowed
+func parseNibblePrefix(s string) (trie.Keybytes, []byte, error) {
+	nibbles := make([]byte, len(s))
+	for i := 0; i < len(s); i++ {
+		n, err := hex.DecodeString("0" + s[i:i+1])
+		if err != nil {
+			return trie.Keybytes{}, nil, fmt.Errorf("invalid prefix %q: %w", s, err)
+		}
+		nibbles[i] = n[0]
+	}
+	if len(nibbles) > 2*common.HashLength {
+		return trie.Keybytes{}, nil, fmt.Errorf("prefix %q is longer than the key", s)
+	}
+	prefix := trie.Keybytes{Data: make([]byte, (len(nibbles)+1)/2), Odd: len(nibbles)%2 == 1}
+	for i, n := range nibbles {
+		if i%2 == 0 {
+			prefix.Data[i/2] = n << 4
+		} else {
+			prefix.Data[i/2] |= n
+		}
+	}
+	return prefix, nibbles, nil
+}
+
+// witnessNodeReferences returns the references of all the nodes in the witnesses of the block,
+// as written by the stateless command into the witness database
+func witnessNodeReferences(witnessDbPath string, blockNum uint64, trieSize uint32) (map[string]struct{}, error) {
+	db, err := ethdb.Open(witnessDbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	serialized, err := NewWitnessDBReader(db).GetWitnessesForBlock(blockNum, trieSize)
+	if err != nil {
+		return nil, fmt.Errorf("witnesses for the block %d: %w", blockNum, err)
+	}
+	refs := make(map[string]struct{})
+	r := bytes.NewReader(serialized)
+	for r.Len() > 0 {
+		witness, err := trie.NewWitnessFromReader(r, false /* trace */)
+		if err != nil {
+			return nil, err
+		}
+		t, err := trie.BuildTrieFromWitness(witness, false /* isBinary */, false /* trace */)
+		if err != nil {
+			return nil, err
+		}
+		for ref := range t.NodeReferences() {
+			refs[ref] = struct{}{}
+		}
+	}
+	return refs, nil
+}
+
+// VisualTrie renders the subtree of the state at the given block as an interactive HTML page.
+// The subtree contains the accounts with hashes of addresses starting with the prefix (given as hex digits).
+// If the witness database is given, the nodes which are part of the witnesses of the block are highlighted
+func VisualTrie(chaindata string, blockNum uint64, prefixStr string, limit int, witnessDbPath string, trieSize uint32, out string) error {
+	prefix, nibbles, err := parseNibblePrefix(prefixStr)
+	if err != nil {
+		return err
+	}
+	db, err := ethdb.Open(chaindata)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	t := trie.New(common.Hash{})
+	dbState := state.NewDbState(db.KV(), blockNum)
+	complete, err := dbState.WalkRangeOfAccounts(prefix, limit, func(addrHash common.Hash, acc *accounts.Account) {
+		t.UpdateAccount(addrHash[:], acc.SelfCopy())
+	})
+	if err != nil {
+		return err
+	}
+	if !complete {
+		return fmt.Errorf("more than %d accounts under the prefix %q, use a longer prefix or increase the limit", limit, prefixStr)
+	}
+
+	opts := &trie.HTMLVisualOpts{
+		Title:  fmt.Sprintf("State under the prefix %q at the block %d", prefixStr, blockNum),
+		Prefix: nibbles,
+	}
+	if witnessDbPath != "" {
+		if opts.Touched, err = witnessNodeReferences(witnessDbPath, blockNum, trieSize); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	if err = trie.VisualHTML(t, w, opts); err != nil {
+		return err
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	log.Info("Visualisation written", "file", out, "touched nodes", len(opts.Touched))
+	return nil
+}
@@ -41,7 +41,11 @@ func CheckIndex(chaindata string, changeSetBucket []byte, indexBucket []byte) er
 			}
 
 			index := dbutils.WrapHistoryIndex(indexBytes)
-			if findVal, _, ok := index.Search(blockNum); !ok {
+			findVal, _, ok, innerErr := index.Search(blockNum)
+			if innerErr != nil {
+				return innerErr
+			}
+			if !ok {
 				return fmt.Errorf("%v,%v,%v", blockNum, findVal, common.Bytes2Hex(key))
 			}
 			return nil
@@ -231,6 +231,14 @@ var (
 		Name:  "plainstate",
 		Usage: "use plain state when doing staged sync (affects only syncmode=staged)",
 	}
+	StagedSyncParallelExecFlag = cli.BoolFlag{
+		Name:  "parallel-exec",
+		Usage: "execute the transactions of a block speculatively in parallel when doing staged sync (affects only syncmode=staged)",
+	}
+	StagedSyncVerifyParallelExecFlag = cli.BoolFlag{
+		Name:  "parallel-exec.verify",
+		Usage: "execute the blocks sequentially as well and check that the changesets are the same as the ones of the parallel execution",
+	}
 	GCModePruningFlag = cli.BoolFlag{
 		Name:  "pruning",
 		Usage: `Enable storage pruning`,
@@ -316,6 +324,10 @@ var (
 		Name:  "debug-protocol",
 		Usage: "Enable the DBG (debug) protocol",
 	}
+	FirehoseSyncFlag = cli.BoolFlag{
+		Name:  "firehose.sync",
+		Usage: "Download the state via the Firehose protocol instead of executing blocks from genesis (staged sync only)",
+	}
 	// Ethash settings
 	EthashCacheDirFlag = DirectoryFlag{
 		Name:  "ethash.cachedir",
@@ -446,6 +458,10 @@ var (
 * t - write tx lookup index to the DB`,
 		Value: ethdb.DefaultStorageMode.ToString(),
 	}
+	TrieSnapshotFlag = cli.StringFlag{
+		Name:  "trie.snapshot",
+		Usage: "File (relative to the data directory) to persist the resident state trie on shutdown and reload it on start (empty to disable)",
+	}
 	ArchiveSyncInterval = cli.IntFlag{
 		Name:  "archive-sync-interval",
 		Usage: "When to switch from full to archive sync",
@@ -456,6 +472,14 @@ var (
 		Usage: "Which database software to use? Currently supported values: badger & bolt & lmdb",
 		Value: "lmdb",
 	}
+	DatabaseCompressionFlag = cli.BoolFlag{
+		Name:  "database.compression",
+		Usage: "Compress block bodies, receipts and changesets with zstd. Applies to a new database, compressed buckets stay compressed without the flag",
+	}
+	DatabaseTraceFlag = cli.StringFlag{
+		Name:  "database.trace",
+		Usage: "Record all the operations with the chaindata into the file, to replay them by 'integration replay_kv'",
+	}
 	RemoteDbListenAddress = cli.StringFlag{
 		Name:  "remote-db-listen-addr",
 		Usage: "network address (for example, localhost:9999) to start remote database server on",
@@ -1285,6 +1309,8 @@ func SetNodeConfig(ctx *cli.Context, cfg *node.Config) {
 	cfg.BadgerDB = strings.EqualFold(databaseFlag, "badger") //case insensitive
 	cfg.LMDB = strings.EqualFold(databaseFlag, "lmdb")       //case insensitive
 	cfg.Bolt = strings.EqualFold(databaseFlag, "bolt")       //case insensitive
+	cfg.DatabaseCompression = ctx.GlobalBool(DatabaseCompressionFlag.Name)
+	cfg.DatabaseTrace = ctx.GlobalString(DatabaseTraceFlag.Name)
 }
 
 func setSmartCard(ctx *cli.Context, cfg *node.Config) {
@@ -1543,6 +1569,11 @@ func SetEthConfig(ctx *cli.Context, stack *node.Node, cfg *eth.Config) {
 
 	core.UsePlainStateExecution = ctx.Bool(StagedSyncPlainExecFlag.Name)
 	log.Info("setting up plain text execution", "plain", core.UsePlainStateExecution)
+	core.ParallelExecution = ctx.Bool(StagedSyncParallelExecFlag.Name)
+	core.VerifyParallelExecution = ctx.Bool(StagedSyncVerifyParallelExecFlag.Name)
+	if core.ParallelExecution {
+		log.Info("setting up parallel execution", "verify", core.VerifyParallelExecution)
+	}
 
 	if ctx.GlobalIsSet(SyncModeFlag.Name) {
 		cfg.SyncMode = *GlobalTextMarshaler(ctx, SyncModeFlag.Name).(*downloader.SyncMode)
@@ -1568,6 +1599,7 @@ func SetEthConfig(ctx *cli.Context, stack *node.Node, cfg *eth.Config) {
 	cfg.DownloadOnly = ctx.GlobalBoolT(DownloadOnlyFlag.Name)
 
 	cfg.EnableDebugProtocol = ctx.GlobalBool(DebugProtocolFlag.Name)
+	cfg.FirehoseSync = ctx.GlobalBool(FirehoseSyncFlag.Name)
 
 	mode, err := ethdb.StorageModeFromString(ctx.GlobalString(StorageModeFlag.Name))
 	if err != nil {
@@ -1576,6 +1608,7 @@ func SetEthConfig(ctx *cli.Context, stack *node.Node, cfg *eth.Config) {
 
 	cfg.StorageMode = mode
 	cfg.ArchiveSyncInterval = ctx.GlobalInt(ArchiveSyncInterval.Name)
+	cfg.TrieSnapshot = ctx.GlobalString(TrieSnapshotFlag.Name)
 
 	if ctx.GlobalIsSet(CacheFlag.Name) || ctx.GlobalIsSet(CacheTrieFlag.Name) {
 		cfg.TrieCleanCache = ctx.GlobalInt(CacheFlag.Name) * ctx.GlobalInt(CacheTrieFlag.Name) / 100
@@ -2,6 +2,7 @@ package dbutils
 
 import (
 	"bytes"
+	"fmt"
 	"sort"
 
 	"github.com/ledgerwatch/turbo-geth/metrics"
@@ -62,6 +63,10 @@ var (
 	//value - contract code
 	CodeBucket = []byte("CODE")
 
+	//key - rank of the analysis, the most recently used code first
+	//value - contract code hash + jumpdest analysis of the code (the bitmap of the data locations, see vm.CodeAnalysisVersion)
+	CodeAnalysisBucket = []byte("codeAnalysis")
+
 	//key - addressHash+incarnation
 	//value - code hash
 	ContractCodeBucket = []byte("contractCode")
@@ -131,6 +136,12 @@ var (
 	// LastAppliedMigration keep the name of tle last applied migration.
 	LastAppliedMigration = []byte("lastAppliedMigration")
 
+	// CodeAnalysisVersionKey keeps the version of the format of CodeAnalysisBucket values.
+	CodeAnalysisVersionKey = []byte("codeAnalysisVersion")
+
+	// MigrationProgressPrefix + migration name keeps the progress of the migration which is being applied or rolled back.
+	MigrationProgressPrefix = []byte("migrationProgress")
+
 	//StorageModeHistory - does node save history.
 	StorageModeHistory = []byte("smHistory")
 	//StorageModeReceipts - does node save receipts.
@@ -163,6 +174,7 @@ var Buckets = [][]byte{
 	AccountsHistoryBucket,
 	StorageHistoryBucket,
 	CodeBucket,
+	CodeAnalysisBucket,
 	ContractCodeBucket,
 	AccountChangeSetBucket,
 	StorageChangeSetBucket,
@@ -205,6 +217,77 @@ var Buckets = [][]byte{
 
 var BucketsIndex = map[string]int{}
 
+// BucketFlags - configuration of a bucket, values are the same as the flags of LMDB databases
+type BucketFlags uint
+
+const (
+	Default BucketFlags = 0x00
+	// DupSort - bucket keeps multiple values (duplicates) per key, sorted. Duplicates are stored natively by LMDB
+	// and emulated by Bolt and Badger, which store them under the composite keys key+value. Emulation preserves
+	// the order of LMDB only if no key of the bucket is a prefix of another one (for example, if keys have fixed length)
+	DupSort BucketFlags = 0x04
+)
+
+// Codec - compression of the values of a bucket. Compression is opt-in: the codec is applied only to the buckets which are
+// empty when the database is opened with the compression enabled for the first time, the codec is recorded then
+// in the bucket itself under BucketCodecKey. Compressed buckets stay compressed when the database is opened without
+// the compression, buckets with data written without it stay uncompressed. Buckets with DupSort flag can't be compressed
+type Codec byte
+
+const (
+	NoCodec Codec = 0
+	Snappy  Codec = 1
+	Zstd    Codec = 2 // optionally with BucketConfigItem.Dictionary
+)
+
+func (c Codec) String() string {
+	switch c {
+	case NoCodec:
+		return ""
+	case Snappy:
+		return "snappy"
+	case Zstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(c))
+	}
+}
+
+type BucketConfigItem struct {
+	Flags BucketFlags
+	Codec Codec // used if the database is opened with the compression
+
+	// Dictionary - zstd dictionary (for example, trained by `zstd --train` on sample values), can't be changed
+	// after the bucket is compressed with it
+	Dictionary []byte
+}
+
+// BucketsCfg - configuration of the buckets by name
+type BucketsCfg map[string]BucketConfigItem
+
+// BucketsConfigs - configuration of the buckets which are not Default. All buckets mentioned here must be in Buckets
+var BucketsConfigs = BucketsCfg{
+	string(BlockBodyPrefix):             {Codec: Zstd},
+	string(BlockReceiptsPrefix):         {Codec: Zstd},
+	string(AccountChangeSetBucket):      {Codec: Zstd},
+	string(StorageChangeSetBucket):      {Codec: Zstd},
+	string(PlainAccountChangeSetBucket): {Codec: Zstd},
+	string(PlainStorageChangeSetBucket): {Codec: Zstd},
+}
+
+// BucketCodecKey - key of the record keeping the codec of a compressed bucket in the bucket itself. It sorts before
+// the keys of the compressed buckets and is hidden from the readers of the bucket
+var BucketCodecKey = []byte{0}
+
+// DefaultBucketsConfig returns the configuration of all buckets in Buckets, the one used by databases unless overridden
+func DefaultBucketsConfig() BucketsCfg {
+	cfg := make(BucketsCfg, len(Buckets))
+	for _, name := range Buckets {
+		cfg[string(name)] = BucketsConfigs[string(name)]
+	}
+	return cfg
+}
+
 func init() {
 	sort.SliceStable(Buckets, func(i, j int) bool {
 		return bytes.Compare(Buckets[i], Buckets[j]) < 0
@@ -5,29 +5,78 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"github.com/ledgerwatch/turbo-geth/common"
-	"sort"
+	"math"
 	"strconv"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/ledgerwatch/turbo-geth/common"
 )
 
 const (
-	ItemLen      = 3
+	// MaxChunkSize - number of the blocks in the index chunk, after which a new chunk is started
 	MaxChunkSize = 1000
+
+	// bitmapIndexVersion - first byte of the encoded chunk. Chunks of the legacy format start with
+	// the most significant byte of the block number, which is always 0
+	bitmapIndexVersion byte = 1
 )
 
+// HistoryIndexBytes - encoded chunk of the history index: the blocks at which the key has changed, and the subset
+// of those blocks at which the key changed from the empty value. Both sets are stored as compressed (roaring) bitmaps:
+// version byte, bitmap of the blocks, bitmap of the "empty" markers. Block numbers must fit into uint32
+type HistoryIndexBytes []byte
+
+// NewHistoryIndex returns the empty chunk
 func NewHistoryIndex() HistoryIndexBytes {
-	return make(HistoryIndexBytes, 8)
+	return HistoryIndexBytes{}
 }
 
 func WrapHistoryIndex(b []byte) HistoryIndexBytes {
-	index := HistoryIndexBytes(b)
-	if len(index) == 0 {
-		index = make(HistoryIndexBytes, 8)
+	return HistoryIndexBytes(b)
+}
+
+func encodeHistoryIndex(blocks, empty *roaring.Bitmap) (HistoryIndexBytes, error) {
+	blocks.RunOptimize()
+	empty.RunOptimize()
+	var buf bytes.Buffer
+	buf.WriteByte(bitmapIndexVersion)
+	if _, err := blocks.WriteTo(&buf); err != nil {
+		return nil, fmt.Errorf("encoding blocks of the index chunk: %w", err)
+	}
+	if _, err := empty.WriteTo(&buf); err != nil {
+		return nil, fmt.Errorf("encoding empty markers of the index chunk: %w", err)
 	}
-	return index
+	return buf.Bytes(), nil
 }
 
-type HistoryIndexBytes []byte
+// Bitmaps decodes the chunk into the bitmap of the blocks and the bitmap of the "empty" markers.
+// The bitmaps don't reference the chunk, so they stay valid after the database transaction is closed
+func (hi HistoryIndexBytes) Bitmaps() (blocks *roaring.Bitmap, empty *roaring.Bitmap, err error) {
+	if len(hi) == 0 {
+		return roaring.New(), roaring.New(), nil
+	}
+	if hi[0] != bitmapIndexVersion {
+		return nil, nil, fmt.Errorf("unknown format of the index chunk, len %d", len(hi))
+	}
+	r := bytes.NewReader(hi[1:])
+	blocks, empty = roaring.New(), roaring.New()
+	if _, err = blocks.ReadFrom(r); err != nil {
+		return nil, nil, fmt.Errorf("decoding blocks of the index chunk: %w", err)
+	}
+	if _, err = empty.ReadFrom(r); err != nil {
+		return nil, nil, fmt.Errorf("decoding empty markers of the index chunk: %w", err)
+	}
+	return blocks, empty, nil
+}
+
+// Decoded returns the chunk decoded for the searches and the appends
+func (hi HistoryIndexBytes) Decoded() (*HistoryIndex, error) {
+	blocks, empty, err := hi.Bitmaps()
+	if err != nil {
+		return nil, err
+	}
+	return &HistoryIndex{blocks: blocks, empty: empty}, nil
+}
 
 func (hi HistoryIndexBytes) String() string {
 	var buffer bytes.Buffer
@@ -40,106 +89,138 @@ func (hi HistoryIndexBytes) String() string {
 
 // decode is used for debugging and in tests
 func (hi HistoryIndexBytes) Decode() ([]uint64, []bool, error) {
-	if len(hi) < 8 {
-		return nil, nil, fmt.Errorf("minimal length of index chunk is %d, got %d", 8, len(hi))
+	index, err := hi.Decoded()
+	if err != nil {
+		return nil, nil, err
 	}
-	if (len(hi)-8)%ItemLen != 0 {
-		return nil, nil, fmt.Errorf("length of index chunk should be 8 (mod %d), got %d", ItemLen, len(hi))
-	}
-	numElements := (len(hi) - 8) / 3
-	minElement := binary.BigEndian.Uint64(hi[:8])
-	numbers := make([]uint64, 0, numElements)
-	sets := make([]bool, 0, numElements)
-	for i := 8; i < len(hi); i += 3 {
-		numbers = append(numbers, minElement+(uint64(hi[i]&0x7f)<<16)+(uint64(hi[i+1])<<8)+uint64(hi[i+2]))
-		sets = append(sets, hi[i]&0x80 != 0)
+	numbers := make([]uint64, 0, index.blocks.GetCardinality())
+	sets := make([]bool, 0, index.blocks.GetCardinality())
+	for it := index.blocks.Iterator(); it.HasNext(); {
+		v := it.Next()
+		numbers = append(numbers, uint64(v))
+		sets = append(sets, index.empty.Contains(v))
 	}
 	return numbers, sets, nil
 }
 
-func (hi HistoryIndexBytes) Append(v uint64, emptyValue bool) HistoryIndexBytes {
-	if len(hi) < 8 {
-		panic(fmt.Errorf("minimal length of index chunk is %d, got %d", 8, len(hi)))
+// Append returns the chunk with the block added. Every call decodes and encodes the chunk, HistoryIndex appends many blocks at once
+func (hi HistoryIndexBytes) Append(v uint64, emptyValue bool) (HistoryIndexBytes, error) {
+	index, err := hi.Decoded()
+	if err != nil {
+		return nil, err
 	}
-	if (len(hi)-8)%ItemLen != 0 {
-		panic(fmt.Errorf("length of index chunk should be 8 (mod %d), got %d", ItemLen, len(hi)))
+	if err = index.Append(v, emptyValue); err != nil {
+		return nil, err
 	}
-	numElements := (len(hi) - 8) / 3
-	var minElement uint64
-	if numElements == 0 {
-		minElement = v
-		binary.BigEndian.PutUint64(hi[:], minElement)
-	} else {
-		minElement = binary.BigEndian.Uint64(hi[:8])
+	return index.Encode()
+}
+
+func (hi HistoryIndexBytes) Len() (int, error) {
+	index, err := hi.Decoded()
+	if err != nil {
+		return 0, err
 	}
-	if v > minElement+0x7fffff { // Maximum number representable in 23 bits
-		panic(fmt.Errorf("item %d cannot be placed into the chunk with minElement %d", v, minElement))
+	return index.Len(), nil
+}
+
+// Truncate all the timestamps that are strictly greater than the given bound
+func (hi HistoryIndexBytes) TruncateGreater(lower uint64) (HistoryIndexBytes, error) {
+	index, err := hi.Decoded()
+	if err != nil {
+		return nil, err
 	}
-	v -= minElement
-	if emptyValue {
-		hi = append(hi, 0x80|byte(v>>16))
-	} else {
-		hi = append(hi, byte(v>>16))
+	index.TruncateGreater(lower)
+	return index.Encode()
+}
+
+// Search looks for the element which is equal or greater of given timestamp
+func (hi HistoryIndexBytes) Search(v uint64) (uint64, bool, bool, error) {
+	index, err := hi.Decoded()
+	if err != nil {
+		return 0, false, false, err
 	}
-	hi = append(hi, byte(v>>8))
-	hi = append(hi, byte(v))
-	return hi
+	found, set, ok := index.Search(v)
+	return found, set, ok, nil
 }
 
-func (hi HistoryIndexBytes) Len() int {
-	if len(hi) < 8 {
-		panic(fmt.Errorf("minimal length of index chunk is %d, got %d", 8, len(hi)))
+func (hi HistoryIndexBytes) Key(key []byte) ([]byte, error) {
+	index, err := hi.Decoded()
+	if err != nil {
+		return nil, err
 	}
-	if (len(hi)-8)%ItemLen != 0 {
-		panic(fmt.Errorf("length of index chunk should be 8 (mod %d), got %d", ItemLen, len(hi)))
+	return index.Key(key)
+}
+
+func (hi HistoryIndexBytes) LastElement() (uint64, bool, error) {
+	index, err := hi.Decoded()
+	if err != nil {
+		return 0, false, err
 	}
-	return (len(hi) - 8) / 3
+	last, ok := index.LastElement()
+	return last, ok, nil
 }
 
-// Truncate all the timestamps that are strictly greater than the given bound
-func (hi HistoryIndexBytes) TruncateGreater(lower uint64) HistoryIndexBytes {
-	if len(hi) < 8 {
-		panic(fmt.Errorf("minimal length of index chunk is %d, got %d", 8, len(hi)))
+// EncodeHistoryIndex encodes the blocks and their "empty" markers into one chunk at once
+func EncodeHistoryIndex(numbers []uint64, sets []bool) (HistoryIndexBytes, error) {
+	index := &HistoryIndex{blocks: roaring.New(), empty: roaring.New()}
+	for i, n := range numbers {
+		if err := index.Append(n, sets[i]); err != nil {
+			return nil, err
+		}
+	}
+	return index.Encode()
+}
+
+// HistoryIndex - decoded chunk of the history index
+type HistoryIndex struct {
+	blocks *roaring.Bitmap
+	empty  *roaring.Bitmap
+}
+
+// Blocks returns the bitmap of the blocks of the chunk, it must not be modified
+func (hi *HistoryIndex) Blocks() *roaring.Bitmap {
+	return hi.blocks
+}
+
+func (hi *HistoryIndex) Append(v uint64, emptyValue bool) error {
+	if v > math.MaxUint32 {
+		return fmt.Errorf("block %d cannot be placed into the index chunk, maximum is %d", v, uint64(math.MaxUint32))
 	}
-	if (len(hi)-8)%ItemLen != 0 {
-		panic(fmt.Errorf("length of index chunk should be 8 (mod %d), got %d", ItemLen, len(hi)))
+	hi.blocks.Add(uint32(v))
+	if emptyValue {
+		hi.empty.Add(uint32(v))
 	}
-	numElements := (len(hi) - 8) / 3
-	minElement := binary.BigEndian.Uint64(hi[:8])
-	elements := hi[8:]
-	// We are looking for the truncation point, i.e. the index of the first element which is strictly greater
-	// than `lower`. Then, we will use that truncation point to shrink the slice
-	truncationPoint := sort.Search(numElements, func(i int) bool {
-		return lower < minElement+(uint64(elements[i*ItemLen]&0x7f)<<16)+(uint64(elements[i*ItemLen+1])<<8)+uint64(elements[i*ItemLen+2])
-	})
-	return hi[:8+truncationPoint*ItemLen] // We preserve minElement field and all elements prior to the truncation point
+	return nil
+}
+
+func (hi *HistoryIndex) Len() int {
+	return int(hi.blocks.GetCardinality())
+}
+
+// TruncateGreater removes all the timestamps that are strictly greater than the given bound
+func (hi *HistoryIndex) TruncateGreater(lower uint64) {
+	hi.blocks.RemoveRange(lower+1, math.MaxUint32+1)
+	hi.empty.RemoveRange(lower+1, math.MaxUint32+1)
 }
 
 // Search looks for the element which is equal or greater of given timestamp
-func (hi HistoryIndexBytes) Search(v uint64) (uint64, bool, bool) {
-	if len(hi) < 8 {
-		panic(fmt.Errorf("minimal length of index chunk is %d, got %d", 8, len(hi)))
+func (hi *HistoryIndex) Search(v uint64) (uint64, bool, bool) {
+	if v > math.MaxUint32 {
+		return 0, false, false
 	}
-	if (len(hi)-8)%ItemLen != 0 {
-		panic(fmt.Errorf("length of index chunk should be 8 (mod %d), got %d", ItemLen, len(hi)))
+	var rank uint64 // number of the elements less than v
+	if v > 0 {
+		rank = hi.blocks.Rank(uint32(v - 1))
 	}
-	numElements := (len(hi) - 8) / 3
-	minElement := binary.BigEndian.Uint64(hi[:8])
-	elements := hi[8:]
-	idx := sort.Search(numElements, func(i int) bool {
-		return v <= minElement+(uint64(elements[i*ItemLen]&0x7f)<<16)+(uint64(elements[i*ItemLen+1])<<8)+uint64(elements[i*ItemLen+2])
-	}) * ItemLen
-	if idx == len(elements) {
+	if rank >= hi.blocks.GetCardinality() {
 		return 0, false, false
 	}
-	return minElement +
-			(uint64(elements[idx]&0x7f) << 16) +
-			(uint64(elements[idx+1]) << 8) +
-			uint64(elements[idx+2]),
-		(elements[idx] & 0x80) != 0, true
+	// the element with the index rank exists, so Select doesn't fail
+	found, _ := hi.blocks.Select(uint32(rank))
+	return uint64(found), hi.empty.Contains(found), true
 }
 
-func (hi HistoryIndexBytes) Key(key []byte) ([]byte, error) {
+func (hi *HistoryIndex) Key(key []byte) ([]byte, error) {
 	blockNum, ok := hi.LastElement()
 	if !ok {
 		return nil, errors.New("empty index")
@@ -147,20 +228,81 @@ func (hi HistoryIndexBytes) Key(key []byte) ([]byte, error) {
 	return IndexChunkKey(key, blockNum), nil
 }
 
-func (hi HistoryIndexBytes) LastElement() (uint64, bool) {
-	if len(hi) < 8 {
-		panic(fmt.Errorf("minimal length of index chunk is %d, got %d", 8, len(hi)))
+func (hi *HistoryIndex) LastElement() (uint64, bool) {
+	if hi.blocks.IsEmpty() {
+		return 0, false
 	}
-	if (len(hi)-8)%ItemLen != 0 {
-		panic(fmt.Errorf("length of index chunk should be 8 (mod %d), got %d", ItemLen, len(hi)))
+	return uint64(hi.blocks.Maximum()), true
+}
+
+func (hi *HistoryIndex) Encode() (HistoryIndexBytes, error) {
+	return encodeHistoryIndex(hi.blocks, hi.empty)
+}
+
+// LegacyHistoryIndexBytes - the format of the history index chunks before HistoryIndexBytes switched to the bitmaps:
+// the minimal block number (8 bytes), then 3 bytes per block with the offset from the minimal one and
+// the "empty" marker in the highest bit. Only decoding is supported, for the migration
+type LegacyHistoryIndexBytes []byte
+
+const (
+	legacyItemLen = 3
+
+	// LegacyMaxSpan - maximal difference between the blocks of one LegacyHistoryIndexBytes chunk
+	LegacyMaxSpan = 0x7fffff
+)
+
+func (hi LegacyHistoryIndexBytes) Decode() ([]uint64, []bool, error) {
+	if len(hi) < 8 {
+		return nil, nil, fmt.Errorf("minimal length of index chunk is %d, got %d", 8, len(hi))
 	}
-	numElements := (len(hi) - 8) / 3
-	if numElements == 0 {
-		return 0, false
+	if (len(hi)-8)%legacyItemLen != 0 {
+		return nil, nil, fmt.Errorf("length of index chunk should be 8 (mod %d), got %d", legacyItemLen, len(hi))
 	}
+	numElements := (len(hi) - 8) / legacyItemLen
 	minElement := binary.BigEndian.Uint64(hi[:8])
-	idx := 8 + ItemLen*(numElements-1)
-	return minElement + (uint64(hi[idx]&0x7f) << 16) + (uint64(hi[idx+1]) << 8) + uint64(hi[idx+2]), true
+	numbers := make([]uint64, 0, numElements)
+	sets := make([]bool, 0, numElements)
+	for i := 8; i < len(hi); i += legacyItemLen {
+		numbers = append(numbers, minElement+(uint64(hi[i]&0x7f)<<16)+(uint64(hi[i+1])<<8)+uint64(hi[i+2]))
+		sets = append(sets, hi[i]&0x80 != 0)
+	}
+	return numbers, sets, nil
+}
+
+// IsLegacyHistoryIndex tells if the chunk is in the format of LegacyHistoryIndexBytes
+func IsLegacyHistoryIndex(b []byte) bool {
+	return len(b) >= 8 && b[0] != bitmapIndexVersion
+}
+
+// ConvertLegacyHistoryIndex re-encodes the chunk of LegacyHistoryIndexBytes format into HistoryIndexBytes
+func ConvertLegacyHistoryIndex(b []byte) (HistoryIndexBytes, error) {
+	numbers, sets, err := LegacyHistoryIndexBytes(b).Decode()
+	if err != nil {
+		return nil, err
+	}
+	return EncodeHistoryIndex(numbers, sets)
+}
+
+// EncodeLegacyHistoryIndex encodes sorted blocks and their "empty" markers in the LegacyHistoryIndexBytes format,
+// used to roll back the migration to the bitmaps
+func EncodeLegacyHistoryIndex(numbers []uint64, sets []bool) (LegacyHistoryIndexBytes, error) {
+	b := make(LegacyHistoryIndexBytes, 8, 8+len(numbers)*legacyItemLen)
+	if len(numbers) == 0 {
+		return b, nil
+	}
+	minElement := numbers[0]
+	binary.BigEndian.PutUint64(b, minElement)
+	for i, n := range numbers {
+		if n < minElement || n-minElement > LegacyMaxSpan {
+			return nil, fmt.Errorf("block %d doesn't fit into the legacy chunk starting at %d", n, minElement)
+		}
+		offset := n - minElement
+		b = append(b, byte(offset>>16), byte(offset>>8), byte(offset))
+		if sets[i] {
+			b[len(b)-legacyItemLen] |= 0x80
+		}
+	}
+	return b, nil
 }
 
 func CurrentChunkKey(key []byte) []byte {
@@ -220,17 +362,11 @@ func IsIndexBucket(b []byte) bool {
 	return bytes.Equal(b, AccountsHistoryBucket) || bytes.Equal(b, StorageHistoryBucket)
 }
 
-func CheckNewIndexChunk(b []byte, v uint64) bool {
-	if len(b) < 8 {
-		panic(fmt.Errorf("minimal length of index chunk is %d, got %d", 8, len(b)))
-	}
-	if (len(b)-8)%ItemLen != 0 {
-		panic(fmt.Errorf("length of index chunk should be 8 (mod %d), got %d", ItemLen, len(b)))
-	}
-	numElements := (len(b) - 8) / 3
-	if numElements == 0 {
-		return false
+// CheckNewIndexChunk tells if the block v has to go into a new chunk, because the current one is full
+func CheckNewIndexChunk(b []byte, v uint64) (bool, error) {
+	n, err := HistoryIndexBytes(b).Len()
+	if err != nil {
+		return false, err
 	}
-	minElement := binary.BigEndian.Uint64(b[:8])
-	return (numElements >= MaxChunkSize) || (v > minElement+0x7fffff)
+	return n >= MaxChunkSize, nil
 }
@@ -2,13 +2,14 @@ package dbutils
 
 import (
 	"fmt"
+	"math"
 	"reflect"
 	"testing"
 )
 
 func TestHistoryIndex_Search1(t *testing.T) {
-	index := NewHistoryIndex().Append(3, false).Append(5, false).Append(8, false)
-	fmt.Println(index.Decode())
+	index := newTestIndex(t, 3, 5, 8)
+	fmt.Println(index.Blocks())
 	v, _, _ := index.Search(1)
 	if v != 3 {
 		t.Fatal("must be 3 but", v)
@@ -42,8 +43,10 @@ func TestHistoryIndex_Search1(t *testing.T) {
 }
 
 func TestHistoryIndex_Search_EmptyIndex(t *testing.T) {
-	index := NewHistoryIndex()
-	_, _, b := index.Search(1)
+	_, _, b, err := NewHistoryIndex().Search(1)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if b {
 		t.FailNow()
 	}
@@ -52,7 +55,10 @@ func TestHistoryIndex_Search_EmptyIndex(t *testing.T) {
 func TestHistoryIndex_Append(t *testing.T) {
 	index := NewHistoryIndex()
 	for i := uint64(1); i < 10; i++ {
-		index = index.Append(i, false)
+		var err error
+		if index, err = index.Append(i, false); err != nil {
+			t.Fatal(err)
+		}
 	}
 
 	res, _, err := index.Decode()
@@ -63,7 +69,110 @@ func TestHistoryIndex_Append(t *testing.T) {
 		t.Fatal("Not equal")
 	}
 
-	if index.Len() != 9 {
-		t.Fatal()
+	if n, err := index.Len(); err != nil || n != 9 {
+		t.Fatal(n, err)
+	}
+}
+
+func TestHistoryIndex_EmptyValues(t *testing.T) {
+	decoded := newTestIndex(t, 3, 5, 70000, 70001)
+	if err := decoded.Append(5, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := decoded.Append(70000, true); err != nil {
+		t.Fatal(err)
+	}
+	index, err := decoded.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	numbers, sets, err := index.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(numbers, []uint64{3, 5, 70000, 70001}) {
+		t.Fatal("unexpected numbers", numbers)
+	}
+	if !reflect.DeepEqual(sets, []bool{false, true, true, false}) {
+		t.Fatal("unexpected empty markers", sets)
+	}
+
+	v, set, ok, err := index.Search(4)
+	if err != nil || !ok || v != 5 || !set {
+		t.Fatal("must be 5 and empty, got", v, set, ok, err)
+	}
+
+	if index, err = index.TruncateGreater(5); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := index.Len(); err != nil || n != 2 {
+		t.Fatal("must be 2 elements, got", n, err)
+	}
+	if last, ok, err := index.LastElement(); err != nil || !ok || last != 5 {
+		t.Fatal("last element must be 5, got", last, err)
+	}
+	if _, _, ok, err = index.Search(6); err != nil || ok {
+		t.Fatal("must be not found", err)
+	}
+}
+
+func TestConvertLegacyHistoryIndex(t *testing.T) {
+	legacy := []byte{0, 0, 0, 0, 0, 0, 0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x05, 0x01, 0x00, 0x00}
+	if !IsLegacyHistoryIndex(legacy) {
+		t.Fatal("must be legacy")
+	}
+	index, err := ConvertLegacyHistoryIndex(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IsLegacyHistoryIndex(index) {
+		t.Fatal("must not be legacy")
+	}
+	numbers, sets, err := index.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(numbers, []uint64{256, 261, 65792}) {
+		t.Fatal("unexpected numbers", numbers)
+	}
+	if !reflect.DeepEqual(sets, []bool{true, false, false}) {
+		t.Fatal("unexpected empty markers", sets)
+	}
+}
+
+func TestHistoryIndex_Errors(t *testing.T) {
+	index := newTestIndex(t, 3)
+	if err := index.Append(math.MaxUint32+1, false); err == nil {
+		t.Fatal("block above the maximum must not be appended")
+	}
+	if _, _, ok := index.Search(math.MaxUint32 + 1); ok {
+		t.Fatal("must be not found")
+	}
+
+	corrupted := HistoryIndexBytes{bitmapIndexVersion, 1, 2, 3}
+	if _, err := corrupted.Append(1, false); err == nil {
+		t.Fatal("corrupted chunk must not be appended to")
+	}
+	if _, _, _, err := corrupted.Search(1); err == nil {
+		t.Fatal("corrupted chunk must not be searched")
+	}
+	if _, err := corrupted.Len(); err == nil {
+		t.Fatal("corrupted chunk must not be counted")
+	}
+	if _, err := CheckNewIndexChunk(corrupted, 1); err == nil {
+		t.Fatal("corrupted chunk must not be checked")
+	}
+}
+
+func newTestIndex(t *testing.T, blocks ...uint64) *HistoryIndex {
+	index, err := NewHistoryIndex().Decoded()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range blocks {
+		if err = index.Append(b, false); err != nil {
+			t.Fatal(err)
+		}
 	}
+	return index
 }
@@ -87,4 +87,10 @@ type StorageBucketWriteStats struct {
 	TotalDelete      StorageCounter
 	TotalBytesPut    StorageSize
 	TotalBytesDelete StorageSize
+
+	Codec                 string      // compression codec of the values, empty if the values are not compressed
+	CompressedBytesPut    StorageSize // size of the compressed values put since the database is opened
+	UncompressedBytesPut  StorageSize // size of the same values before the compression
+	CompressedBytesRead   StorageSize // size of the compressed values read since the database is opened
+	UncompressedBytesRead StorageSize // size of the same values after the decompression
 }
@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"io"
 	"math/big"
+	"os"
 	"sort"
 	"sync"
 	"sync/atomic"
@@ -124,6 +125,7 @@ type CacheConfig struct {
 	ArchiveSyncInterval uint64
 	DownloadOnly        bool
 	NoHistory           bool
+	TrieSnapshotFile    string // File to keep the resident state trie in between restarts, empty to disable
 }
 
 // BlockChain represents the canonical chain given a database with a genesis
@@ -352,6 +354,13 @@ func (bc *BlockChain) GetTrieDbState() (*state.TrieDbState, error) {
 		if err != nil {
 			return nil, err
 		}
+		if snapshotFile := bc.cacheConfig.TrieSnapshotFile; snapshotFile != "" {
+			if err = trieDbState.LoadTrieSnapshot(snapshotFile); err == nil {
+				log.Info("Loaded trie snapshot", "file", snapshotFile, "block", currentBlockNr)
+			} else if !os.IsNotExist(err) {
+				log.Warn("Could not load trie snapshot, starting with cold trie", "file", snapshotFile, "err", err)
+			}
+		}
 		bc.setTrieDbState(trieDbState)
 		log.Info("Creation complete.")
 	}
@@ -823,6 +832,13 @@ func (bc *BlockChain) Stop() {
 	if bc.senderCacher != nil {
 		bc.senderCacher.Close()
 	}
+	if snapshotFile := bc.cacheConfig.TrieSnapshotFile; snapshotFile != "" && bc.trieDbState != nil {
+		if err := bc.trieDbState.WriteTrieSnapshot(snapshotFile); err != nil {
+			log.Warn("Could not write trie snapshot", "file", snapshotFile, "err", err)
+		} else {
+			log.Info("Wrote trie snapshot", "file", snapshotFile, "block", bc.trieDbState.GetBlockNr())
+		}
+	}
 	log.Info("Blockchain stopped")
 }
 
@@ -2326,21 +2342,11 @@ func ExecuteBlockEphemerally(
 ) (types.Receipts, error) {
 	ibs := state.New(stateReader)
 	header := block.Header()
-	var receipts types.Receipts
-	usedGas := new(uint64)
-	gp := new(GasPool).AddGas(block.GasLimit())
-
-	if chainConfig.DAOForkSupport && chainConfig.DAOForkBlock != nil && chainConfig.DAOForkBlock.Cmp(block.Number()) == 0 {
-		misc.ApplyDAOHardFork(ibs)
-	}
-	noop := state.NewNoopWriter()
-	for i, tx := range block.Transactions() {
-		ibs.Prepare(tx.Hash(), block.Hash(), i)
-		receipt, err := ApplyTransaction(chainConfig, chainContext, nil, gp, ibs, noop, header, tx, usedGas, *vmConfig, dests)
-		if err != nil {
-			return nil, fmt.Errorf("tx %x failed: %v", tx.Hash(), err)
-		}
-		receipts = append(receipts, receipt)
+	// The tracers aren't safe for the concurrent use
+	parallel := ParallelExecution && !vmConfig.Debug
+	receipts, err := executeTransactions(chainConfig, vmConfig, chainContext, block, stateReader, ibs, dests, parallel)
+	if err != nil {
+		return nil, err
 	}
 
 	if chainConfig.IsByzantium(header.Number) {
@@ -2355,6 +2361,12 @@ func ExecuteBlockEphemerally(
 		return nil, fmt.Errorf("finalize of block %d failed: %v", block.NumberU64(), err)
 	}
 
+	if parallel && VerifyParallelExecution {
+		if err := verifyParallelExecution(chainConfig, vmConfig, chainContext, engine, block, stateReader, ibs, dests); err != nil {
+			return nil, err
+		}
+	}
+
 	ctx := chainConfig.WithEIPsFlags(context.Background(), header.Number)
 	if err := ibs.CommitBlock(ctx, stateWriter); err != nil {
 		return nil, fmt.Errorf("committing block %d failed: %v", block.NumberU64(), err)
@@ -2367,6 +2379,42 @@ func ExecuteBlockEphemerally(
 	return receipts, nil
 }
 
+// executeTransactions applies the DAO hard fork and the transactions of the block to ibs
+func executeTransactions(
+	chainConfig *params.ChainConfig,
+	vmConfig *vm.Config,
+	chainContext ChainContext,
+	block *types.Block,
+	stateReader state.StateReader,
+	ibs *state.IntraBlockState,
+	dests vm.Cache,
+	parallel bool,
+) (types.Receipts, error) {
+	if chainConfig.DAOForkSupport && chainConfig.DAOForkBlock != nil && chainConfig.DAOForkBlock.Cmp(block.Number()) == 0 {
+		misc.ApplyDAOHardFork(ibs)
+		// The speculative execution would miss the changes of the fork
+		parallel = false
+	}
+	if parallel {
+		return executeTransactionsParallel(chainConfig, vmConfig, chainContext, block, stateReader, ibs, dests)
+	}
+
+	header := block.Header()
+	var receipts types.Receipts
+	usedGas := new(uint64)
+	gp := new(GasPool).AddGas(block.GasLimit())
+	noop := state.NewNoopWriter()
+	for i, tx := range block.Transactions() {
+		ibs.Prepare(tx.Hash(), block.Hash(), i)
+		receipt, err := ApplyTransaction(chainConfig, chainContext, nil, gp, ibs, noop, header, tx, usedGas, *vmConfig, dests)
+		if err != nil {
+			return nil, fmt.Errorf("tx %x failed: %v", tx.Hash(), err)
+		}
+		receipts = append(receipts, receipt)
+	}
+	return receipts, nil
+}
+
 // InsertBodies is insertChain with execute=false and ommission of blockchain object
 func InsertBodies(
 	ctx context.Context,
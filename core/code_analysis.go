@@ -0,0 +1,67 @@
+package core
+
+import (
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+)
+
+// WarmDestsCache loads the persisted code analyses into the cache, up to its size, so that the most recently
+// used ones before the restart stay the most recent. The analyses beyond the size, or made with another
+// vm.CodeAnalysisVersion, are deleted.
+func WarmDestsCache(db ethdb.Database, dests *vm.DestsCache, maxSize int) error {
+	if version := rawdb.ReadCodeAnalysisVersion(db); version != vm.CodeAnalysisVersion {
+		stale, err := rawdb.DeleteCodeAnalyses(db)
+		if err != nil {
+			return err
+		}
+		rawdb.WriteCodeAnalysisVersion(db, vm.CodeAnalysisVersion)
+		if stale > 0 {
+			log.Info("Dropped code analyses of the old format", "version", version, "count", stale)
+		}
+		return nil
+	}
+	var hashes []common.Hash
+	var analyses [][]uint64
+	var pruned []uint64
+	if err := rawdb.WalkCodeAnalyses(db, func(rank uint64, codeHash common.Hash, analysis []uint64) bool {
+		if len(hashes) < maxSize {
+			hashes = append(hashes, codeHash)
+			analyses = append(analyses, analysis)
+		} else {
+			pruned = append(pruned, rank)
+		}
+		return true
+	}); err != nil {
+		return err
+	}
+	for _, rank := range pruned {
+		rawdb.DeleteCodeAnalysis(db, rank)
+	}
+	// The most recently used analysis is added last
+	for i := len(hashes) - 1; i >= 0; i-- {
+		dests.Set(hashes[i], analyses[i])
+	}
+	dests.SetPersisted(len(hashes))
+	log.Info("Loaded code analyses", "count", len(hashes), "pruned", len(pruned))
+	return nil
+}
+
+// SaveDestsCache replaces the persisted code analyses with the contents of the cache, the most recently used
+// first, if the cache is a vm.DestsCache. The database never keeps more analyses than the cache does.
+func SaveDestsCache(db ethdb.Database, dests vm.Cache) {
+	cache, ok := dests.(*vm.DestsCache)
+	if !ok || cache == nil {
+		return
+	}
+	hashes, analyses := cache.Recent()
+	for i := range hashes {
+		rawdb.WriteCodeAnalysis(db, uint64(i), hashes[i], analyses[i])
+	}
+	previous := cache.SetPersisted(len(hashes))
+	for rank := len(hashes); rank < previous; rank++ {
+		rawdb.DeleteCodeAnalysis(db, uint64(rank))
+	}
+}
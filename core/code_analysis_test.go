@@ -0,0 +1,90 @@
+package core
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestDestsCachePersistence(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+
+	hash1, hash2, hash3 := common.HexToHash("0x01"), common.HexToHash("0x02"), common.HexToHash("0x03")
+	analyses := map[common.Hash][]uint64{hash1: {1, 0xffffffffffffffff}, hash2: {2}, hash3: {3}}
+	// persisted returns the hashes of the stored analyses in the order of their ranks
+	persisted := func() []common.Hash {
+		var hashes []common.Hash
+		if err := rawdb.WalkCodeAnalyses(db, func(_ uint64, codeHash common.Hash, analysis []uint64) bool {
+			if !reflect.DeepEqual(analysis, analyses[codeHash]) {
+				t.Errorf("analysis of %x is %v, expected %v", codeHash, analysis, analyses[codeHash])
+			}
+			hashes = append(hashes, codeHash)
+			return true
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return hashes
+	}
+
+	dests := vm.NewDestsCache(2)
+	if err := WarmDestsCache(db, dests, 2); err != nil {
+		t.Fatal(err)
+	}
+	if version := rawdb.ReadCodeAnalysisVersion(db); version != vm.CodeAnalysisVersion {
+		t.Fatalf("version %d, expected %d", version, vm.CodeAnalysisVersion)
+	}
+	// hash1 is evicted, hash2 is used after hash3
+	dests.Set(hash1, analyses[hash1])
+	dests.Set(hash2, analyses[hash2])
+	dests.Set(hash3, analyses[hash3])
+	dests.Get(hash2)
+	SaveDestsCache(db, dests)
+	if hashes := persisted(); !reflect.DeepEqual(hashes, []common.Hash{hash2, hash3}) {
+		t.Fatalf("persisted %x, expected the contents of the cache, the most recent first", hashes)
+	}
+
+	// Restart keeps the order of use
+	dests = vm.NewDestsCache(2)
+	if err := WarmDestsCache(db, dests, 2); err != nil {
+		t.Fatal(err)
+	}
+	if hashes, _ := dests.Recent(); !reflect.DeepEqual(hashes, []common.Hash{hash2, hash3}) {
+		t.Fatalf("loaded %x, expected the order before the restart", hashes)
+	}
+	// The analyses dropped from the cache are dropped from the database
+	dests.Set(hash1, analyses[hash1])
+	SaveDestsCache(db, dests)
+	if hashes := persisted(); !reflect.DeepEqual(hashes, []common.Hash{hash1, hash2}) {
+		t.Fatalf("persisted %x, expected the contents of the cache, the most recent first", hashes)
+	}
+
+	// Restart with the smaller cache loads the most recent analyses and prunes the others
+	dests = vm.NewDestsCache(1)
+	if err := WarmDestsCache(db, dests, 1); err != nil {
+		t.Fatal(err)
+	}
+	if hashes, _ := dests.Recent(); !reflect.DeepEqual(hashes, []common.Hash{hash1}) {
+		t.Fatalf("loaded %x, expected the most recent analysis", hashes)
+	}
+	if hashes := persisted(); !reflect.DeepEqual(hashes, []common.Hash{hash1}) {
+		t.Fatalf("persisted %x after the restart, expected the loaded analysis", hashes)
+	}
+
+	// Restart after the format change
+	rawdb.WriteCodeAnalysisVersion(db, vm.CodeAnalysisVersion+1)
+	dests = vm.NewDestsCache(10)
+	if err := WarmDestsCache(db, dests, 10); err != nil {
+		t.Fatal(err)
+	}
+	if dests.Len() != 0 || len(persisted()) != 0 {
+		t.Error("analyses of the old format are not dropped")
+	}
+	if version := rawdb.ReadCodeAnalysisVersion(db); version != vm.CodeAnalysisVersion {
+		t.Fatalf("version %d, expected %d", version, vm.CodeAnalysisVersion)
+	}
+}
@@ -108,14 +108,21 @@ func (ig *IndexGenerator) Truncate(timestampTo uint64, changeSetBucket []byte) e
 			if timestamp > timestampTo {
 				historyEffects[kStr] = nil
 				// truncate the chunk
-				index := dbutils.WrapHistoryIndex(v)
-				index = index.TruncateGreater(timestampTo)
-				if len(index) > 8 { // If the chunk is empty after truncation, it gets simply deleted
+				index, err := dbutils.WrapHistoryIndex(v).Decoded()
+				if err != nil {
+					return false, fmt.Errorf("truncating index chunk %x: %w", k, err)
+				}
+				index.TruncateGreater(timestampTo)
+				if index.Len() > 0 { // If the chunk is empty after truncation, it gets simply deleted
+					indexBytes, err := index.Encode()
+					if err != nil {
+						return false, err
+					}
 					// Truncated chunk becomes "the last chunk" with the timestamp 0xffff....ffff
 					lastK := make([]byte, len(k))
 					copy(lastK, k[:keySize])
 					binary.BigEndian.PutUint64(lastK[keySize:], ^uint64(0))
-					historyEffects[string(lastK)] = common.CopyBytes(index)
+					historyEffects[string(lastK)] = indexBytes
 				}
 			}
 			return true, nil
@@ -165,33 +172,46 @@ func loadFunc(k []byte, value []byte, state etl.State, next etl.LoadNextFunc) er
 	if err1 != nil && !errors.Is(err1, ethdb.ErrKeyNotFound) {
 		return fmt.Errorf("find chunk failed: %w", err1)
 	}
-	currentIndex := dbutils.WrapHistoryIndex(indexBytes)
+	// the chunk is kept decoded while the blocks are appended, and gets encoded only when it is flushed
+	currentIndex, err := dbutils.WrapHistoryIndex(indexBytes).Decoded()
+	if err != nil {
+		return fmt.Errorf("decoding chunk %x: %w", currentChunkKey, err)
+	}
 
 	for i := 0; i < len(value); i += 9 {
 		b := binary.BigEndian.Uint64(value[i:])
 		vzero := value[i+8] == 1
 		blockNr := b
-		if err1 != nil && err1 != ethdb.ErrKeyNotFound {
-			return fmt.Errorf("find chunk failed: %w", err1)
-		}
 
-		if dbutils.CheckNewIndexChunk(currentIndex, blockNr) {
+		if currentIndex.Len() >= dbutils.MaxChunkSize {
 			// Chunk overflow, need to write the "old" current chunk under its key derived from the last element
 			indexKey, err3 := currentIndex.Key(k)
 			if err3 != nil {
 				return err3
 			}
+			indexBytes, err3 := currentIndex.Encode()
+			if err3 != nil {
+				return err3
+			}
 			// Flush the old chunk
-			if err4 := next(k, indexKey, currentIndex); err4 != nil {
+			if err4 := next(k, indexKey, indexBytes); err4 != nil {
 				return err4
 			}
 			// Start a new chunk
-			currentIndex = dbutils.NewHistoryIndex()
+			if currentIndex, err = dbutils.NewHistoryIndex().Decoded(); err != nil {
+				return err
+			}
+		}
+		if err = currentIndex.Append(blockNr, vzero); err != nil {
+			return err
 		}
-		currentIndex = currentIndex.Append(blockNr, vzero)
 	}
 
-	if err := next(k, currentChunkKey, currentIndex); err != nil {
+	indexBytes, err = currentIndex.Encode()
+	if err != nil {
+		return err
+	}
+	if err := next(k, currentChunkKey, indexBytes); err != nil {
 		return err
 	}
 
@@ -196,30 +196,21 @@ func generateTestData(t *testing.T, db ethdb.Database, csBucket []byte, numOfBlo
 			t.Fatal(err)
 		}
 
-		if dbutils.CheckNewIndexChunk(expected1[len(expected1)-1], uint64(i)) {
-			expected1 = append(expected1, dbutils.NewHistoryIndex())
-		}
-		expected1[len(expected1)-1] = expected1[len(expected1)-1].Append(uint64(i), false)
+		expected1 = appendToIndex(t, expected1, uint64(i))
 
 		if i%2 == 0 {
 			err = cs.Add(addrs[1], []byte(strconv.Itoa(i)))
 			if err != nil {
 				t.Fatal(err)
 			}
-			if dbutils.CheckNewIndexChunk(expected2[len(expected2)-1], uint64(i)) {
-				expected2 = append(expected2, dbutils.NewHistoryIndex())
-			}
-			expected2[len(expected2)-1] = expected2[len(expected2)-1].Append(uint64(i), false)
+			expected2 = appendToIndex(t, expected2, uint64(i))
 		}
 		if i%3 == 0 {
 			err = cs.Add(addrs[2], []byte(strconv.Itoa(i)))
 			if err != nil {
 				t.Fatal(err)
 			}
-			if dbutils.CheckNewIndexChunk(expected3[len(expected3)-1], uint64(i)) {
-				expected3 = append(expected3, dbutils.NewHistoryIndex())
-			}
-			expected3[len(expected3)-1] = expected3[len(expected3)-1].Append(uint64(i), false)
+			expected3 = appendToIndex(t, expected3, uint64(i))
 		}
 		v, err := csInfo.Encode(cs)
 		if err != nil {
@@ -259,6 +250,22 @@ func generateTestData(t *testing.T, db ethdb.Database, csBucket []byte, numOfBlo
 	}
 }
 
+// appendToIndex appends the block to the last chunk, or to a new one if the last chunk is full
+func appendToIndex(t *testing.T, chunks []dbutils.HistoryIndexBytes, blockNum uint64) []dbutils.HistoryIndexBytes {
+	t.Helper()
+	newChunk, err := dbutils.CheckNewIndexChunk(chunks[len(chunks)-1], blockNum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newChunk {
+		chunks = append(chunks, dbutils.NewHistoryIndex())
+	}
+	if chunks[len(chunks)-1], err = chunks[len(chunks)-1].Append(blockNum, false); err != nil {
+		t.Fatal(err)
+	}
+	return chunks
+}
+
 func checkIndex(t *testing.T, db ethdb.Database, bucket, addrHash []byte, chunkBlock uint64, expected []uint64) {
 	t.Helper()
 	b, err := db.GetIndexChunk(bucket, addrHash, chunkBlock)
@@ -0,0 +1,207 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+
+	"github.com/ledgerwatch/turbo-geth/common/changeset"
+	"github.com/ledgerwatch/turbo-geth/consensus"
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/params"
+)
+
+// ParallelExecution makes ExecuteBlockEphemerally execute the transactions of a block speculatively
+// in parallel, on the state at the beginning of the block. The transactions which read the state
+// modified by the earlier ones in the block are executed again, in order.
+var ParallelExecution = false
+
+// VerifyParallelExecution makes ExecuteBlockEphemerally execute the transactions of every block
+// sequentially as well, and fail if the changesets aren't the same as the ones of the parallel execution.
+var VerifyParallelExecution = false
+
+// speculativeTx is the result of the speculative execution of a transaction
+type speculativeTx struct {
+	done   chan struct{}
+	state  *state.IntraBlockState
+	msg    types.Message
+	result *ExecutionResult
+	err    error
+}
+
+// executeTransactionsParallel executes the transactions of the block speculatively, by the
+// runtime.NumCPU() workers, and merges them into ibs in the order of the block. The transactions
+// conflicting with the earlier ones are executed again on ibs.
+func executeTransactionsParallel(
+	chainConfig *params.ChainConfig,
+	vmConfig *vm.Config,
+	chainContext ChainContext,
+	block *types.Block,
+	stateReader state.StateReader,
+	ibs *state.IntraBlockState,
+	dests vm.Cache,
+) (types.Receipts, error) {
+	header := block.Header()
+	txs := block.Transactions()
+	signer := types.MakeSigner(chainConfig, header.Number)
+
+	specs := make([]*speculativeTx, len(txs))
+	for i := range specs {
+		specs[i] = &speculativeTx{done: make(chan struct{})}
+	}
+	// The workers which already started are waited for on return, as they read the state of stateReader
+	quit := make(chan struct{})
+	var wg sync.WaitGroup
+	defer func() {
+		close(quit)
+		wg.Wait()
+	}()
+	sem := make(chan struct{}, runtime.NumCPU())
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i, tx := range txs {
+			select {
+			case sem <- struct{}{}:
+			case <-quit:
+				return
+			}
+			wg.Add(1)
+			go func(i int, tx *types.Transaction) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				executeSpeculatively(chainConfig, vmConfig, chainContext, block, i, tx, signer, stateReader, specs[i], dests)
+			}(i, tx)
+		}
+	}()
+
+	ctx := chainConfig.WithEIPsFlags(context.Background(), header.Number)
+	ibs.TrackWrites()
+	noop := state.NewNoopWriter()
+	usedGas := new(uint64)
+	gp := new(GasPool).AddGas(block.GasLimit())
+	receipts := make(types.Receipts, 0, len(txs))
+	for i, tx := range txs {
+		spec := specs[i]
+		<-spec.done
+		ibs.Prepare(tx.Hash(), block.Hash(), i)
+		if spec.err != nil || ibs.Conflicts(spec.state) {
+			receipt, err := ApplyTransaction(chainConfig, chainContext, nil, gp, ibs, noop, header, tx, usedGas, *vmConfig, dests)
+			if err != nil {
+				return nil, fmt.Errorf("tx %x failed: %v", tx.Hash(), err)
+			}
+			receipts = append(receipts, receipt)
+			continue
+		}
+		// The gas pool of the block is used as ApplyMessage would do
+		if err := gp.SubGas(spec.msg.Gas()); err != nil {
+			return nil, fmt.Errorf("tx %x failed: %v", tx.Hash(), err)
+		}
+		gp.AddGas(spec.msg.Gas() - spec.result.UsedGas)
+		if err := ibs.MergeTx(ctx, spec.state, noop); err != nil {
+			return nil, fmt.Errorf("tx %x failed: %v", tx.Hash(), err)
+		}
+		*usedGas += spec.result.UsedGas
+		receipts = append(receipts, makeReceipt(ibs, tx, spec.msg, spec.result, *usedGas))
+	}
+	return receipts, nil
+}
+
+// executeSpeculatively executes the transaction on the state at the beginning of the block
+func executeSpeculatively(
+	chainConfig *params.ChainConfig,
+	vmConfig *vm.Config,
+	chainContext ChainContext,
+	block *types.Block,
+	txIndex int,
+	tx *types.Transaction,
+	signer types.Signer,
+	stateReader state.StateReader,
+	spec *speculativeTx,
+	dests vm.Cache,
+) {
+	defer close(spec.done)
+	spec.state = state.New(stateReader)
+	spec.state.TrackReads()
+	spec.state.Prepare(tx.Hash(), block.Hash(), txIndex)
+	spec.msg, spec.err = tx.AsMessage(signer)
+	if spec.err != nil {
+		return
+	}
+	vmenv := vm.NewEVM(NewEVMContext(spec.msg, block.Header(), chainContext, nil), spec.state, chainConfig, *vmConfig, dests)
+	spec.result, spec.err = ApplyMessage(vmenv, spec.msg, new(GasPool).AddGas(spec.msg.Gas()))
+}
+
+// verifyParallelExecution executes the block sequentially and compares the changesets with the ones
+// of the parallel execution in ibs. CommitBlock writes the same changes when it's repeated, so ibs
+// can be committed to the state writer afterwards.
+func verifyParallelExecution(
+	chainConfig *params.ChainConfig,
+	vmConfig *vm.Config,
+	chainContext ChainContext,
+	engine consensus.Engine,
+	block *types.Block,
+	stateReader state.StateReader,
+	ibs *state.IntraBlockState,
+	dests vm.Cache,
+) error {
+	sequential := state.New(stateReader)
+	receipts, err := executeTransactions(chainConfig, vmConfig, chainContext, block, stateReader, sequential, dests, false)
+	if err != nil {
+		return err
+	}
+	header := block.Header()
+	if _, err = engine.FinalizeAndAssemble(chainConfig, header, sequential, block.Transactions(), block.Uncles(), receipts); err != nil {
+		return fmt.Errorf("finalize of block %d failed: %v", block.NumberU64(), err)
+	}
+
+	ctx := chainConfig.WithEIPsFlags(context.Background(), header.Number)
+	expected, err := encodeChangeSets(ctx, sequential, block.NumberU64())
+	if err != nil {
+		return err
+	}
+	got, err := encodeChangeSets(ctx, ibs, block.NumberU64())
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got[0], expected[0]) {
+		return fmt.Errorf("parallel execution of block %d: account changeset %x, sequential %x", block.NumberU64(), got[0], expected[0])
+	}
+	if !bytes.Equal(got[1], expected[1]) {
+		return fmt.Errorf("parallel execution of block %d: storage changeset %x, sequential %x", block.NumberU64(), got[1], expected[1])
+	}
+	return nil
+}
+
+// encodeChangeSets commits the block state and returns the encoded account and storage changesets
+func encodeChangeSets(ctx context.Context, ibs *state.IntraBlockState, blockNum uint64) ([2][]byte, error) {
+	var encoded [2][]byte
+	csw := state.NewChangeSetWriter()
+	encodeAccounts, encodeStorage := changeset.EncodeAccounts, changeset.EncodeStorage
+	if UsePlainStateExecution {
+		csw = state.NewChangeSetWriterPlain(blockNum)
+		encodeAccounts, encodeStorage = changeset.EncodeAccountsPlain, changeset.EncodeStoragePlain
+	}
+	if err := ibs.CommitBlock(ctx, csw); err != nil {
+		return encoded, err
+	}
+	accountChanges, err := csw.GetAccountChanges()
+	if err != nil {
+		return encoded, err
+	}
+	if encoded[0], err = encodeAccounts(accountChanges); err != nil {
+		return encoded, err
+	}
+	storageChanges, err := csw.GetStorageChanges()
+	if err != nil {
+		return encoded, err
+	}
+	if encoded[1], err = encodeStorage(storageChanges); err != nil {
+		return encoded, err
+	}
+	return encoded, nil
+}
@@ -0,0 +1,226 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"math/big"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/consensus"
+	"github.com/ledgerwatch/turbo-geth/consensus/ethash"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/params"
+)
+
+type dbChainContext struct {
+	db ethdb.Database
+}
+
+func (c *dbChainContext) GetHeader(hash common.Hash, number uint64) *types.Header {
+	return rawdb.ReadHeader(c.db, hash, number)
+}
+
+func (c *dbChainContext) Engine() consensus.Engine {
+	return ethash.NewFaker()
+}
+
+func TestParallelExecution(t *testing.T) {
+	var (
+		perCaller = common.HexToAddress("0x1000") // increments the slot of the caller
+		shared    = common.HexToAddress("0x2000") // increments the slot 0 and logs its value
+		reader    = common.HexToAddress("0x3000") // stores the balance of the coinbase
+		suicider  = common.HexToAddress("0x4000") // self-destructs to the caller
+		coinbase  = common.HexToAddress("0xc0ffee")
+		alloc     = GenesisAlloc{
+			perCaller: {Balance: new(big.Int), Code: []byte{byte(vm.CALLER), byte(vm.SLOAD), byte(vm.PUSH1), 1, byte(vm.ADD), byte(vm.CALLER), byte(vm.SSTORE), byte(vm.STOP)}},
+			shared: {Balance: new(big.Int), Code: []byte{
+				byte(vm.PUSH1), 0, byte(vm.SLOAD), byte(vm.PUSH1), 1, byte(vm.ADD), byte(vm.DUP1), byte(vm.PUSH1), 0, byte(vm.SSTORE),
+				byte(vm.PUSH1), 0, byte(vm.MSTORE), byte(vm.PUSH1), 32, byte(vm.PUSH1), 0, byte(vm.LOG0), byte(vm.STOP),
+			}},
+			reader:   {Balance: new(big.Int), Code: []byte{byte(vm.COINBASE), byte(vm.BALANCE), byte(vm.PUSH1), 0, byte(vm.SSTORE), byte(vm.STOP)}},
+			suicider: {Balance: new(big.Int), Code: []byte{byte(vm.CALLER), byte(vm.SELFDESTRUCT)}},
+		}
+		// stores 7 into the slot 0 of the created contract
+		initCode = []byte{byte(vm.PUSH1), 7, byte(vm.PUSH1), 0, byte(vm.SSTORE), byte(vm.STOP)}
+		keys     = make([]*ecdsaKey, 8)
+		signer   = types.MakeSigner(params.TestChainConfig, big.NewInt(1))
+		engine   = ethash.NewFaker()
+	)
+	for i := range keys {
+		key, err := crypto.ToECDSA(common.LeftPadBytes([]byte{byte(i + 1)}, 32))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = &ecdsaKey{key, crypto.PubkeyToAddress(key.PublicKey)}
+		alloc[keys[i].addr] = GenesisAccount{Balance: big.NewInt(1000000000000)}
+	}
+	gspec := &Genesis{Config: params.TestChainConfig, Alloc: alloc}
+
+	genDb := ethdb.NewMemDatabase()
+	defer genDb.Close()
+	genesis := gspec.MustCommit(genDb)
+	blocks, _, err := GenerateChain(gspec.Config, genesis, engine, genDb, 5, func(i int, block *BlockGen) {
+		block.SetCoinbase(coinbase)
+		addTx := func(k int, to *common.Address, value uint64, data []byte) {
+			nonce := block.TxNonce(keys[k].addr)
+			var tx *types.Transaction
+			if to == nil {
+				tx = types.NewContractCreation(nonce, uint256.NewInt().SetUint64(value), 100000, uint256.NewInt().SetOne(), data)
+			} else {
+				tx = types.NewTransaction(nonce, *to, uint256.NewInt().SetUint64(value), 100000, uint256.NewInt().SetOne(), data)
+			}
+			signed, err := types.SignTx(tx, signer, keys[k].key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			block.AddTx(signed)
+		}
+		// The transactions of the different senders commute, except for the shared counter
+		// and the coinbase balance. The later transactions of the same sender conflict.
+		for k := 0; k < 4; k++ {
+			addTx(k, &perCaller, 0, nil)
+		}
+		addTx(4, &shared, 0, nil)
+		addTx(5, &shared, 0, nil)
+		to := common.Address{0x50, byte(i)}
+		addTx(6, &to, 1, nil)
+		addTx(6, &to, 1, nil)
+		if i%2 == 1 {
+			addTx(7, &reader, 0, nil)
+		}
+		if i == 2 {
+			addTx(6, &suicider, 5, nil)
+		}
+		if i == 3 {
+			addTx(7, nil, 0, initCode)
+		}
+	}, false /* intermediateHashes */)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	UsePlainStateExecution = true
+	defer func() { UsePlainStateExecution = false }()
+	execute := func(parallel bool) (ethdb.Database, []types.Receipts) {
+		ParallelExecution, VerifyParallelExecution = parallel, parallel
+		defer func() { ParallelExecution, VerifyParallelExecution = false, false }()
+		db := ethdb.NewMemDatabase()
+		gspec.MustCommit(db)
+		var receipts []types.Receipts
+		for _, block := range blocks {
+			rawdb.WriteBlock(context.Background(), db, block)
+			rawdb.WriteCanonicalHash(db, block.Hash(), block.NumberU64())
+			r, err := ExecuteBlockEphemerally(gspec.Config, &vm.Config{}, &dbChainContext{db}, engine, block,
+				state.NewPlainStateReader(db), state.NewPlainStateWriter(db, block.NumberU64()), nil)
+			if err != nil {
+				t.Fatalf("block %d, parallel %t: %v", block.NumberU64(), parallel, err)
+			}
+			receipts = append(receipts, r)
+		}
+		return db, receipts
+	}
+	sequentialDb, sequentialReceipts := execute(false)
+	defer sequentialDb.Close()
+	parallelDb, parallelReceipts := execute(true)
+	defer parallelDb.Close()
+
+	for i := range blocks {
+		for j, receipt := range parallelReceipts[i] {
+			expected := sequentialReceipts[i][j]
+			if receipt.CumulativeGasUsed != expected.CumulativeGasUsed || receipt.Status != expected.Status || len(receipt.Logs) != len(expected.Logs) {
+				t.Fatalf("receipt %d of block %d is %+v, expected %+v", j, blocks[i].NumberU64(), receipt, expected)
+			}
+			for l, log := range receipt.Logs {
+				if log.Index != expected.Logs[l].Index || !bytes.Equal(log.Data, expected.Logs[l].Data) {
+					t.Errorf("log %d of receipt %d of block %d is %+v, expected %+v", l, j, blocks[i].NumberU64(), log, expected.Logs[l])
+				}
+			}
+		}
+	}
+	for _, bucket := range [][]byte{dbutils.PlainStateBucket, dbutils.PlainContractCodeBucket, dbutils.PlainAccountChangeSetBucket, dbutils.PlainStorageChangeSetBucket} {
+		expected, got := walkBucket(t, sequentialDb, bucket), walkBucket(t, parallelDb, bucket)
+		if len(expected) == 0 || len(got) != len(expected) {
+			t.Errorf("bucket %s has %d entries, expected %d", bucket, len(got), len(expected))
+		}
+		for k, v := range expected {
+			if !bytes.Equal(got[k], v) {
+				t.Errorf("bucket %s, key %x: %x, expected %x", bucket, k, got[k], v)
+			}
+		}
+	}
+}
+
+// returnCheckingReader fails the test if the state is read after executeTransactionsParallel returned
+type returnCheckingReader struct {
+	state.StateReader
+	t        *testing.T
+	returned int32
+}
+
+func (r *returnCheckingReader) ReadAccountData(address common.Address) (*accounts.Account, error) {
+	if atomic.LoadInt32(&r.returned) == 1 {
+		r.t.Errorf("account %x is read after the return", address)
+	}
+	return r.StateReader.ReadAccountData(address)
+}
+
+func TestParallelExecutionWaitsForWorkers(t *testing.T) {
+	key, err := crypto.ToECDSA(common.LeftPadBytes([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := crypto.PubkeyToAddress(key.PublicKey)
+	gspec := &Genesis{Config: params.TestChainConfig, Alloc: GenesisAlloc{sender: {Balance: big.NewInt(1000000000000)}}}
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	genesis := gspec.MustCommit(db)
+
+	// Only the first transaction fits into the block, the error is returned while the others are executed
+	signer := types.MakeSigner(gspec.Config, big.NewInt(1))
+	txs := make([]*types.Transaction, 256)
+	for i := range txs {
+		if txs[i], err = types.SignTx(types.NewTransaction(uint64(i), common.Address{byte(i)}, uint256.NewInt().SetOne(), 21000, uint256.NewInt(), nil), signer, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	header := &types.Header{ParentHash: genesis.Hash(), Number: big.NewInt(1), GasLimit: 21000, Difficulty: big.NewInt(1)}
+	block := types.NewBlock(header, txs, nil, nil)
+
+	reader := &returnCheckingReader{StateReader: state.NewDbStateReader(db), t: t}
+	_, err = executeTransactionsParallel(gspec.Config, &vm.Config{}, &dbChainContext{db}, block, reader, state.New(reader), nil)
+	atomic.StoreInt32(&reader.returned, 1)
+	if err == nil {
+		t.Fatal("expected the gas limit error")
+	}
+	// The workers still running after the return would report the reads
+	time.Sleep(10 * time.Millisecond)
+}
+
+type ecdsaKey struct {
+	key  *ecdsa.PrivateKey
+	addr common.Address
+}
+
+func walkBucket(t *testing.T, db ethdb.Database, bucket []byte) map[string][]byte {
+	entries := make(map[string][]byte)
+	if err := db.Walk(bucket, nil, 0, func(k, v []byte) (bool, error) {
+		entries[string(k)] = common.CopyBytes(v)
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
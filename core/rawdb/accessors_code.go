@@ -0,0 +1,88 @@
+package rawdb
+
+import (
+	"encoding/binary"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/log"
+)
+
+// WriteCodeAnalysis stores the jumpdest analysis of the contract code with the given hash at the rank,
+// the analyses are kept in the order of their ranks.
+func WriteCodeAnalysis(db DatabaseWriter, rank uint64, codeHash common.Hash, analysis []uint64) {
+	data := make([]byte, common.HashLength+8*len(analysis))
+	copy(data, codeHash[:])
+	for i, bits := range analysis {
+		binary.BigEndian.PutUint64(data[common.HashLength+8*i:], bits)
+	}
+	if err := db.Put(dbutils.CodeAnalysisBucket, codeAnalysisKey(rank), data); err != nil {
+		log.Crit("Failed to store code analysis", "err", err)
+	}
+}
+
+// WalkCodeAnalyses calls walker with the stored code analyses, in the order of their ranks, until it returns false.
+func WalkCodeAnalyses(db DatabaseIterator, walker func(rank uint64, codeHash common.Hash, analysis []uint64) bool) error {
+	return db.Walk(dbutils.CodeAnalysisBucket, nil, 0, func(k, v []byte) (bool, error) {
+		return walker(binary.BigEndian.Uint64(k), common.BytesToHash(v[:common.HashLength]), decodeCodeAnalysis(v[common.HashLength:])), nil
+	})
+}
+
+// DeleteCodeAnalysis removes the jumpdest analysis stored at the rank.
+func DeleteCodeAnalysis(db DatabaseDeleter, rank uint64) {
+	if err := db.Delete(dbutils.CodeAnalysisBucket, codeAnalysisKey(rank)); err != nil {
+		log.Crit("Failed to delete code analysis", "err", err)
+	}
+}
+
+// DeleteCodeAnalyses removes all the stored code analyses, whatever their format, and returns their number.
+func DeleteCodeAnalyses(db interface {
+	DatabaseIterator
+	DatabaseDeleter
+}) (int, error) {
+	var keys [][]byte
+	if err := db.Walk(dbutils.CodeAnalysisBucket, nil, 0, func(k, _ []byte) (bool, error) {
+		keys = append(keys, common.CopyBytes(k))
+		return true, nil
+	}); err != nil {
+		return 0, err
+	}
+	for _, k := range keys {
+		if err := db.Delete(dbutils.CodeAnalysisBucket, k); err != nil {
+			return 0, err
+		}
+	}
+	return len(keys), nil
+}
+
+func codeAnalysisKey(rank uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, rank)
+	return k
+}
+
+// ReadCodeAnalysisVersion retrieves the format version of the stored code analyses, 0 if there is none.
+func ReadCodeAnalysisVersion(db DatabaseReader) uint64 {
+	data, _ := db.Get(dbutils.DatabaseInfoBucket, dbutils.CodeAnalysisVersionKey)
+	if len(data) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(data)
+}
+
+// WriteCodeAnalysisVersion stores the format version of the code analyses.
+func WriteCodeAnalysisVersion(db DatabaseWriter, version uint64) {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, version)
+	if err := db.Put(dbutils.DatabaseInfoBucket, dbutils.CodeAnalysisVersionKey, data); err != nil {
+		log.Crit("Failed to store code analysis version", "err", err)
+	}
+}
+
+func decodeCodeAnalysis(data []byte) []uint64 {
+	analysis := make([]uint64, len(data)/8)
+	for i := range analysis {
+		analysis[i] = binary.BigEndian.Uint64(data[8*i:])
+	}
+	return analysis
+}
@@ -31,3 +31,8 @@ type DatabaseWriter interface {
 type DatabaseDeleter interface {
 	Delete(bucket, key []byte) error
 }
+
+// DatabaseIterator wraps the Walk method of a backing data store.
+type DatabaseIterator interface {
+	Walk(bucket, startkey []byte, fixedbits int, walker func([]byte, []byte) (bool, error)) error
+}
@@ -24,6 +24,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"runtime"
 	"sort"
 	"sync"
@@ -45,6 +46,9 @@ var _ StateWriter = (*TrieStateWriter)(nil)
 // MaxTrieCacheSize is the trie cache size limit after which to evict trie nodes from memory.
 var MaxTrieCacheSize = uint64(1024 * 1024)
 
+// TrieSnapshotLevels is the number of top levels of the state trie that are always written into the trie snapshot
+var TrieSnapshotLevels = 5
+
 const (
 	//FirstContractIncarnation - first incarnation for contract accounts. After 1 it increases by 1.
 	FirstContractIncarnation = 1
@@ -265,6 +269,17 @@ func (tds *TrieDbState) SetResolveReads(rr bool) {
 	tds.resolveReads = rr
 }
 
+// EnableCodeChunks makes the extracted witnesses carry only the chunks of contract codes that were touched
+// by the interpreter, instead of the full bytecode. The TrieDbState needs to be set as the CodeAccessRecorder of the EVM
+func (tds *TrieDbState) EnableCodeChunks(enable bool) {
+	tds.retainListBuilder.EnableCodeChunks(enable)
+}
+
+// TouchCode is a part of the vm.CodeAccessRecorder interface
+func (tds *TrieDbState) TouchCode(codeHash common.Hash, offset, length uint64) {
+	tds.retainListBuilder.TouchCode(codeHash, offset, length)
+}
+
 func (tds *TrieDbState) SetNoHistory(nh bool) {
 	tds.noHistory = nh
 }
@@ -955,14 +970,21 @@ func (tds *TrieDbState) truncateHistory(timestampTo uint64, accountMap map[strin
 			if timestamp > timestampTo {
 				accountHistoryEffects[kStr] = nil
 				// truncate the chunk
-				index := dbutils.WrapHistoryIndex(v)
-				index = index.TruncateGreater(timestampTo)
-				if len(index) > 8 { // If the chunk is empty after truncation, it gets simply deleted
+				index, err := dbutils.WrapHistoryIndex(v).Decoded()
+				if err != nil {
+					return false, fmt.Errorf("truncating index chunk %x: %w", k, err)
+				}
+				index.TruncateGreater(timestampTo)
+				if index.Len() > 0 { // If the chunk is empty after truncation, it gets simply deleted
 					// Truncated chunk becomes "the last chunk" with the timestamp 0xffff....ffff
 					lastK := make([]byte, len(k))
 					copy(lastK, k[:common.HashLength])
 					binary.BigEndian.PutUint64(lastK[common.HashLength:], ^uint64(0))
-					accountHistoryEffects[string(lastK)] = common.CopyBytes(index)
+					indexBytes, err := index.Encode()
+					if err != nil {
+						return false, err
+					}
+					accountHistoryEffects[string(lastK)] = indexBytes
 				}
 			}
 			return true, nil
@@ -981,14 +1003,21 @@ func (tds *TrieDbState) truncateHistory(timestampTo uint64, accountMap map[strin
 			kStr := string(common.CopyBytes(k))
 			if timestamp > timestampTo {
 				storageHistoryEffects[kStr] = nil
-				index := dbutils.WrapHistoryIndex(v)
-				index = index.TruncateGreater(timestampTo)
-				if len(index) > 8 { // If the chunk is empty after truncation, it gets simply deleted
+				index, err := dbutils.WrapHistoryIndex(v).Decoded()
+				if err != nil {
+					return false, fmt.Errorf("truncating index chunk %x: %w", k, err)
+				}
+				index.TruncateGreater(timestampTo)
+				if index.Len() > 0 { // If the chunk is empty after truncation, it gets simply deleted
 					// Truncated chunk becomes "the last chunk" with the timestamp 0xffff....ffff
 					lastK := make([]byte, len(k))
 					copy(lastK, k[:2*common.HashLength])
 					binary.BigEndian.PutUint64(lastK[2*common.HashLength:], ^uint64(0))
-					storageHistoryEffects[string(lastK)] = common.CopyBytes(index)
+					indexBytes, err := index.Encode()
+					if err != nil {
+						return false, err
+					}
+					storageHistoryEffects[string(lastK)] = indexBytes
 				}
 			}
 			return true, nil
@@ -1280,6 +1309,48 @@ func (tds *TrieDbState) EvictTries(print bool) {
 	}
 }
 
+// WriteTrieSnapshot writes the resident state trie into the file, so that it can be reloaded after restart
+// instead of warming up the trie from the database. Only the top levels of the trie and the nodes from the most
+// recent eviction generations are written, other parts of the trie are replaced by their hashes
+func (tds *TrieDbState) WriteTrieSnapshot(path string) error {
+	tds.tMu.Lock()
+	defer tds.tMu.Unlock()
+
+	rl := trie.NewRetainList(0)
+	for _, hex := range tds.tp.HotKeys(MaxTrieCacheSize) {
+		rl.AddHex(hex)
+	}
+
+	// Write into a temporary file first, so that a crash does not leave a truncated snapshot behind
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if err = tds.t.WriteSnapshot(f, trie.NewRetainLevels(rl, TrieSnapshotLevels)); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// LoadTrieSnapshot loads the resident state trie from the file written by WriteTrieSnapshot.
+// The snapshot is rejected if it does not match the current state root
+func (tds *TrieDbState) LoadTrieSnapshot(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tds.tMu.Lock()
+	defer tds.tMu.Unlock()
+	return tds.t.LoadSnapshot(f)
+}
+
 func (tds *TrieDbState) TrieStateWriter() *TrieStateWriter {
 	return &TrieStateWriter{tds: tds}
 }
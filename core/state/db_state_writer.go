@@ -265,9 +265,13 @@ func writeIndex(blocknum uint64, changes *changeset.ChangeSet, bucket []byte, ch
 		}
 
 		var index dbutils.HistoryIndexBytes
+		newChunk, err := dbutils.CheckNewIndexChunk(indexBytes, blocknum)
+		if err != nil {
+			return fmt.Errorf("checking chunk %x: %w", currentChunkKey, err)
+		}
 		if len(indexBytes) == 0 {
 			index = dbutils.NewHistoryIndex()
-		} else if dbutils.CheckNewIndexChunk(indexBytes, blocknum) {
+		} else if newChunk {
 			// Chunk overflow, need to write the "old" current chunk under its key derived from the last element
 			index = dbutils.WrapHistoryIndex(indexBytes)
 			indexKey, err := index.Key(change.Key)
@@ -283,7 +287,9 @@ func writeIndex(blocknum uint64, changes *changeset.ChangeSet, bucket []byte, ch
 		} else {
 			index = dbutils.WrapHistoryIndex(indexBytes)
 		}
-		index = index.Append(blocknum, len(change.Value) == 0)
+		if index, err = index.Append(blocknum, len(change.Value) == 0); err != nil {
+			return fmt.Errorf("appending to chunk %x: %w", currentChunkKey, err)
+		}
 
 		if err := changeDb.Put(bucket, currentChunkKey, index); err != nil {
 			return err
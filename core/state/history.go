@@ -6,8 +6,10 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"math"
 	"sort"
 
+	"github.com/RoaringBitmap/roaring"
 	"github.com/ledgerwatch/turbo-geth/common"
 	"github.com/ledgerwatch/turbo-geth/common/changeset"
 	"github.com/ledgerwatch/turbo-geth/common/dbutils"
@@ -61,7 +63,45 @@ func FindByHistory(tx ethdb.Tx, plain, storage bool, key []byte, timestamp uint6
 	if hB == nil {
 		return nil, ethdb.ErrKeyNotFound
 	}
+	return findByHistory(tx, hB.Cursor(), nil, plain, storage, key, timestamp)
+}
+
+// FindManyByHistory is FindByHistory for many keys at once. It shares the index cursor between the keys
+// and reads every changeset found in the index bitmaps only once, however many of the keys changed in it.
+// The value of the key not found in the history is nil
+func FindManyByHistory(tx ethdb.Tx, plain, storage bool, keys [][]byte, timestamp uint64) ([][]byte, error) {
+	var hBucket []byte
+	if storage {
+		hBucket = dbutils.StorageHistoryBucket
+	} else {
+		hBucket = dbutils.AccountsHistoryBucket
+	}
+	values := make([][]byte, len(keys))
+	hB := tx.Bucket(hBucket)
+	if hB == nil {
+		return values, nil
+	}
+	// seeking the keys in order keeps the cursor moving forward
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return bytes.Compare(keys[order[i]], keys[order[j]]) < 0 })
 	c := hB.Cursor()
+	changesets := make(map[uint64][]byte)
+	for _, i := range order {
+		v, err := findByHistory(tx, c, changesets, plain, storage, keys[i], timestamp)
+		if err != nil && !errors.Is(err, ethdb.ErrKeyNotFound) {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+// findByHistory looks the key up with the cursor of the history index. Changesets read from the index,
+// if the map is given, are kept in it
+func findByHistory(tx ethdb.Tx, c ethdb.Cursor, changesets map[uint64][]byte, plain, storage bool, key []byte, timestamp uint64) ([]byte, error) {
 	k, v, err := c.Seek(dbutils.IndexChunkKey(key, timestamp))
 	if err != nil {
 		return nil, err
@@ -86,7 +126,10 @@ func FindByHistory(tx ethdb.Tx, plain, storage bool, key []byte, timestamp uint6
 			return nil, ethdb.ErrKeyNotFound
 		}
 	}
-	index := dbutils.WrapHistoryIndex(v)
+	index, err := dbutils.WrapHistoryIndex(v).Decoded()
+	if err != nil {
+		return nil, fmt.Errorf("index chunk %x: %w", k, err)
+	}
 
 	changeSetBlock, set, ok := index.Search(timestamp)
 	var data []byte
@@ -102,8 +145,13 @@ func FindByHistory(tx ethdb.Tx, plain, storage bool, key []byte, timestamp uint6
 			return nil, fmt.Errorf("no changeset bucket %s", csB)
 		}
 
-		csKey := dbutils.EncodeTimestamp(changeSetBlock)
-		changeSetData, _ := csB.Get(csKey)
+		changeSetData, cached := changesets[changeSetBlock]
+		if !cached {
+			changeSetData, _ = csB.Get(dbutils.EncodeTimestamp(changeSetBlock))
+			if changesets != nil {
+				changesets[changeSetBlock] = changeSetData
+			}
+		}
 
 		if plain {
 			if storage {
@@ -135,9 +183,9 @@ func FindByHistory(tx ethdb.Tx, plain, storage bool, key []byte, timestamp uint6
 				lastChangesetBlock = binary.BigEndian.Uint64(v1[:8])
 			}
 			if storage {
-				v1, err1 = stageBucket.Get([]byte{byte(stages.AccountHistoryIndex)})
-			} else {
 				v1, err1 = stageBucket.Get([]byte{byte(stages.StorageHistoryIndex)})
+			} else {
+				v1, err1 = stageBucket.Get([]byte{byte(stages.AccountHistoryIndex)})
 			}
 			if err1 != nil && !errors.Is(err1, ethdb.ErrKeyNotFound) {
 				return nil, err1
@@ -152,17 +200,19 @@ func FindByHistory(tx ethdb.Tx, plain, storage bool, key []byte, timestamp uint6
 			csBucket := dbutils.ChangeSetByIndexBucket(plain, storage)
 			csB := tx.Bucket(csBucket)
 			c := csB.Cursor()
+			// the changeset of the block holds the values before the block, same as the index search,
+			// the changeset at timestamp is the first one to look at
 			var startTimestamp uint64
-			if timestamp < lastIndexBlock {
+			if timestamp <= lastIndexBlock {
 				startTimestamp = lastIndexBlock + 1
 			} else {
-				startTimestamp = timestamp + 1
+				startTimestamp = timestamp
 			}
 			startKey := dbutils.EncodeTimestamp(startTimestamp)
-			err = nil
+			err = changeset.ErrNotFound
 			for k, v, err1 := c.Seek(startKey); k != nil && err1 == nil; k, v, err1 = c.Next() {
 				if storage {
-					data, err = changeset.StorageChangeSetPlainBytes(v).Find(key)
+					data, err = changeset.StorageChangeSetPlainBytes(v).FindWithIncarnation(key)
 				} else {
 					data, err = changeset.AccountChangeSetPlainBytes(v).Find(key)
 				}
@@ -210,6 +260,46 @@ func FindByHistory(tx ethdb.Tx, plain, storage bool, key []byte, timestamp uint6
 	return data, nil
 }
 
+// ChangedBlocks returns the blocks in the range [from, to] at which any of the keys has changed, according to the history index.
+// Keys are of the same format as for FindByHistory, the bitmaps of all their index chunks overlapping the range are merged
+func ChangedBlocks(tx ethdb.Tx, storage bool, keys [][]byte, from, to uint64) (*roaring.Bitmap, error) {
+	hBucket := dbutils.AccountsHistoryBucket
+	if storage {
+		hBucket = dbutils.StorageHistoryBucket
+	}
+	c := tx.Bucket(hBucket).Cursor()
+	var bitmaps []*roaring.Bitmap
+	for _, key := range keys {
+		prefix := dbutils.CompositeKeyWithoutIncarnation(key)
+		// chunk keys end with the last block of the chunk, so the first chunk to look at is the first one ending not before `from`
+		for k, v, err := c.Seek(dbutils.IndexChunkKey(key, from)); k != nil; k, v, err = c.Next() {
+			if err != nil {
+				return nil, err
+			}
+			if len(k) != len(prefix)+8 || !bytes.HasPrefix(k, prefix) {
+				break
+			}
+			blocks, _, decodeErr := dbutils.HistoryIndexBytes(v).Bitmaps()
+			if decodeErr != nil {
+				return nil, fmt.Errorf("index chunk %x: %w", k, decodeErr)
+			}
+			if blocks.IsEmpty() {
+				continue
+			}
+			bitmaps = append(bitmaps, blocks)
+			if uint64(blocks.Maximum()) >= to {
+				break
+			}
+		}
+	}
+	res := roaring.FastOr(bitmaps...)
+	if to < math.MaxUint32 {
+		res.RemoveRange(to+1, math.MaxUint32+1)
+	}
+	res.RemoveRange(0, from)
+	return res, nil
+}
+
 func WalkAsOf(db ethdb.KV, bucket, hBucket, startkey []byte, fixedbits int, timestamp uint64, walker func(k []byte, v []byte) (bool, error)) error {
 	//fmt.Printf("WalkAsOf %x %x %x %d %d\n", bucket, hBucket, startkey, fixedbits, timestamp)
 	if !(bytes.Equal(bucket, dbutils.PlainStateBucket) || bytes.Equal(bucket, dbutils.CurrentStateBucket)) {
@@ -517,7 +607,10 @@ func keyCmp(key1, key2 []byte) (int, bool) {
 }
 
 func findInHistory(hK, hV []byte, timestamp uint64, csGetter func([]byte) ([]byte, error), adapter func(v []byte) changeset.Walker) ([]byte, bool, error) {
-	index := dbutils.WrapHistoryIndex(hV)
+	index, err := dbutils.WrapHistoryIndex(hV).Decoded()
+	if err != nil {
+		return nil, false, fmt.Errorf("index chunk %x: %w", hK, err)
+	}
 	if changeSetBlock, set, ok := index.Search(timestamp); ok {
 		// set == true if this change was from empty record (non-existent account) to non-empty
 		// In such case, we do not need to examine changeSet and simply skip the record
@@ -97,6 +97,10 @@ type IntraBlockState struct {
 	nextRevisionID int
 	tracer         StateTracer
 	trace          bool
+
+	// Items read and written by the transactions, tracked for the speculative execution
+	reads  *readSet
+	writes *writeSet
 }
 
 // Create a new state from a given trie
@@ -458,9 +462,19 @@ func (sdb *IntraBlockState) AddBalance(addr common.Address, amount *uint256.Int)
 			fmt.Println("CaptureAccountWrite err", err)
 		}
 	}
+	var read bool
+	if sdb.reads != nil {
+		_, read = sdb.reads.accounts[addr]
+	}
 	sdb.Unlock()
 
 	stateObject := sdb.GetOrNewStateObject(addr)
+	if sdb.reads != nil && !read {
+		sdb.Lock()
+		delete(sdb.reads.accounts, addr)
+		sdb.reads.balanceAdds[addr] = struct{}{}
+		sdb.Unlock()
+	}
 	if stateObject != nil {
 		stateObject.AddBalance(amount)
 	}
@@ -613,6 +627,9 @@ var nullValue = common.Big0
 // do not lock!!!
 // Retrieve a state object given my the address. Returns nil if not found.
 func (sdb *IntraBlockState) getStateObject(addr common.Address) (stateObject *stateObject) {
+	if sdb.reads != nil {
+		sdb.reads.accounts[addr] = struct{}{}
+	}
 	// Prefer 'live' objects.
 	if obj := sdb.stateObjects[addr]; obj != nil {
 		return obj
@@ -823,6 +840,9 @@ func (sdb *IntraBlockState) FinalizeTx(ctx context.Context, stateWriter StateWri
 
 		sdb.stateObjectsDirty[addr] = struct{}{}
 	}
+	if sdb.writes != nil {
+		sdb.recordWrites(sdb.writes)
+	}
 	// Invalidate journal because reverting across transactions is not allowed.
 	sdb.clearJournalAndRefund()
 	return nil
@@ -0,0 +1,195 @@
+package state
+
+import (
+	"context"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+)
+
+// readSet is the set of the state items an IntraBlockState read from its StateReader. The accounts
+// are read together with their code and incarnation. The accounts which were only added to with
+// AddBalance, like the coinbase receiving the fees, are kept apart: the additions commute.
+type readSet struct {
+	accounts    map[common.Address]struct{}
+	storage     map[common.Address]map[common.Hash]struct{}
+	balanceAdds map[common.Address]struct{}
+}
+
+// writeSet is the set of the state items modified by the transactions finalized in an IntraBlockState
+type writeSet struct {
+	accounts map[common.Address]struct{}
+	storage  map[common.Address]map[common.Hash]struct{}
+}
+
+// TrackReads makes the IntraBlockState record the items it reads from the StateReader. It's used to
+// execute a transaction speculatively and merge it into the block state later with MergeTx.
+func (sdb *IntraBlockState) TrackReads() {
+	sdb.Lock()
+	defer sdb.Unlock()
+	sdb.reads = &readSet{
+		accounts:    make(map[common.Address]struct{}),
+		storage:     make(map[common.Address]map[common.Hash]struct{}),
+		balanceAdds: make(map[common.Address]struct{}),
+	}
+}
+
+// TrackWrites makes the IntraBlockState record the items modified by the transactions it finalizes,
+// Conflicts checks the speculatively executed transactions against them.
+func (sdb *IntraBlockState) TrackWrites() {
+	sdb.Lock()
+	defer sdb.Unlock()
+	sdb.writes = &writeSet{
+		accounts: make(map[common.Address]struct{}),
+		storage:  make(map[common.Address]map[common.Hash]struct{}),
+	}
+}
+
+// do not lock
+func (sdb *IntraBlockState) readStorage(addr common.Address, key *common.Hash) {
+	if sdb.reads == nil {
+		return
+	}
+	keys, ok := sdb.reads.storage[addr]
+	if !ok {
+		keys = make(map[common.Hash]struct{})
+		sdb.reads.storage[addr] = keys
+	}
+	keys[*key] = struct{}{}
+}
+
+// do not lock
+// recordWrites adds the items modified by the current transaction to the write set
+func (sdb *IntraBlockState) recordWrites(w *writeSet) {
+	for _, entry := range sdb.journal.entries {
+		switch ch := entry.(type) {
+		case storageChange:
+			keys, ok := w.storage[*ch.account]
+			if !ok {
+				keys = make(map[common.Hash]struct{})
+				w.storage[*ch.account] = keys
+			}
+			keys[ch.key] = struct{}{}
+			// The empty accounts are removed by FinalizeTx after EIP-158
+			if obj := sdb.stateObjects[*ch.account]; obj != nil && obj.empty() {
+				w.accounts[*ch.account] = struct{}{}
+			}
+		case resetObjectChange:
+			w.accounts[ch.prev.address] = struct{}{}
+		default:
+			if addr := entry.dirtied(); addr != nil {
+				w.accounts[*addr] = struct{}{}
+			}
+		}
+	}
+	// RIPEMD stays dirty after the revert of its touch, see stateObject.touch
+	if _, ok := sdb.journal.dirties[ripemd]; ok {
+		w.accounts[ripemd] = struct{}{}
+	}
+}
+
+// balanceOnly returns the accounts the transaction only added to with AddBalance
+func (r *readSet) balanceOnly() map[common.Address]struct{} {
+	only := make(map[common.Address]struct{})
+	for addr := range r.balanceAdds {
+		if _, ok := r.accounts[addr]; !ok {
+			only[addr] = struct{}{}
+		}
+	}
+	return only
+}
+
+// Conflicts reports whether the transaction executed speculatively in txState, on the state at the
+// beginning of the block, could have seen the items modified by the transactions finalized so far.
+// The IntraBlockState has to track the writes, and txState the reads.
+func (sdb *IntraBlockState) Conflicts(txState *IntraBlockState) bool {
+	sdb.RLock()
+	defer sdb.RUnlock()
+	txState.RLock()
+	defer txState.RUnlock()
+
+	if txState.dbErr != nil {
+		return true
+	}
+	for addr := range txState.reads.accounts {
+		if _, ok := sdb.writes.accounts[addr]; ok {
+			return true
+		}
+	}
+	for addr, keys := range txState.reads.storage {
+		written, ok := sdb.writes.storage[addr]
+		if !ok {
+			continue
+		}
+		for key := range keys {
+			if _, ok := written[key]; ok {
+				return true
+			}
+		}
+	}
+	// The recreated accounts drop the storage written by the earlier transactions
+	for addr := range txState.journal.dirties {
+		if obj := txState.stateObjects[addr]; obj != nil && obj.created && len(sdb.writes.storage[addr]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// MergeTx applies the changes of the transaction executed speculatively in txState, which isn't
+// finalized, and finalizes the transaction as ApplyTransaction would do. The transaction must not
+// conflict with the earlier ones, see Conflicts, and has to be prepared with Prepare.
+func (sdb *IntraBlockState) MergeTx(ctx context.Context, txState *IntraBlockState, stateWriter StateWriter) error {
+	txState.RLock()
+	defer txState.RUnlock()
+
+	balanceOnly := txState.reads.balanceOnly()
+	sdb.Lock()
+	if sdb.writes != nil {
+		txState.recordWrites(sdb.writes)
+	}
+	for addr := range txState.journal.dirties {
+		if _, ok := balanceOnly[addr]; ok {
+			continue
+		}
+		sdb.journal.dirty(addr)
+		obj, ok := txState.stateObjects[addr]
+		if !ok {
+			continue
+		}
+		merged := obj.deepCopy(sdb)
+		merged.created = obj.created
+		if prev := sdb.stateObjects[addr]; prev != nil && !obj.created {
+			// Keep the storage items read and written by the earlier transactions
+			mergeStorage(merged.originStorage, prev.originStorage)
+			mergeStorage(merged.blockOriginStorage, prev.blockOriginStorage)
+			mergeStorage(merged.dirtyStorage, prev.dirtyStorage)
+		}
+		sdb.setStateObject(merged)
+	}
+	sdb.Unlock()
+
+	for addr := range balanceOnly {
+		obj, ok := txState.stateObjects[addr]
+		if _, dirty := txState.journal.dirties[addr]; !ok || !dirty {
+			continue
+		}
+		sdb.AddBalance(addr, new(uint256.Int).Sub(&obj.data.Balance, &obj.original.Balance))
+	}
+	for _, log := range txState.logs[txState.thash] {
+		sdb.AddLog(log)
+	}
+	for hash, preimage := range txState.preimages {
+		sdb.AddPreimage(hash, preimage)
+	}
+	return sdb.FinalizeTx(ctx, stateWriter)
+}
+
+func mergeStorage(dst, src Storage) {
+	for key, value := range src {
+		if _, ok := dst[key]; !ok {
+			dst[key] = value
+		}
+	}
+}
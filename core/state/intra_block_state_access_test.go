@@ -0,0 +1,99 @@
+package state
+
+import (
+	"context"
+	"testing"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestSpeculativeTxConflicts(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	ctx := context.Background()
+	var (
+		contract = common.HexToAddress("0x1000")
+		coinbase = common.HexToAddress("0x2000")
+		alice    = common.HexToAddress("0x3000")
+		bob      = common.HexToAddress("0x4000")
+		key1     = common.HexToHash("0x01")
+		key2     = common.HexToHash("0x02")
+	)
+	u := func(v uint64) *uint256.Int { return uint256.NewInt().SetUint64(v) }
+
+	genesis := New(NewPlainStateReader(db))
+	genesis.SetCode(contract, []byte{0})
+	genesis.AddBalance(alice, u(100))
+	genesis.AddBalance(bob, u(100))
+	if err := genesis.CommitBlock(ctx, NewPlainStateWriter(db, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	speculate := func(f func(s *IntraBlockState)) *IntraBlockState {
+		s := New(NewPlainStateReader(db))
+		s.TrackReads()
+		f(s)
+		return s
+	}
+	// Different slots of the same contract, and the fees
+	tx0 := speculate(func(s *IntraBlockState) {
+		s.SubBalance(alice, u(10))
+		s.SetState(contract, &key1, *u(1))
+		s.AddBalance(coinbase, u(1))
+	})
+	tx1 := speculate(func(s *IntraBlockState) {
+		s.SubBalance(bob, u(10))
+		s.SetState(contract, &key2, *u(2))
+		s.AddBalance(coinbase, u(2))
+	})
+	// Reads the slot written by tx0
+	tx2 := speculate(func(s *IntraBlockState) {
+		var value uint256.Int
+		s.GetState(contract, &key1, &value)
+		s.SetState(contract, &key2, value)
+	})
+	// Reads the fees
+	tx3 := speculate(func(s *IntraBlockState) {
+		s.GetBalance(coinbase)
+	})
+
+	block := New(NewPlainStateReader(db))
+	block.TrackWrites()
+	for i, tx := range []*IntraBlockState{tx0, tx1} {
+		if block.Conflicts(tx) {
+			t.Fatalf("tx%d conflicts", i)
+		}
+		block.Prepare(common.Hash{byte(i)}, common.Hash{}, i)
+		if err := block.MergeTx(ctx, tx, NewNoopWriter()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !block.Conflicts(tx2) {
+		t.Errorf("tx2 reads the slot written by tx0")
+	}
+	if !block.Conflicts(tx3) {
+		t.Errorf("tx3 reads the balance of the coinbase")
+	}
+
+	for _, balance := range []struct {
+		addr     common.Address
+		expected uint64
+	}{{alice, 90}, {bob, 90}, {coinbase, 3}} {
+		if b := block.GetBalance(balance.addr); !b.Eq(u(balance.expected)) {
+			t.Errorf("balance of %x is %d, expected %d", balance.addr, b, balance.expected)
+		}
+	}
+	for _, slot := range []struct {
+		key      common.Hash
+		expected uint64
+	}{{key1, 1}, {key2, 2}} {
+		var value uint256.Int
+		block.GetState(contract, &slot.key, &value)
+		if !value.Eq(u(slot.expected)) {
+			t.Errorf("slot %x is %d, expected %d", slot.key, &value, slot.expected)
+		}
+	}
+}
@@ -182,6 +182,7 @@ func (so *stateObject) GetCommittedState(key *common.Hash, out *uint256.Int) {
 		return
 	}
 	// Load from DB in case it is missing.
+	so.db.readStorage(so.address, key)
 	enc, err := so.db.stateReader.ReadAccountStorage(so.address, so.data.GetIncarnation(), key)
 	if err != nil {
 		so.setError(err)
@@ -46,13 +46,19 @@ type Stateless struct {
 	accountUpdates map[common.Hash]*accounts.Account
 	deleted        map[common.Hash]struct{}
 	created        map[common.Hash]struct{}
+	codeChunks     map[common.Hash]*trie.OperatorCodeChunks // Touched chunks of the contract codes, by code hash
+	codeRoots      trie.CodeRoots                           // Code merkle roots of the full codes seen so far
+	partialCodes   map[common.Hash]*trie.PartialCode        // Codes assembled from the verified chunks, by code hash
+	codeErr        error                                    // First access to a chunk missing from the witness
 	trace          bool
 }
 
 // NewStateless creates a new instance of Stateless
 // It deserialises the block witness and creates the state trie out of it, checking that the root of the constructed
 // state trie matches the value of `stateRoot` parameter
-func NewStateless(stateRoot common.Hash, blockWitness *trie.Witness, blockNr uint64, trace bool, isBinary bool) (*Stateless, error) {
+// The code merkle roots of the full codes in the witness, and of the codes created by the block, are added to
+// `codeRoots`, which is expected to be kept between the blocks, the chunks of the codes are verified against them
+func NewStateless(stateRoot common.Hash, blockWitness *trie.Witness, blockNr uint64, trace bool, isBinary bool, codeRoots trie.CodeRoots) (*Stateless, error) {
 	t, err := trie.BuildTrieFromWitness(blockWitness, isBinary, trace)
 	if err != nil {
 		return nil, err
@@ -69,6 +75,19 @@ func NewStateless(stateRoot common.Hash, blockWitness *trie.Witness, blockNr uin
 			return nil, fmt.Errorf("state root mistmatch when creating Stateless2, got %x, expected %x", t.Hash(), stateRoot)
 		}
 	}
+	if codeRoots == nil {
+		codeRoots = make(trie.CodeRoots)
+	}
+	codeChunks := make(map[common.Hash]*trie.OperatorCodeChunks)
+	for _, operator := range blockWitness.Operators {
+		switch op := operator.(type) {
+		case *trie.OperatorCode:
+			// The full code is authenticated by its hash in the state trie
+			codeRoots.AddCode(op.Code)
+		case *trie.OperatorCodeChunks:
+			codeChunks[op.CodeHash] = op
+		}
+	}
 	return &Stateless{
 		t:              t,
 		codeUpdates:    make(map[common.Hash][]byte),
@@ -76,6 +95,9 @@ func NewStateless(stateRoot common.Hash, blockWitness *trie.Witness, blockNr uin
 		accountUpdates: make(map[common.Hash]*accounts.Account),
 		deleted:        make(map[common.Hash]struct{}),
 		created:        make(map[common.Hash]struct{}),
+		codeChunks:     codeChunks,
+		codeRoots:      codeRoots,
+		partialCodes:   make(map[common.Hash]*trie.PartialCode),
 		blockNr:        blockNr,
 		trace:          trace,
 	}, nil
@@ -140,9 +162,52 @@ func (s *Stateless) ReadAccountCode(address common.Address, codeHash common.Hash
 	if code, ok := s.t.GetAccountCode(addrHash[:]); ok {
 		return code, nil
 	}
+
+	if partial, ok, err := s.readPartialCode(codeHash); err != nil {
+		return nil, fmt.Errorf("invalid code chunks for acc: %x hash %x: %v", address, codeHash, err)
+	} else if ok {
+		s.codeUpdates[addrHash] = partial.Code
+		return partial.Code, nil
+	}
 	return nil, fmt.Errorf("could not find bytecode for acc: %x hash %x", address, codeHash)
 }
 
+// readPartialCode verifies the chunks of the code in the witness, if there are any, and assembles the code
+func (s *Stateless) readPartialCode(codeHash common.Hash) (*trie.PartialCode, bool, error) {
+	if partial, ok := s.partialCodes[codeHash]; ok {
+		return partial, true, nil
+	}
+	op, ok := s.codeChunks[codeHash]
+	if !ok {
+		return nil, false, nil
+	}
+	if err := op.Verify(s.codeRoots); err != nil {
+		return nil, false, err
+	}
+	partial := trie.AssembleCode(int(op.CodeSize), op.Chunks)
+	s.partialCodes[codeHash] = partial
+	return partial, true, nil
+}
+
+// TouchCode is a part of the vm.CodeAccessRecorder interface
+// This implementation records the accesses to the chunks of the codes which are missing from the witness,
+// see CodeAccessError
+func (s *Stateless) TouchCode(codeHash common.Hash, offset, length uint64) {
+	partial, ok := s.partialCodes[codeHash]
+	if !ok || s.codeErr != nil {
+		return
+	}
+	if err := partial.Check(offset, length); err != nil {
+		s.codeErr = fmt.Errorf("code %x: %v", codeHash, err)
+	}
+}
+
+// CodeAccessError returns an error if the execution accessed a chunk of a contract code missing from the witness.
+// The missing chunks are filled with zeroes, so the results of such execution are not valid
+func (s *Stateless) CodeAccessError() error {
+	return s.codeErr
+}
+
 // ReadAccountCodeSize is a part of the StateReader interface
 // This implementation looks the code up in the codeMap, and returns its size
 // It fails if the code is not found in the map
@@ -168,6 +233,12 @@ func (s *Stateless) ReadAccountCodeSize(address common.Address, codeHash common.
 		return codeSize, nil
 	}
 
+	if partial, ok, err := s.readPartialCode(codeHash); err != nil {
+		return 0, fmt.Errorf("invalid code chunks for acc: %x hash %x: %v", address, codeHash, err)
+	} else if ok {
+		return len(partial.Code), nil
+	}
+
 	return 0, fmt.Errorf("could not find bytecode for hash %x", codeHash)
 }
 
@@ -208,6 +279,7 @@ func (s *Stateless) DeleteAccount(_ context.Context, address common.Address, ori
 // This implementation adds the code to the codeMap to make it available for further accesses
 func (s *Stateless) UpdateAccountCode(address common.Address, incarnation uint64, codeHash common.Hash, code []byte) error {
 	s.codeUpdates[codeHash] = code
+	s.codeRoots.AddCode(code)
 
 	if s.trace {
 		fmt.Printf("Stateless: UpdateAccountCode %x codeHash %x\n", address, codeHash)
@@ -0,0 +1,236 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"sort"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/params"
+)
+
+// AccountDiff is the change of the account made by the current transaction
+type AccountDiff struct {
+	Address common.Address
+
+	Existed       bool // the account existed before the transaction
+	Exists        bool // the account exists after the transaction
+	BalanceBefore uint256.Int
+	BalanceAfter  uint256.Int
+	NonceBefore   uint64
+	NonceAfter    uint64
+	CodeBefore    []byte
+	CodeAfter     []byte
+	Storage       map[common.Hash]StorageDiff // changed storage items
+}
+
+// StorageDiff is the change of the storage item
+type StorageDiff struct {
+	Before, After uint256.Int
+}
+
+// txOrigin collects the values of the account before the transaction from the journal, the first change of each field
+// keeps its value before the transaction
+type txOrigin struct {
+	hasAccount, hasBalance, hasNonce, hasCode bool // the value is known
+
+	existed bool
+	balance uint256.Int
+	nonce   uint64
+	code    []byte
+	reset   *stateObject // the account object replaced by the first reset of the account in the transaction
+	storage map[common.Hash]uint256.Int
+}
+
+// TxStateDiff returns the changes of the accounts made by the current transaction, ordered by address. The values
+// before the transaction come from the journal, so it has to be called before FinalizeTx. Accounts touched without
+// changes are skipped.
+func (sdb *IntraBlockState) TxStateDiff(ctx context.Context) []*AccountDiff {
+	sdb.Lock()
+	defer sdb.Unlock()
+
+	origins := map[common.Address]*txOrigin{}
+	origin := func(addr common.Address) *txOrigin {
+		o, ok := origins[addr]
+		if !ok {
+			o = &txOrigin{storage: map[common.Hash]uint256.Int{}}
+			origins[addr] = o
+		}
+		return o
+	}
+	sdb.journal.RLock()
+	for _, entry := range sdb.journal.entries {
+		switch ch := entry.(type) {
+		case createObjectChange:
+			o := origin(*ch.account)
+			if !o.hasAccount {
+				// no account before the first change
+				o.hasAccount, o.hasBalance, o.hasNonce, o.hasCode = true, true, true, true
+			}
+		case resetObjectChange:
+			o := origin(ch.prev.address)
+			if o.reset == nil {
+				o.reset = ch.prev
+			}
+			if !o.hasAccount {
+				o.hasAccount, o.existed = true, !ch.prev.deleted
+			}
+			if !o.hasBalance {
+				o.hasBalance, o.balance = true, ch.prev.data.Balance
+			}
+			if !o.hasNonce {
+				o.hasNonce, o.nonce = true, ch.prev.data.Nonce
+			}
+			if !o.hasCode {
+				o.hasCode, o.code = true, ch.prev.Code()
+			}
+		case suicideChange:
+			o := origin(*ch.account)
+			if !o.hasBalance {
+				o.hasBalance, o.balance = true, ch.prevbalance
+			}
+		case balanceChange:
+			o := origin(*ch.account)
+			if !o.hasBalance {
+				o.hasBalance, o.balance = true, ch.prev
+			}
+		case nonceChange:
+			o := origin(*ch.account)
+			if !o.hasNonce {
+				o.hasNonce, o.nonce = true, ch.prev
+			}
+		case codeChange:
+			o := origin(*ch.account)
+			if !o.hasCode {
+				o.hasCode, o.code = true, ch.prevcode
+			}
+		case storageChange:
+			o := origin(*ch.account)
+			if _, ok := o.storage[ch.key]; ok {
+				continue
+			}
+			if o.reset != nil {
+				// the storage of the new object starts empty, the replaced object keeps the value before the reset
+				var value uint256.Int
+				o.reset.GetState(&ch.key, &value)
+				o.storage[ch.key] = value
+			} else {
+				o.storage[ch.key] = ch.prevalue
+			}
+		case touchChange:
+			origin(*ch.account)
+		}
+	}
+	sdb.journal.RUnlock()
+
+	emptyRemoval := params.GetForkFlag(ctx, params.IsEIP158Enabled)
+	diffs := make([]*AccountDiff, 0, len(origins))
+	for addr, o := range origins {
+		obj, ok := sdb.stateObjects[addr]
+		if !ok {
+			// the touch of ripeMD survives the revert of the journal, see FinalizeTx
+			continue
+		}
+		d := &AccountDiff{
+			Address:      addr,
+			Existed:      !obj.deleted,
+			Exists:       !obj.deleted && !obj.suicided && !(emptyRemoval && obj.empty()),
+			BalanceAfter: obj.data.Balance,
+			NonceAfter:   obj.data.Nonce,
+			CodeAfter:    obj.Code(),
+		}
+		if o.hasAccount {
+			d.Existed = o.existed
+		}
+		d.BalanceBefore, d.NonceBefore, d.CodeBefore = d.BalanceAfter, d.NonceAfter, d.CodeAfter
+		if o.hasBalance {
+			d.BalanceBefore = o.balance
+		}
+		if o.hasNonce {
+			d.NonceBefore = o.nonce
+		}
+		if o.hasCode {
+			d.CodeBefore = o.code
+		}
+		for key, before := range o.storage {
+			key := key
+			var after uint256.Int
+			obj.GetState(&key, &after)
+			if before != after || d.Existed != d.Exists {
+				if d.Storage == nil {
+					d.Storage = map[common.Hash]StorageDiff{}
+				}
+				d.Storage[key] = StorageDiff{Before: before, After: after}
+			}
+		}
+		if d.unchanged() {
+			continue
+		}
+		diffs = append(diffs, d)
+	}
+	sortAccountDiffs(diffs)
+	return diffs
+}
+
+// MergeAccountDiffs returns the changes of the accounts made by the sequence of transactions, given the changes made by
+// each of them in order. The storage items untouched by the earlier transactions take their values before the later
+// ones, even if the account was recreated in between.
+func MergeAccountDiffs(txDiffs ...[]*AccountDiff) []*AccountDiff {
+	merged := map[common.Address]*AccountDiff{}
+	for _, diffs := range txDiffs {
+		for _, d := range diffs {
+			m, ok := merged[d.Address]
+			if !ok {
+				m = &AccountDiff{
+					Address:       d.Address,
+					Existed:       d.Existed,
+					BalanceBefore: d.BalanceBefore,
+					NonceBefore:   d.NonceBefore,
+					CodeBefore:    d.CodeBefore,
+				}
+				merged[d.Address] = m
+			}
+			m.Exists, m.BalanceAfter, m.NonceAfter, m.CodeAfter = d.Exists, d.BalanceAfter, d.NonceAfter, d.CodeAfter
+			for key, s := range d.Storage {
+				if m.Storage == nil {
+					m.Storage = map[common.Hash]StorageDiff{}
+				}
+				if prev, ok := m.Storage[key]; ok {
+					s.Before = prev.Before
+				}
+				m.Storage[key] = s
+			}
+		}
+	}
+	diffs := make([]*AccountDiff, 0, len(merged))
+	for _, m := range merged {
+		if m.Existed == m.Exists {
+			// the later transactions may have reverted the changes of the earlier ones
+			for key, s := range m.Storage {
+				if s.Before == s.After {
+					delete(m.Storage, key)
+				}
+			}
+		}
+		if m.unchanged() {
+			continue
+		}
+		diffs = append(diffs, m)
+	}
+	sortAccountDiffs(diffs)
+	return diffs
+}
+
+// unchanged reports whether the account is the same before and after the transactions
+func (d *AccountDiff) unchanged() bool {
+	return d.Existed == d.Exists && (!d.Exists || d.BalanceBefore == d.BalanceAfter && d.NonceBefore == d.NonceAfter &&
+		bytes.Equal(d.CodeBefore, d.CodeAfter) && len(d.Storage) == 0)
+}
+
+func sortAccountDiffs(diffs []*AccountDiff) {
+	sort.Slice(diffs, func(i, j int) bool {
+		return bytes.Compare(diffs[i].Address[:], diffs[j].Address[:]) < 0
+	})
+}
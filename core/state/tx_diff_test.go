@@ -0,0 +1,128 @@
+package state
+
+import (
+	"context"
+	"testing"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestTxStateDiff(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	tds := NewTrieDbState(common.Hash{}, db, 0)
+	state := New(tds)
+
+	var (
+		changed  = common.Address{1}
+		reverted = common.Address{2}
+		died     = common.Address{3}
+		born     = common.Address{4}
+		reset    = common.Address{5}
+		key1     = common.Hash{1}
+		key2     = common.Hash{2}
+	)
+	// the first transaction, its changes are the state before the traced one
+	tds.StartNewBuffer()
+	state.SetBalance(changed, uint256.NewInt().SetUint64(100))
+	state.SetNonce(changed, 1)
+	state.SetCode(changed, []byte{1, 2})
+	state.SetState(changed, &key1, *uint256.NewInt().SetUint64(1))
+	state.SetBalance(reverted, uint256.NewInt().SetUint64(50))
+	state.SetBalance(died, uint256.NewInt().SetUint64(60))
+	state.SetState(died, &key1, *uint256.NewInt().SetUint64(2))
+	state.SetBalance(reset, uint256.NewInt().SetUint64(70))
+	state.SetState(reset, &key1, *uint256.NewInt().SetUint64(7))
+	if err := state.FinalizeTx(context.Background(), tds.TrieStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+
+	tds.StartNewBuffer()
+	state.AddBalance(changed, uint256.NewInt().SetUint64(10))
+	state.SetState(changed, &key1, *uint256.NewInt().SetUint64(2))
+	state.SetState(changed, &key1, *uint256.NewInt().SetUint64(3))
+	state.SetState(changed, &key2, *uint256.NewInt().SetUint64(4))
+	snapshot := state.Snapshot()
+	state.SetBalance(reverted, uint256.NewInt().SetUint64(55))
+	state.RevertToSnapshot(snapshot)
+	state.Suicide(died)
+	state.CreateAccount(born, false)
+	state.AddBalance(born, uint256.NewInt().SetUint64(5))
+	state.CreateAccount(reset, true)
+	state.SetState(reset, &key1, *uint256.NewInt().SetUint64(8))
+
+	diffs := state.TxStateDiff(context.Background())
+	if len(diffs) != 4 {
+		t.Fatalf("expected 4 changed accounts, got %d", len(diffs))
+	}
+
+	d := diffs[0]
+	if d.Address != changed || !d.Existed || !d.Exists {
+		t.Errorf("changed account: %+v", d)
+	}
+	if d.BalanceBefore.Uint64() != 100 || d.BalanceAfter.Uint64() != 110 {
+		t.Errorf("balance of changed account: %d -> %d", d.BalanceBefore.Uint64(), d.BalanceAfter.Uint64())
+	}
+	if d.NonceBefore != 1 || d.NonceAfter != 1 || string(d.CodeBefore) != string(d.CodeAfter) {
+		t.Errorf("nonce or code of changed account: %+v", d)
+	}
+	s1, s2 := d.Storage[key1], d.Storage[key2]
+	if len(d.Storage) != 2 || s1.Before.Uint64() != 1 || s1.After.Uint64() != 3 || !s2.Before.IsZero() || s2.After.Uint64() != 4 {
+		t.Errorf("storage of changed account: %+v", d.Storage)
+	}
+
+	d = diffs[1]
+	if d.Address != died || !d.Existed || d.Exists {
+		t.Errorf("died account: %+v", d)
+	}
+	if d.BalanceBefore.Uint64() != 60 || !d.BalanceAfter.IsZero() {
+		t.Errorf("balance of died account: %d -> %d", d.BalanceBefore.Uint64(), d.BalanceAfter.Uint64())
+	}
+
+	d = diffs[2]
+	if d.Address != born || d.Existed || !d.Exists || d.BalanceAfter.Uint64() != 5 {
+		t.Errorf("born account: %+v", d)
+	}
+
+	d = diffs[3]
+	if d.Address != reset || !d.Existed || !d.Exists {
+		t.Errorf("reset account: %+v", d)
+	}
+	if d.BalanceBefore.Uint64() != 70 || d.BalanceAfter.Uint64() != 70 {
+		t.Errorf("balance of reset account: %d -> %d", d.BalanceBefore.Uint64(), d.BalanceAfter.Uint64())
+	}
+	s1 = d.Storage[key1]
+	if len(d.Storage) != 1 || s1.Before.Uint64() != 7 || s1.After.Uint64() != 8 {
+		t.Errorf("storage of reset account: %+v", d.Storage)
+	}
+}
+
+func TestMergeAccountDiffs(t *testing.T) {
+	var (
+		addr1 = common.Address{1}
+		addr2 = common.Address{2}
+		key   = common.Hash{1}
+	)
+	first := []*AccountDiff{
+		{Address: addr1, Existed: true, Exists: true, BalanceBefore: *uint256.NewInt().SetUint64(10), BalanceAfter: *uint256.NewInt().SetUint64(20),
+			Storage: map[common.Hash]StorageDiff{key: {Before: *uint256.NewInt().SetUint64(1), After: *uint256.NewInt().SetUint64(2)}}},
+		{Address: addr2, Existed: true, Exists: true, NonceBefore: 1, NonceAfter: 2},
+	}
+	second := []*AccountDiff{
+		// reverts the change of the first transaction
+		{Address: addr1, Existed: true, Exists: true, BalanceBefore: *uint256.NewInt().SetUint64(20), BalanceAfter: *uint256.NewInt().SetUint64(10),
+			Storage: map[common.Hash]StorageDiff{key: {Before: *uint256.NewInt().SetUint64(2), After: *uint256.NewInt().SetUint64(1)}}},
+		{Address: addr2, Existed: true, Exists: false, NonceBefore: 2, NonceAfter: 2},
+	}
+
+	diffs := MergeAccountDiffs(first, second)
+	if len(diffs) != 1 {
+		t.Fatalf("expected 1 changed account, got %d", len(diffs))
+	}
+	if d := diffs[0]; d.Address != addr2 || !d.Existed || d.Exists || d.NonceBefore != 1 || d.NonceAfter != 2 {
+		t.Errorf("merged account: %+v", d)
+	}
+}
@@ -236,17 +236,22 @@ func ApplyTransaction(config *params.ChainConfig, bc ChainContext, author *commo
 
 	*usedGas += result.UsedGas
 
+	return makeReceipt(statedb, tx, msg, result, *usedGas), nil
+}
+
+// makeReceipt creates the receipt of the transaction applied to the statedb
+func makeReceipt(statedb *state.IntraBlockState, tx *types.Transaction, msg types.Message, result *ExecutionResult, usedGas uint64) *types.Receipt {
 	// Create a new receipt for the transaction, storing the intermediate root and gas used by the tx
 	// based on the eip phase, we're passing whether the root touch-delete accounts.
-	receipt := types.NewReceipt(result.Failed(), *usedGas)
+	receipt := types.NewReceipt(result.Failed(), usedGas)
 	receipt.TxHash = tx.Hash()
 	receipt.GasUsed = result.UsedGas
 	// if the transaction created a contract, store the creation address in the receipt.
 	if msg.To() == nil {
-		receipt.ContractAddress = crypto.CreateAddress(vmenv.Context.Origin, tx.Nonce())
+		receipt.ContractAddress = crypto.CreateAddress(msg.From(), tx.Nonce())
 	}
 	// Set the receipt logs and create a bloom for filtering
 	receipt.Logs = statedb.GetLogs(tx.Hash())
 	receipt.Bloom = types.CreateBloom(types.Receipts{receipt})
-	return receipt, err
+	return receipt
 }
@@ -17,6 +17,8 @@
 package vm
 
 import (
+	"sync"
+
 	"github.com/hashicorp/golang-lru"
 	"github.com/ledgerwatch/turbo-geth/common"
 )
@@ -27,20 +29,27 @@ type Cache interface {
 	Get(hash common.Hash) ([]uint64, bool)
 }
 
+// CodeAnalysisVersion is the version of the format of the code analyses, the persisted analyses of
+// another version are dropped on start. It has to be bumped when codeBitmap changes.
+const CodeAnalysisVersion = 2
+
 type DestsCache struct {
 	*lru.Cache
+
+	mu        sync.Mutex
+	persisted int // number of the analyses in the database, see SetPersisted
 }
 
 func NewDestsCache(maxSize int) *DestsCache {
 	c, _ := lru.New(maxSize)
-	return &DestsCache{c}
+	return &DestsCache{Cache: c}
 }
 
 func (d *DestsCache) Set(hash common.Hash, v []uint64) {
 	d.Add(hash, v)
 }
 
-func (d DestsCache) Get(hash common.Hash) ([]uint64, bool) {
+func (d *DestsCache) Get(hash common.Hash) ([]uint64, bool) {
 	if v, ok := d.Cache.Get(hash); ok {
 		return v.([]uint64), true
 	}
@@ -51,6 +60,31 @@ func (d *DestsCache) Len() int {
 	return d.Cache.Len()
 }
 
+// Recent returns the analyses in the cache, the most recently used first.
+func (d *DestsCache) Recent() ([]common.Hash, [][]uint64) {
+	keys := d.Keys() // the oldest first
+	hashes := make([]common.Hash, 0, len(keys))
+	analyses := make([][]uint64, 0, len(keys))
+	for i := len(keys) - 1; i >= 0; i-- {
+		v, ok := d.Peek(keys[i])
+		if !ok {
+			continue // evicted meanwhile
+		}
+		hashes = append(hashes, keys[i].(common.Hash))
+		analyses = append(analyses, v.([]uint64))
+	}
+	return hashes, analyses
+}
+
+// SetPersisted records the number of the analyses in the database and returns the previous one.
+func (d *DestsCache) SetPersisted(n int) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	previous := d.persisted
+	d.persisted = n
+	return previous
+}
+
 // codeBitmap collects data locations in code.
 func codeBitmap(code []byte) []uint64 {
 	// The bitmap is 4 bytes longer than necessary, in case the code
@@ -387,6 +387,9 @@ func opCodeCopy(pc *uint64, interpreter *EVMInterpreter, callContext *callCtx) (
 	len64 := length.Uint64()
 	codeCopy := getDataBig(callContext.contract.Code, &codeOffset, len64)
 	callContext.memory.Set(memOffset.Uint64(), len64, codeCopy)
+	if recorder := interpreter.cfg.CodeAccessRecorder; recorder != nil && codeOffset.IsUint64() {
+		recordCodeAccess(recorder, callContext.contract.CodeHash, uint64(len(callContext.contract.Code)), codeOffset.Uint64(), len64)
+	}
 	return nil, nil
 }
 
@@ -399,8 +402,12 @@ func opExtCodeCopy(pc *uint64, interpreter *EVMInterpreter, callContext *callCtx
 	)
 	addr := common.Address(a.Bytes20())
 	len64 := length.Uint64()
-	codeCopy := getDataBig(interpreter.evm.IntraBlockState.GetCode(addr), &codeOffset, len64)
+	code := interpreter.evm.IntraBlockState.GetCode(addr)
+	codeCopy := getDataBig(code, &codeOffset, len64)
 	callContext.memory.Set(memOffset.Uint64(), len64, codeCopy)
+	if recorder := interpreter.cfg.CodeAccessRecorder; recorder != nil && codeOffset.IsUint64() {
+		recordCodeAccess(recorder, interpreter.evm.IntraBlockState.GetCodeHash(addr), uint64(len(code)), codeOffset.Uint64(), len64)
+	}
 	return nil, nil
 }
 
@@ -38,6 +38,15 @@ type Config struct {
 	EVMInterpreter   string // External EVM interpreter options
 
 	ExtraEips []int // Additional EIPS that are to be enabled
+
+	CodeAccessRecorder CodeAccessRecorder // Gets notified about the parts of contract codes accessed by the interpreter
+}
+
+// CodeAccessRecorder is notified about the ranges of contract bytecode read by the interpreter, either by executing
+// the instructions (including PUSH data) or by copying the code. It is used to include only the touched chunks of the
+// contract codes into the block witnesses
+type CodeAccessRecorder interface {
+	TouchCode(codeHash common.Hash, offset, length uint64)
 }
 
 // Interpreter is used to run Ethereum based contracts and will utilise the
@@ -246,6 +255,9 @@ func (in *EVMInterpreter) Run(contract *Contract, input []byte, readOnly bool) (
 		// enough stack items available to perform the operation.
 		op = contract.GetOp(pc)
 		operation := &in.jt[op]
+		if in.cfg.CodeAccessRecorder != nil {
+			recordInstructionAccess(in.cfg.CodeAccessRecorder, contract, pc, op)
+		}
 
 		if !operation.valid {
 			return nil, &ErrInvalidOpCode{opcode: op}
@@ -337,3 +349,23 @@ func (in *EVMInterpreter) Run(contract *Contract, input []byte, readOnly bool) (
 func (in *EVMInterpreter) CanRun(code []byte) bool {
 	return true
 }
+
+// recordInstructionAccess reports the instruction at pc, together with its PUSH data, to the code access recorder
+func recordInstructionAccess(recorder CodeAccessRecorder, contract *Contract, pc uint64, op OpCode) {
+	length := uint64(1)
+	if op.IsPush() {
+		length += uint64(op - PUSH1 + 1)
+	}
+	recordCodeAccess(recorder, contract.CodeHash, uint64(len(contract.Code)), pc, length)
+}
+
+// recordCodeAccess reports the range of the code to the code access recorder, clipping it to the code size
+func recordCodeAccess(recorder CodeAccessRecorder, codeHash common.Hash, codeSize uint64, offset, length uint64) {
+	if offset >= codeSize || length == 0 {
+		return
+	}
+	if length > codeSize-offset {
+		length = codeSize - offset
+	}
+	recorder.TouchCode(codeHash, offset, length)
+}
@@ -0,0 +1,64 @@
+package eth
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/eth/tracers"
+)
+
+// StartSession starts the interactive debugging of the transaction, paused at
+// its first instruction. The session is driven by the Step, Continue, Breakpoint
+// and Inspect calls, and released by StopSession.
+func (api *PrivateDebugAPI) StartSession(ctx context.Context, hash common.Hash) (*tracers.DebugSessionStart, error) {
+	tx, blockHash, _, index := rawdb.ReadTransaction(api.eth.ChainDb(), hash)
+	if tx == nil {
+		return nil, fmt.Errorf("transaction %#x not found", hash)
+	}
+	msg, vmctx, statedb, _, err := ComputeTxEnv(ctx, api.eth.blockchain, api.eth.blockchain.Config(), api.eth.blockchain, api.eth.ChainKV(), blockHash, index, api.eth.blockchain.DestsCache)
+	if err != nil {
+		return nil, err
+	}
+	return api.sessions.Start(func(tracer vm.Tracer) (*core.ExecutionResult, error) {
+		vmenv := vm.NewEVM(vmctx, statedb, api.eth.blockchain.Config(), vm.Config{Debug: true, Tracer: tracer}, nil)
+		return core.ApplyMessage(vmenv, msg, new(core.GasPool).AddGas(msg.Gas()))
+	})
+}
+
+// Step executes the paused instruction of the debugging session and pauses at
+// the next one.
+func (api *PrivateDebugAPI) Step(id string) (*tracers.DebugState, error) {
+	return api.sessions.Step(id)
+}
+
+// Continue resumes the execution of the debugging session till the next
+// breakpoint or the end of the transaction.
+func (api *PrivateDebugAPI) Continue(id string) (*tracers.DebugState, error) {
+	return api.sessions.Continue(id)
+}
+
+// Breakpoint adds the breakpoint on the pc, the opcode or the address to the
+// debugging session and returns the number of its breakpoints.
+func (api *PrivateDebugAPI) Breakpoint(id string, bp tracers.Breakpoint) (int, error) {
+	return api.sessions.Breakpoint(id, bp)
+}
+
+// ClearBreakpoints removes all breakpoints of the debugging session.
+func (api *PrivateDebugAPI) ClearBreakpoints(id string) error {
+	return api.sessions.ClearBreakpoints(id)
+}
+
+// Inspect returns the "stack", the "memory" or the "storage" of the paused
+// contract of the debugging session.
+func (api *PrivateDebugAPI) Inspect(id string, what string) (interface{}, error) {
+	return api.sessions.Inspect(id, what)
+}
+
+// StopSession aborts the execution of the debugging session and releases it.
+func (api *PrivateDebugAPI) StopSession(id string) error {
+	return api.sessions.Stop(id)
+}
@@ -208,18 +208,18 @@ func New(ctx *node.ServiceContext, config *Config) (*Ethereum, error) {
 		return nil, errors.New("mode is " + config.StorageMode.ToString() + " original mode is " + sm.ToString())
 	}
 
-	err = migrations.NewMigrator().Apply(
-		chainDb,
-		config.StorageMode.History,
-		config.StorageMode.Receipts,
-		config.StorageMode.TxIndex,
-		config.StorageMode.Preimages,
-	)
+	err = migrations.NewMigrator().Apply(chainDb, ctx.Config.DataDir)
 	if err != nil {
 		return nil, err
 	}
 
+	if config.TrieSnapshot != "" {
+		config.TrieSnapshot = ctx.ResolvePath(config.TrieSnapshot)
+	}
 	vmConfig, cacheConfig, dests := BlockchainRuntimeConfig(config)
+	if err = core.WarmDestsCache(chainDb, dests, destsCacheSize); err != nil {
+		return nil, err
+	}
 	txCacher := core.NewTxSenderCacher(runtime.NumCPU())
 	eth.blockchain, err = core.NewBlockChain(chainDb, cacheConfig, chainConfig, eth.engine, vmConfig, eth.shouldPreserve, dests, txCacher)
 	if err != nil {
@@ -260,6 +260,9 @@ func New(ctx *node.ServiceContext, config *Config) (*Ethereum, error) {
 		return nil, err
 	}
 	eth.protocolManager.SetDataDir(ctx.Config.DataDir)
+	if config.FirehoseSync {
+		eth.protocolManager.EnableFirehoseSync()
+	}
 
 	if config.SyncMode != downloader.StagedSync {
 		if err = eth.StartTxPool(); err != nil {
@@ -292,6 +295,9 @@ func New(ctx *node.ServiceContext, config *Config) (*Ethereum, error) {
 	return eth, nil
 }
 
+// destsCacheSize is the number of the code analyses kept in memory, and loaded from the database on start.
+const destsCacheSize = 50000
+
 func BlockchainRuntimeConfig(config *Config) (vm.Config, *core.CacheConfig, *vm.DestsCache) {
 	var (
 		vmConfig = vm.Config{
@@ -311,9 +317,10 @@ func BlockchainRuntimeConfig(config *Config) (vm.Config, *core.CacheConfig, *vm.
 			DownloadOnly:        config.DownloadOnly,
 			NoHistory:           !config.StorageMode.History,
 			ArchiveSyncInterval: uint64(config.ArchiveSyncInterval),
+			TrieSnapshotFile:    config.TrieSnapshot,
 		}
 	)
-	return vmConfig, cacheConfig, vm.NewDestsCache(50000)
+	return vmConfig, cacheConfig, vm.NewDestsCache(destsCacheSize)
 }
 
 func makeExtraData(extra []byte) []byte {
@@ -617,6 +624,10 @@ func (s *Ethereum) Protocols() []p2p.Protocol {
 		protos = append(protos, s.protocolManager.makeDebugProtocol())
 	}
 
+	if s.config.FirehoseSync {
+		protos = append(protos, s.protocolManager.makeFirehoseProtocol())
+	}
+
 	if s.lesServer != nil {
 		protos = append(protos, s.lesServer.Protocols()...)
 	}
@@ -698,6 +709,7 @@ func (s *Ethereum) Stop() error {
 	}
 	s.miner.Stop()
 	s.blockchain.Stop()
+	core.SaveDestsCache(s.chainDb, s.blockchain.DestsCache)
 	s.engine.Close()
 	s.chainDb.Close()
 	s.eventMux.Stop()
@@ -141,6 +141,7 @@ type Config struct {
 	TrieDirtyCache int
 	TrieTimeout    time.Duration
 	SnapshotCache  int
+	TrieSnapshot   string // File (relative to the data directory) to keep the resident state trie between restarts
 
 	// Mining options
 	Miner miner.Config
@@ -160,6 +161,9 @@ type Config struct {
 	// Enables the dbg protocol
 	EnableDebugProtocol bool
 
+	// Downloads the state via the Firehose protocol in the staged sync
+	FirehoseSync bool
+
 	// Miscellaneous options
 	DocRoot string `toml:"-"`
 
@@ -167,7 +167,8 @@ type Downloader struct {
 	bodiesState    *stagedsync.StageState
 	bodiesUnwinder stagedsync.Unwinder
 
-	stagedSync *stagedsync.State
+	stagedSync      *stagedsync.State
+	stateDownloader stagedsync.StateDownloader // Downloads the state at a pivot block during staged sync, if set
 }
 
 // LightChain encapsulates functions required to synchronise a light chain.
@@ -270,6 +271,12 @@ func New(checkpoint uint64, stateDB ethdb.Database, stateBloom *trie.SyncBloom,
 	return dl
 }
 
+// SetStateDownloader enables downloading of the state at a pivot block during staged sync,
+// instead of executing all the blocks from genesis
+func (d *Downloader) SetStateDownloader(sd stagedsync.StateDownloader) {
+	d.stateDownloader = sd
+}
+
 // DataDir sets the directory where download is allowed to create temporary files
 func (d *Downloader) SetDataDir(datadir string) {
 	d.datadir = datadir
@@ -578,6 +585,7 @@ func (d *Downloader) syncWithPeer(p *peerConnection, hash common.Hash, td *big.I
 			fetchers,
 			dests,
 			txPoolControl,
+			d.stateDownloader,
 			nil,
 		)
 		if err != nil {
@@ -1,11 +1,14 @@
 package eth
 
 import (
+	"bytes"
+	"fmt"
 	"math/big"
 
 	"github.com/ledgerwatch/turbo-geth/common"
 	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
 	"github.com/ledgerwatch/turbo-geth/p2p"
+	"github.com/ledgerwatch/turbo-geth/rlp"
 	"github.com/ledgerwatch/turbo-geth/trie"
 )
 
@@ -13,10 +16,10 @@ import (
 var FirehoseName = "frh" // Parity only supports 3 letter capabilities
 
 // FirehoseVersions are the supported versions of the Firehose protocol.
-var FirehoseVersions = []uint{1}
+var FirehoseVersions = []uint{2, 1}
 
 // FirehoseLengths are the number of implemented message corresponding to different protocol versions.
-var FirehoseLengths = []uint64{12}
+var FirehoseLengths = []uint64{14, 12}
 
 // FirehoseMaxMsgSize is the maximum cap on the size of a message.
 const FirehoseMaxMsgSize = 10 * 1024 * 1024
@@ -38,6 +41,10 @@ const (
 	BytecodeCode         = 0x09
 	GetStorageSizesCode  = 0x0a
 	StorageSizesCode     = 0x0b
+
+	// Protocol messages belonging to frh/2
+	GetPreimagesCode = 0x0c
+	PreimagesCode    = 0x0d
 )
 
 // Status of Firehose results.
@@ -65,6 +72,7 @@ type accountLeaf struct {
 type firehoseAccountRange struct {
 	Status Status
 	Leaves []accountLeaf
+	Proof  [][]byte // range proof of the leaves against the state root, see trie.VerifyRangeProof
 }
 
 type getStateRangesOrNodes struct {
@@ -98,6 +106,7 @@ type storageLeaf struct {
 type storageRange struct {
 	Status Status
 	Leaves []storageLeaf
+	Proof  [][]byte // range proof of the leaves against the storage root of the account
 }
 
 type storageRangesMsg struct {
@@ -133,8 +142,94 @@ type bytecodeMsg struct {
 	Code [][]byte
 }
 
+type getPreimagesMsg struct {
+	ID     uint64
+	Hashes []common.Hash // hashes of account addresses or storage keys
+}
+
+type preimagesMsg struct {
+	ID        uint64
+	Preimages [][]byte // empty for unknown hashes
+}
+
 // SendByteCode sends a BytecodeCode message.
 func (p *firehosePeer) SendByteCode(id uint64, data [][]byte) error {
 	msg := bytecodeMsg{ID: id, Code: data}
 	return p2p.Send(p.rw, BytecodeCode, msg)
 }
+
+// prefixRangeBounds returns the smallest and the largest hashes starting with the prefix
+func prefixRangeBounds(prefix trie.Keybytes) ([]byte, []byte) {
+	first := make([]byte, common.HashLength)
+	last := bytes.Repeat([]byte{0xff}, common.HashLength)
+	copy(first, prefix.Data)
+	copy(last, prefix.Data)
+	if prefix.Odd && len(prefix.Data) > 0 {
+		last[len(prefix.Data)-1] |= 0x0f
+	}
+	return first, last
+}
+
+// proveAccountRange attaches the range proof for the prefix to the account range.
+// The nodes on the boundary paths of the prefix need to be loaded into the state trie
+func proveAccountRange(t *trie.Trie, prefix trie.Keybytes, r *firehoseAccountRange) error {
+	first, last := prefixRangeBounds(prefix)
+	proof, err := t.ProveRange(first, last, 0, false /* storage */)
+	if err != nil {
+		return err
+	}
+	r.Proof = proof
+	return nil
+}
+
+// verify checks that the leaves are all the accounts starting with the prefix in the state with given root
+func (r *firehoseAccountRange) verify(root common.Hash, prefix trie.Keybytes) error {
+	if r.Status != OK {
+		return nil
+	}
+	keys := make([][]byte, len(r.Leaves))
+	values := make([][]byte, len(r.Leaves))
+	for i, leaf := range r.Leaves {
+		if leaf.Val == nil {
+			return fmt.Errorf("empty account leaf %x", leaf.Key)
+		}
+		keys[i] = common.CopyBytes(leaf.Key[:])
+		values[i] = make([]byte, leaf.Val.EncodingLengthForHashing())
+		leaf.Val.EncodeForHashing(values[i])
+	}
+	first, last := prefixRangeBounds(prefix)
+	_, err := trie.VerifyRangeProof(root, first, last, keys, values, r.Proof)
+	return err
+}
+
+// proveStorageRange attaches the range proof for the prefix to the storage range of the account.
+// The nodes on the boundary paths of the prefix need to be loaded into the storage of the account in the state trie
+func proveStorageRange(t *trie.Trie, addrHash common.Hash, prefix trie.Keybytes, r *storageRange) error {
+	first, last := prefixRangeBounds(prefix)
+	proof, err := t.ProveRange(append(addrHash.Bytes(), first...), append(addrHash.Bytes(), last...), 2*common.HashLength, true /* storage */)
+	if err != nil {
+		return err
+	}
+	r.Proof = proof
+	return nil
+}
+
+// verify checks that the leaves are all the storage items starting with the prefix in the storage with given root
+func (r *storageRange) verify(storageRoot common.Hash, prefix trie.Keybytes) error {
+	if r.Status != OK {
+		return nil
+	}
+	keys := make([][]byte, len(r.Leaves))
+	values := make([][]byte, len(r.Leaves))
+	for i, leaf := range r.Leaves {
+		keys[i] = common.CopyBytes(leaf.Key[:])
+		enc, err := rlp.EncodeToBytes(leaf.Val.Bytes())
+		if err != nil {
+			return err
+		}
+		values[i] = enc
+	}
+	first, last := prefixRangeBounds(prefix)
+	_, err := trie.VerifyRangeProof(storageRoot, first, last, keys, values, r.Proof)
+	return err
+}
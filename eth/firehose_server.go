@@ -0,0 +1,376 @@
+package eth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+// servedState returns the header of the block whose state is served to the Firehose peers: the current state,
+// once both the hashed state and the intermediate hashes are computed for it. Returns nil while the staged sync
+// is in the middle of updating the state
+func (fs *firehoseSync) servedState() (*types.Header, error) {
+	hashProgress, _, err := stages.GetStageProgress(fs.chaindb, stages.HashState)
+	if err != nil {
+		return nil, err
+	}
+	ihProgress, _, err := stages.GetStageProgress(fs.chaindb, stages.IntermediateHashes)
+	if err != nil {
+		return nil, err
+	}
+	if hashProgress != ihProgress {
+		return nil, nil
+	}
+	hash := rawdb.ReadCanonicalHash(fs.chaindb, ihProgress)
+	if hash == (common.Hash{}) {
+		return nil, nil
+	}
+	return rawdb.ReadHeader(fs.chaindb, hash, ihProgress), nil
+}
+
+// availableBlocks lists the blocks whose state can be requested instead of an unavailable one
+func availableBlocks(served *types.Header) []common.Hash {
+	if served == nil {
+		return nil
+	}
+	return []common.Hash{served.Hash()}
+}
+
+// loadStateTrie loads the parts of the current state trie retained by the list, checking them against the root
+func (fs *firehoseSync) loadStateTrie(root common.Hash, rl *trie.RetainList) (*trie.Trie, error) {
+	loader := trie.NewFlatDbSubTrieLoader()
+	if err := loader.Reset(fs.chaindb, rl, rl, nil /* hashCollector */, [][]byte{nil}, []int{0}, false); err != nil {
+		return nil, err
+	}
+	subTries, err := loader.LoadSubTries()
+	if err != nil {
+		return nil, err
+	}
+	tr := trie.New(root)
+	if err = tr.HookSubTries(subTries, [][]byte{nil}); err != nil {
+		return nil, fmt.Errorf("loading state trie: %w", err)
+	}
+	return tr, nil
+}
+
+// firehoseAccountHash accepts either the raw address or its hash
+func firehoseAccountHash(account []byte) (common.Hash, error) {
+	switch len(account) {
+	case common.AddressLength:
+		return crypto.Keccak256Hash(account), nil
+	case common.HashLength:
+		return common.BytesToHash(account), nil
+	default:
+		return common.Hash{}, errResp(ErrDecode, "invalid account %x", account)
+	}
+}
+
+// storagePrefix returns the prefix of the storage keys of the current incarnation of the account in the hashed state,
+// nil if there is no such account
+func (fs *firehoseSync) storagePrefix(addrHash common.Hash) ([]byte, error) {
+	enc, err := fs.chaindb.Get(dbutils.CurrentStateBucket, addrHash[:])
+	if err != nil && !errors.Is(err, ethdb.ErrKeyNotFound) {
+		return nil, err
+	}
+	if len(enc) == 0 {
+		return nil, nil
+	}
+	var acc accounts.Account
+	if err = acc.DecodeForStorage(enc); err != nil {
+		return nil, err
+	}
+	return dbutils.GenerateStoragePrefix(addrHash[:], acc.Incarnation), nil
+}
+
+func checkFirehosePrefixes(prefixes []trie.Keybytes) error {
+	if len(prefixes) > firehoseMaxPrefixes {
+		return errResp(ErrMsgTooLarge, "%d prefixes > %d", len(prefixes), firehoseMaxPrefixes)
+	}
+	for _, prefix := range prefixes {
+		if len(prefix.Data) > common.HashLength || (prefix.Odd && len(prefix.Data) == 0) {
+			return errResp(ErrDecode, "invalid prefix %x", prefix.Data)
+		}
+	}
+	return nil
+}
+
+// accountKeys returns the hashes of the accounts between first and last (both inclusive), skipping their storage.
+// At most MaxLeavesPerPrefix+1 hashes are returned, which is enough to tell that there are too many of them
+func accountKeys(tx ethdb.Tx, first, last []byte) ([][]byte, error) {
+	var keys [][]byte
+	c := tx.Bucket(dbutils.CurrentStateBucket).Cursor()
+	seek := first
+	for len(keys) <= MaxLeavesPerPrefix {
+		k, _, err := c.Seek(seek)
+		if err != nil {
+			return nil, err
+		}
+		if k == nil || bytes.Compare(k[:common.HashLength], last) > 0 {
+			break
+		}
+		if len(k) == common.HashLength {
+			keys = append(keys, common.CopyBytes(k))
+		}
+		next, ok := dbutils.NextSubtree(k[:common.HashLength])
+		if !ok {
+			break
+		}
+		seek = next
+	}
+	return keys, nil
+}
+
+// stateRanges answers GetStateRanges request with the accounts of the current state, proven against its root
+func (fs *firehoseSync) stateRanges(req *getStateRangesOrNodes) (*stateRangesMsg, error) {
+	if err := checkFirehosePrefixes(req.Prefixes); err != nil {
+		return nil, err
+	}
+	res := &stateRangesMsg{ID: req.ID, Entries: make([]firehoseAccountRange, len(req.Prefixes))}
+	served, err := fs.servedState()
+	if err != nil {
+		return nil, err
+	}
+	if served == nil || served.Hash() != req.Block {
+		for i := range res.Entries {
+			res.Entries[i].Status = NoData
+		}
+		res.AvailableBlocks = availableBlocks(served)
+		return res, nil
+	}
+
+	keys := make([][][]byte, len(req.Prefixes))
+	rl := trie.NewRetainList(0)
+	if err = fs.chaindb.(ethdb.HasKV).KV().View(context.Background(), func(tx ethdb.Tx) error {
+		for i, prefix := range req.Prefixes {
+			first, last := prefixRangeBounds(prefix)
+			if keys[i], err = accountKeys(tx, first, last); err != nil {
+				return err
+			}
+			if len(keys[i]) > MaxLeavesPerPrefix {
+				res.Entries[i].Status = TooManyLeaves
+				continue
+			}
+			rl.AddKey(first)
+			rl.AddKey(last)
+			for _, k := range keys[i] {
+				rl.AddKey(k)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	tr, err := fs.loadStateTrie(served.Root, rl)
+	if err != nil {
+		return nil, err
+	}
+	for i, prefix := range req.Prefixes {
+		if res.Entries[i].Status != OK {
+			continue
+		}
+		for _, k := range keys[i] {
+			// The storage roots are only known to the trie
+			acc, ok := tr.GetAccount(k)
+			if !ok || acc == nil {
+				return nil, fmt.Errorf("account %x is not found in the state trie", k)
+			}
+			res.Entries[i].Leaves = append(res.Entries[i].Leaves, accountLeaf{Key: common.BytesToHash(k), Val: acc})
+		}
+		if err = proveAccountRange(tr, prefix, &res.Entries[i]); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// storageRanges answers GetStorageRanges request with the storage of the current incarnations of the contracts,
+// proven against their storage roots
+func (fs *firehoseSync) storageRanges(req *getStorageRangesOrNodes) (*storageRangesMsg, error) {
+	if len(req.Requests) > firehoseMaxStorageAccounts {
+		return nil, errResp(ErrMsgTooLarge, "%d accounts > %d", len(req.Requests), firehoseMaxStorageAccounts)
+	}
+	res := &storageRangesMsg{ID: req.ID, Entries: make([][]storageRange, len(req.Requests))}
+	addrHashes := make([]common.Hash, len(req.Requests))
+	for i, r := range req.Requests {
+		if err := checkFirehosePrefixes(r.Prefixes); err != nil {
+			return nil, err
+		}
+		var err error
+		if addrHashes[i], err = firehoseAccountHash(r.Account); err != nil {
+			return nil, err
+		}
+		res.Entries[i] = make([]storageRange, len(r.Prefixes))
+	}
+	served, err := fs.servedState()
+	if err != nil {
+		return nil, err
+	}
+	if served == nil || served.Hash() != req.Block {
+		for i := range res.Entries {
+			for j := range res.Entries[i] {
+				res.Entries[i][j].Status = NoData
+			}
+		}
+		res.AvailableBlocks = availableBlocks(served)
+		return res, nil
+	}
+
+	rl := trie.NewRetainList(0)
+	for i, r := range req.Requests {
+		storagePrefix, err := fs.storagePrefix(addrHashes[i])
+		if err != nil {
+			return nil, err
+		}
+		if storagePrefix == nil {
+			// No account, no storage
+			continue
+		}
+		for j, prefix := range r.Prefixes {
+			first, last := prefixRangeBounds(prefix)
+			fixedbits := 8 * (len(storagePrefix) + len(prefix.Data))
+			if prefix.Odd {
+				fixedbits -= 4
+			}
+			entry := &res.Entries[i][j]
+			if err = fs.chaindb.Walk(dbutils.CurrentStateBucket, append(common.CopyBytes(storagePrefix), first...), fixedbits, func(k, v []byte) (bool, error) {
+				if len(entry.Leaves) == MaxLeavesPerPrefix {
+					entry.Status = TooManyLeaves
+					entry.Leaves = nil
+					return false, nil
+				}
+				leaf := storageLeaf{Key: common.BytesToHash(k[len(storagePrefix):])}
+				leaf.Val.SetBytes(v)
+				entry.Leaves = append(entry.Leaves, leaf)
+				return true, nil
+			}); err != nil {
+				return nil, err
+			}
+			if entry.Status == OK {
+				rl.AddKey(append(common.CopyBytes(storagePrefix), first...))
+				rl.AddKey(append(common.CopyBytes(storagePrefix), last...))
+			}
+		}
+	}
+	tr, err := fs.loadStateTrie(served.Root, rl)
+	if err != nil {
+		return nil, err
+	}
+	for i, r := range req.Requests {
+		for j, prefix := range r.Prefixes {
+			if res.Entries[i][j].Status != OK {
+				continue
+			}
+			if err = proveStorageRange(tr, addrHashes[i], prefix, &res.Entries[i][j]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return res, nil
+}
+
+// stateNodes answers GetStateNodes request with the nodes of the current state trie. There is no node for a prefix
+// ending in the middle of an extension or a leaf key, an empty one is returned then
+func (fs *firehoseSync) stateNodes(req *getStateRangesOrNodes) (*stateNodesMsg, error) {
+	if err := checkFirehosePrefixes(req.Prefixes); err != nil {
+		return nil, err
+	}
+	served, err := fs.servedState()
+	if err != nil {
+		return nil, err
+	}
+	if served == nil || served.Hash() != req.Block {
+		return &stateNodesMsg{ID: req.ID, AvailableBlocks: availableBlocks(served)}, nil
+	}
+
+	rl := trie.NewRetainList(0)
+	for _, prefix := range req.Prefixes {
+		rl.AddHex(prefix.ToHex())
+	}
+	tr, err := fs.loadStateTrie(served.Root, rl)
+	if err != nil {
+		return nil, err
+	}
+	res := &stateNodesMsg{ID: req.ID, Nodes: make([][]byte, len(req.Prefixes))}
+	for i, prefix := range req.Prefixes {
+		if prefix.Nibbles() >= firehoseMaxPrefixNibbles {
+			// The path would go on into the storage
+			continue
+		}
+		if res.Nodes[i], err = tr.GetNodeByPath(prefix.ToHex()); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// storageNodes answers GetStorageNodes request with the nodes of the storage tries of the current state
+func (fs *firehoseSync) storageNodes(req *getStorageRangesOrNodes) (*storageNodesMsg, error) {
+	if len(req.Requests) > firehoseMaxStorageAccounts {
+		return nil, errResp(ErrMsgTooLarge, "%d accounts > %d", len(req.Requests), firehoseMaxStorageAccounts)
+	}
+	for _, r := range req.Requests {
+		if err := checkFirehosePrefixes(r.Prefixes); err != nil {
+			return nil, err
+		}
+	}
+	served, err := fs.servedState()
+	if err != nil {
+		return nil, err
+	}
+	if served == nil || served.Hash() != req.Block {
+		return &storageNodesMsg{ID: req.ID, AvailableBlocks: availableBlocks(served)}, nil
+	}
+
+	// The paths in the trie go from the account right into its storage, while the keys
+	// in the retain list have the incarnation in the middle, as the keys of the hashed state
+	paths := make([][][]byte, len(req.Requests))
+	rl := trie.NewRetainList(0)
+	for i, r := range req.Requests {
+		addrHash, err := firehoseAccountHash(r.Account)
+		if err != nil {
+			return nil, err
+		}
+		storagePrefix, err := fs.storagePrefix(addrHash)
+		if err != nil {
+			return nil, err
+		}
+		paths[i] = make([][]byte, len(r.Prefixes))
+		if storagePrefix == nil {
+			continue
+		}
+		accountPath := (&trie.Keybytes{Data: addrHash[:]}).ToHex()
+		retainPath := (&trie.Keybytes{Data: storagePrefix}).ToHex()
+		for j, prefix := range r.Prefixes {
+			paths[i][j] = append(common.CopyBytes(accountPath), prefix.ToHex()...)
+			rl.AddHex(append(common.CopyBytes(retainPath), prefix.ToHex()...))
+		}
+	}
+	tr, err := fs.loadStateTrie(served.Root, rl)
+	if err != nil {
+		return nil, err
+	}
+	res := &storageNodesMsg{ID: req.ID, Nodes: make([][][]byte, len(req.Requests))}
+	for i := range paths {
+		res.Nodes[i] = make([][]byte, len(paths[i]))
+		for j, path := range paths[i] {
+			if path == nil {
+				continue
+			}
+			if res.Nodes[i][j], err = tr.GetNodeByPath(path); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return res, nil
+}
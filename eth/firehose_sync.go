@@ -0,0 +1,925 @@
+package eth
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+	"github.com/ledgerwatch/turbo-geth/p2p"
+	"github.com/ledgerwatch/turbo-geth/p2p/enode"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+const (
+	firehoseRequestTimeout     = 30 * time.Second // Time allowed for a peer to respond to a request
+	firehosePeerWaitTimeout    = 30 * time.Second // Time to wait for a Firehose peer to connect
+	firehoseMaxPrefixes        = 64               // Maximum number of prefixes in a single request
+	firehoseMaxStorageAccounts = 16               // Maximum number of contracts in a single storage request
+	firehoseMaxBytecodes       = 64               // Maximum number of bytecodes in a single request
+	firehoseMaxPreimages       = 1024             // Maximum number of preimages in a single request
+	firehoseMaxPrefixNibbles   = 2 * common.HashLength
+)
+
+var (
+	errFirehoseTimeout  = errors.New("firehose request timed out")
+	errFirehoseCanceled = errors.New("firehose state download canceled")
+)
+
+// firehoseRequest is a request sent to a peer, waiting for the response with the same ID
+type firehoseRequest struct {
+	peer *firehosePeer
+	code uint64 // expected response message code
+	ch   chan interface{}
+}
+
+// firehoseSync runs the Firehose protocol with the remote peers: it serves the bytecode and the preimages
+// from the local database and downloads the state for the staged sync, see stagedsync.StateDownloader
+type firehoseSync struct {
+	chaindb ethdb.Database
+
+	lock    sync.Mutex
+	peers   map[string]*firehosePeer
+	pending map[uint64]*firehoseRequest
+	nextID  uint64
+	newPeer chan struct{} // closed and replaced whenever a peer registers
+}
+
+func newFirehoseSync(chaindb ethdb.Database) *firehoseSync {
+	return &firehoseSync{
+		chaindb: chaindb,
+		peers:   make(map[string]*firehosePeer),
+		pending: make(map[uint64]*firehoseRequest),
+		newPeer: make(chan struct{}),
+	}
+}
+
+func firehosePeerID(id enode.ID) string {
+	return fmt.Sprintf("%x", id[:8])
+}
+
+// EnableFirehoseSync makes the staged sync download the state from the peers talking Firehose protocol
+// instead of executing all blocks from genesis
+func (pm *ProtocolManager) EnableFirehoseSync() {
+	pm.firehose = newFirehoseSync(pm.chaindb)
+	pm.downloader.SetStateDownloader(pm.firehose)
+}
+
+func (pm *ProtocolManager) makeFirehoseProtocol() p2p.Protocol {
+	log.Info("Initialising Firehose protocol", "versions", FirehoseVersions)
+	return p2p.Protocol{
+		Name:    FirehoseName,
+		Version: FirehoseVersions[0],
+		Length:  FirehoseLengths[0],
+		Run: func(p *p2p.Peer, rw p2p.MsgReadWriter) error {
+			peer := &firehosePeer{Peer: p, rw: rw}
+			select {
+			case <-pm.quitSync:
+				return p2p.DiscQuitting
+			default:
+				pm.wg.Add(1)
+				defer pm.wg.Done()
+				return pm.firehose.handle(peer)
+			}
+		},
+		NodeInfo: func() interface{} {
+			return pm.NodeInfo()
+		},
+		PeerInfo: func(id enode.ID) interface{} {
+			if info := pm.firehose.peerInfo(id); info != nil {
+				return info
+			}
+			return nil
+		},
+	}
+}
+
+// firehosePeerInfo represents a short summary of a connected Firehose peer
+type firehosePeerInfo struct {
+	Version uint `json:"version"` // Firehose protocol version
+}
+
+// peerInfo returns the summary of the Firehose peer, nil if it isn't connected over Firehose
+func (fs *firehoseSync) peerInfo(id enode.ID) *firehosePeerInfo {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if _, ok := fs.peers[firehosePeerID(id)]; !ok {
+		return nil
+	}
+	return &firehosePeerInfo{Version: FirehoseVersions[0]}
+}
+
+// handle is invoked for each connected Firehose peer; the connection is torn down upon returning any error
+func (fs *firehoseSync) handle(p *firehosePeer) error {
+	id := firehosePeerID(p.ID())
+	fs.lock.Lock()
+	fs.peers[id] = p
+	close(fs.newPeer)
+	fs.newPeer = make(chan struct{})
+	fs.lock.Unlock()
+	defer fs.unregister(id)
+
+	for {
+		if err := fs.handleMsg(p); err != nil {
+			p.Log().Debug("Firehose message handling failed", "err", err)
+			return err
+		}
+	}
+}
+
+func (fs *firehoseSync) unregister(id string) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	delete(fs.peers, id)
+}
+
+func (fs *firehoseSync) handleMsg(p *firehosePeer) error {
+	msg, err := p.rw.ReadMsg()
+	if err != nil {
+		return fmt.Errorf("handleFirehoseMsg p.rw.ReadMsg: %w", err)
+	}
+	if msg.Size > FirehoseMaxMsgSize {
+		return errResp(ErrMsgTooLarge, "%v > %v", msg.Size, FirehoseMaxMsgSize)
+	}
+	defer msg.Discard()
+
+	switch msg.Code {
+	case GetStateRangesCode:
+		var req getStateRangesOrNodes
+		if err := msg.Decode(&req); err != nil {
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		res, err := fs.stateRanges(&req)
+		if err != nil {
+			return err
+		}
+		return p2p.Send(p.rw, StateRangesCode, res)
+
+	case GetStorageRangesCode:
+		var req getStorageRangesOrNodes
+		if err := msg.Decode(&req); err != nil {
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		res, err := fs.storageRanges(&req)
+		if err != nil {
+			return err
+		}
+		return p2p.Send(p.rw, StorageRangesCode, res)
+
+	case GetStateNodesCode:
+		var req getStateRangesOrNodes
+		if err := msg.Decode(&req); err != nil {
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		res, err := fs.stateNodes(&req)
+		if err != nil {
+			return err
+		}
+		return p2p.Send(p.rw, StateNodesCode, res)
+
+	case GetStorageNodesCode:
+		var req getStorageRangesOrNodes
+		if err := msg.Decode(&req); err != nil {
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		res, err := fs.storageNodes(&req)
+		if err != nil {
+			return err
+		}
+		return p2p.Send(p.rw, StorageNodesCode, res)
+
+	case GetBytecodeCode:
+		var req getBytecodeMsg
+		if err := msg.Decode(&req); err != nil {
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		code := make([][]byte, len(req.Ref))
+		for i, ref := range req.Ref {
+			if c, err := fs.chaindb.Get(dbutils.CodeBucket, ref.CodeHash[:]); err == nil {
+				code[i] = c
+			}
+		}
+		return p.SendByteCode(req.ID, code)
+
+	case GetPreimagesCode:
+		var req getPreimagesMsg
+		if err := msg.Decode(&req); err != nil {
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		preimages := make([][]byte, len(req.Hashes))
+		for i, hash := range req.Hashes {
+			if preimage, err := fs.chaindb.Get(dbutils.PreimagePrefix, hash[:]); err == nil {
+				preimages[i] = preimage
+			}
+		}
+		return p2p.Send(p.rw, PreimagesCode, preimagesMsg{ID: req.ID, Preimages: preimages})
+
+	case StateRangesCode:
+		var res stateRangesMsg
+		if err := msg.Decode(&res); err != nil {
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		fs.deliver(p, msg.Code, res.ID, &res)
+
+	case StorageRangesCode:
+		var res storageRangesMsg
+		if err := msg.Decode(&res); err != nil {
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		fs.deliver(p, msg.Code, res.ID, &res)
+
+	case BytecodeCode:
+		var res bytecodeMsg
+		if err := msg.Decode(&res); err != nil {
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		fs.deliver(p, msg.Code, res.ID, &res)
+
+	case PreimagesCode:
+		var res preimagesMsg
+		if err := msg.Decode(&res); err != nil {
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		fs.deliver(p, msg.Code, res.ID, &res)
+
+	default:
+		// Node and storage size responses are never requested
+		return errResp(ErrInvalidMsgCode, "%v", msg.Code)
+	}
+	return nil
+}
+
+// deliver hands the response over to the pending request, unsolicited responses are dropped
+func (fs *firehoseSync) deliver(p *firehosePeer, code uint64, id uint64, res interface{}) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	req, ok := fs.pending[id]
+	if !ok || req.peer != p || req.code != code {
+		p.Log().Debug("Unexpected Firehose response", "code", code, "id", id)
+		return
+	}
+	delete(fs.pending, id)
+	req.ch <- res
+}
+
+// request sends the request to the peer and waits for the response
+func (fs *firehoseSync) request(p *firehosePeer, code uint64, resCode uint64, makeReq func(id uint64) interface{}, quit <-chan struct{}) (interface{}, error) {
+	ch := make(chan interface{}, 1)
+	fs.lock.Lock()
+	fs.nextID++
+	id := fs.nextID
+	fs.pending[id] = &firehoseRequest{peer: p, code: resCode, ch: ch}
+	fs.lock.Unlock()
+	defer func() {
+		fs.lock.Lock()
+		delete(fs.pending, id)
+		fs.lock.Unlock()
+	}()
+
+	if err := p2p.Send(p.rw, code, makeReq(id)); err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(firehoseRequestTimeout)
+	defer timer.Stop()
+	select {
+	case res := <-ch:
+		return res, nil
+	case <-timer.C:
+		return nil, errFirehoseTimeout
+	case <-quit:
+		return nil, errFirehoseCanceled
+	}
+}
+
+// peer picks a random connected peer, waiting for one to connect if necessary
+func (fs *firehoseSync) peer(quit <-chan struct{}) (*firehosePeer, error) {
+	timer := time.NewTimer(firehosePeerWaitTimeout)
+	defer timer.Stop()
+	for {
+		fs.lock.Lock()
+		ids := make([]string, 0, len(fs.peers))
+		for id := range fs.peers {
+			ids = append(ids, id)
+		}
+		newPeer := fs.newPeer
+		var p *firehosePeer
+		if len(ids) > 0 {
+			p = fs.peers[ids[rand.Intn(len(ids))]]
+		}
+		fs.lock.Unlock()
+		if p != nil {
+			return p, nil
+		}
+		select {
+		case <-newPeer:
+		case <-timer.C:
+			return nil, stagedsync.ErrNoStateDownloadPeers
+		case <-quit:
+			return nil, errFirehoseCanceled
+		}
+	}
+}
+
+// dropPeer disconnects the peer which failed to serve a request
+func (fs *firehoseSync) dropPeer(p *firehosePeer, err error) {
+	p.Log().Debug("Dropping Firehose peer", "err", err)
+	fs.unregister(firehosePeerID(p.ID()))
+	p.Disconnect(p2p.DiscUselessPeer)
+}
+
+// DownloadState implements stagedsync.StateDownloader
+func (fs *firehoseSync) DownloadState(db ethdb.Database, pivot *types.Header, quit <-chan struct{}) (*types.Header, error) {
+	d := &firehoseStateDownload{
+		fs:        fs,
+		db:        db,
+		pivot:     pivot,
+		quit:      quit,
+		contracts: make(map[common.Hash]*firehoseContract),
+	}
+	for {
+		moved, err := d.downloadAccounts()
+		if err != nil {
+			return nil, err
+		}
+		if moved {
+			// Healing: the account ranges are downloaded again at the new pivot,
+			// only the storage of contracts with changed storage root is downloaded again
+			continue
+		}
+		if moved, err = d.downloadStorage(); err != nil {
+			return nil, err
+		}
+		if !moved {
+			break
+		}
+	}
+	if err := d.downloadBytecode(); err != nil {
+		return nil, err
+	}
+	return d.pivot, nil
+}
+
+// firehoseContract is a downloaded account with non-empty storage or code
+type firehoseContract struct {
+	address     common.Address
+	root        common.Hash
+	codeHash    common.Hash
+	storageDone bool // storage is downloaded completely for the root
+}
+
+// firehoseStateDownload is a single state download for the staged sync
+type firehoseStateDownload struct {
+	fs        *firehoseSync
+	db        ethdb.Database
+	pivot     *types.Header
+	quit      <-chan struct{}
+	contracts map[common.Hash]*firehoseContract
+}
+
+// splitPrefix returns the 16 prefixes one nibble longer than the given one
+func splitPrefix(prefix trie.Keybytes) ([]trie.Keybytes, error) {
+	nibbles := 2 * len(prefix.Data)
+	if prefix.Odd {
+		nibbles--
+	}
+	if nibbles >= firehoseMaxPrefixNibbles {
+		return nil, fmt.Errorf("can not split full-length prefix %x", prefix.Data)
+	}
+	prefixes := make([]trie.Keybytes, 16)
+	for i := range prefixes {
+		if prefix.Odd {
+			data := common.CopyBytes(prefix.Data)
+			data[len(data)-1] |= byte(i)
+			prefixes[i] = trie.Keybytes{Data: data}
+		} else {
+			prefixes[i] = trie.Keybytes{Data: append(common.CopyBytes(prefix.Data), byte(i)<<4), Odd: true}
+		}
+	}
+	return prefixes, nil
+}
+
+// movePivot moves the pivot forward to the newest canonical block among the ones available at the peer.
+// It returns false if none of the blocks is newer than the current pivot
+func (d *firehoseStateDownload) movePivot(available []common.Hash) bool {
+	var newPivot *types.Header
+	for _, hash := range available {
+		number := rawdb.ReadHeaderNumber(d.db, hash)
+		if number == nil || *number <= d.pivot.Number.Uint64() || rawdb.ReadCanonicalHash(d.db, *number) != hash {
+			continue
+		}
+		if newPivot != nil && newPivot.Number.Uint64() >= *number {
+			continue
+		}
+		newPivot = rawdb.ReadHeader(d.db, hash, *number)
+	}
+	if newPivot == nil {
+		return false
+	}
+	log.Info("Moving Firehose pivot forward", "from", d.pivot.Number, "to", newPivot.Number, "root", newPivot.Root)
+	d.pivot = newPivot
+	return true
+}
+
+// downloadAccounts downloads all the accounts at the pivot. It returns true if the pivot has moved during the download
+func (d *firehoseStateDownload) downloadAccounts() (bool, error) {
+	tasks, _ := splitPrefix(trie.Keybytes{})
+	var done int
+	for len(tasks) > 0 {
+		batch := tasks
+		if len(batch) > firehoseMaxPrefixes {
+			batch = batch[:firehoseMaxPrefixes]
+		}
+		p, err := d.fs.peer(d.quit)
+		if err != nil {
+			return false, err
+		}
+		block := d.pivot.Hash()
+		res, err := d.fs.request(p, GetStateRangesCode, StateRangesCode, func(id uint64) interface{} {
+			return getStateRangesOrNodes{ID: id, Block: block, Prefixes: batch}
+		}, d.quit)
+		if errors.Is(err, errFirehoseCanceled) {
+			return false, err
+		}
+		if err != nil {
+			d.fs.dropPeer(p, err)
+			continue
+		}
+		msg := res.(*stateRangesMsg)
+		if len(msg.Entries) != len(batch) {
+			d.fs.dropPeer(p, fmt.Errorf("%d account ranges for %d prefixes", len(msg.Entries), len(batch)))
+			continue
+		}
+		var noData bool
+		for i := range msg.Entries {
+			if msg.Entries[i].Status == NoData {
+				noData = true
+			}
+			if err = msg.Entries[i].verify(d.pivot.Root, batch[i]); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			d.fs.dropPeer(p, fmt.Errorf("invalid account range: %w", err))
+			continue
+		}
+		if noData {
+			if d.movePivot(msg.AvailableBlocks) {
+				return true, nil
+			}
+			d.fs.dropPeer(p, fmt.Errorf("no state for the pivot %d", d.pivot.Number))
+			continue
+		}
+		var next []trie.Keybytes
+		for i := range msg.Entries {
+			switch msg.Entries[i].Status {
+			case OK:
+				if err = d.writeAccounts(p, batch[i], msg.Entries[i].Leaves); err != nil {
+					return false, err
+				}
+				done++
+			case TooManyLeaves:
+				prefixes, err := splitPrefix(batch[i])
+				if err != nil {
+					return false, err
+				}
+				next = append(next, prefixes...)
+			default:
+				return false, fmt.Errorf("unknown status %d of account range", msg.Entries[i].Status)
+			}
+		}
+		tasks = append(tasks[len(batch):], next...)
+		log.Info("Firehose accounts", "ranges", done, "pending", len(tasks), "contracts", len(d.contracts))
+	}
+	return false, nil
+}
+
+// writeAccounts replaces all the accounts under the prefix with the downloaded ones
+func (d *firehoseStateDownload) writeAccounts(p *firehosePeer, prefix trie.Keybytes, leaves []accountLeaf) error {
+	hashes := make([]common.Hash, len(leaves))
+	for i, leaf := range leaves {
+		hashes[i] = leaf.Key
+	}
+	preimages, err := d.preimages(p, hashes)
+	if err != nil {
+		return err
+	}
+	batch := d.db.NewBatch()
+	defer batch.Rollback()
+
+	// Accounts left from the previous pivot
+	downloaded := make(map[common.Hash]struct{}, len(leaves))
+	for _, leaf := range leaves {
+		downloaded[leaf.Key] = struct{}{}
+	}
+	first, _ := prefixRangeBounds(prefix)
+	fixedbits := 8 * len(prefix.Data)
+	if prefix.Odd {
+		fixedbits -= 4
+	}
+	var stale []common.Hash
+	if err = d.db.Walk(dbutils.CurrentStateBucket, first, fixedbits, func(k, v []byte) (bool, error) {
+		if len(k) != common.HashLength {
+			return true, nil
+		}
+		if _, ok := downloaded[common.BytesToHash(k)]; !ok {
+			stale = append(stale, common.BytesToHash(k))
+		}
+		return true, nil
+	}); err != nil {
+		return err
+	}
+	for _, addrHash := range stale {
+		if err = d.deleteAccount(batch, addrHash); err != nil {
+			return err
+		}
+	}
+
+	for _, leaf := range leaves {
+		address := common.BytesToAddress(preimages[leaf.Key])
+		acc := leaf.Val.SelfCopy()
+		if !acc.IsEmptyRoot() || !acc.IsEmptyCodeHash() {
+			acc.Incarnation = state.FirstContractIncarnation
+		}
+		c, known := d.contracts[leaf.Key]
+		if known && c.root != acc.Root {
+			// Storage of the contract has changed since the previous pivot
+			if err = d.deleteStorage(batch, leaf.Key, c.address); err != nil {
+				return err
+			}
+			c.root = acc.Root
+			c.storageDone = false
+		}
+		if acc.Incarnation > 0 {
+			if !known {
+				d.contracts[leaf.Key] = &firehoseContract{address: address, root: acc.Root, codeHash: acc.CodeHash, storageDone: acc.IsEmptyRoot()}
+			} else {
+				c.codeHash = acc.CodeHash
+			}
+			if err = batch.Put(dbutils.ContractCodeBucket, dbutils.GenerateStoragePrefix(leaf.Key[:], acc.Incarnation), acc.CodeHash[:]); err != nil {
+				return err
+			}
+			if err = batch.Put(dbutils.PlainContractCodeBucket, dbutils.PlainGenerateStoragePrefix(address[:], acc.Incarnation), acc.CodeHash[:]); err != nil {
+				return err
+			}
+		} else if known {
+			delete(d.contracts, leaf.Key)
+		}
+		value := make([]byte, acc.EncodingLengthForStorage())
+		acc.EncodeForStorage(value)
+		if err = batch.Put(dbutils.CurrentStateBucket, leaf.Key[:], value); err != nil {
+			return err
+		}
+		if err = batch.Put(dbutils.PlainStateBucket, address[:], value); err != nil {
+			return err
+		}
+	}
+	_, err = batch.Commit()
+	return err
+}
+
+// deleteAccount removes the account left from the previous pivot together with its storage
+func (d *firehoseStateDownload) deleteAccount(batch ethdb.DbWithPendingMutations, addrHash common.Hash) error {
+	preimage, err := d.db.Get(dbutils.PreimagePrefix, addrHash[:])
+	if err != nil {
+		return fmt.Errorf("preimage of the account %x: %w", addrHash, err)
+	}
+	address := common.BytesToAddress(preimage)
+	if err = d.deleteStorage(batch, addrHash, address); err != nil {
+		return err
+	}
+	delete(d.contracts, addrHash)
+	if err = batch.Delete(dbutils.CurrentStateBucket, addrHash[:]); err != nil {
+		return err
+	}
+	return batch.Delete(dbutils.PlainStateBucket, address[:])
+}
+
+// deleteStorage removes the downloaded storage of the contract
+func (d *firehoseStateDownload) deleteStorage(batch ethdb.DbWithPendingMutations, addrHash common.Hash, address common.Address) error {
+	prefix := dbutils.GenerateStoragePrefix(addrHash[:], state.FirstContractIncarnation)
+	var keys [][]byte
+	if err := d.db.Walk(dbutils.CurrentStateBucket, prefix, 8*len(prefix), func(k, _ []byte) (bool, error) {
+		keys = append(keys, common.CopyBytes(k))
+		return true, nil
+	}); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		keyHash := k[len(prefix):]
+		preimage, err := d.db.Get(dbutils.PreimagePrefix, keyHash)
+		if err != nil {
+			return fmt.Errorf("preimage of the storage key %x: %w", keyHash, err)
+		}
+		if err = batch.Delete(dbutils.CurrentStateBucket, k); err != nil {
+			return err
+		}
+		plainKey := dbutils.PlainGenerateCompositeStorageKey(address, state.FirstContractIncarnation, common.BytesToHash(preimage))
+		if err = batch.Delete(dbutils.PlainStateBucket, plainKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storageTask is the pending download of the storage of one contract
+type storageTask struct {
+	addrHash common.Hash
+	contract *firehoseContract
+	prefixes []trie.Keybytes
+}
+
+// downloadStorage downloads the storage of all the contracts which do not have it yet.
+// It returns true if the pivot has moved during the download
+func (d *firehoseStateDownload) downloadStorage() (bool, error) {
+	var tasks []*storageTask
+	for addrHash, c := range d.contracts {
+		if c.storageDone {
+			continue
+		}
+		tasks = append(tasks, &storageTask{addrHash: addrHash, contract: c, prefixes: []trie.Keybytes{{}}})
+	}
+	sort.Slice(tasks, func(i, j int) bool { return bytes.Compare(tasks[i].addrHash[:], tasks[j].addrHash[:]) < 0 })
+	// Storage which is partially downloaded is downloaded again from scratch
+	batch := d.db.NewBatch()
+	defer batch.Rollback()
+	for _, task := range tasks {
+		if err := d.deleteStorage(batch, task.addrHash, task.contract.address); err != nil {
+			return false, err
+		}
+	}
+	if _, err := batch.Commit(); err != nil {
+		return false, err
+	}
+
+	var done int
+	for len(tasks) > 0 {
+		n := len(tasks)
+		if n > firehoseMaxStorageAccounts {
+			n = firehoseMaxStorageAccounts
+		}
+		requests := make([]storageReqForOneAccount, n)
+		for i, task := range tasks[:n] {
+			prefixes := task.prefixes
+			if len(prefixes) > firehoseMaxPrefixes {
+				prefixes = prefixes[:firehoseMaxPrefixes]
+			}
+			requests[i] = storageReqForOneAccount{Account: task.addrHash[:], Prefixes: prefixes}
+		}
+		p, err := d.fs.peer(d.quit)
+		if err != nil {
+			return false, err
+		}
+		block := d.pivot.Hash()
+		res, err := d.fs.request(p, GetStorageRangesCode, StorageRangesCode, func(id uint64) interface{} {
+			return getStorageRangesOrNodes{ID: id, Block: block, Requests: requests}
+		}, d.quit)
+		if errors.Is(err, errFirehoseCanceled) {
+			return false, err
+		}
+		if err != nil {
+			d.fs.dropPeer(p, err)
+			continue
+		}
+		msg := res.(*storageRangesMsg)
+		if err = verifyStorageRanges(msg, requests, tasks[:n]); err != nil {
+			d.fs.dropPeer(p, fmt.Errorf("invalid storage range: %w", err))
+			continue
+		}
+		var noData bool
+		for i := range msg.Entries {
+			for j := range msg.Entries[i] {
+				noData = noData || msg.Entries[i][j].Status == NoData
+			}
+		}
+		if noData {
+			if d.movePivot(msg.AvailableBlocks) {
+				return true, nil
+			}
+			d.fs.dropPeer(p, fmt.Errorf("no state for the pivot %d", d.pivot.Number))
+			continue
+		}
+		var remaining []*storageTask
+		for i, task := range tasks[:n] {
+			var next []trie.Keybytes
+			for j, r := range msg.Entries[i] {
+				switch r.Status {
+				case OK:
+					if err = d.writeStorage(p, task, r.Leaves); err != nil {
+						return false, err
+					}
+				case TooManyLeaves:
+					prefixes, err := splitPrefix(requests[i].Prefixes[j])
+					if err != nil {
+						return false, err
+					}
+					next = append(next, prefixes...)
+				default:
+					return false, fmt.Errorf("unknown status %d of storage range", r.Status)
+				}
+			}
+			task.prefixes = append(task.prefixes[len(requests[i].Prefixes):], next...)
+			if len(task.prefixes) == 0 {
+				task.contract.storageDone = true
+				done++
+			} else {
+				remaining = append(remaining, task)
+			}
+		}
+		tasks = append(remaining, tasks[n:]...)
+		log.Info("Firehose storage", "contracts", done, "pending", len(tasks))
+	}
+	return false, nil
+}
+
+// verifyStorageRanges checks the shape of the response as well as the range proofs
+func verifyStorageRanges(msg *storageRangesMsg, requests []storageReqForOneAccount, tasks []*storageTask) error {
+	if len(msg.Entries) != len(requests) {
+		return fmt.Errorf("%d storage ranges for %d contracts", len(msg.Entries), len(requests))
+	}
+	for i, entries := range msg.Entries {
+		if len(entries) != len(requests[i].Prefixes) {
+			return fmt.Errorf("%d storage ranges for %d prefixes", len(entries), len(requests[i].Prefixes))
+		}
+		for j := range entries {
+			if err := entries[j].verify(tasks[i].contract.root, requests[i].Prefixes[j]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeStorage writes the downloaded storage range of the contract
+func (d *firehoseStateDownload) writeStorage(p *firehosePeer, task *storageTask, leaves []storageLeaf) error {
+	hashes := make([]common.Hash, len(leaves))
+	for i, leaf := range leaves {
+		hashes[i] = leaf.Key
+	}
+	preimages, err := d.preimages(p, hashes)
+	if err != nil {
+		return err
+	}
+	batch := d.db.NewBatch()
+	defer batch.Rollback()
+	for _, leaf := range leaves {
+		if leaf.Val.Sign() == 0 {
+			continue
+		}
+		value := leaf.Val.Bytes()
+		if err = batch.Put(dbutils.CurrentStateBucket, dbutils.GenerateCompositeStorageKey(task.addrHash, state.FirstContractIncarnation, leaf.Key), value); err != nil {
+			return err
+		}
+		key := common.BytesToHash(preimages[leaf.Key])
+		if err = batch.Put(dbutils.PlainStateBucket, dbutils.PlainGenerateCompositeStorageKey(task.contract.address, state.FirstContractIncarnation, key), value); err != nil {
+			return err
+		}
+	}
+	_, err = batch.Commit()
+	return err
+}
+
+// downloadBytecode downloads the code of the contracts which is not in the database yet
+func (d *firehoseStateDownload) downloadBytecode() error {
+	missing := make(map[common.Hash]common.Hash) // code hash => hash of an account having the code
+	for addrHash, c := range d.contracts {
+		if c.codeHash == (common.Hash{}) || c.codeHash == crypto.Keccak256Hash(nil) {
+			continue
+		}
+		if _, ok := missing[c.codeHash]; ok {
+			continue
+		}
+		if ok, err := d.db.Has(dbutils.CodeBucket, c.codeHash[:]); err != nil {
+			return err
+		} else if !ok {
+			missing[c.codeHash] = addrHash
+		}
+	}
+	refs := make([]bytecodeRef, 0, len(missing))
+	for codeHash, addrHash := range missing {
+		refs = append(refs, bytecodeRef{Account: common.CopyBytes(addrHash[:]), CodeHash: codeHash})
+	}
+	sort.Slice(refs, func(i, j int) bool { return bytes.Compare(refs[i].CodeHash[:], refs[j].CodeHash[:]) < 0 })
+
+	for len(refs) > 0 {
+		batch := refs
+		if len(batch) > firehoseMaxBytecodes {
+			batch = batch[:firehoseMaxBytecodes]
+		}
+		p, err := d.fs.peer(d.quit)
+		if err != nil {
+			return err
+		}
+		res, err := d.fs.request(p, GetBytecodeCode, BytecodeCode, func(id uint64) interface{} {
+			return getBytecodeMsg{ID: id, Ref: batch}
+		}, d.quit)
+		if errors.Is(err, errFirehoseCanceled) {
+			return err
+		}
+		if err != nil {
+			d.fs.dropPeer(p, err)
+			continue
+		}
+		msg := res.(*bytecodeMsg)
+		if len(msg.Code) != len(batch) {
+			d.fs.dropPeer(p, fmt.Errorf("%d bytecodes for %d requested", len(msg.Code), len(batch)))
+			continue
+		}
+		for i, ref := range batch {
+			if crypto.Keccak256Hash(msg.Code[i]) != ref.CodeHash {
+				err = fmt.Errorf("invalid bytecode for the code hash %x", ref.CodeHash)
+				break
+			}
+		}
+		if err != nil {
+			d.fs.dropPeer(p, err)
+			continue
+		}
+		dbBatch := d.db.NewBatch()
+		for i, ref := range batch {
+			if err = dbBatch.Put(dbutils.CodeBucket, ref.CodeHash[:], msg.Code[i]); err != nil {
+				dbBatch.Rollback()
+				return err
+			}
+		}
+		if _, err = dbBatch.Commit(); err != nil {
+			return err
+		}
+		refs = refs[len(batch):]
+	}
+	return nil
+}
+
+// preimages returns the preimages of the hashes of the account addresses or storage keys.
+// The ones missing in the database are requested from the peer serving the state and then other peers
+func (d *firehoseStateDownload) preimages(p *firehosePeer, hashes []common.Hash) (map[common.Hash][]byte, error) {
+	preimages := make(map[common.Hash][]byte, len(hashes))
+	var missing []common.Hash
+	for _, hash := range hashes {
+		if preimage, err := d.db.Get(dbutils.PreimagePrefix, hash[:]); err == nil {
+			preimages[hash] = preimage
+		} else {
+			missing = append(missing, hash)
+		}
+	}
+	for len(missing) > 0 {
+		batch := missing
+		if len(batch) > firehoseMaxPreimages {
+			batch = batch[:firehoseMaxPreimages]
+		}
+		if p == nil {
+			var err error
+			if p, err = d.fs.peer(d.quit); err != nil {
+				return nil, err
+			}
+		}
+		res, err := d.fs.request(p, GetPreimagesCode, PreimagesCode, func(id uint64) interface{} {
+			return getPreimagesMsg{ID: id, Hashes: batch}
+		}, d.quit)
+		if errors.Is(err, errFirehoseCanceled) {
+			return nil, err
+		}
+		if err == nil {
+			msg := res.(*preimagesMsg)
+			if len(msg.Preimages) != len(batch) {
+				err = fmt.Errorf("%d preimages for %d hashes", len(msg.Preimages), len(batch))
+			}
+			for i := 0; err == nil && i < len(batch); i++ {
+				if crypto.Keccak256Hash(msg.Preimages[i]) != batch[i] {
+					err = fmt.Errorf("invalid preimage for %x", batch[i])
+				}
+			}
+			if err == nil {
+				dbBatch := d.db.NewBatch()
+				for i, hash := range batch {
+					preimages[hash] = msg.Preimages[i]
+					if err = dbBatch.Put(dbutils.PreimagePrefix, hash[:], msg.Preimages[i]); err != nil {
+						dbBatch.Rollback()
+						return nil, err
+					}
+				}
+				if _, err = dbBatch.Commit(); err != nil {
+					return nil, err
+				}
+				missing = missing[len(batch):]
+				continue
+			}
+		}
+		d.fs.dropPeer(p, err)
+		p = nil
+	}
+	return preimages, nil
+}
+
+var _ stagedsync.StateDownloader = (*firehoseSync)(nil)
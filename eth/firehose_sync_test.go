@@ -0,0 +1,296 @@
+package eth
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"sort"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/p2p"
+	"github.com/ledgerwatch/turbo-geth/p2p/enode"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+// firehoseTestState is the state served by the test Firehose peer
+type firehoseTestState struct {
+	tr        *trie.Trie
+	accounts  []accountLeaf
+	storage   map[common.Hash][]storageLeaf
+	preimages map[common.Hash][]byte
+	code      map[common.Hash][]byte
+}
+
+// newFirehoseTestState generates the state of 200 accounts, 3 of them being contracts.
+// The second version of the state has one account deleted, one balance and one storage item changed
+func newFirehoseTestState(version int) *firehoseTestState {
+	s := &firehoseTestState{
+		tr:        trie.New(common.Hash{}),
+		storage:   make(map[common.Hash][]storageLeaf),
+		preimages: make(map[common.Hash][]byte),
+		code:      make(map[common.Hash][]byte),
+	}
+	for i := 0; i < 200; i++ {
+		if version == 2 && i == 7 {
+			continue
+		}
+		address := common.BytesToAddress([]byte{byte(i), 0x01})
+		addrHash := crypto.Keccak256Hash(address[:])
+		s.preimages[addrHash] = address[:]
+		acc := accounts.NewAccount()
+		acc.Balance = *uint256.NewInt().SetUint64(uint64(i + 1))
+		if version == 2 && i == 5 {
+			acc.Balance = *uint256.NewInt().SetUint64(1000)
+		}
+		s.tr.UpdateAccount(addrHash[:], &acc)
+		if i < 3 {
+			code := []byte{0x60, byte(i)}
+			acc.CodeHash = crypto.Keccak256Hash(code)
+			s.code[acc.CodeHash] = code
+			var leaves []storageLeaf
+			for k := 1; k <= 30; k++ {
+				key := common.BigToHash(big.NewInt(int64(k)))
+				keyHash := crypto.Keccak256Hash(key[:])
+				s.preimages[keyHash] = key[:]
+				value := big.NewInt(int64(k * (i + 1)))
+				if version == 2 && i == 1 && k == 3 {
+					value = big.NewInt(999)
+				}
+				s.tr.Update(append(addrHash.Bytes(), keyHash[:]...), value.Bytes())
+				leaves = append(leaves, storageLeaf{Key: keyHash, Val: *value})
+			}
+			sort.Slice(leaves, func(i, j int) bool { return bytes.Compare(leaves[i].Key[:], leaves[j].Key[:]) < 0 })
+			s.storage[addrHash] = leaves
+			_, acc.Root = s.tr.DeepHash(addrHash[:])
+			s.tr.UpdateAccount(addrHash[:], &acc)
+		}
+		s.accounts = append(s.accounts, accountLeaf{Key: addrHash, Val: &acc})
+	}
+	sort.Slice(s.accounts, func(i, j int) bool { return bytes.Compare(s.accounts[i].Key[:], s.accounts[j].Key[:]) < 0 })
+	return s
+}
+
+// serveFirehose answers the requests of the client the way a full node would. The first state is served at
+// the block oldBlock for the first few requests, afterwards only the second state at the block newBlock is available
+func serveFirehose(t *testing.T, rw p2p.MsgReadWriter, oldBlock, newBlock common.Hash, oldState, newState *firehoseTestState) {
+	const leafLimit = 8
+	var stateRequests int
+	for {
+		msg, err := rw.ReadMsg()
+		if err != nil {
+			return
+		}
+		switch msg.Code {
+		case GetStateRangesCode:
+			var req getStateRangesOrNodes
+			require.NoError(t, msg.Decode(&req))
+			stateRequests++
+			s := newState
+			if stateRequests <= 3 {
+				s = oldState
+			}
+			res := stateRangesMsg{ID: req.ID, Entries: make([]firehoseAccountRange, len(req.Prefixes))}
+			for i, prefix := range req.Prefixes {
+				if (s == oldState && req.Block != oldBlock) || (s == newState && req.Block != newBlock) {
+					res.Entries[i].Status = NoData
+					res.AvailableBlocks = []common.Hash{newBlock}
+					continue
+				}
+				first, last := prefixRangeBounds(prefix)
+				for _, leaf := range s.accounts {
+					if bytes.Compare(leaf.Key[:], first) >= 0 && bytes.Compare(leaf.Key[:], last) <= 0 {
+						res.Entries[i].Leaves = append(res.Entries[i].Leaves, leaf)
+					}
+				}
+				if len(res.Entries[i].Leaves) > leafLimit {
+					res.Entries[i] = firehoseAccountRange{Status: TooManyLeaves}
+					continue
+				}
+				require.NoError(t, proveAccountRange(s.tr, prefix, &res.Entries[i]))
+			}
+			require.NoError(t, p2p.Send(rw, StateRangesCode, res))
+
+		case GetStorageRangesCode:
+			var req getStorageRangesOrNodes
+			require.NoError(t, msg.Decode(&req))
+			s := newState
+			if req.Block == oldBlock {
+				s = oldState
+			}
+			res := storageRangesMsg{ID: req.ID, Entries: make([][]storageRange, len(req.Requests))}
+			for i, r := range req.Requests {
+				addrHash := common.BytesToHash(r.Account)
+				res.Entries[i] = make([]storageRange, len(r.Prefixes))
+				for j, prefix := range r.Prefixes {
+					first, last := prefixRangeBounds(prefix)
+					for _, leaf := range s.storage[addrHash] {
+						if bytes.Compare(leaf.Key[:], first) >= 0 && bytes.Compare(leaf.Key[:], last) <= 0 {
+							res.Entries[i][j].Leaves = append(res.Entries[i][j].Leaves, leaf)
+						}
+					}
+					if len(res.Entries[i][j].Leaves) > leafLimit {
+						res.Entries[i][j] = storageRange{Status: TooManyLeaves}
+						continue
+					}
+					require.NoError(t, proveStorageRange(s.tr, addrHash, prefix, &res.Entries[i][j]))
+				}
+			}
+			require.NoError(t, p2p.Send(rw, StorageRangesCode, res))
+
+		case GetBytecodeCode:
+			var req getBytecodeMsg
+			require.NoError(t, msg.Decode(&req))
+			res := bytecodeMsg{ID: req.ID, Code: make([][]byte, len(req.Ref))}
+			for i, ref := range req.Ref {
+				res.Code[i] = newState.code[ref.CodeHash]
+			}
+			require.NoError(t, p2p.Send(rw, BytecodeCode, res))
+
+		case GetPreimagesCode:
+			var req getPreimagesMsg
+			require.NoError(t, msg.Decode(&req))
+			res := preimagesMsg{ID: req.ID, Preimages: make([][]byte, len(req.Hashes))}
+			for i, hash := range req.Hashes {
+				res.Preimages[i] = newState.preimages[hash]
+				if res.Preimages[i] == nil {
+					res.Preimages[i] = oldState.preimages[hash]
+				}
+			}
+			require.NoError(t, p2p.Send(rw, PreimagesCode, res))
+
+		default:
+			t.Errorf("unexpected message %d", msg.Code)
+			return
+		}
+	}
+}
+
+// downloadFirehoseTestState downloads the test state from the test peer, which moves the pivot
+// to the block with the second version of the state
+func downloadFirehoseTestState(t *testing.T) (ethdb.Database, *types.Header) {
+	db := ethdb.NewMemDatabase()
+
+	oldState, newState := newFirehoseTestState(1), newFirehoseTestState(2)
+	pivot := &types.Header{Number: big.NewInt(100), Root: oldState.tr.Hash(), Difficulty: big.NewInt(1)}
+	newPivot := &types.Header{Number: big.NewInt(101), ParentHash: pivot.Hash(), Root: newState.tr.Hash(), Difficulty: big.NewInt(1)}
+	for _, header := range []*types.Header{pivot, newPivot} {
+		rawdb.WriteHeader(context.Background(), db, header)
+		rawdb.WriteCanonicalHash(db, header.Hash(), header.Number.Uint64())
+	}
+
+	fs := newFirehoseSync(db)
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	peer := &firehosePeer{Peer: p2p.NewPeer(enode.ID{1}, "test", nil), rw: net}
+	go fs.handle(peer) //nolint:errcheck
+	go serveFirehose(t, app, pivot.Hash(), newPivot.Hash(), oldState, newState)
+
+	header, err := fs.DownloadState(db, pivot, nil)
+	require.NoError(t, err)
+	assert.Equal(t, newPivot.Hash(), header.Hash())
+	// Peer info is of the Firehose peers, not of the eth ones
+	assert.Equal(t, &firehosePeerInfo{Version: FirehoseVersions[0]}, fs.peerInfo(enode.ID{1}))
+	assert.Nil(t, fs.peerInfo(enode.ID{2}))
+	return db, newPivot
+}
+
+func TestFirehoseDownloadState(t *testing.T) {
+	db, newPivot := downloadFirehoseTestState(t)
+	defer db.Close()
+
+	// Hashed state matches the state root of the new pivot
+	loader := trie.NewFlatDbSubTrieLoader()
+	rl := trie.NewRetainList(0)
+	require.NoError(t, loader.Reset(db, rl, rl, nil /* hashCollector */, [][]byte{nil}, []int{0}, false))
+	subTries, err := loader.LoadSubTries()
+	require.NoError(t, err)
+	assert.Equal(t, newPivot.Root, subTries.Hashes[0])
+
+	// Plain state
+	deleted := common.BytesToAddress([]byte{7, 0x01})
+	_, err = db.Get(dbutils.PlainStateBucket, deleted[:])
+	assert.Equal(t, ethdb.ErrKeyNotFound, err)
+	changed := common.BytesToAddress([]byte{5, 0x01})
+	enc, err := db.Get(dbutils.PlainStateBucket, changed[:])
+	require.NoError(t, err)
+	var acc accounts.Account
+	require.NoError(t, acc.DecodeForStorage(enc))
+	assert.Equal(t, uint64(1000), acc.Balance.Uint64())
+
+	contract := common.BytesToAddress([]byte{1, 0x01})
+	enc, err = db.Get(dbutils.PlainStateBucket, contract[:])
+	require.NoError(t, err)
+	require.NoError(t, acc.DecodeForStorage(enc))
+	assert.Equal(t, uint64(state.FirstContractIncarnation), acc.Incarnation)
+	value, err := db.Get(dbutils.PlainStateBucket, dbutils.PlainGenerateCompositeStorageKey(contract, acc.Incarnation, common.BigToHash(big.NewInt(3))))
+	require.NoError(t, err)
+	assert.Equal(t, big.NewInt(999).Bytes(), value)
+	code, err := db.Get(dbutils.CodeBucket, acc.CodeHash[:])
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x60, 0x01}, code)
+}
+
+func TestFirehoseServeState(t *testing.T) {
+	serverDb, head := downloadFirehoseTestState(t)
+	defer serverDb.Close()
+	for _, stage := range []stages.SyncStage{stages.HashState, stages.IntermediateHashes} {
+		require.NoError(t, stages.SaveStageProgress(serverDb, stage, head.Number.Uint64(), nil))
+	}
+	server := newFirehoseSync(serverDb)
+
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	rawdb.WriteHeader(context.Background(), db, head)
+	rawdb.WriteCanonicalHash(db, head.Hash(), head.Number.Uint64())
+	fs := newFirehoseSync(db)
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	go server.handle(&firehosePeer{Peer: p2p.NewPeer(enode.ID{2}, "client", nil), rw: app}) //nolint:errcheck
+	go fs.handle(&firehosePeer{Peer: p2p.NewPeer(enode.ID{1}, "server", nil), rw: net})     //nolint:errcheck
+
+	header, err := fs.DownloadState(db, head, nil)
+	require.NoError(t, err)
+	assert.Equal(t, head.Hash(), header.Hash())
+	loader := trie.NewFlatDbSubTrieLoader()
+	rl := trie.NewRetainList(0)
+	require.NoError(t, loader.Reset(db, rl, rl, nil /* hashCollector */, [][]byte{nil}, []int{0}, false))
+	subTries, err := loader.LoadSubTries()
+	require.NoError(t, err)
+	assert.Equal(t, head.Root, subTries.Hashes[0])
+
+	// Nodes
+	stateNodes, err := server.stateNodes(&getStateRangesOrNodes{Block: head.Hash(), Prefixes: []trie.Keybytes{{}, {Data: []byte{0x30}, Odd: true}}})
+	require.NoError(t, err)
+	require.Len(t, stateNodes.Nodes, 2)
+	assert.Equal(t, head.Root, crypto.Keccak256Hash(stateNodes.Nodes[0]))
+	assert.NotEmpty(t, stateNodes.Nodes[1])
+	contract := common.BytesToAddress([]byte{1, 0x01})
+	var storageRoot common.Hash
+	for _, leaf := range newFirehoseTestState(2).accounts {
+		if leaf.Key == crypto.Keccak256Hash(contract[:]) {
+			storageRoot = leaf.Val.Root
+		}
+	}
+	storageNodes, err := server.storageNodes(&getStorageRangesOrNodes{Block: head.Hash(), Requests: []storageReqForOneAccount{{Account: contract[:], Prefixes: []trie.Keybytes{{}}}}})
+	require.NoError(t, err)
+	assert.Equal(t, storageRoot, crypto.Keccak256Hash(storageNodes.Nodes[0][0]))
+
+	// State of other blocks is not available
+	ranges, err := server.stateRanges(&getStateRangesOrNodes{Block: head.ParentHash, Prefixes: []trie.Keybytes{{}}})
+	require.NoError(t, err)
+	assert.Equal(t, NoData, ranges.Entries[0].Status)
+	assert.Equal(t, []common.Hash{head.Hash()}, ranges.AvailableBlocks)
+}
@@ -0,0 +1,81 @@
+package eth
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"sort"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+func TestFirehoseRangeProofs(t *testing.T) {
+	tr := trie.New(common.Hash{})
+	var accountLeaves []accountLeaf
+	for i := 0; i < 300; i++ {
+		acc := accounts.NewAccount()
+		acc.Nonce = uint64(i)
+		acc.Balance = *uint256.NewInt().SetUint64(uint64(i))
+		addrHash := crypto.Keccak256Hash([]byte(fmt.Sprintf("account%d", i)))
+		tr.UpdateAccount(addrHash[:], &acc)
+		accountLeaves = append(accountLeaves, accountLeaf{Key: addrHash, Val: &acc})
+	}
+	// Storage of one contract
+	contract := accountLeaves[0].Key
+	var storageLeaves []storageLeaf
+	for i := 1; i <= 50; i++ {
+		keyHash := crypto.Keccak256Hash([]byte(fmt.Sprintf("slot%d", i)))
+		tr.Update(append(contract.Bytes(), keyHash[:]...), big.NewInt(int64(i)).Bytes())
+		storageLeaves = append(storageLeaves, storageLeaf{Key: keyHash, Val: *big.NewInt(int64(i))})
+	}
+	_, storageRoot := tr.DeepHash(contract[:])
+	accountLeaves[0].Val.Root = storageRoot
+	tr.UpdateAccount(contract[:], accountLeaves[0].Val)
+	root := tr.Hash()
+
+	sort.Slice(accountLeaves, func(i, j int) bool { return bytes.Compare(accountLeaves[i].Key[:], accountLeaves[j].Key[:]) < 0 })
+	sort.Slice(storageLeaves, func(i, j int) bool { return bytes.Compare(storageLeaves[i].Key[:], storageLeaves[j].Key[:]) < 0 })
+
+	for _, prefix := range []trie.Keybytes{
+		{},
+		{Data: []byte{0x30}, Odd: true},
+		{Data: []byte{0xa7}},
+		{Data: []byte{0x00, 0x00}},
+	} {
+		first, last := prefixRangeBounds(prefix)
+		var r firehoseAccountRange
+		for _, leaf := range accountLeaves {
+			if bytes.Compare(leaf.Key[:], first) >= 0 && bytes.Compare(leaf.Key[:], last) <= 0 {
+				r.Leaves = append(r.Leaves, leaf)
+			}
+		}
+		require.NoError(t, proveAccountRange(tr, prefix, &r))
+		assert.NoError(t, r.verify(root, prefix), "prefix %x", prefix.Data)
+		if len(r.Leaves) > 0 {
+			r.Leaves = r.Leaves[1:]
+			assert.Error(t, r.verify(root, prefix), "prefix %x with missing leaf", prefix.Data)
+		}
+	}
+
+	prefix := trie.Keybytes{Data: []byte{0x80}, Odd: true}
+	first, last := prefixRangeBounds(prefix)
+	var sr storageRange
+	for _, leaf := range storageLeaves {
+		if bytes.Compare(leaf.Key[:], first) >= 0 && bytes.Compare(leaf.Key[:], last) <= 0 {
+			sr.Leaves = append(sr.Leaves, leaf)
+		}
+	}
+	require.NotEmpty(t, sr.Leaves)
+	require.NoError(t, proveStorageRange(tr, contract, prefix, &sr))
+	assert.NoError(t, sr.verify(storageRoot, prefix))
+	sr.Leaves[0].Val = *big.NewInt(1000)
+	assert.Error(t, sr.verify(storageRoot, prefix))
+}
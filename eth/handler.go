@@ -81,6 +81,7 @@ type ProtocolManager struct {
 	blockFetcher *fetcher.BlockFetcher
 	txFetcher    *fetcher.TxFetcher
 	peers        *peerSet
+	firehose     *firehoseSync // Firehose state download for the staged sync, nil unless enabled
 
 	eventMux      *event.TypeMux
 	txsCh         chan core.NewTxsEvent
@@ -176,6 +177,9 @@ func initPm(manager *ProtocolManager, engine consensus.Engine, chainConfig *para
 	}
 	manager.downloader = downloader.New(manager.checkpointNumber, chaindb, nil /*stateBloom */, manager.eventMux, chainConfig, blockchain, nil, manager.removePeer, sm)
 	manager.downloader.SetDataDir(manager.datadir)
+	if manager.firehose != nil {
+		manager.downloader.SetStateDownloader(manager.firehose)
+	}
 
 	// Construct the fetcher (short sync)
 	validator := func(header *types.Header) error {
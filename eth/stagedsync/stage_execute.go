@@ -103,6 +103,7 @@ func SpawnExecuteBlocksStage(s *StageState, stateDB ethdb.Database, chainConfig
 		}
 
 		if batch.BatchSize() >= stateDB.IdealBatchSize() {
+			core.SaveDestsCache(batch, dests)
 			if err = s.Update(batch, blockNum); err != nil {
 				return err
 			}
@@ -138,6 +139,7 @@ func SpawnExecuteBlocksStage(s *StageState, stateDB ethdb.Database, chainConfig
 		logTime, logBlock = logProgress(logTime, logBlock, blockNum, batch)
 	}
 
+	core.SaveDestsCache(batch, dests)
 	if err := s.Update(batch, stageProgress); err != nil {
 		return err
 	}
@@ -0,0 +1,69 @@
+package stagedsync
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+)
+
+// FirehosePivotDistance is how far behind the head of the downloaded headers the state is downloaded.
+// Peers only serve the state for the recent blocks
+const FirehosePivotDistance = 64
+
+// ErrNoStateDownloadPeers is returned by the StateDownloader if there are no peers to download the state from
+var ErrNoStateDownloadPeers = errors.New("no peers to download the state from")
+
+// SpawnFirehoseStateStage downloads the state at the pivot block instead of executing the blocks from genesis.
+// It only runs on an empty database, afterwards the execution (as well as hashing of the state and generation
+// of intermediate hashes) continues from the pivot block
+func SpawnFirehoseStateStage(s *StageState, db ethdb.Database, sd StateDownloader, datadir string, quit <-chan struct{}) error {
+	if s.BlockNumber > 0 {
+		s.Done()
+		return nil
+	}
+	executionAt, err := s.ExecutionAt(db)
+	if err != nil {
+		return err
+	}
+	headersAt, _, err := stages.GetStageProgress(db, stages.Headers)
+	if err != nil {
+		return err
+	}
+	if executionAt > 0 || headersAt <= FirehosePivotDistance {
+		// Too late or too early to download the state, executing blocks instead
+		s.Done()
+		return nil
+	}
+	pivotNumber := headersAt - FirehosePivotDistance
+	pivot := rawdb.ReadHeader(db, rawdb.ReadCanonicalHash(db, pivotNumber), pivotNumber)
+	if pivot == nil {
+		return fmt.Errorf("firehose: pivot header %d not found", pivotNumber)
+	}
+	log.Info("Downloading state via Firehose", "pivot", pivotNumber, "root", pivot.Root)
+	pivot, err = sd.DownloadState(db, pivot, quit)
+	if errors.Is(err, ErrNoStateDownloadPeers) {
+		log.Warn("Firehose state download is not possible, executing blocks from genesis", "err", err)
+		s.Done()
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("firehose: downloading state: %w", err)
+	}
+	pivotNumber = pivot.Number.Uint64()
+	log.Info("Generating intermediate hashes for the downloaded state", "pivot", pivotNumber)
+	if err = regenerateIntermediateHashes(db, datadir, pivot.Root, quit); err != nil {
+		return err
+	}
+	// The state is complete at the pivot, all state-related stages continue from there
+	for _, stage := range []stages.SyncStage{stages.Execution, stages.IntermediateHashes, stages.HashState} {
+		if err = stages.SaveStageProgress(db, stage, pivotNumber, nil); err != nil {
+			return err
+		}
+	}
+	log.Info("Firehose state download finished", "pivot", pivotNumber)
+	return s.DoneAndUpdate(db, pivotNumber)
+}
@@ -25,6 +25,7 @@ func PrepareStagedSync(
 	headersFetchers []func() error,
 	dests vm.Cache,
 	txPoolControl *TxPoolStartStopper,
+	stateDownloader StateDownloader,
 	changeSetHook ChangeSetHook,
 ) (*State, error) {
 	defer log.Info("Staged sync finished")
@@ -74,6 +75,18 @@ func PrepareStagedSync(
 				return UnwindSendersStage(u, stateDB)
 			},
 		},
+		{
+			ID:                  stages.FirehoseState,
+			Description:         "Downloading the state via Firehose",
+			Disabled:            stateDownloader == nil,
+			DisabledDescription: "Enable by adding --firehose.sync",
+			ExecFunc: func(s *StageState, u Unwinder) error {
+				return SpawnFirehoseStateStage(s, stateDB, stateDownloader, datadir, quitCh)
+			},
+			UnwindFunc: func(u *UnwindState, s *StageState) error {
+				return u.Done(stateDB)
+			},
+		},
 		{
 			ID:          stages.Execution,
 			Description: "Executing blocks w/o hash checks",
@@ -41,6 +41,7 @@ const (
 	TxLookup                             // Generating transactions lookup index
 	TxPool                               // Starts TxPool
 	Finish                               // Nominal stage after all other stages
+	FirehoseState                        // Downloading the state at a pivot block via Firehose protocol instead of executing from genesis
 )
 
 // GetStageProgress retrieves saved progress of given sync stage from the database
@@ -4,6 +4,7 @@ import (
 	"github.com/ledgerwatch/turbo-geth/core"
 	"github.com/ledgerwatch/turbo-geth/core/types"
 	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
 )
 
 type BlockChain interface {
@@ -16,3 +17,10 @@ type DownloaderGlue interface {
 	SpawnHeaderDownloadStage([]func() error, *StageState, Unwinder) error
 	SpawnBodyDownloadStage(string, *StageState, Unwinder) (bool, error)
 }
+
+// StateDownloader downloads the state at the pivot block from the network and writes it into the
+// plain and hashed state buckets. The pivot may be moved forward while downloading (if the peers
+// do not serve the state of the original one anymore), the header of the final pivot is returned
+type StateDownloader interface {
+	DownloadState(db ethdb.Database, pivot *types.Header, quit <-chan struct{}) (*types.Header, error)
+}
@@ -0,0 +1,462 @@
+package tracers
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/hexutil"
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/core/vm/stack"
+	"github.com/ledgerwatch/turbo-geth/rpc"
+)
+
+// maxDebugSessions is the number of the debugging sessions kept at once.
+const maxDebugSessions = 16
+
+// debugSessionTimeout is the time after the last command of the session it is
+// considered abandoned, then its execution is aborted and the session is dropped.
+var debugSessionTimeout = 10 * time.Minute
+
+var errDebugSessionFinished = errors.New("execution finished")
+
+// Breakpoint pauses the execution in the debugging session at the instruction
+// matching all of its fields. The breakpoint of the address only pauses at the
+// first instruction of each call of its code.
+type Breakpoint struct {
+	PC      *uint64         `json:"pc,omitempty"`
+	Op      *string         `json:"opcode,omitempty"`
+	Address *common.Address `json:"address,omitempty"`
+}
+
+// DebugState is the position of the paused execution, or the result of the
+// finished one.
+type DebugState struct {
+	Finished bool           `json:"finished"`
+	PC       uint64         `json:"pc"`
+	Op       string         `json:"op"`
+	Gas      uint64         `json:"gas"`
+	GasCost  uint64         `json:"gasCost"`
+	Depth    int            `json:"depth"`
+	Address  common.Address `json:"address"`
+	Error    string         `json:"error,omitempty"`
+
+	// Result of the transaction, once finished
+	GasUsed     uint64        `json:"gasUsed,omitempty"`
+	ReturnValue hexutil.Bytes `json:"returnValue,omitempty"`
+}
+
+// DebugSessionStart is the new debugging session with the execution paused at
+// the first instruction.
+type DebugSessionStart struct {
+	Session string      `json:"session"`
+	State   *DebugState `json:"state"`
+}
+
+type inspectRequest struct {
+	what  string
+	reply chan inspectReply
+}
+
+type inspectReply struct {
+	value interface{}
+	err   error
+}
+
+// stepDebugger is the tracer of the debugging session. It blocks the execution
+// in CaptureState until the session resumes it, and serves the inspections of
+// the paused execution in the meantime, so they run on the goroutine of the EVM.
+type stepDebugger struct {
+	mu          sync.Mutex
+	breakpoints []Breakpoint
+
+	stepping bool // pause at the next instruction
+	entered  bool // the next instruction starts the call
+	storage  map[common.Address]map[common.Hash]struct{}
+
+	paused   chan *DebugState
+	resume   chan bool // true steps, false continues to the next breakpoint
+	requests chan inspectRequest
+	quit     chan struct{}
+	quitOnce sync.Once
+
+	// the paused instruction
+	env      *vm.EVM
+	memory   *vm.Memory
+	stack    *stack.Stack
+	contract *vm.Contract
+}
+
+func newStepDebugger() *stepDebugger {
+	return &stepDebugger{
+		stepping: true,
+		storage:  map[common.Address]map[common.Hash]struct{}{},
+		paused:   make(chan *DebugState),
+		resume:   make(chan bool),
+		requests: make(chan inspectRequest),
+		quit:     make(chan struct{}),
+	}
+}
+
+// stop releases the paused execution and aborts it.
+func (d *stepDebugger) stop() {
+	d.quitOnce.Do(func() { close(d.quit) })
+}
+
+func (d *stepDebugger) CaptureStart(depth int, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) error {
+	d.entered = true
+	return nil
+}
+
+func (d *stepDebugger) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, st *stack.Stack, rStack *stack.ReturnStack, contract *vm.Contract, depth int, err error) error {
+	select {
+	case <-d.quit:
+		env.Cancel()
+		return nil
+	default:
+	}
+	entered := d.entered
+	d.entered = false
+	if (op == vm.SLOAD || op == vm.SSTORE) && st.Len() >= 1 {
+		keys, ok := d.storage[contract.Address()]
+		if !ok {
+			keys = map[common.Hash]struct{}{}
+			d.storage[contract.Address()] = keys
+		}
+		keys[common.Hash(st.Back(0).Bytes32())] = struct{}{}
+	}
+	if !d.stepping && !d.hit(pc, op, contract.Address(), entered) {
+		return nil
+	}
+
+	state := &DebugState{
+		PC:      pc,
+		Op:      op.String(),
+		Gas:     gas,
+		GasCost: cost,
+		Depth:   depth,
+		Address: contract.Address(),
+	}
+	if err != nil {
+		state.Error = err.Error()
+	}
+	d.env, d.memory, d.stack, d.contract = env, memory, st, contract
+	defer func() { d.env, d.memory, d.stack, d.contract = nil, nil, nil, nil }()
+
+	select {
+	case d.paused <- state:
+	case <-d.quit:
+		env.Cancel()
+		return nil
+	}
+	for {
+		select {
+		case req := <-d.requests:
+			value, err := d.inspect(req.what)
+			req.reply <- inspectReply{value, err}
+		case d.stepping = <-d.resume:
+			return nil
+		case <-d.quit:
+			env.Cancel()
+			return nil
+		}
+	}
+}
+
+func (d *stepDebugger) CaptureFault(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, st *stack.Stack, rStack *stack.ReturnStack, contract *vm.Contract, depth int, err error) error {
+	return nil
+}
+
+func (d *stepDebugger) CaptureEnd(depth int, output []byte, gasUsed uint64, t time.Duration, err error) error {
+	return nil
+}
+
+func (d *stepDebugger) CaptureCreate(creator, creation common.Address) error {
+	return nil
+}
+
+func (d *stepDebugger) CaptureAccountRead(account common.Address) error {
+	return nil
+}
+
+func (d *stepDebugger) CaptureAccountWrite(account common.Address) error {
+	return nil
+}
+
+// hit reports whether any of the breakpoints matches the instruction.
+func (d *stepDebugger) hit(pc uint64, op vm.OpCode, addr common.Address, entered bool) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, bp := range d.breakpoints {
+		if bp.Address != nil && *bp.Address != addr {
+			continue
+		}
+		if bp.PC != nil && *bp.PC != pc {
+			continue
+		}
+		if bp.Op != nil && vm.StringToOp(strings.ToUpper(*bp.Op)) != op {
+			continue
+		}
+		if bp.PC == nil && bp.Op == nil && !entered {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// inspect returns the stack, the memory or the storage items accessed so far
+// of the paused contract.
+func (d *stepDebugger) inspect(what string) (interface{}, error) {
+	switch what {
+	case "stack":
+		// Top of the stack is the last item, as in the struct logs
+		data := d.stack.GetData()
+		items := make([]*hexutil.Big, len(data))
+		for i := range data {
+			items[i] = (*hexutil.Big)(data[i].ToBig())
+		}
+		return items, nil
+	case "memory":
+		return hexutil.Bytes(d.memory.GetCopy(0, uint64(d.memory.Len()))), nil
+	case "storage":
+		addr := d.contract.Address()
+		storage := make(map[common.Hash]common.Hash, len(d.storage[addr]))
+		for key := range d.storage[addr] {
+			key := key
+			var value uint256.Int
+			d.env.IntraBlockState.GetState(addr, &key, &value)
+			storage[key] = common.Hash(value.Bytes32())
+		}
+		return storage, nil
+	default:
+		return nil, fmt.Errorf("unknown inspection %q, expected stack, memory or storage", what)
+	}
+}
+
+// DebugSession is the execution of the transaction controlled by the client.
+type DebugSession struct {
+	mu       sync.Mutex // one command at a time
+	debugger *stepDebugger
+	lastUsed time.Time   // guarded by the mutex of DebugSessions
+	timer    *time.Timer // drops the abandoned session
+
+	done   chan struct{} // closed when the execution is finished
+	result *core.ExecutionResult
+	err    error
+}
+
+// wait returns the state of the next pause, or of the finished execution.
+func (s *DebugSession) wait() (*DebugState, error) {
+	select {
+	case state := <-s.debugger.paused:
+		return state, nil
+	case <-s.done:
+		return s.finished()
+	}
+}
+
+func (s *DebugSession) finished() (*DebugState, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	state := &DebugState{
+		Finished:    true,
+		GasUsed:     s.result.UsedGas,
+		ReturnValue: s.result.Return(),
+	}
+	if s.result.Err != nil {
+		state.ReturnValue = s.result.Revert()
+		state.Error = s.result.Err.Error()
+	}
+	return state, nil
+}
+
+// run resumes the execution till the next instruction when stepping, or till the
+// next breakpoint otherwise.
+func (s *DebugSession) run(step bool) (*DebugState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case s.debugger.resume <- step:
+		return s.wait()
+	case <-s.done:
+		return s.finished()
+	}
+}
+
+func (s *DebugSession) inspect(what string) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	req := inspectRequest{what: what, reply: make(chan inspectReply, 1)}
+	select {
+	case s.debugger.requests <- req:
+		reply := <-req.reply
+		return reply.value, reply.err
+	case <-s.done:
+		return nil, errDebugSessionFinished
+	}
+}
+
+// DebugSessions keeps the interactive debugging sessions of the transactions,
+// which are driven by the debug_step, debug_continue, debug_breakpoint and
+// debug_inspect calls.
+type DebugSessions struct {
+	mu       sync.Mutex
+	sessions map[string]*DebugSession
+}
+
+func NewDebugSessions() *DebugSessions {
+	return &DebugSessions{sessions: map[string]*DebugSession{}}
+}
+
+// Start runs the execution with the debugger of the new session in the background
+// and returns the session paused at the first instruction. The run function has
+// to execute the transaction with the given tracer.
+func (ds *DebugSessions) Start(run func(tracer vm.Tracer) (*core.ExecutionResult, error)) (*DebugSessionStart, error) {
+	ds.mu.Lock()
+	if len(ds.sessions) >= maxDebugSessions {
+		ds.mu.Unlock()
+		return nil, fmt.Errorf("too many debug sessions, at most %d are allowed", maxDebugSessions)
+	}
+	id := string(rpc.NewID())
+	s := &DebugSession{debugger: newStepDebugger(), lastUsed: time.Now(), done: make(chan struct{})}
+	s.timer = time.AfterFunc(debugSessionTimeout, func() { ds.expire(id, s) })
+	ds.sessions[id] = s
+	ds.mu.Unlock()
+
+	go func() {
+		s.result, s.err = run(s.debugger)
+		// The finished session is dropped before the commands waiting for it return
+		ds.remove(id, s)
+		close(s.done)
+	}()
+	state, err := s.wait()
+	if err != nil {
+		return nil, err
+	}
+	return &DebugSessionStart{Session: id, State: state}, nil
+}
+
+// remove drops the session unless it has been dropped already.
+func (ds *DebugSessions) remove(id string, s *DebugSession) bool {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	s.timer.Stop()
+	if ds.sessions[id] != s {
+		return false
+	}
+	delete(ds.sessions, id)
+	return true
+}
+
+// expire aborts the execution of the session if there were no commands of the
+// session during debugSessionTimeout, otherwise it checks the session again
+// when the timeout of its last command passes.
+func (ds *DebugSessions) expire(id string, s *DebugSession) {
+	ds.mu.Lock()
+	if ds.sessions[id] != s {
+		ds.mu.Unlock()
+		return
+	}
+	if idle := time.Since(s.lastUsed); idle < debugSessionTimeout {
+		s.timer.Reset(debugSessionTimeout - idle)
+		ds.mu.Unlock()
+		return
+	}
+	delete(ds.sessions, id)
+	ds.mu.Unlock()
+	s.debugger.stop()
+}
+
+func (ds *DebugSessions) get(id string) (*DebugSession, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	s, ok := ds.sessions[id]
+	if !ok {
+		return nil, fmt.Errorf("debug session %s not found", id)
+	}
+	s.lastUsed = time.Now()
+	return s, nil
+}
+
+// Step executes the paused instruction and pauses at the next one.
+func (ds *DebugSessions) Step(id string) (*DebugState, error) {
+	s, err := ds.get(id)
+	if err != nil {
+		return nil, err
+	}
+	return s.run(true)
+}
+
+// Continue resumes the execution till the next breakpoint or the end.
+func (ds *DebugSessions) Continue(id string) (*DebugState, error) {
+	s, err := ds.get(id)
+	if err != nil {
+		return nil, err
+	}
+	return s.run(false)
+}
+
+// Breakpoint adds the breakpoint to the session and returns their number.
+func (ds *DebugSessions) Breakpoint(id string, bp Breakpoint) (int, error) {
+	if bp.PC == nil && bp.Op == nil && bp.Address == nil {
+		return 0, errors.New("empty breakpoint")
+	}
+	if bp.Op != nil {
+		name := strings.ToUpper(*bp.Op)
+		if op := vm.StringToOp(name); op == vm.STOP && name != "STOP" {
+			return 0, fmt.Errorf("unknown opcode %q", *bp.Op)
+		}
+	}
+	s, err := ds.get(id)
+	if err != nil {
+		return 0, err
+	}
+	s.debugger.mu.Lock()
+	defer s.debugger.mu.Unlock()
+	s.debugger.breakpoints = append(s.debugger.breakpoints, bp)
+	return len(s.debugger.breakpoints), nil
+}
+
+// ClearBreakpoints removes all breakpoints of the session.
+func (ds *DebugSessions) ClearBreakpoints(id string) error {
+	s, err := ds.get(id)
+	if err != nil {
+		return err
+	}
+	s.debugger.mu.Lock()
+	defer s.debugger.mu.Unlock()
+	s.debugger.breakpoints = nil
+	return nil
+}
+
+// Inspect returns the stack, the memory or the storage of the paused contract,
+// the storage contains only the items accessed so far.
+func (ds *DebugSessions) Inspect(id string, what string) (interface{}, error) {
+	s, err := ds.get(id)
+	if err != nil {
+		return nil, err
+	}
+	return s.inspect(what)
+}
+
+// Stop aborts the execution of the session and drops it.
+func (ds *DebugSessions) Stop(id string) error {
+	ds.mu.Lock()
+	s, ok := ds.sessions[id]
+	ds.mu.Unlock()
+	if !ok || !ds.remove(id, s) {
+		return fmt.Errorf("debug session %s not found", id)
+	}
+	s.debugger.stop()
+	<-s.done
+	return nil
+}
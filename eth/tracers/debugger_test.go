@@ -0,0 +1,189 @@
+package tracers
+
+import (
+	"context"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/hexutil"
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/params"
+	"github.com/ledgerwatch/turbo-geth/tests"
+)
+
+// startDebugSession starts the session of the call of the contract storing 1 at
+// the slot 0 and 2 into the memory.
+func startDebugSession(t *testing.T, sessions *DebugSessions) *DebugSessionStart {
+	var (
+		from     = common.HexToAddress("0x1000")
+		contract = common.HexToAddress("0x2000")
+		code     = []byte{
+			byte(vm.PUSH1), 1, byte(vm.PUSH1), 0, byte(vm.SSTORE),
+			byte(vm.PUSH1), 2, byte(vm.PUSH1), 0, byte(vm.MSTORE),
+			byte(vm.STOP),
+		}
+	)
+	db := ethdb.NewMemDatabase()
+	t.Cleanup(db.Close)
+	ctx := params.TestChainConfig.WithEIPsFlags(context.Background(), big.NewInt(1))
+	statedb, _, err := tests.MakePreState(ctx, db, core.GenesisAlloc{contract: {Code: code, Balance: big.NewInt(0)}}, 0)
+	if err != nil {
+		t.Fatalf("Could not make prestate: %v", err)
+	}
+	start, err := sessions.Start(func(tracer vm.Tracer) (*core.ExecutionResult, error) {
+		evmContext := vm.Context{
+			CanTransfer: core.CanTransfer,
+			Transfer:    core.Transfer,
+			BlockNumber: big.NewInt(1),
+		}
+		evm := vm.NewEVM(evmContext, statedb, params.TestChainConfig, vm.Config{Debug: true, Tracer: tracer}, nil)
+		gas := uint64(100000)
+		ret, left, err := evm.Call(vm.AccountRef(from), contract, nil, gas, new(uint256.Int))
+		return &core.ExecutionResult{UsedGas: gas - left, Err: err, ReturnData: ret}, nil
+	})
+	if err != nil {
+		t.Fatalf("failed to start the session: %v", err)
+	}
+	return start
+}
+
+func checkDebugState(t *testing.T, state *DebugState, err error, pc uint64, op string) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if state.Finished || state.PC != pc || state.Op != op {
+		t.Fatalf("expected %s at %d, got %+v", op, pc, state)
+	}
+}
+
+func TestDebugSession(t *testing.T) {
+	sessions := NewDebugSessions()
+	start := startDebugSession(t, sessions)
+	id := start.Session
+	checkDebugState(t, start.State, nil, 0, "PUSH1")
+	if start.State.Depth != 1 || start.State.Address != common.HexToAddress("0x2000") {
+		t.Fatalf("unexpected first state %+v", start.State)
+	}
+
+	state, err := sessions.Step(id)
+	checkDebugState(t, state, err, 2, "PUSH1")
+
+	if _, err = sessions.Breakpoint(id, Breakpoint{Op: new(string)}); err == nil {
+		t.Fatal("expected error for the unknown opcode")
+	}
+	op := "sstore"
+	if n, err := sessions.Breakpoint(id, Breakpoint{Op: &op}); err != nil || n != 1 {
+		t.Fatalf("failed to add the breakpoint: %d %v", n, err)
+	}
+	state, err = sessions.Continue(id)
+	checkDebugState(t, state, err, 4, "SSTORE")
+
+	stack, err := sessions.Inspect(id, "stack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items := stack.([]*hexutil.Big); len(items) != 2 || items[0].ToInt().Int64() != 1 || items[1].ToInt().Int64() != 0 {
+		t.Fatalf("unexpected stack %v", items)
+	}
+	storage, err := sessions.Inspect(id, "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := storage.(map[common.Hash]common.Hash)[common.Hash{}]; value != (common.Hash{}) {
+		t.Fatalf("expected the empty slot before SSTORE, got %x", value)
+	}
+	state, err = sessions.Step(id)
+	checkDebugState(t, state, err, 5, "PUSH1")
+	storage, _ = sessions.Inspect(id, "storage")
+	if value := storage.(map[common.Hash]common.Hash)[common.Hash{}]; value != common.BigToHash(big.NewInt(1)) {
+		t.Fatalf("expected 1 in the slot after SSTORE, got %x", value)
+	}
+	if _, err = sessions.Inspect(id, "registers"); err == nil {
+		t.Fatal("expected error for the unknown inspection")
+	}
+
+	pc := uint64(10)
+	if _, err = sessions.Breakpoint(id, Breakpoint{PC: &pc}); err != nil {
+		t.Fatal(err)
+	}
+	state, err = sessions.Continue(id)
+	checkDebugState(t, state, err, 10, "STOP")
+	memory, _ := sessions.Inspect(id, "memory")
+	if data := memory.(hexutil.Bytes); len(data) != 32 || data[31] != 2 {
+		t.Fatalf("unexpected memory %x", data)
+	}
+
+	state, err = sessions.Continue(id)
+	if err != nil || !state.Finished || state.GasUsed == 0 || state.Error != "" {
+		t.Fatalf("expected the finished execution, got %+v %v", state, err)
+	}
+	// The finished session is dropped
+	if len(sessions.sessions) != 0 {
+		t.Fatalf("expected no sessions, got %d", len(sessions.sessions))
+	}
+	if _, err = sessions.Step(id); err == nil {
+		t.Fatal("expected error for the finished session")
+	}
+	if err = sessions.Stop(id); err == nil {
+		t.Fatal("expected error for the finished session")
+	}
+}
+
+func TestDebugSessionTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { debugSessionTimeout = timeout }(debugSessionTimeout)
+	debugSessionTimeout = 100 * time.Millisecond
+	sessions := NewDebugSessions()
+	id := startDebugSession(t, sessions).Session
+
+	// The commands keep the session
+	for i := 0; i < 3; i++ {
+		time.Sleep(debugSessionTimeout / 2)
+		if _, err := sessions.Inspect(id, "stack"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The abandoned session is dropped
+	time.Sleep(2 * debugSessionTimeout)
+	sessions.mu.Lock()
+	n := len(sessions.sessions)
+	sessions.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("expected no sessions, got %d", n)
+	}
+	if _, err := sessions.Step(id); err == nil {
+		t.Fatal("expected error for the abandoned session")
+	}
+}
+
+func TestDebugSessionStop(t *testing.T) {
+	sessions := NewDebugSessions()
+	id := startDebugSession(t, sessions).Session
+	// The paused execution is aborted
+	if err := sessions.Stop(id); err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions.sessions) != 0 {
+		t.Fatalf("expected no sessions, got %d", len(sessions.sessions))
+	}
+	for i := 0; i < maxDebugSessions; i++ {
+		startDebugSession(t, sessions)
+	}
+	if _, err := sessions.Start(func(tracer vm.Tracer) (*core.ExecutionResult, error) {
+		t.Fatal("unexpected execution")
+		return nil, nil
+	}); err == nil {
+		t.Fatal("expected error for too many sessions")
+	}
+	for id := range sessions.sessions {
+		if err := sessions.Stop(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package tracers
+
+import (
+	"encoding/json"
+	"sync/atomic"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/log"
+)
+
+// ResultTracer is a vm.Tracer assembling a JSON result of the traced transaction,
+// implemented by the JavaScript tracer and by the native ones.
+type ResultTracer interface {
+	vm.Tracer
+
+	// GetResult returns the result of the tracing, or any accumulated error.
+	GetResult() (json.RawMessage, error)
+
+	// Stop terminates execution of the tracer at the first opportune moment.
+	Stop(err error)
+}
+
+// natives contains the built in Go tracers by name, they replace the JavaScript
+// tracers of the same names. stateDiffTracer has no JavaScript version.
+var natives = map[string]func() ResultTracer{
+	"callTracer":      func() ResultTracer { return newCallTracer() },
+	"prestateTracer":  func() ResultTracer { return newPrestateTracer() },
+	"4byteTracer":     func() ResultTracer { return newFourByteTracer() },
+	"stateDiffTracer": func() ResultTracer { return newStateDiffTracer() },
+}
+
+// NewTracer instantiates the tracer for the TraceConfig.Tracer value: the native
+// tracer if there is one of the name, or the JavaScript tracer otherwise.
+func NewTracer(code string) (ResultTracer, error) {
+	if constructor, ok := natives[code]; ok {
+		return constructor(), nil
+	}
+	return New(code)
+}
+
+// nativeTracer contains the parts common to the native tracers: the interruption
+// and no-op implementations of the hooks they don't need.
+type nativeTracer struct {
+	interrupt uint32 // Atomic flag to signal execution interruption
+	reason    error  // Textual reason for the interruption
+	err       error  // Error, if one has occurred
+}
+
+// Stop terminates execution of the tracer at the first opportune moment.
+func (t *nativeTracer) Stop(err error) {
+	t.reason = err
+	atomic.StoreUint32(&t.interrupt, 1)
+}
+
+// stopped reports whether the tracing has to be skipped, because of an error or
+// an interruption.
+func (t *nativeTracer) stopped() bool {
+	if t.err != nil {
+		return true
+	}
+	if atomic.LoadUint32(&t.interrupt) > 0 {
+		t.err = t.reason
+		return true
+	}
+	return false
+}
+
+func (t *nativeTracer) CaptureCreate(creator, creation common.Address) error {
+	return nil
+}
+
+func (t *nativeTracer) CaptureAccountRead(account common.Address) error {
+	return nil
+}
+
+func (t *nativeTracer) CaptureAccountWrite(account common.Address) error {
+	return nil
+}
+
+// memorySlice returns a copy of the memory range [begin, end), or nil if it's out
+// of bounds, the same way as the memory of the JavaScript tracers does.
+func memorySlice(memory *vm.Memory, begin, end uint64) []byte {
+	if end == begin {
+		return []byte{}
+	}
+	if end < begin || uint64(memory.Len()) < end {
+		log.Warn("Tracer accessed out of bound memory", "available", memory.Len(), "offset", begin, "end", end)
+		return nil
+	}
+	return memory.GetCopy(begin, end-begin)
+}
+
+// isPrecompiled reports whether the address is one of the precompiled contracts.
+func isPrecompiled(addr common.Address) bool {
+	_, ok := vm.PrecompiledContractsIstanbul[addr]
+	return ok
+}
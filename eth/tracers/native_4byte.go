@@ -0,0 +1,90 @@
+package tracers
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/core/vm/stack"
+)
+
+// fourByteTracer is the native version of 4byte_tracer.js, it counts the 4byte
+// method identifiers of the calls, together with the sizes of their arguments.
+type fourByteTracer struct {
+	nativeTracer
+
+	ids   map[string]int // Number of calls by "<id>-<size of arguments>"
+	input []byte         // Input of the transaction
+}
+
+func newFourByteTracer() *fourByteTracer {
+	return &fourByteTracer{ids: map[string]int{}}
+}
+
+// store saves the given identifier and datasize.
+func (t *fourByteTracer) store(id []byte, size uint64) {
+	t.ids[fmt.Sprintf("0x%x-%d", id, size)]++
+}
+
+// CaptureStart implements the Tracer interface to initialize the tracing operation.
+func (t *fourByteTracer) CaptureStart(depth int, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) error {
+	if depth != 0 {
+		return nil
+	}
+	t.input = common.CopyBytes(input)
+	return nil
+}
+
+// CaptureState implements the Tracer interface to trace a single step of VM execution.
+func (t *fourByteTracer) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, st *stack.Stack, rStack *stack.ReturnStack, contract *vm.Contract, depth int, err error) error {
+	if t.stopped() {
+		return nil
+	}
+	// Skip any opcodes that are not internal calls, ct is the stack position of
+	// the input offset
+	var ct int
+	switch op {
+	case vm.CALL, vm.CALLCODE:
+		ct = 3
+	case vm.DELEGATECALL, vm.STATICCALL:
+		ct = 2
+	default:
+		return nil
+	}
+	// Skip any pre-compile invocations, those are just fancy opcodes
+	if isPrecompiled(common.Address(st.Back(1).Bytes20())) {
+		return nil
+	}
+	// Gather internal call details
+	if inSz := st.Back(ct + 1).Uint64(); inSz >= 4 {
+		inOff := st.Back(ct).Uint64()
+		t.store(memorySlice(memory, inOff, inOff+4), inSz-4)
+	}
+	return nil
+}
+
+// CaptureFault implements the Tracer interface to trace an execution fault
+// while running an opcode.
+func (t *fourByteTracer) CaptureFault(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, st *stack.Stack, rStack *stack.ReturnStack, contract *vm.Contract, depth int, err error) error {
+	return nil
+}
+
+// CaptureEnd is called after the call finishes to finalize the tracing.
+func (t *fourByteTracer) CaptureEnd(depth int, output []byte, gasUsed uint64, d time.Duration, err error) error {
+	return nil
+}
+
+// GetResult returns the counts of the identifiers, or any accumulated error.
+func (t *fourByteTracer) GetResult() (json.RawMessage, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	// Save the outer calldata also
+	if len(t.input) >= 4 {
+		t.store(t.input[:4], uint64(len(t.input)-4))
+	}
+	return json.Marshal(t.ids)
+}
@@ -0,0 +1,149 @@
+package tracers
+
+import (
+	"encoding/json"
+	"math/big"
+	"time"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/hexutil"
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/core/vm/stack"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+)
+
+// prestateAccount is an account of the prestateTracer result.
+type prestateAccount struct {
+	Balance *hexutil.Big                  `json:"balance"`
+	Nonce   uint64                        `json:"nonce"`
+	Code    hexutil.Bytes                 `json:"code"`
+	Storage map[common.Hash]hexutil.Bytes `json:"storage"`
+}
+
+// prestateTracer is the native version of prestate_tracer.js, it collects the
+// accounts and the storage accessed by the transaction, in their state before it.
+type prestateTracer struct {
+	nativeTracer
+
+	prestate map[common.Address]*prestateAccount
+	db       vm.IntraBlockState // State of the last step, the accounts are read from
+
+	// Transaction context
+	create bool
+	from   common.Address
+	to     common.Address
+	value  *big.Int
+}
+
+func newPrestateTracer() *prestateTracer {
+	return &prestateTracer{prestate: map[common.Address]*prestateAccount{}, value: new(big.Int)}
+}
+
+// lookupAccount injects the specified account into the prestate.
+func (t *prestateTracer) lookupAccount(addr common.Address) {
+	if _, ok := t.prestate[addr]; ok {
+		return
+	}
+	t.prestate[addr] = &prestateAccount{
+		Balance: (*hexutil.Big)(t.db.GetBalance(addr).ToBig()),
+		Nonce:   t.db.GetNonce(addr),
+		Code:    common.CopyBytes(t.db.GetCode(addr)),
+		Storage: map[common.Hash]hexutil.Bytes{},
+	}
+}
+
+// lookupStorage injects the specified storage entry of the given account into
+// the prestate.
+func (t *prestateTracer) lookupStorage(addr common.Address, key common.Hash) {
+	storage := t.prestate[addr].Storage
+	if _, ok := storage[key]; ok {
+		return
+	}
+	var value uint256.Int
+	t.db.GetState(addr, &key, &value)
+	storage[key] = value.Bytes()
+}
+
+// CaptureStart implements the Tracer interface to initialize the tracing operation.
+func (t *prestateTracer) CaptureStart(depth int, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) error {
+	if depth != 0 {
+		return nil
+	}
+	t.create, t.from, t.to, t.value = create, from, to, value
+	return nil
+}
+
+// CaptureState implements the Tracer interface to trace a single step of VM execution.
+func (t *prestateTracer) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, st *stack.Stack, rStack *stack.ReturnStack, contract *vm.Contract, depth int, err error) error {
+	if t.stopped() {
+		return nil
+	}
+	// Add the current account if we just started tracing
+	if t.db == nil {
+		t.db = env.IntraBlockState
+		// Balance will potentially be wrong here, since this will include the value
+		// sent along with the message. We fix that in GetResult.
+		t.lookupAccount(contract.Address())
+	}
+	// Whenever new state is accessed, add it to the prestate
+	switch op {
+	case vm.EXTCODECOPY, vm.EXTCODESIZE, vm.BALANCE:
+		t.lookupAccount(common.Address(st.Back(0).Bytes20()))
+	case vm.CREATE:
+		from := contract.Address()
+		t.lookupAccount(crypto.CreateAddress(from, t.db.GetNonce(from)))
+	case vm.CREATE2:
+		// stack: endowment, offset, size, salt
+		offset := st.Back(1).Uint64()
+		init := memorySlice(memory, offset, offset+st.Back(2).Uint64())
+		salt := st.Back(3).Bytes32()
+		t.lookupAccount(crypto.CreateAddress2(contract.Address(), salt, crypto.Keccak256(init)))
+	case vm.CALL, vm.CALLCODE, vm.DELEGATECALL, vm.STATICCALL:
+		t.lookupAccount(common.Address(st.Back(1).Bytes20()))
+	case vm.SSTORE, vm.SLOAD:
+		t.lookupStorage(contract.Address(), common.Hash(st.Back(0).Bytes32()))
+	}
+	return nil
+}
+
+// CaptureFault implements the Tracer interface to trace an execution fault
+// while running an opcode.
+func (t *prestateTracer) CaptureFault(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, st *stack.Stack, rStack *stack.ReturnStack, contract *vm.Contract, depth int, err error) error {
+	return nil
+}
+
+// CaptureEnd is called after the call finishes to finalize the tracing.
+func (t *prestateTracer) CaptureEnd(depth int, output []byte, gasUsed uint64, d time.Duration, err error) error {
+	return nil
+}
+
+// GetResult returns the accounts accessed by the transaction, or any accumulated
+// error. Transactions not executing any code have no prestate collected.
+func (t *prestateTracer) GetResult() (json.RawMessage, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	if t.db != nil {
+		// At this point, we need to deduct the 'value' from the
+		// outer transaction, and move it back to the origin
+		t.lookupAccount(t.from)
+
+		from := t.prestate[t.from]
+		fromBal := from.Balance.ToInt()
+		if to, ok := t.prestate[t.to]; ok {
+			to.Balance = (*hexutil.Big)(new(big.Int).Sub(to.Balance.ToInt(), t.value))
+		}
+		from.Balance = (*hexutil.Big)(new(big.Int).Add(fromBal, t.value))
+
+		// Decrement the caller's nonce, and remove empty create targets
+		from.Nonce--
+		if t.create {
+			// We can blindly delete the contract prestate, as any existing state would
+			// have caused the transaction to be rejected as invalid in the first place.
+			delete(t.prestate, t.to)
+		}
+	}
+	return json.Marshal(t.prestate)
+}
@@ -0,0 +1,132 @@
+package tracers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/hexutil"
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/core/vm/stack"
+	"github.com/ledgerwatch/turbo-geth/params"
+)
+
+// StateTracer is a tracer reading the changes of the transaction from the state it
+// runs on, the state has to be set before the execution.
+type StateTracer interface {
+	SetState(ibs vm.IntraBlockState, chainConfig *params.ChainConfig, blockNumber *big.Int)
+}
+
+// StateDiffAccount is an account of the stateDiff format of Parity, every value
+// is either "=" when unchanged, or {"+": new} for the created account, {"-": old}
+// for the deleted one, or {"*": {"from": old, "to": new}}.
+type StateDiffAccount struct {
+	Balance interface{}                 `json:"balance"`
+	Code    interface{}                 `json:"code"`
+	Nonce   interface{}                 `json:"nonce"`
+	Storage map[common.Hash]interface{} `json:"storage"`
+}
+
+type stateDiffChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// stateDiffTracer reports the accounts changed by the transaction, with their
+// values before and after it, in the stateDiff format of Parity. The values before
+// the transaction come from the journal of the state, so the result has to be
+// taken before the transaction is finalized.
+type stateDiffTracer struct {
+	nativeTracer
+
+	ibs         vm.IntraBlockState
+	chainConfig *params.ChainConfig
+	blockNumber *big.Int
+}
+
+func newStateDiffTracer() *stateDiffTracer {
+	return &stateDiffTracer{}
+}
+
+// SetState implements the StateTracer interface.
+func (t *stateDiffTracer) SetState(ibs vm.IntraBlockState, chainConfig *params.ChainConfig, blockNumber *big.Int) {
+	t.ibs, t.chainConfig, t.blockNumber = ibs, chainConfig, blockNumber
+}
+
+func (t *stateDiffTracer) CaptureStart(depth int, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) error {
+	return nil
+}
+
+func (t *stateDiffTracer) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, st *stack.Stack, rStack *stack.ReturnStack, contract *vm.Contract, depth int, err error) error {
+	t.stopped()
+	return nil
+}
+
+func (t *stateDiffTracer) CaptureFault(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, st *stack.Stack, rStack *stack.ReturnStack, contract *vm.Contract, depth int, err error) error {
+	return nil
+}
+
+func (t *stateDiffTracer) CaptureEnd(depth int, output []byte, gasUsed uint64, d time.Duration, err error) error {
+	return nil
+}
+
+// stateDiffValue returns the diff of one value of the account.
+func stateDiffValue(d *state.AccountDiff, before, after interface{}, equal bool) interface{} {
+	switch {
+	case !d.Existed:
+		return map[string]interface{}{"+": after}
+	case !d.Exists:
+		return map[string]interface{}{"-": before}
+	case equal:
+		return "="
+	default:
+		return map[string]interface{}{"*": stateDiffChange{From: before, To: after}}
+	}
+}
+
+// GetResult returns the changes of the accounts, or any accumulated error.
+func (t *stateDiffTracer) GetResult() (json.RawMessage, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	if t.ibs == nil {
+		return nil, errors.New("state of the transaction is not set")
+	}
+	ibs, ok := t.ibs.(*state.IntraBlockState)
+	if !ok {
+		return nil, fmt.Errorf("state diff is not supported by %T", t.ibs)
+	}
+	ctx := t.chainConfig.WithEIPsFlags(context.Background(), t.blockNumber)
+	return json.Marshal(StateDiff(ibs.TxStateDiff(ctx)))
+}
+
+// StateDiff converts the changes of the accounts into the stateDiff format of
+// Parity.
+func StateDiff(diffs []*state.AccountDiff) map[common.Address]*StateDiffAccount {
+	result := make(map[common.Address]*StateDiffAccount, len(diffs))
+	for _, d := range diffs {
+		account := &StateDiffAccount{
+			Balance: stateDiffValue(d, (*hexutil.Big)(d.BalanceBefore.ToBig()), (*hexutil.Big)(d.BalanceAfter.ToBig()),
+				d.BalanceBefore == d.BalanceAfter),
+			Code: stateDiffValue(d, hexutil.Bytes(d.CodeBefore), hexutil.Bytes(d.CodeAfter),
+				string(d.CodeBefore) == string(d.CodeAfter)),
+			Nonce: stateDiffValue(d, hexutil.Uint64(d.NonceBefore), hexutil.Uint64(d.NonceAfter),
+				d.NonceBefore == d.NonceAfter),
+			Storage: map[common.Hash]interface{}{},
+		}
+		for key, s := range d.Storage {
+			// born accounts report the set items only, died ones the items which were set
+			if !d.Existed && s.After.IsZero() || !d.Exists && s.Before.IsZero() {
+				continue
+			}
+			account.Storage[key] = stateDiffValue(d, common.Hash(s.Before.Bytes32()), common.Hash(s.After.Bytes32()), false)
+		}
+		result[d.Address] = account
+	}
+	return result
+}
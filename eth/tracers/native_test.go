@@ -0,0 +1,206 @@
+package tracers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/hexutil"
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/rlp"
+	"github.com/ledgerwatch/turbo-geth/tests"
+)
+
+// callTracerTests returns the names of the call tracer test files.
+func callTracerTests(t *testing.T) []string {
+	files, err := ioutil.ReadDir("testdata")
+	if err != nil {
+		t.Fatalf("failed to retrieve tracer test suite: %v", err)
+	}
+	var names []string
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), "call_tracer_") {
+			names = append(names, file.Name())
+		}
+	}
+	return names
+}
+
+// runTracerTest executes the transaction of the call tracer test file with the
+// tracer and returns the test and the result of the tracer.
+func runTracerTest(t *testing.T, name string, tracer ResultTracer) (*callTracerTest, json.RawMessage) {
+	blob, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("failed to read testcase: %v", err)
+	}
+	test := new(callTracerTest)
+	if err := json.Unmarshal(blob, test); err != nil {
+		t.Fatalf("failed to parse testcase: %v", err)
+	}
+	tx := new(types.Transaction)
+	if err := rlp.DecodeBytes(common.FromHex(test.Input), tx); err != nil {
+		t.Fatalf("failed to parse testcase input: %v", err)
+	}
+	signer := types.MakeSigner(test.Genesis.Config, new(big.Int).SetUint64(uint64(test.Context.Number)))
+	origin, _ := signer.Sender(tx)
+
+	evmContext := vm.Context{
+		CanTransfer: core.CanTransfer,
+		Transfer:    core.Transfer,
+		Origin:      origin,
+		Coinbase:    test.Context.Miner,
+		BlockNumber: new(big.Int).SetUint64(uint64(test.Context.Number)),
+		Time:        new(big.Int).SetUint64(uint64(test.Context.Time)),
+		Difficulty:  (*big.Int)(test.Context.Difficulty),
+		GasLimit:    uint64(test.Context.GasLimit),
+		GasPrice:    tx.GasPrice().ToBig(),
+	}
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+
+	ctx := test.Genesis.Config.WithEIPsFlags(context.Background(), big.NewInt(1))
+	statedb, _, err := tests.MakePreState(ctx, db, test.Genesis.Alloc, 0)
+	if err != nil {
+		t.Fatalf("Could not make prestate: %v", err)
+	}
+	if st, ok := tracer.(StateTracer); ok {
+		st.SetState(statedb, test.Genesis.Config, evmContext.BlockNumber)
+	}
+	evm := vm.NewEVM(evmContext, statedb, test.Genesis.Config, vm.Config{Debug: true, Tracer: tracer}, nil)
+
+	msg, err := tx.AsMessage(signer)
+	if err != nil {
+		t.Fatalf("failed to prepare transaction for tracing: %v", err)
+	}
+	st := core.NewStateTransition(evm, msg, new(core.GasPool).AddGas(tx.Gas()))
+	if _, err = st.TransitionDb(); err != nil {
+		t.Fatalf("failed to execute transaction: %v", err)
+	}
+	res, err := tracer.GetResult()
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	return test, res
+}
+
+func TestNativeCallTracer(t *testing.T) {
+	for _, name := range callTracerTests(t) {
+		name := name
+		t.Run(camel(strings.TrimSuffix(strings.TrimPrefix(name, "call_tracer_"), ".json")), func(t *testing.T) {
+			t.Parallel()
+
+			tracer, err := NewTracer("callTracer")
+			if err != nil {
+				t.Fatalf("failed to create call tracer: %v", err)
+			}
+			if _, ok := tracer.(*callTracer); !ok {
+				t.Fatalf("expected the native call tracer, got %T", tracer)
+			}
+			test, res := runTracerTest(t, name, tracer)
+			ret := new(callTrace)
+			if err := json.Unmarshal(res, ret); err != nil {
+				t.Fatalf("failed to unmarshal trace result: %v", err)
+			}
+			if !reflect.DeepEqual(ret, test.Result) {
+				t.Fatalf("trace mismatch: \nhave %+v\nwant %+v", ret, test.Result)
+			}
+		})
+	}
+}
+
+// Runs the native and the JavaScript versions of the tracers on the call tracer
+// test files and compares their results.
+func TestNativeTracersMatchJavaScript(t *testing.T) {
+	for _, tracerName := range []string{"callTracer", "prestateTracer", "4byteTracer"} {
+		for _, name := range callTracerTests(t) {
+			tracerName, name := tracerName, name
+			t.Run(tracerName+"/"+camel(strings.TrimSuffix(strings.TrimPrefix(name, "call_tracer_"), ".json")), func(t *testing.T) {
+				t.Parallel()
+
+				jsTracer, err := New(tracerName)
+				if err != nil {
+					t.Fatalf("failed to create JavaScript tracer: %v", err)
+				}
+				_, jsRes := runTracerTest(t, name, jsTracer)
+				_, nativeRes := runTracerTest(t, name, natives[tracerName]())
+
+				var have, want interface{}
+				if err := json.Unmarshal(nativeRes, &have); err != nil {
+					t.Fatalf("failed to unmarshal native result: %v", err)
+				}
+				if err := json.Unmarshal(jsRes, &want); err != nil {
+					t.Fatalf("failed to unmarshal JavaScript result: %v", err)
+				}
+				// The execution times differ
+				if tracerName == "callTracer" {
+					delete(have.(map[string]interface{}), "time")
+					delete(want.(map[string]interface{}), "time")
+				}
+				if !reflect.DeepEqual(have, want) {
+					t.Fatalf("result mismatch: \nhave %s\nwant %s", nativeRes, jsRes)
+				}
+			})
+		}
+	}
+}
+
+func TestNativeStateDiffTracer(t *testing.T) {
+	for _, name := range callTracerTests(t) {
+		name := name
+		t.Run(camel(strings.TrimSuffix(strings.TrimPrefix(name, "call_tracer_"), ".json")), func(t *testing.T) {
+			t.Parallel()
+
+			test, res := runTracerTest(t, name, newStateDiffTracer())
+			var diff map[common.Address]struct {
+				Balance interface{}                 `json:"balance"`
+				Nonce   interface{}                 `json:"nonce"`
+				Code    interface{}                 `json:"code"`
+				Storage map[common.Hash]interface{} `json:"storage"`
+			}
+			if err := json.Unmarshal(res, &diff); err != nil {
+				t.Fatalf("failed to unmarshal state diff: %v", err)
+			}
+			// The sender pays for the gas and bumps the nonce
+			sender, ok := diff[test.Result.From]
+			if !ok {
+				t.Fatalf("sender %x missing from the state diff: %s", test.Result.From, res)
+			}
+			nonce := uint64(test.Genesis.Alloc[test.Result.From].Nonce)
+			want := map[string]interface{}{"*": map[string]interface{}{
+				"from": hexutil.Uint64(nonce).String(),
+				"to":   hexutil.Uint64(nonce + 1).String(),
+			}}
+			if !reflect.DeepEqual(sender.Nonce, want) {
+				t.Fatalf("nonce mismatch: have %v, want %v", sender.Nonce, want)
+			}
+			if _, ok := sender.Balance.(map[string]interface{})["*"]; !ok {
+				t.Fatalf("expected changed balance of the sender, got %v", sender.Balance)
+			}
+			if sender.Code != "=" {
+				t.Fatalf("expected unchanged code of the sender, got %v", sender.Code)
+			}
+		})
+	}
+}
+
+func TestNativeTracerStop(t *testing.T) {
+	errStopped := errors.New("execution timeout")
+	tracer := newCallTracer()
+	tracer.Stop(errStopped)
+	if err := tracer.CaptureState(nil, 0, vm.STOP, 0, 0, nil, nil, nil, nil, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tracer.GetResult(); err != errStopped {
+		t.Fatalf("expected %v, got %v", errStopped, err)
+	}
+}
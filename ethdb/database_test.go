@@ -315,3 +315,28 @@ func testWalk(db Database, t *testing.T) {
 
 	assert.Equal(t, keysInRange, gotKeys)
 }
+
+func TestLMDB_OpenReadOnly(t *testing.T) {
+	dirname, err := ioutil.TempDir(os.TempDir(), "ethdb_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirname)
+	dbPath := path.Join(dirname, "db_lmdb")
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, db.Put(dbutils.PlainStateBucket, []byte{1}, []byte{2}))
+	db.Close()
+
+	db, err = OpenReadOnly(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	v, err := db.Get(dbutils.PlainStateBucket, []byte{1})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{2}, v)
+	assert.Error(t, db.Put(dbutils.PlainStateBucket, []byte{1}, []byte{3}))
+}
@@ -18,11 +18,13 @@ package dbtest
 
 import (
 	"bytes"
+	"context"
 	"reflect"
 	"sort"
 	"testing"
 
 	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
 )
 
@@ -275,6 +277,150 @@ func TestDatabaseSuite(t *testing.T, New func() dataStore) {
 	})
 }
 
+// TestCursorSuite runs a suite of tests of the positioning methods (Last, Prev, SeekExact) of the cursors
+// against a KV implementation. Data is written into writeDB and read from readDB, which are different
+// objects for the remote KV (client and the database served by the server)
+func TestCursorSuite(t *testing.T, writeDB ethdb.KV, readDB ethdb.KV) {
+	bucket := dbutils.Buckets[0]
+	content := [][]byte{{1}, {2, 1}, {2, 2}, {2, 3}, {3}, {4, 0}}
+	if err := writeDB.Update(context.Background(), func(tx ethdb.Tx) error {
+		b := tx.Bucket(bucket)
+		for _, k := range content {
+			if err := b.Put(k, append([]byte{0xff}, k...)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to write the content: %v", err)
+	}
+
+	// view runs f with a fresh cursor over the bucket, restricted to the prefix
+	view := func(t *testing.T, prefix []byte, f func(c ethdb.Cursor)) {
+		if err := readDB.View(context.Background(), func(tx ethdb.Tx) error {
+			f(tx.Bucket(bucket).Cursor().Prefix(prefix))
+			return nil
+		}); err != nil {
+			t.Fatalf("view failed: %v", err)
+		}
+	}
+	check := func(t *testing.T, op string, expected []byte, k, v []byte, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", op, err)
+		}
+		if !bytes.Equal(k, expected) {
+			t.Fatalf("%s: key mismatch: have %x, want %x", op, k, expected)
+		}
+		if expected != nil && !bytes.Equal(v, append([]byte{0xff}, expected...)) {
+			t.Fatalf("%s: value mismatch for the key %x: have %x", op, k, v)
+		}
+	}
+
+	t.Run("Reverse", func(t *testing.T) {
+		view(t, nil, func(c ethdb.Cursor) {
+			k, v, err := c.Last()
+			for i := len(content) - 1; i >= 0; i-- {
+				check(t, "Last/Prev", content[i], k, v, err)
+				k, v, err = c.Prev()
+			}
+			check(t, "Prev past the first key", nil, k, v, err)
+		})
+	})
+
+	t.Run("ReversePrefix", func(t *testing.T) {
+		view(t, []byte{2}, func(c ethdb.Cursor) {
+			k, v, err := c.Last()
+			check(t, "Last", []byte{2, 3}, k, v, err)
+			k, v, err = c.Prev()
+			check(t, "Prev", []byte{2, 2}, k, v, err)
+			k, v, err = c.Prev()
+			check(t, "Prev", []byte{2, 1}, k, v, err)
+			k, v, err = c.Prev()
+			check(t, "Prev out of prefix", nil, k, v, err)
+		})
+		view(t, []byte{5}, func(c ethdb.Cursor) {
+			k, v, err := c.Last()
+			check(t, "Last of empty prefix", nil, k, v, err)
+		})
+	})
+
+	t.Run("ChangeDirection", func(t *testing.T) {
+		view(t, nil, func(c ethdb.Cursor) {
+			k, v, err := c.Seek([]byte{2, 2})
+			check(t, "Seek", []byte{2, 2}, k, v, err)
+			k, v, err = c.Prev()
+			check(t, "Prev", []byte{2, 1}, k, v, err)
+			k, v, err = c.Next()
+			check(t, "Next", []byte{2, 2}, k, v, err)
+			k, v, err = c.Next()
+			check(t, "Next", []byte{2, 3}, k, v, err)
+		})
+		// With prefetching the remote cursor runs ahead of the caller
+		view(t, nil, func(c ethdb.Cursor) {
+			c = c.Prefetch(4)
+			k, v, err := c.First()
+			check(t, "First", []byte{1}, k, v, err)
+			k, v, err = c.Next()
+			check(t, "Next", []byte{2, 1}, k, v, err)
+			k, v, err = c.Prev()
+			check(t, "Prev", []byte{1}, k, v, err)
+		})
+	})
+
+	t.Run("SeekExact", func(t *testing.T) {
+		view(t, nil, func(c ethdb.Cursor) {
+			k, v, err := c.SeekExact([]byte{2, 2})
+			check(t, "SeekExact", []byte{2, 2}, k, v, err)
+			k, v, err = c.SeekExact([]byte{2})
+			check(t, "SeekExact of absent key", nil, k, v, err)
+			k, v, err = c.SeekExact([]byte{4, 0})
+			check(t, "SeekExact", []byte{4, 0}, k, v, err)
+		})
+		view(t, []byte{2}, func(c ethdb.Cursor) {
+			k, v, err := c.SeekExact([]byte{3})
+			check(t, "SeekExact out of prefix", nil, k, v, err)
+		})
+	})
+
+	t.Run("NoValues", func(t *testing.T) {
+		view(t, []byte{2}, func(c ethdb.Cursor) {
+			nc := c.NoValues()
+			k, vSize, err := nc.Last()
+			if err != nil || !bytes.Equal(k, []byte{2, 3}) || vSize != 3 {
+				t.Fatalf("Last: have %x (value size %d, err %v)", k, vSize, err)
+			}
+			k, vSize, err = nc.Prev()
+			if err != nil || !bytes.Equal(k, []byte{2, 2}) || vSize != 3 {
+				t.Fatalf("Prev: have %x (value size %d, err %v)", k, vSize, err)
+			}
+			k, vSize, err = nc.SeekExact([]byte{2, 1})
+			if err != nil || !bytes.Equal(k, []byte{2, 1}) || vSize != 3 {
+				t.Fatalf("SeekExact: have %x (value size %d, err %v)", k, vSize, err)
+			}
+			k, _, err = nc.Prev()
+			if err != nil || k != nil {
+				t.Fatalf("Prev out of prefix: have %x (err %v)", k, err)
+			}
+		})
+		view(t, nil, func(c ethdb.Cursor) {
+			nc := c.NoValues()
+			k, _, err := nc.Seek([]byte{0xff})
+			if err != nil || k != nil {
+				t.Fatalf("Seek past the end: have %x (err %v)", k, err)
+			}
+			k, _, err = nc.Last()
+			if err != nil || k == nil {
+				t.Fatalf("Last: have %x (err %v)", k, err)
+			}
+			k, _, err = nc.Next()
+			if err != nil || k != nil {
+				t.Fatalf("Next past the end: have %x (err %v)", k, err)
+			}
+		})
+	})
+}
+
 func iterateKeys(db ethdb.Database) []string {
 	return iterateKeysFromKey(db, []byte{})
 }
@@ -288,3 +434,152 @@ func iterateKeysFromKey(db ethdb.Database, fromKey []byte) []string {
 	sort.Strings(keys)
 	return keys
 }
+
+// TestDupSortSuite runs a suite of tests of the buckets with dbutils.DupSort flag against a KV implementation.
+// The bucket must be configured as DupSort when the database is opened
+func TestDupSortSuite(t *testing.T, db ethdb.KV, bucket []byte) {
+	ctx := context.Background()
+	type pair struct{ k, v []byte }
+	content := []pair{
+		{[]byte{1, 0}, []byte{3}}, {[]byte{1, 0}, []byte{1}}, {[]byte{1, 0}, []byte{2}}, {[]byte{1, 0}, []byte{2}},
+		{[]byte{2, 0}, []byte{5}},
+		{[]byte{3, 0}, []byte{9}}, {[]byte{3, 0}, []byte{1}},
+	}
+	update := func(t *testing.T, f func(b ethdb.Bucket) error) {
+		if err := db.Update(ctx, func(tx ethdb.Tx) error { return f(tx.Bucket(bucket)) }); err != nil {
+			t.Fatalf("update failed: %v", err)
+		}
+	}
+	view := func(t *testing.T, f func(b ethdb.Bucket) error) {
+		if err := db.View(ctx, func(tx ethdb.Tx) error { return f(tx.Bucket(bucket)) }); err != nil {
+			t.Fatalf("view failed: %v", err)
+		}
+	}
+	all := func(t *testing.T) []pair {
+		var res []pair
+		view(t, func(b ethdb.Bucket) error {
+			return b.Cursor().Walk(func(k, v []byte) (bool, error) {
+				res = append(res, pair{common.CopyBytes(k), common.CopyBytes(v)})
+				return true, nil
+			})
+		})
+		return res
+	}
+	check := func(t *testing.T, op string, expK, expV []byte, k, v []byte, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", op, err)
+		}
+		if !bytes.Equal(k, expK) || !bytes.Equal(v, expV) {
+			t.Fatalf("%s: have (%x, %x), want (%x, %x)", op, k, v, expK, expV)
+		}
+	}
+
+	update(t, func(b ethdb.Bucket) error {
+		for _, p := range content {
+			if err := b.Put(p.k, p.v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	t.Run("Iterate", func(t *testing.T) {
+		expected := []pair{
+			{[]byte{1, 0}, []byte{1}}, {[]byte{1, 0}, []byte{2}}, {[]byte{1, 0}, []byte{3}},
+			{[]byte{2, 0}, []byte{5}},
+			{[]byte{3, 0}, []byte{1}}, {[]byte{3, 0}, []byte{9}},
+		}
+		if have := all(t); !reflect.DeepEqual(have, expected) {
+			t.Fatalf("content mismatch: have %x, want %x", have, expected)
+		}
+		view(t, func(b ethdb.Bucket) error {
+			k, v, err := b.Cursor().Last()
+			check(t, "Last", []byte{3, 0}, []byte{9}, k, v, err)
+			var keys int
+			if err := b.Cursor().Prefix([]byte{1}).NoValues().Walk(func(k []byte, vSize uint32) (bool, error) {
+				if !bytes.Equal(k, []byte{1, 0}) || vSize != 1 {
+					t.Fatalf("NoValues: have %x (value size %d)", k, vSize)
+				}
+				keys++
+				return true, nil
+			}); err != nil {
+				return err
+			}
+			if keys != 3 {
+				t.Fatalf("NoValues: have %d pairs, want 3", keys)
+			}
+			return nil
+		})
+	})
+
+	t.Run("Get", func(t *testing.T) {
+		view(t, func(b ethdb.Bucket) error {
+			v, err := b.Get([]byte{1, 0})
+			check(t, "Get", nil, []byte{1}, nil, v, err)
+			v, err = b.Get([]byte{4, 0})
+			check(t, "Get of absent key", nil, nil, nil, v, err)
+			return nil
+		})
+	})
+
+	t.Run("Dups", func(t *testing.T) {
+		view(t, func(b ethdb.Bucket) error {
+			c := b.CursorDupSort()
+			k, v, err := c.SeekBothRange([]byte{1, 0}, []byte{2})
+			check(t, "SeekBothRange", []byte{1, 0}, []byte{2}, k, v, err)
+			k, v, err = c.SeekBothRange([]byte{1, 0}, []byte{4})
+			check(t, "SeekBothRange past the values", nil, nil, k, v, err)
+
+			k, v, err = c.SeekExact([]byte{1, 0})
+			check(t, "SeekExact", []byte{1, 0}, []byte{1}, k, v, err)
+			k, v, err = c.NextDup()
+			check(t, "NextDup", []byte{1, 0}, []byte{2}, k, v, err)
+			k, v, err = c.NextDup()
+			check(t, "NextDup", []byte{1, 0}, []byte{3}, k, v, err)
+			k, v, err = c.NextDup()
+			check(t, "NextDup past the values", nil, nil, k, v, err)
+			k, v, err = c.NextNoDup()
+			check(t, "NextNoDup", []byte{2, 0}, []byte{5}, k, v, err)
+			k, v, err = c.NextNoDup()
+			check(t, "NextNoDup", []byte{3, 0}, []byte{1}, k, v, err)
+
+			k, v, err = c.SeekBothRange([]byte{3, 0}, []byte{5})
+			check(t, "SeekBothRange", []byte{3, 0}, []byte{9}, k, v, err)
+			v, err = c.FirstDup()
+			check(t, "FirstDup", nil, []byte{1}, nil, v, err)
+			k, v, err = c.NextNoDup()
+			check(t, "NextNoDup past the last key", nil, nil, k, v, err)
+			return nil
+		})
+	})
+
+	t.Run("Unpositioned", func(t *testing.T) {
+		// the cursors are opened lazily, the dup methods called first must open them too,
+		// the results are not checked as the backends treat the unpositioned cursor differently
+		view(t, func(b ethdb.Bucket) error {
+			_, _ = b.CursorDupSort().FirstDup()
+			_, _, _ = b.CursorDupSort().NextDup()
+			return nil
+		})
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		update(t, func(b ethdb.Bucket) error {
+			c := b.CursorDupSort()
+			k, v, err := c.SeekBothRange([]byte{1, 0}, []byte{2})
+			check(t, "SeekBothRange", []byte{1, 0}, []byte{2}, k, v, err)
+			return c.DeleteCurrent()
+		})
+		update(t, func(b ethdb.Bucket) error {
+			return b.Delete([]byte{3, 0})
+		})
+		expected := []pair{
+			{[]byte{1, 0}, []byte{1}}, {[]byte{1, 0}, []byte{3}},
+			{[]byte{2, 0}, []byte{5}},
+		}
+		if have := all(t); !reflect.DeepEqual(have, expected) {
+			t.Fatalf("content mismatch after deletes: have %x, want %x", have, expected)
+		}
+	})
+}
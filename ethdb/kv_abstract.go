@@ -4,6 +4,7 @@ import (
 	"context"
 
 	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
 )
 
 type KV interface {
@@ -13,8 +14,13 @@ type KV interface {
 
 	Begin(ctx context.Context, writable bool) (Tx, error)
 	IdealBatchSize() int
+	AllBuckets() dbutils.BucketsCfg
 }
 
+// BucketConfigsFunc - function modifying the default configuration of the buckets (see dbutils.DefaultBucketsConfig),
+// used by the databases to open the buckets with non-default flags
+type BucketConfigsFunc func(defaultBuckets dbutils.BucketsCfg) dbutils.BucketsCfg
+
 type NativeGet interface {
 	Get(ctx context.Context, bucket, key []byte) ([]byte, error)
 	Has(ctx context.Context, bucket, key []byte) (bool, error)
@@ -32,6 +38,7 @@ type Bucket interface {
 	Put(key []byte, value []byte) error
 	Delete(key []byte) error
 	Cursor() Cursor
+	CursorDupSort() CursorDupSort // only for the buckets with dbutils.DupSort flag
 
 	Size() (uint64, error)
 	Clear() error
@@ -47,6 +54,9 @@ type Cursor interface {
 	Seek(seek []byte) ([]byte, []byte, error)
 	SeekTo(seek []byte) ([]byte, []byte, error)
 	Next() ([]byte, []byte, error)
+	Prev() ([]byte, []byte, error)
+	Last() ([]byte, []byte, error)
+	SeekExact(key []byte) ([]byte, []byte, error) // returns nil key if the key is not present
 	Walk(walker func(k, v []byte) (bool, error)) error
 
 	Put(key []byte, value []byte) error
@@ -54,10 +64,26 @@ type Cursor interface {
 	Append(key []byte, value []byte) error // Danger: if provided data will not sorted (or bucket have old records which mess with new in sorting manner) - db will corrupt. Method also doesn't tolerate duplicates.
 }
 
+// CursorDupSort - cursor over a bucket with dbutils.DupSort flag, which keeps multiple sorted values (duplicates) per key.
+// Methods of Cursor iterate over all (key, value) pairs, Put adds one more value to the key, Delete removes all values of the key.
+// Bucket.Get returns the first value of the key
+type CursorDupSort interface {
+	Cursor
+
+	SeekBothRange(key, value []byte) ([]byte, []byte, error) // first value of the key which is >= value, nil key if there is none
+	FirstDup() ([]byte, error)                               // first value of the current key
+	NextDup() ([]byte, []byte, error)                        // next value of the current key, nil key if there is none
+	NextNoDup() ([]byte, []byte, error)                      // first value of the next key
+	DeleteCurrent() error                                    // deletes the current (key, value) pair
+}
+
 type NoValuesCursor interface {
 	First() ([]byte, uint32, error)
 	Seek(seek []byte) ([]byte, uint32, error)
 	Next() ([]byte, uint32, error)
+	Prev() ([]byte, uint32, error)
+	Last() ([]byte, uint32, error)
+	SeekExact(key []byte) ([]byte, uint32, error)
 	Walk(walker func(k []byte, vSize uint32) (bool, error)) error
 }
 
@@ -11,6 +11,7 @@ import (
 	"github.com/ledgerwatch/turbo-geth/common"
 	"github.com/ledgerwatch/turbo-geth/common/dbutils"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb/dbtest"
 	"github.com/ledgerwatch/turbo-geth/ethdb/remote/remotedbserver"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -61,6 +62,38 @@ func TestManagedTx(t *testing.T) {
 	}
 }
 
+func TestCursorSuite(t *testing.T) {
+	writeDBs, readDBs, closeAll := setupDatabases()
+	defer closeAll()
+
+	for i := range readDBs {
+		writeDB, readDB := writeDBs[i], readDBs[i]
+		t.Run(fmt.Sprintf("%T", readDB), func(t *testing.T) {
+			dbtest.TestCursorSuite(t, writeDB, readDB)
+		})
+	}
+}
+
+func TestDupSortSuite(t *testing.T) {
+	bucket := dbutils.Buckets[0]
+	dupSort := func(defaultBuckets dbutils.BucketsCfg) dbutils.BucketsCfg {
+		defaultBuckets[string(bucket)] = dbutils.BucketConfigItem{Flags: dbutils.DupSort}
+		return defaultBuckets
+	}
+	dbs := []ethdb.KV{
+		ethdb.NewBolt().InMem().WithBucketsConfig(dupSort).MustOpen(),
+		ethdb.NewBadger().InMem().WithBucketsConfig(dupSort).MustOpen(),
+		ethdb.NewLMDB().InMem().WithBucketsConfig(dupSort).MustOpen(),
+	}
+	for _, db := range dbs {
+		db := db
+		t.Run(fmt.Sprintf("%T", db), func(t *testing.T) {
+			defer db.Close()
+			dbtest.TestDupSortSuite(t, db, bucket)
+		})
+	}
+}
+
 func setupDatabases() (writeDBs []ethdb.KV, readDBs []ethdb.KV, close func()) {
 	writeDBs = []ethdb.KV{
 		ethdb.NewBolt().InMem().MustOpen(),
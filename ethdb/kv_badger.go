@@ -1,6 +1,7 @@
 package ethdb
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -20,7 +21,9 @@ var (
 )
 
 type badgerOpts struct {
-	Badger badger.Options
+	Badger     badger.Options
+	compress   bool
+	bucketsCfg BucketConfigsFunc
 }
 
 func (opts badgerOpts) Path(path string) badgerOpts {
@@ -38,6 +41,17 @@ func (opts badgerOpts) ReadOnly() badgerOpts {
 	return opts
 }
 
+// Compress - the empty buckets with a codec in the configuration are compressed, see dbutils.Codec
+func (opts badgerOpts) Compress() badgerOpts {
+	opts.compress = true
+	return opts
+}
+
+func (opts badgerOpts) WithBucketsConfig(f BucketConfigsFunc) badgerOpts {
+	opts.bucketsCfg = f
+	return opts
+}
+
 func (opts badgerOpts) Open() (KV, error) {
 	logger := log.New("badger_db", opts.Badger.Dir)
 	opts.Badger = opts.Badger.WithMaxTableSize(128 << 20) // 128MB, default 64Mb
@@ -63,6 +77,14 @@ func (opts badgerOpts) Open() (KV, error) {
 		log:    logger,
 		wg:     &sync.WaitGroup{},
 	}
+	db.buckets = dbutils.DefaultBucketsConfig()
+	if opts.bucketsCfg != nil {
+		db.buckets = opts.bucketsCfg(db.buckets)
+	}
+	if db.codecs, err = openCodecs(db, db.buckets, opts.compress, opts.Badger.ReadOnly); err != nil {
+		badgerDB.Close()
+		return nil, err
+	}
 
 	if !opts.Badger.InMemory {
 		ctx, ctxCancel := context.WithCancel(context.Background())
@@ -88,11 +110,13 @@ func (opts badgerOpts) MustOpen() KV {
 }
 
 type badgerKV struct {
-	opts   badgerOpts
-	badger *badger.DB
-	log    log.Logger
-	stopGC context.CancelFunc
-	wg     *sync.WaitGroup
+	opts    badgerOpts
+	badger  *badger.DB
+	log     log.Logger
+	buckets dbutils.BucketsCfg
+	codecs  map[string]*bucketCodec // codecs of the compressed buckets
+	stopGC  context.CancelFunc
+	wg      *sync.WaitGroup
 }
 
 func NewBadger() badgerOpts {
@@ -151,7 +175,13 @@ func (db *badgerKV) DiskSize(_ context.Context) (common.StorageSize, error) {
 }
 
 func (db *badgerKV) BucketsStat(_ context.Context) (map[string]common.StorageBucketWriteStats, error) {
-	return map[string]common.StorageBucketWriteStats{}, nil
+	res := map[string]common.StorageBucketWriteStats{}
+	codecsStat(db.codecs, res)
+	return res, nil
+}
+
+func (db *badgerKV) AllBuckets() dbutils.BucketsCfg {
+	return db.buckets
 }
 
 func (db *badgerKV) IdealBatchSize() int {
@@ -180,6 +210,8 @@ type badgerBucket struct {
 	tx      *badgerTx
 	prefix  []byte
 	id      int
+
+	isDupsort bool // DupSort buckets are emulated, see dupSortCursor
 }
 
 type badgerCursor struct {
@@ -188,7 +220,8 @@ type badgerCursor struct {
 	bucket     badgerBucket
 	prefix     []byte
 
-	badger *badger.Iterator
+	badger  *badger.Iterator
+	reverse bool // direction of the iterator
 
 	k   []byte
 	v   []byte
@@ -222,6 +255,10 @@ func (db *badgerKV) Update(ctx context.Context, f func(tx Tx) error) (err error)
 func (tx *badgerTx) Bucket(name []byte) Bucket {
 	b := badgerBucket{tx: tx, nameLen: uint(len(name)), id: dbutils.BucketsIndex[string(name)]}
 	b.prefix = name
+	b.isDupsort = tx.db.buckets[string(name)].Flags&dbutils.DupSort != 0
+	if codec, ok := tx.db.codecs[string(name)]; ok {
+		return compressedBucket{Bucket: b, codec: codec}
+	}
 	return b
 }
 
@@ -274,6 +311,14 @@ func (b badgerBucket) Get(key []byte) (val []byte, err error) {
 	default:
 	}
 
+	if b.isDupsort {
+		err = b.withDupSortCursor(func(c *dupSortCursor) error {
+			val, err = c.get(key)
+			return err
+		})
+		return val, err
+	}
+
 	var item *badger.Item
 	b.prefix = append(b.prefix[:b.nameLen], key...)
 	item, err = b.tx.badger.Get(b.prefix)
@@ -299,6 +344,9 @@ func (b badgerBucket) Put(key []byte, value []byte) error {
 	default:
 	}
 
+	if b.isDupsort {
+		key = dupSortKey(key, value)
+	}
 	b.prefix = append(b.prefix[:b.nameLen], key...) // avoid passing buffer in Put, need copy bytes
 	return b.tx.badger.Set(common.CopyBytes(b.prefix), value)
 }
@@ -310,6 +358,11 @@ func (b badgerBucket) Delete(key []byte) error {
 	default:
 	}
 
+	if b.isDupsort {
+		return b.withDupSortCursor(func(c *dupSortCursor) error {
+			return c.Delete(key)
+		})
+	}
 	b.prefix = append(b.prefix[:b.nameLen], key...)
 	return b.tx.badger.Delete(b.prefix)
 }
@@ -323,6 +376,38 @@ func (b badgerBucket) Clear() error {
 }
 
 func (b badgerBucket) Cursor() Cursor {
+	if b.isDupsort {
+		return b.CursorDupSort()
+	}
+	return b.rawCursor()
+}
+
+func (b badgerBucket) CursorDupSort() CursorDupSort {
+	if !b.isDupsort {
+		panic(fmt.Errorf("bucket is not DupSort: %s", dbutils.Buckets[b.id]))
+	}
+	raw := b
+	raw.isDupsort = false
+	return newDupSortCursor(raw.rawCursor())
+}
+
+// withDupSortCursor runs f with a cursor of the DupSort bucket and closes its iterator afterwards,
+// because read-write transactions of badger allow only one iterator at a time
+func (b badgerBucket) withDupSortCursor(f func(c *dupSortCursor) error) error {
+	raw := b
+	raw.isDupsort = false
+	c := raw.rawCursor()
+	defer func() {
+		if c.badger != nil {
+			c.badger.Close()
+			c.badger = nil
+		}
+	}()
+	return f(newDupSortCursor(c))
+}
+
+// rawCursor - cursor over the keys stored in the bucket, composite keys in the case of DupSort buckets
+func (b badgerBucket) rawCursor() *badgerCursor {
 	c := badgerCursorPool.Get().(*badgerCursor)
 	c.bucket = b
 	c.ctx = b.tx.ctx
@@ -333,6 +418,7 @@ func (b badgerBucket) Cursor() Cursor {
 	c.v = nil
 	c.err = nil
 	c.badger = nil
+	c.reverse = false
 	// add to auto-close on end of transactions
 	if b.tx.cursors == nil {
 		b.tx.cursors = make([]*badgerCursor, 0, 1)
@@ -342,11 +428,111 @@ func (b badgerBucket) Cursor() Cursor {
 }
 
 func (c *badgerCursor) initCursor() {
-	if c.badger != nil {
+	c.setDirection(false)
+}
+
+// setDirection re-creates the iterator when the direction of the iteration changes,
+// because badger allows only one iterator at a time in read-write transactions.
+// Reverse iterator does not use the prefix option, because it would be invalid after seeking past the prefix
+func (c *badgerCursor) setDirection(reverse bool) {
+	if c.badger != nil && c.reverse == reverse {
 		return
 	}
+	if c.badger != nil {
+		c.badger.Close()
+	}
+	c.reverse = reverse
+	opts := c.badgerOpts
+	if reverse {
+		opts.Reverse = true
+		opts.Prefix = nil
+	}
+	c.badger = c.bucket.tx.badger.NewIterator(opts)
+}
+
+// current returns the item under the iterator, or nil if there is none matching the prefix of the cursor
+func (c *badgerCursor) current() *badger.Item {
+	if !c.badger.Valid() {
+		return nil
+	}
+	item := c.badger.Item()
+	if !bytes.HasPrefix(item.Key(), c.badgerOpts.Prefix) {
+		return nil
+	}
+	return item
+}
+
+// seekFrom positions the iterator at the key following the given one in the current direction
+func (c *badgerCursor) seekFrom(key []byte) *badger.Item {
+	c.badger.Seek(key)
+	if c.badger.Valid() && bytes.Equal(c.badger.Item().Key(), key) {
+		c.badger.Next()
+	}
+	return c.current()
+}
+
+// currentKey returns the full key the cursor is positioned at (including the bucket name), or nil
+func (c *badgerCursor) currentKey() []byte {
+	if c.k == nil {
+		return nil
+	}
+	return append(common.CopyBytes(c.badgerOpts.Prefix[:c.bucket.nameLen]), c.k...)
+}
 
-	c.badger = c.bucket.tx.badger.NewIterator(c.badgerOpts)
+func (c *badgerCursor) next() *badger.Item {
+	if !c.reverse {
+		c.badger.Next()
+		return c.current()
+	}
+	key := c.currentKey()
+	c.setDirection(false)
+	if key == nil {
+		c.badger.Rewind()
+		return c.current()
+	}
+	return c.seekFrom(key)
+}
+
+func (c *badgerCursor) last() *badger.Item {
+	c.setDirection(true)
+	upper, ok := dbutils.NextSubtree(c.badgerOpts.Prefix)
+	if !ok {
+		c.badger.Rewind()
+		return c.current()
+	}
+	return c.seekFrom(upper)
+}
+
+func (c *badgerCursor) prev() *badger.Item {
+	if c.reverse {
+		c.badger.Next()
+		return c.current()
+	}
+	key := c.currentKey()
+	if key == nil {
+		return c.last()
+	}
+	c.setDirection(true)
+	return c.seekFrom(key)
+}
+
+// itemKV reads the key and the value of the item the cursor has moved to
+func (c *badgerCursor) itemKV(item *badger.Item) ([]byte, []byte, error) {
+	if item == nil {
+		c.k, c.v = nil, nil
+		return c.k, c.v, nil
+	}
+	c.k = item.Key()[c.bucket.nameLen:]
+	if c.badgerOpts.PrefetchValues {
+		c.v, c.err = item.ValueCopy(c.v)
+	}
+	if c.err != nil {
+		return []byte{}, nil, c.err
+	}
+	if c.v == nil {
+		c.v = []byte{}
+	}
+	return c.k, c.v, nil
 }
 
 func (c *badgerCursor) First() ([]byte, []byte, error) {
@@ -411,23 +597,38 @@ func (c *badgerCursor) Next() ([]byte, []byte, error) {
 	default:
 	}
 
-	c.badger.Next()
-	if !c.badger.Valid() {
-		c.k, c.v = nil, nil
-		return c.k, c.v, nil
+	return c.itemKV(c.next())
+}
+
+func (c *badgerCursor) Last() ([]byte, []byte, error) {
+	select {
+	case <-c.ctx.Done():
+		return []byte{}, nil, c.ctx.Err()
+	default:
 	}
-	item := c.badger.Item()
-	c.k = item.Key()[c.bucket.nameLen:]
-	if c.badgerOpts.PrefetchValues {
-		c.v, c.err = item.ValueCopy(c.v)
+
+	return c.itemKV(c.last())
+}
+
+func (c *badgerCursor) Prev() ([]byte, []byte, error) {
+	select {
+	case <-c.ctx.Done():
+		return []byte{}, nil, c.ctx.Err()
+	default:
 	}
-	if c.err != nil {
-		return []byte{}, nil, c.err // on error key should be != nil
+
+	return c.itemKV(c.prev())
+}
+
+func (c *badgerCursor) SeekExact(key []byte) ([]byte, []byte, error) {
+	k, v, err := c.Seek(key)
+	if err != nil {
+		return []byte{}, nil, err
 	}
-	if c.v == nil {
-		c.v = []byte{}
+	if !bytes.Equal(k, key) {
+		return nil, nil, nil
 	}
-	return c.k, c.v, nil
+	return k, v, nil
 }
 
 func (c *badgerCursor) Delete(key []byte) error {
@@ -533,12 +734,45 @@ func (c *badgerNoValuesCursor) Next() ([]byte, uint32, error) {
 	default:
 	}
 
-	c.badger.Next()
-	if !c.badger.Valid() {
+	return c.itemSize(c.next())
+}
+
+func (c *badgerNoValuesCursor) Last() ([]byte, uint32, error) {
+	select {
+	case <-c.ctx.Done():
+		return []byte{}, 0, c.ctx.Err()
+	default:
+	}
+
+	return c.itemSize(c.last())
+}
+
+func (c *badgerNoValuesCursor) Prev() ([]byte, uint32, error) {
+	select {
+	case <-c.ctx.Done():
+		return []byte{}, 0, c.ctx.Err()
+	default:
+	}
+
+	return c.itemSize(c.prev())
+}
+
+func (c *badgerNoValuesCursor) SeekExact(key []byte) ([]byte, uint32, error) {
+	k, vSize, err := c.Seek(key)
+	if err != nil {
+		return []byte{}, 0, err
+	}
+	if !bytes.Equal(k, key) {
+		return nil, 0, nil
+	}
+	return k, vSize, nil
+}
+
+func (c *badgerNoValuesCursor) itemSize(item *badger.Item) ([]byte, uint32, error) {
+	if item == nil {
 		c.k, c.v = nil, nil
 		return c.k, 0, nil
 	}
-	item := c.badger.Item()
 	c.k = item.Key()[c.bucket.nameLen:]
 	return c.k, uint32(item.ValueSize()), nil
 }
@@ -90,14 +90,18 @@ func collectBoltMetrics(ctx context.Context, db *bolt.DB, ticker *time.Ticker) {
 }
 
 type boltOpts struct {
-	Bolt *bolt.Options
-	path string
+	Bolt       *bolt.Options
+	path       string
+	compress   bool
+	bucketsCfg BucketConfigsFunc
 }
 
 type BoltKV struct {
 	opts        boltOpts
 	bolt        *bolt.DB
 	log         log.Logger
+	buckets     dbutils.BucketsCfg
+	codecs      map[string]*bucketCodec // codecs of the compressed buckets
 	stopMetrics context.CancelFunc
 	wg          *sync.WaitGroup
 }
@@ -110,10 +114,11 @@ type boltTx struct {
 }
 
 type boltBucket struct {
-	tx      *boltTx
-	bolt    *bolt.Bucket
-	id      int
-	nameLen uint
+	tx        *boltTx
+	bolt      *bolt.Bucket
+	id        int
+	nameLen   uint
+	isDupsort bool // DupSort buckets are emulated, see dupSortCursor
 }
 
 type boltCursor struct {
@@ -143,6 +148,17 @@ func (opts boltOpts) Path(path string) boltOpts {
 	return opts
 }
 
+// Compress - the empty buckets with a codec in the configuration are compressed, see dbutils.Codec
+func (opts boltOpts) Compress() boltOpts {
+	opts.compress = true
+	return opts
+}
+
+func (opts boltOpts) WithBucketsConfig(f BucketConfigsFunc) boltOpts {
+	opts.bucketsCfg = f
+	return opts
+}
+
 func (opts boltOpts) Open() (KV, error) {
 	if !opts.Bolt.MemOnly {
 		if err := os.MkdirAll(path.Dir(opts.path), 0744); err != nil {
@@ -174,6 +190,14 @@ func (opts boltOpts) Open() (KV, error) {
 		log:  log.New("bolt_db", opts.path),
 		wg:   &sync.WaitGroup{},
 	}
+	db.buckets = dbutils.DefaultBucketsConfig()
+	if opts.bucketsCfg != nil {
+		db.buckets = opts.bucketsCfg(db.buckets)
+	}
+	if db.codecs, err = openCodecs(db, db.buckets, opts.compress, opts.Bolt.ReadOnly); err != nil {
+		boltDB.Close()
+		return nil, err
+	}
 
 	if metrics.Enabled {
 		ctx, cancel := context.WithCancel(context.Background())
@@ -239,14 +263,25 @@ func (db *BoltKV) BucketsStat(_ context.Context) (map[string]common.StorageBucke
 			TotalBytesDelete: common.StorageSize(stats.TotalBytesDelete),
 		}
 	}
+	codecsStat(db.codecs, res)
 	return res, nil
 }
 
+func (db *BoltKV) AllBuckets() dbutils.BucketsCfg {
+	return db.buckets
+}
+
 func (db *BoltKV) IdealBatchSize() int {
 	return 50 * 1024 * 1024 // 50 Mb
 }
 
 func (db *BoltKV) Get(ctx context.Context, bucket, key []byte) (val []byte, err error) {
+	if db.buckets[string(bucket)].Flags&dbutils.DupSort != 0 {
+		return getDupSort(ctx, db, bucket, key)
+	}
+	if _, ok := db.codecs[string(bucket)]; ok {
+		return getCompressed(ctx, db, bucket, key)
+	}
 	err = db.bolt.View(func(tx *bolt.Tx) error {
 		v, _ := tx.Bucket(bucket).Get(key)
 		if v != nil {
@@ -262,6 +297,14 @@ func (db *BoltKV) Get(ctx context.Context, bucket, key []byte) (val []byte, err
 }
 
 func (db *BoltKV) Has(ctx context.Context, bucket, key []byte) (bool, error) {
+	if db.buckets[string(bucket)].Flags&dbutils.DupSort != 0 {
+		v, err := getDupSort(ctx, db, bucket, key)
+		return v != nil, err
+	}
+	if _, ok := db.codecs[string(bucket)]; ok {
+		v, err := getCompressed(ctx, db, bucket, key)
+		return v != nil, err
+	}
 	var has bool
 	err := db.bolt.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket(bucket)
@@ -337,6 +380,10 @@ func (tx *boltTx) Yield() {
 func (tx *boltTx) Bucket(name []byte) Bucket {
 	b := boltBucket{tx: tx, nameLen: uint(len(name)), id: dbutils.BucketsIndex[string(name)]}
 	b.bolt = tx.bolt.Bucket(name)
+	b.isDupsort = tx.db.buckets[string(name)].Flags&dbutils.DupSort != 0
+	if codec, ok := tx.db.codecs[string(name)]; ok {
+		return compressedBucket{Bucket: b, codec: codec}
+	}
 	return b
 }
 
@@ -382,6 +429,9 @@ func (b boltBucket) Get(key []byte) (val []byte, err error) {
 	default:
 	}
 
+	if b.isDupsort {
+		return b.CursorDupSort().(*dupSortCursor).get(key)
+	}
 	val, _ = b.bolt.Get(key)
 	return val, err
 }
@@ -392,6 +442,9 @@ func (b boltBucket) Put(key []byte, value []byte) error {
 		return b.tx.ctx.Err()
 	default:
 	}
+	if b.isDupsort {
+		return b.bolt.Put(dupSortKey(key, value), value)
+	}
 	return b.bolt.Put(key, value)
 }
 
@@ -402,10 +455,30 @@ func (b boltBucket) Delete(key []byte) error {
 	default:
 	}
 
+	if b.isDupsort {
+		return b.CursorDupSort().Delete(key)
+	}
 	return b.bolt.Delete(key)
 }
 
 func (b boltBucket) Cursor() Cursor {
+	if b.isDupsort {
+		return b.CursorDupSort()
+	}
+	return b.rawCursor()
+}
+
+func (b boltBucket) CursorDupSort() CursorDupSort {
+	if !b.isDupsort {
+		panic(fmt.Errorf("bucket is not DupSort: %s", dbutils.Buckets[b.id]))
+	}
+	raw := b
+	raw.isDupsort = false
+	return newDupSortCursor(raw.rawCursor())
+}
+
+// rawCursor - cursor over the keys stored in the bucket, composite keys in the case of DupSort buckets
+func (b boltBucket) rawCursor() *boltCursor {
 	c := boltCursorPool.Get().(*boltCursor)
 	c.ctx = b.tx.ctx
 	c.bucket = b
@@ -479,6 +552,64 @@ func (c *boltCursor) Next() (k, v []byte, err error) {
 	return k, v, nil
 }
 
+func (c *boltCursor) Last() (k, v []byte, err error) {
+	select {
+	case <-c.ctx.Done():
+		return []byte{}, nil, c.ctx.Err()
+	default:
+	}
+
+	k, v = c.last()
+	return k, v, nil
+}
+
+// last positions the cursor at the last key matching the prefix
+func (c *boltCursor) last() (k, v []byte) {
+	if len(c.prefix) == 0 {
+		return c.bolt.Last()
+	}
+	if next, ok := dbutils.NextSubtree(c.prefix); ok {
+		if k, _ = c.bolt.Seek(next); k != nil {
+			k, v = c.bolt.Prev()
+		} else {
+			k, v = c.bolt.Last()
+		}
+	} else {
+		k, v = c.bolt.Last()
+	}
+	if !bytes.HasPrefix(k, c.prefix) {
+		return nil, nil
+	}
+	return k, v
+}
+
+func (c *boltCursor) Prev() (k, v []byte, err error) {
+	select {
+	case <-c.ctx.Done():
+		return []byte{}, nil, c.ctx.Err()
+	default:
+	}
+
+	k, v = c.bolt.Prev()
+	if c.prefix != nil {
+		if !bytes.HasPrefix(k, c.prefix) {
+			k, v = nil, nil
+		}
+	}
+	return k, v, nil
+}
+
+func (c *boltCursor) SeekExact(key []byte) (k, v []byte, err error) {
+	k, v, err = c.Seek(key)
+	if err != nil {
+		return []byte{}, nil, err
+	}
+	if !bytes.Equal(k, key) {
+		return nil, nil, nil
+	}
+	return k, v, nil
+}
+
 func (c *boltCursor) Delete(key []byte) error {
 	select {
 	case <-c.ctx.Done():
@@ -582,3 +713,43 @@ func (c *noValuesBoltCursor) Next() (k []byte, vSize uint32, err error) {
 	}
 	return k, uint32(len(v)), nil
 }
+
+func (c *noValuesBoltCursor) Last() (k []byte, vSize uint32, err error) {
+	select {
+	case <-c.ctx.Done():
+		return []byte{}, 0, c.ctx.Err()
+	default:
+	}
+
+	var v []byte
+	k, v = c.last()
+	return k, uint32(len(v)), nil
+}
+
+func (c *noValuesBoltCursor) Prev() (k []byte, vSize uint32, err error) {
+	select {
+	case <-c.ctx.Done():
+		return []byte{}, 0, c.ctx.Err()
+	default:
+	}
+
+	var v []byte
+	k, v = c.bolt.Prev()
+	if c.prefix != nil {
+		if !bytes.HasPrefix(k, c.prefix) {
+			return nil, 0, nil
+		}
+	}
+	return k, uint32(len(v)), nil
+}
+
+func (c *noValuesBoltCursor) SeekExact(key []byte) (k []byte, vSize uint32, err error) {
+	k, vSize, err = c.Seek(key)
+	if err != nil {
+		return []byte{}, 0, err
+	}
+	if !bytes.Equal(k, key) {
+		return nil, 0, nil
+	}
+	return k, vSize, nil
+}
@@ -0,0 +1,485 @@
+package ethdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sync"
+	"sync/atomic"
+
+	"github.com/DataDog/zstd"
+	"github.com/golang/snappy"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+)
+
+// Values of the compressed buckets are prefixed by the tag
+const (
+	valueRaw        byte = 0 // the rest is the value itself
+	valueCompressed byte = 1 // the rest is uvarint size of the value and the compressed value
+)
+
+// values shorter than minCompressSize are stored raw, they don't get much smaller
+const minCompressSize = 64
+
+// bucketCodec compresses the values of one bucket and counts the bytes passed through it
+type bucketCodec struct {
+	codec  dbutils.Codec
+	header []byte              // value of the dbutils.BucketCodecKey record
+	zstd   sync.Pool           // zstd.Ctx, contexts are reused, but can't be shared by the concurrent calls
+	dict   *zstd.BulkProcessor // digested zstd dictionary, if the dictionary is used
+
+	compressedPut    uint64 // atomic
+	uncompressedPut  uint64 // atomic
+	compressedRead   uint64 // atomic
+	uncompressedRead uint64 // atomic
+}
+
+// codecHeader - value kept in the compressed bucket under dbutils.BucketCodecKey: the codec,
+// followed by the checksum of the dictionary if the dictionary is used
+func codecHeader(codec dbutils.Codec, dict []byte) []byte {
+	header := []byte{byte(codec)}
+	if len(dict) > 0 {
+		header = append(header, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(header[1:], crc32.ChecksumIEEE(dict))
+	}
+	return header
+}
+
+// openCodecs reads the codecs of the buckets from their headers. Only the buckets with a codec in the configuration
+// are looked at. If compress is set, the codecs from the configuration are assigned (and their headers written)
+// to the buckets which are still empty, unless the database is read-only
+func openCodecs(kv KV, cfg dbutils.BucketsCfg, compress, readOnly bool) (map[string]*bucketCodec, error) {
+	headers := map[string][]byte{}
+	newHeaders := map[string][]byte{}
+	// badger allows only one iterator at a time in read-write transactions, so the buckets are checked in a read-only one
+	if err := kv.View(context.Background(), func(tx Tx) error {
+		for _, name := range dbutils.Buckets {
+			bucketCfg := cfg[string(name)]
+			if bucketCfg.Codec == dbutils.NoCodec {
+				continue
+			}
+			if bucketCfg.Flags&dbutils.DupSort != 0 {
+				return fmt.Errorf("bucket %s with DupSort flag can't be compressed", name)
+			}
+			b := tx.Bucket(name)
+			header, err := b.Get(dbutils.BucketCodecKey)
+			if err != nil && !errors.Is(err, ErrKeyNotFound) {
+				return err
+			}
+			if len(header) > 0 {
+				headers[string(name)] = common.CopyBytes(header)
+				continue
+			}
+			if !compress || readOnly {
+				continue
+			}
+			k, _, err := b.Cursor().First()
+			if err != nil {
+				return err
+			}
+			if k != nil {
+				// written without the compression
+				continue
+			}
+			newHeaders[string(name)] = codecHeader(bucketCfg.Codec, bucketCfg.Dictionary)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if len(newHeaders) > 0 {
+		if err := kv.Update(context.Background(), func(tx Tx) error {
+			for name, header := range newHeaders {
+				if err := tx.Bucket([]byte(name)).Put(dbutils.BucketCodecKey, header); err != nil {
+					return err
+				}
+				headers[name] = header
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	codecs := map[string]*bucketCodec{}
+	for name, header := range headers {
+		codec := &bucketCodec{codec: dbutils.Codec(header[0]), header: header}
+		switch codec.codec {
+		case dbutils.Snappy:
+		case dbutils.Zstd:
+			dict := cfg[name].Dictionary
+			if !bytes.Equal(header, codecHeader(codec.codec, dict)) {
+				return nil, fmt.Errorf("bucket %s is compressed with another zstd dictionary", name)
+			}
+			if len(dict) > 0 {
+				var err error
+				if codec.dict, err = zstd.NewBulkProcessor(dict, zstd.DefaultCompression); err != nil {
+					return nil, fmt.Errorf("zstd dictionary of bucket %s: %w", name, err)
+				}
+			}
+			codec.zstd.New = func() interface{} { return zstd.NewCtx() }
+		default:
+			return nil, fmt.Errorf("bucket %s is compressed with unknown codec %d", name, header[0])
+		}
+		codecs[name] = codec
+	}
+	return codecs, nil
+}
+
+// codecsStat adds the codecs and their counters to the stats of the buckets
+func codecsStat(codecs map[string]*bucketCodec, stats map[string]common.StorageBucketWriteStats) {
+	for name, c := range codecs {
+		s := stats[name]
+		s.Codec = c.codec.String()
+		s.CompressedBytesPut = common.StorageSize(atomic.LoadUint64(&c.compressedPut))
+		s.UncompressedBytesPut = common.StorageSize(atomic.LoadUint64(&c.uncompressedPut))
+		s.CompressedBytesRead = common.StorageSize(atomic.LoadUint64(&c.compressedRead))
+		s.UncompressedBytesRead = common.StorageSize(atomic.LoadUint64(&c.uncompressedRead))
+		stats[name] = s
+	}
+}
+
+func (c *bucketCodec) encode(v []byte) ([]byte, error) {
+	atomic.AddUint64(&c.uncompressedPut, uint64(len(v)))
+	if len(v) < minCompressSize {
+		atomic.AddUint64(&c.compressedPut, uint64(len(v)))
+		return append([]byte{valueRaw}, v...), nil
+	}
+
+	var sizeBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(sizeBuf[:], uint64(len(v)))
+	var compressed []byte
+	switch c.codec {
+	case dbutils.Snappy:
+		compressed = snappy.Encode(nil, v)
+	case dbutils.Zstd:
+		var err error
+		if c.dict != nil {
+			compressed, err = c.dict.Compress(nil, v)
+		} else {
+			ctx := c.zstd.Get().(zstd.Ctx)
+			compressed, err = ctx.Compress(nil, v)
+			c.zstd.Put(ctx)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if 1+n+len(compressed) >= 1+len(v) {
+		atomic.AddUint64(&c.compressedPut, uint64(len(v)))
+		return append([]byte{valueRaw}, v...), nil
+	}
+	atomic.AddUint64(&c.compressedPut, uint64(n+len(compressed)))
+	res := make([]byte, 0, 1+n+len(compressed))
+	res = append(res, valueCompressed)
+	res = append(res, sizeBuf[:n]...)
+	return append(res, compressed...), nil
+}
+
+// decode returns the value, it's a sub-slice of v if the value is stored raw
+func (c *bucketCodec) decode(v []byte) ([]byte, error) {
+	if len(v) == 0 {
+		return v, nil
+	}
+	if v[0] == valueRaw {
+		return v[1:], nil
+	}
+	size, n := binary.Uvarint(v[1:])
+	if n <= 0 || v[0] != valueCompressed {
+		return nil, fmt.Errorf("corrupted compressed value %x", v)
+	}
+	compressed := v[1+n:]
+	res := make([]byte, size)
+	var err error
+	switch c.codec {
+	case dbutils.Snappy:
+		res, err = snappy.Decode(res, compressed)
+	case dbutils.Zstd:
+		if c.dict != nil {
+			res, err = c.dict.Decompress(res, compressed)
+		} else {
+			ctx := c.zstd.Get().(zstd.Ctx)
+			res, err = ctx.Decompress(res, compressed)
+			c.zstd.Put(ctx)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decompressing %s value: %w", c.codec, err)
+	}
+	if uint64(len(res)) != size {
+		return nil, fmt.Errorf("decompressed %s value has size %d, expected %d", c.codec, len(res), size)
+	}
+	atomic.AddUint64(&c.compressedRead, uint64(len(compressed)+n))
+	atomic.AddUint64(&c.uncompressedRead, size)
+	return res, nil
+}
+
+// getCompressed - NativeGet.Get for the compressed buckets
+func getCompressed(ctx context.Context, kv KV, bucket, key []byte) (val []byte, err error) {
+	if isCodecKey(key) {
+		return nil, nil
+	}
+	err = kv.View(ctx, func(tx Tx) error {
+		v, err := tx.Bucket(bucket).Get(key)
+		if err != nil && !errors.Is(err, ErrKeyNotFound) {
+			return err
+		}
+		if v != nil {
+			val = common.CopyBytes(v)
+		}
+		return nil
+	})
+	return val, err
+}
+
+func isCodecKey(key []byte) bool {
+	return bytes.Equal(key, dbutils.BucketCodecKey)
+}
+
+func errCodecKey(key []byte) error {
+	return fmt.Errorf("key %x is reserved for the codec of the compressed bucket", key)
+}
+
+// compressedBucket encodes the values on the way to the underlying bucket and decodes them on the way back.
+// Keys are not changed, so the order of the records and the seeks work as usual. The header of the bucket,
+// its first record, is skipped by the cursors
+type compressedBucket struct {
+	Bucket
+	codec *bucketCodec
+}
+
+type compressedCursor struct {
+	c     Cursor
+	codec *bucketCodec
+}
+
+// compressedNoValuesCursor returns the sizes of the values as they are stored, the values are not read
+type compressedNoValuesCursor struct {
+	c NoValuesCursor
+}
+
+func (b compressedBucket) Get(key []byte) ([]byte, error) {
+	if isCodecKey(key) {
+		return nil, nil
+	}
+	v, err := b.Bucket.Get(key)
+	if err != nil || v == nil {
+		return v, err
+	}
+	return b.codec.decode(v)
+}
+
+func (b compressedBucket) Put(key []byte, value []byte) error {
+	if isCodecKey(key) {
+		return errCodecKey(key)
+	}
+	v, err := b.codec.encode(value)
+	if err != nil {
+		return err
+	}
+	return b.Bucket.Put(key, v)
+}
+
+func (b compressedBucket) Delete(key []byte) error {
+	if isCodecKey(key) {
+		return errCodecKey(key)
+	}
+	return b.Bucket.Delete(key)
+}
+
+func (b compressedBucket) Cursor() Cursor {
+	return &compressedCursor{c: b.Bucket.Cursor(), codec: b.codec}
+}
+
+// Clear keeps the header, so the bucket stays compressed
+func (b compressedBucket) Clear() error {
+	if err := b.Bucket.Clear(); err != nil {
+		return err
+	}
+	return b.Bucket.Put(dbutils.BucketCodecKey, b.codec.header)
+}
+
+// skipHeader moves forward from the header of the bucket
+func (c *compressedCursor) skipHeader(k, v []byte, err error) ([]byte, []byte, error) {
+	if err == nil && isCodecKey(k) {
+		return c.c.Next()
+	}
+	return k, v, err
+}
+
+// stopAtHeader ends the backward iteration at the header of the bucket
+func (c *compressedCursor) stopAtHeader(k, v []byte, err error) ([]byte, []byte, error) {
+	if err == nil && isCodecKey(k) {
+		return nil, nil, nil
+	}
+	return k, v, err
+}
+
+func (c *compressedCursor) decode(k, v []byte, err error) ([]byte, []byte, error) {
+	if err != nil || k == nil {
+		return k, v, err
+	}
+	v, err = c.codec.decode(v)
+	if err != nil {
+		return nil, nil, fmt.Errorf("key %x: %w", k, err)
+	}
+	return k, v, nil
+}
+
+func (c *compressedCursor) Prefix(v []byte) Cursor {
+	c.c = c.c.Prefix(v)
+	return c
+}
+
+func (c *compressedCursor) MatchBits(n uint) Cursor {
+	c.c = c.c.MatchBits(n)
+	return c
+}
+
+func (c *compressedCursor) Prefetch(v uint) Cursor {
+	c.c = c.c.Prefetch(v)
+	return c
+}
+
+func (c *compressedCursor) NoValues() NoValuesCursor {
+	return &compressedNoValuesCursor{c: c.c.NoValues()}
+}
+
+func (c *compressedCursor) First() ([]byte, []byte, error) {
+	return c.decode(c.skipHeader(c.c.First()))
+}
+
+func (c *compressedCursor) Seek(seek []byte) ([]byte, []byte, error) {
+	return c.decode(c.skipHeader(c.c.Seek(seek)))
+}
+
+func (c *compressedCursor) SeekTo(seek []byte) ([]byte, []byte, error) {
+	return c.decode(c.skipHeader(c.c.SeekTo(seek)))
+}
+
+func (c *compressedCursor) Next() ([]byte, []byte, error) {
+	return c.decode(c.skipHeader(c.c.Next()))
+}
+
+func (c *compressedCursor) Prev() ([]byte, []byte, error) {
+	return c.decode(c.stopAtHeader(c.c.Prev()))
+}
+
+func (c *compressedCursor) Last() ([]byte, []byte, error) {
+	return c.decode(c.stopAtHeader(c.c.Last()))
+}
+
+func (c *compressedCursor) SeekExact(key []byte) ([]byte, []byte, error) {
+	if isCodecKey(key) {
+		return nil, nil, nil
+	}
+	return c.decode(c.c.SeekExact(key))
+}
+
+func (c *compressedCursor) Walk(walker func(k, v []byte) (bool, error)) error {
+	return c.c.Walk(func(k, v []byte) (bool, error) {
+		if isCodecKey(k) {
+			return true, nil
+		}
+		v, err := c.codec.decode(v)
+		if err != nil {
+			return false, fmt.Errorf("key %x: %w", k, err)
+		}
+		return walker(k, v)
+	})
+}
+
+func (c *compressedCursor) Put(key []byte, value []byte) error {
+	if isCodecKey(key) {
+		return errCodecKey(key)
+	}
+	v, err := c.codec.encode(value)
+	if err != nil {
+		return err
+	}
+	return c.c.Put(key, v)
+}
+
+func (c *compressedCursor) Delete(key []byte) error {
+	if isCodecKey(key) {
+		return errCodecKey(key)
+	}
+	return c.c.Delete(key)
+}
+
+func (c *compressedCursor) Append(key []byte, value []byte) error {
+	if isCodecKey(key) {
+		return errCodecKey(key)
+	}
+	v, err := c.codec.encode(value)
+	if err != nil {
+		return err
+	}
+	return c.c.Append(key, v)
+}
+
+// size skips the header of the bucket and the tag of the value
+func (c *compressedNoValuesCursor) size(k []byte, vSize uint32, err error) ([]byte, uint32, error) {
+	if err != nil || k == nil {
+		return k, vSize, err
+	}
+	if isCodecKey(k) {
+		return c.size(c.c.Next())
+	}
+	if vSize > 0 {
+		vSize--
+	}
+	return k, vSize, nil
+}
+
+func (c *compressedNoValuesCursor) First() ([]byte, uint32, error) {
+	return c.size(c.c.First())
+}
+
+func (c *compressedNoValuesCursor) Seek(seek []byte) ([]byte, uint32, error) {
+	return c.size(c.c.Seek(seek))
+}
+
+func (c *compressedNoValuesCursor) Next() ([]byte, uint32, error) {
+	return c.size(c.c.Next())
+}
+
+func (c *compressedNoValuesCursor) Prev() ([]byte, uint32, error) {
+	k, vSize, err := c.c.Prev()
+	if err == nil && isCodecKey(k) {
+		return nil, 0, nil
+	}
+	return c.size(k, vSize, err)
+}
+
+func (c *compressedNoValuesCursor) Last() ([]byte, uint32, error) {
+	k, vSize, err := c.c.Last()
+	if err == nil && isCodecKey(k) {
+		return nil, 0, nil
+	}
+	return c.size(k, vSize, err)
+}
+
+func (c *compressedNoValuesCursor) SeekExact(key []byte) ([]byte, uint32, error) {
+	if isCodecKey(key) {
+		return nil, 0, nil
+	}
+	return c.size(c.c.SeekExact(key))
+}
+
+func (c *compressedNoValuesCursor) Walk(walker func(k []byte, vSize uint32) (bool, error)) error {
+	return c.c.Walk(func(k []byte, vSize uint32) (bool, error) {
+		if isCodecKey(k) {
+			return true, nil
+		}
+		if vSize > 0 {
+			vSize--
+		}
+		return walker(k, vSize)
+	})
+}
@@ -0,0 +1,260 @@
+package ethdb_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb/dbtest"
+	"github.com/stretchr/testify/require"
+)
+
+func withCodec(bucket []byte, codec dbutils.Codec, dict []byte) ethdb.BucketConfigsFunc {
+	return func(defaultBuckets dbutils.BucketsCfg) dbutils.BucketsCfg {
+		defaultBuckets[string(bucket)] = dbutils.BucketConfigItem{Codec: codec, Dictionary: dict}
+		return defaultBuckets
+	}
+}
+
+func compressibleValue(i int) []byte {
+	return bytes.Repeat([]byte(fmt.Sprintf("value %d;", i)), 50)
+}
+
+func TestCompressedCursorSuite(t *testing.T) {
+	cfg := withCodec(dbutils.Buckets[0], dbutils.Snappy, nil)
+	dbs := []ethdb.KV{
+		ethdb.NewBolt().InMem().Compress().WithBucketsConfig(cfg).MustOpen(),
+		ethdb.NewBadger().InMem().Compress().WithBucketsConfig(cfg).MustOpen(),
+		ethdb.NewLMDB().InMem().Compress().WithBucketsConfig(cfg).MustOpen(),
+	}
+	for _, db := range dbs {
+		db := db
+		t.Run(fmt.Sprintf("%T", db), func(t *testing.T) {
+			defer db.Close()
+			dbtest.TestCursorSuite(t, db, db)
+		})
+	}
+}
+
+func TestCompression(t *testing.T) {
+	bucket := dbutils.Buckets[0]
+	dict := bytes.Repeat([]byte("value ;"), 100)
+	for _, codec := range []struct {
+		name  string
+		codec dbutils.Codec
+		dict  []byte
+	}{
+		{"snappy", dbutils.Snappy, nil},
+		{"zstd", dbutils.Zstd, nil},
+		{"zstd with dictionary", dbutils.Zstd, dict},
+	} {
+		cfg := withCodec(bucket, codec.codec, codec.dict)
+		dbs := []ethdb.KV{
+			ethdb.NewBolt().InMem().Compress().WithBucketsConfig(cfg).MustOpen(),
+			ethdb.NewBadger().InMem().Compress().WithBucketsConfig(cfg).MustOpen(),
+			ethdb.NewLMDB().InMem().Compress().WithBucketsConfig(cfg).MustOpen(),
+		}
+		for _, db := range dbs {
+			db := db
+			t.Run(fmt.Sprintf("%s %T", codec.name, db), func(t *testing.T) {
+				defer db.Close()
+				testCompression(t, db, bucket, codec.codec)
+			})
+		}
+	}
+}
+
+func testCompression(t *testing.T, db ethdb.KV, bucket []byte, codec dbutils.Codec) {
+	ctx := context.Background()
+	values := map[string][]byte{}
+	require.NoError(t, db.Update(ctx, func(tx ethdb.Tx) error {
+		b := tx.Bucket(bucket)
+		for i := 1; i <= 10; i++ {
+			k, v := []byte{byte(i)}, compressibleValue(i)
+			values[string(k)] = v
+			if err := b.Put(k, v); err != nil {
+				return err
+			}
+		}
+		// short and incompressible values are stored raw
+		values["\x10"] = []byte{1, 2, 3}
+		values["\x11"] = []byte{}
+		if err := b.Put([]byte{0x10}, []byte{1, 2, 3}); err != nil {
+			return err
+		}
+		if err := b.Put([]byte{0x11}, []byte{}); err != nil {
+			return err
+		}
+		c := b.Cursor()
+		for i := 0x20; i < 0x25; i++ {
+			k, v := []byte{byte(i)}, compressibleValue(i)
+			values[string(k)] = v
+			if err := c.Append(k, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	require.NoError(t, db.View(ctx, func(tx ethdb.Tx) error {
+		b := tx.Bucket(bucket)
+		for k, v := range values {
+			have, err := b.Get([]byte(k))
+			require.NoError(t, err)
+			require.Equal(t, v, have, "Get %x", k)
+		}
+
+		count := 0
+		require.NoError(t, b.Cursor().Walk(func(k, v []byte) (bool, error) {
+			require.Equal(t, values[string(k)], v, "Walk %x", k)
+			count++
+			return true, nil
+		}))
+		require.Equal(t, len(values), count)
+
+		k, v, err := b.Cursor().SeekExact([]byte{3})
+		require.NoError(t, err)
+		require.Equal(t, []byte{3}, k)
+		require.Equal(t, values["\x03"], v)
+
+		k, _, err = b.Cursor().Last()
+		require.NoError(t, err)
+		require.Equal(t, []byte{0x24}, k)
+		// the header of the bucket is hidden
+		k, _, err = b.Cursor().Seek(nil)
+		require.NoError(t, err)
+		require.Equal(t, []byte{1}, k)
+		c := b.Cursor()
+		if _, _, err = c.First(); err != nil {
+			return err
+		}
+		k, _, err = c.Prev()
+		require.NoError(t, err)
+		require.Nil(t, k)
+
+		// sizes of the stored values, values are not read
+		count = 0
+		require.NoError(t, b.Cursor().NoValues().Walk(func(k []byte, vSize uint32) (bool, error) {
+			if v := values[string(k)]; len(v) < 64 {
+				require.Equal(t, len(v), int(vSize), "NoValues %x", k)
+			} else {
+				require.True(t, int(vSize) < len(v)/5, "NoValues %x", k)
+			}
+			count++
+			return true, nil
+		}))
+		require.Equal(t, len(values), count)
+		k, _, err = b.Cursor().NoValues().First()
+		require.NoError(t, err)
+		require.Equal(t, []byte{1}, k)
+		return nil
+	}))
+
+	require.Error(t, db.Update(ctx, func(tx ethdb.Tx) error {
+		return tx.Bucket(bucket).Put(dbutils.BucketCodecKey, []byte{1})
+	}))
+
+	if native, ok := db.(ethdb.NativeGet); ok {
+		v, err := native.Get(ctx, bucket, []byte{5})
+		require.NoError(t, err)
+		require.Equal(t, values["\x05"], v)
+		has, err := native.Has(ctx, bucket, []byte{0x11})
+		require.NoError(t, err)
+		require.True(t, has)
+		has, err = native.Has(ctx, bucket, []byte{0x12})
+		require.NoError(t, err)
+		require.False(t, has)
+	}
+
+	stats, err := db.(ethdb.HasStats).BucketsStat(ctx)
+	require.NoError(t, err)
+	s := stats[string(bucket)]
+	require.Equal(t, codec.String(), s.Codec)
+	require.True(t, s.CompressedBytesPut < s.UncompressedBytesPut/5, "%d compressed of %d", s.CompressedBytesPut, s.UncompressedBytesPut)
+	require.True(t, s.CompressedBytesRead > 0 && s.CompressedBytesRead < s.UncompressedBytesRead)
+}
+
+func TestCompressionHeader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lmdb-compression")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	compressed, raw := dbutils.Buckets[0], dbutils.Buckets[1]
+	ctx := context.Background()
+	dict := bytes.Repeat([]byte("value ;"), 100)
+	cfg := func(dict []byte) ethdb.BucketConfigsFunc {
+		return func(defaultBuckets dbutils.BucketsCfg) dbutils.BucketsCfg {
+			defaultBuckets[string(compressed)] = dbutils.BucketConfigItem{Codec: dbutils.Zstd, Dictionary: dict}
+			defaultBuckets[string(raw)] = dbutils.BucketConfigItem{Codec: dbutils.Snappy}
+			return defaultBuckets
+		}
+	}
+
+	put := func(db ethdb.KV, bucket []byte) {
+		require.NoError(t, db.Update(ctx, func(tx ethdb.Tx) error {
+			return tx.Bucket(bucket).Put([]byte{1}, compressibleValue(1))
+		}))
+	}
+	check := func(db ethdb.KV) {
+		require.NoError(t, db.View(ctx, func(tx ethdb.Tx) error {
+			for _, bucket := range [][]byte{compressed, raw} {
+				v, err := tx.Bucket(bucket).Get([]byte{1})
+				require.NoError(t, err)
+				require.Equal(t, compressibleValue(1), v)
+			}
+			return nil
+		}))
+	}
+	codecs := func(db ethdb.KV) (string, string) {
+		stats, err := db.(ethdb.HasStats).BucketsStat(ctx)
+		require.NoError(t, err)
+		return stats[string(compressed)].Codec, stats[string(raw)].Codec
+	}
+
+	// the compression is opt-in
+	db := ethdb.NewLMDB().Path(dir).WithBucketsConfig(cfg(dict)).MustOpen()
+	put(db, raw)
+	compressedCodec, rawCodec := codecs(db)
+	require.Equal(t, "", compressedCodec)
+	require.Equal(t, "", rawCodec)
+	db.Close()
+
+	db = ethdb.NewLMDB().Path(dir).Compress().WithBucketsConfig(cfg(dict)).MustOpen()
+	put(db, compressed)
+	check(db)
+	db.Close()
+
+	// the bucket filled without the compression stays raw, the header decides the codec of the compressed one
+	db = ethdb.NewLMDB().Path(dir).WithBucketsConfig(cfg(dict)).MustOpen()
+	check(db)
+	compressedCodec, rawCodec = codecs(db)
+	require.Equal(t, "zstd", compressedCodec)
+	require.Equal(t, "", rawCodec)
+	// the cleared bucket stays compressed
+	require.NoError(t, db.Update(ctx, func(tx ethdb.Tx) error {
+		return tx.Bucket(compressed).Clear()
+	}))
+	put(db, compressed)
+	db.Close()
+
+	_, err = ethdb.NewLMDB().Path(dir).WithBucketsConfig(cfg([]byte("another dictionary"))).Open()
+	require.Error(t, err)
+
+	db = ethdb.NewLMDB().Path(dir).ReadOnly().WithBucketsConfig(cfg(dict)).MustOpen()
+	check(db)
+	compressedCodec, _ = codecs(db)
+	require.Equal(t, "zstd", compressedCodec)
+	db.Close()
+}
+
+func TestCompressionDupSort(t *testing.T) {
+	_, err := ethdb.NewLMDB().InMem().Compress().WithBucketsConfig(func(defaultBuckets dbutils.BucketsCfg) dbutils.BucketsCfg {
+		defaultBuckets[string(dbutils.Buckets[0])] = dbutils.BucketConfigItem{Flags: dbutils.DupSort, Codec: dbutils.Zstd}
+		return defaultBuckets
+	}).Open()
+	require.Error(t, err)
+}
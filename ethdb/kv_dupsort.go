@@ -0,0 +1,291 @@
+package ethdb
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+)
+
+// dupSortKey - key under which the pair (key, value) of a DupSort bucket is stored by the databases emulating
+// DupSort buckets (Bolt, Badger). Value is stored as is, so the key of the pair is recovered using the size of the value
+func dupSortKey(key, value []byte) []byte {
+	k := make([]byte, len(key)+len(value))
+	copy(k, key)
+	copy(k[len(key):], value)
+	return k
+}
+
+// getDupSort - NativeGet.Get for the emulated DupSort buckets, returns the first value of the key
+func getDupSort(ctx context.Context, db KV, bucket, key []byte) (val []byte, err error) {
+	err = db.View(ctx, func(tx Tx) error {
+		v, err := tx.Bucket(bucket).Get(key)
+		val = common.CopyBytes(v)
+		return err
+	})
+	return val, err
+}
+
+// dupSortCursor emulates the cursor of a DupSort bucket (see dbutils.DupSort) on top of the cursor
+// of the database which doesn't support duplicates natively, the raw cursor works with composite keys (see dupSortKey)
+type dupSortCursor struct {
+	raw    Cursor
+	prefix []byte
+
+	k []byte // key of the current pair
+	v []byte // value of the current pair
+}
+
+func newDupSortCursor(raw Cursor) *dupSortCursor {
+	return &dupSortCursor{raw: raw}
+}
+
+// pair converts the composite key returned by the raw cursor into the key of the pair and remembers the position
+func (c *dupSortCursor) pair(k, v []byte, err error) ([]byte, []byte, error) {
+	if err != nil {
+		return []byte{}, nil, err
+	}
+	if k != nil {
+		k = k[:len(k)-len(v)]
+	}
+	if k == nil || (c.prefix != nil && !bytes.HasPrefix(k, c.prefix)) {
+		c.k, c.v = nil, nil
+		return nil, nil, nil
+	}
+	c.k, c.v = k, v
+	return k, v, nil
+}
+
+func (c *dupSortCursor) Prefix(v []byte) Cursor {
+	c.prefix = v
+	c.raw = c.raw.Prefix(v)
+	return c
+}
+
+func (c *dupSortCursor) MatchBits(n uint) Cursor {
+	panic("not implemented yet")
+}
+
+func (c *dupSortCursor) Prefetch(v uint) Cursor {
+	c.raw = c.raw.Prefetch(v)
+	return c
+}
+
+func (c *dupSortCursor) NoValues() NoValuesCursor {
+	return &dupSortNoValuesCursor{dupSortCursor: c, rawNoValues: c.raw.NoValues()}
+}
+
+func (c *dupSortCursor) First() ([]byte, []byte, error) {
+	return c.pair(c.raw.First())
+}
+
+func (c *dupSortCursor) Seek(seek []byte) ([]byte, []byte, error) {
+	return c.pair(c.raw.Seek(seek))
+}
+
+func (c *dupSortCursor) SeekTo(seek []byte) ([]byte, []byte, error) {
+	return c.pair(c.raw.SeekTo(seek))
+}
+
+func (c *dupSortCursor) Next() ([]byte, []byte, error) {
+	return c.pair(c.raw.Next())
+}
+
+func (c *dupSortCursor) Prev() ([]byte, []byte, error) {
+	return c.pair(c.raw.Prev())
+}
+
+func (c *dupSortCursor) Last() ([]byte, []byte, error) {
+	return c.pair(c.raw.Last())
+}
+
+func (c *dupSortCursor) SeekExact(key []byte) ([]byte, []byte, error) {
+	k, v, err := c.Seek(key)
+	if err != nil {
+		return []byte{}, nil, err
+	}
+	if !bytes.Equal(k, key) {
+		c.k, c.v = nil, nil
+		return nil, nil, nil
+	}
+	return k, v, nil
+}
+
+func (c *dupSortCursor) SeekBothRange(key, value []byte) ([]byte, []byte, error) {
+	k, v, err := c.pair(c.raw.Seek(dupSortKey(key, value)))
+	if err != nil {
+		return []byte{}, nil, err
+	}
+	if !bytes.Equal(k, key) {
+		c.k, c.v = nil, nil
+		return nil, nil, nil
+	}
+	return k, v, nil
+}
+
+func (c *dupSortCursor) FirstDup() ([]byte, error) {
+	if c.k == nil {
+		return nil, nil
+	}
+	_, v, err := c.SeekExact(common.CopyBytes(c.k))
+	return v, err
+}
+
+func (c *dupSortCursor) NextDup() ([]byte, []byte, error) {
+	if c.k == nil {
+		return nil, nil, nil
+	}
+	// raw cursors may reuse the buffers of the current pair
+	key, value := common.CopyBytes(c.k), common.CopyBytes(c.v)
+	k, v, err := c.pair(c.raw.Next())
+	if err != nil {
+		return []byte{}, nil, err
+	}
+	if bytes.Equal(k, key) {
+		return k, v, nil
+	}
+	// no more values of the current key, stay at the last one
+	if _, _, err = c.pair(c.raw.Seek(dupSortKey(key, value))); err != nil {
+		return []byte{}, nil, err
+	}
+	return nil, nil, nil
+}
+
+func (c *dupSortCursor) NextNoDup() ([]byte, []byte, error) {
+	if c.k == nil {
+		return c.First()
+	}
+	next, ok := dbutils.NextSubtree(c.k)
+	if !ok {
+		c.k, c.v = nil, nil
+		return nil, nil, nil
+	}
+	return c.pair(c.raw.Seek(next))
+}
+
+func (c *dupSortCursor) DeleteCurrent() error {
+	if c.k == nil {
+		return nil
+	}
+	return c.raw.Delete(dupSortKey(c.k, c.v))
+}
+
+func (c *dupSortCursor) Walk(walker func(k, v []byte) (bool, error)) error {
+	for k, v, err := c.First(); k != nil; k, v, err = c.Next() {
+		if err != nil {
+			return err
+		}
+		ok, err := walker(k, v)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (c *dupSortCursor) Put(key []byte, value []byte) error {
+	return c.raw.Put(dupSortKey(key, value), value)
+}
+
+func (c *dupSortCursor) Append(key []byte, value []byte) error {
+	return c.raw.Append(dupSortKey(key, value), value)
+}
+
+// Delete removes all values of the key. Pairs are collected before deletion, because iterators
+// of some databases (Badger) don't observe the writes made after their creation
+func (c *dupSortCursor) Delete(key []byte) error {
+	var keys [][]byte
+	for k, v, err := c.SeekExact(key); k != nil; k, v, err = c.NextDup() {
+		if err != nil {
+			return err
+		}
+		keys = append(keys, dupSortKey(k, v))
+	}
+	for _, k := range keys {
+		if err := c.raw.Delete(k); err != nil {
+			return err
+		}
+	}
+	c.k, c.v = nil, nil
+	return nil
+}
+
+// get returns the first value of the key, the same as Bucket.Get of LMDB for DupSort buckets
+func (c *dupSortCursor) get(key []byte) ([]byte, error) {
+	k, v, err := c.SeekExact(key)
+	if err != nil || k == nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+type dupSortNoValuesCursor struct {
+	*dupSortCursor
+	rawNoValues NoValuesCursor
+}
+
+func (c *dupSortNoValuesCursor) key(k []byte, vSize uint32, err error) ([]byte, uint32, error) {
+	if err != nil {
+		return []byte{}, 0, err
+	}
+	if k != nil {
+		k = k[:len(k)-int(vSize)]
+	}
+	if k == nil || (c.prefix != nil && !bytes.HasPrefix(k, c.prefix)) {
+		c.k, c.v = nil, nil
+		return nil, 0, nil
+	}
+	c.k, c.v = k, nil
+	return k, vSize, nil
+}
+
+func (c *dupSortNoValuesCursor) First() ([]byte, uint32, error) {
+	return c.key(c.rawNoValues.First())
+}
+
+func (c *dupSortNoValuesCursor) Seek(seek []byte) ([]byte, uint32, error) {
+	return c.key(c.rawNoValues.Seek(seek))
+}
+
+func (c *dupSortNoValuesCursor) Next() ([]byte, uint32, error) {
+	return c.key(c.rawNoValues.Next())
+}
+
+func (c *dupSortNoValuesCursor) Prev() ([]byte, uint32, error) {
+	return c.key(c.rawNoValues.Prev())
+}
+
+func (c *dupSortNoValuesCursor) Last() ([]byte, uint32, error) {
+	return c.key(c.rawNoValues.Last())
+}
+
+func (c *dupSortNoValuesCursor) SeekExact(key []byte) ([]byte, uint32, error) {
+	k, vSize, err := c.Seek(key)
+	if err != nil {
+		return []byte{}, 0, err
+	}
+	if !bytes.Equal(k, key) {
+		return nil, 0, nil
+	}
+	return k, vSize, nil
+}
+
+func (c *dupSortNoValuesCursor) Walk(walker func(k []byte, vSize uint32) (bool, error)) error {
+	for k, vSize, err := c.First(); k != nil; k, vSize, err = c.Next() {
+		if err != nil {
+			return err
+		}
+		ok, err := walker(k, vSize)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+	}
+	return nil
+}
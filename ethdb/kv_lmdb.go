@@ -24,9 +24,12 @@ var (
 )
 
 type lmdbOpts struct {
-	path     string
-	inMem    bool
-	readOnly bool
+	path       string
+	inMem      bool
+	readOnly   bool
+	mapSize    uint64
+	compress   bool
+	bucketsCfg BucketConfigsFunc
 }
 
 func (opts lmdbOpts) Path(path string) lmdbOpts {
@@ -44,6 +47,23 @@ func (opts lmdbOpts) ReadOnly() lmdbOpts {
 	return opts
 }
 
+// MapSize sets the maximum size of the database, the default is 64MB for in-memory databases and 32TB otherwise
+func (opts lmdbOpts) MapSize(size uint64) lmdbOpts {
+	opts.mapSize = size
+	return opts
+}
+
+// Compress - the empty buckets with a codec in the configuration are compressed, see dbutils.Codec
+func (opts lmdbOpts) Compress() lmdbOpts {
+	opts.compress = true
+	return opts
+}
+
+func (opts lmdbOpts) WithBucketsConfig(f BucketConfigsFunc) lmdbOpts {
+	opts.bucketsCfg = f
+	return opts
+}
+
 func (opts lmdbOpts) Open() (KV, error) {
 	env, err := lmdb.NewEnv()
 	if err != nil {
@@ -56,15 +76,22 @@ func (opts lmdbOpts) Open() (KV, error) {
 
 	var logger log.Logger
 
+	if opts.mapSize == 0 {
+		if opts.inMem {
+			opts.mapSize = 64 << 20 // 64MB
+		} else {
+			opts.mapSize = 32 << 40 // 32TB
+		}
+	}
 	if opts.inMem {
-		err = env.SetMapSize(64 << 20) // 64MB
+		err = env.SetMapSize(int64(opts.mapSize))
 		logger = log.New("lmdb", "inMem")
 		if err != nil {
 			return nil, err
 		}
 		opts.path, _ = ioutil.TempDir(os.TempDir(), "lmdb")
 	} else {
-		err = env.SetMapSize(32 << 40) // 32TB
+		err = env.SetMapSize(int64(opts.mapSize))
 		logger = log.New("lmdb", path.Base(opts.path))
 		if err != nil {
 			return nil, err
@@ -95,11 +122,15 @@ func (opts lmdbOpts) Open() (KV, error) {
 		wg:              &sync.WaitGroup{},
 	}
 
+	db.bucketsCfg = dbutils.DefaultBucketsConfig()
+	if opts.bucketsCfg != nil {
+		db.bucketsCfg = opts.bucketsCfg(db.bucketsCfg)
+	}
 	db.buckets = make([]lmdb.DBI, len(dbutils.Buckets))
 	if opts.readOnly {
 		if err := env.View(func(tx *lmdb.Txn) error {
 			for _, name := range dbutils.Buckets {
-				dbi, createErr := tx.OpenDBI(string(name), 0)
+				dbi, createErr := tx.OpenDBI(string(name), uint(db.bucketsCfg[string(name)].Flags))
 				if createErr != nil {
 					return createErr
 				}
@@ -112,7 +143,7 @@ func (opts lmdbOpts) Open() (KV, error) {
 	} else {
 		if err := env.Update(func(tx *lmdb.Txn) error {
 			for _, name := range dbutils.Buckets {
-				dbi, createErr := tx.OpenDBI(string(name), lmdb.Create)
+				dbi, createErr := tx.OpenDBI(string(name), lmdb.Create|uint(db.bucketsCfg[string(name)].Flags))
 				if createErr != nil {
 					return createErr
 				}
@@ -123,6 +154,10 @@ func (opts lmdbOpts) Open() (KV, error) {
 			return nil, err
 		}
 	}
+	if db.codecs, err = openCodecs(db, db.bucketsCfg, opts.compress, opts.readOnly); err != nil {
+		env.Close()
+		return nil, err
+	}
 
 	if !opts.inMem {
 		ctx, ctxCancel := context.WithCancel(context.Background())
@@ -152,8 +187,10 @@ type LmdbKV struct {
 	env                 *lmdb.Env
 	log                 log.Logger
 	buckets             []lmdb.DBI
-	lmdbTxPool          *lmdbpool.TxnPool // pool of lmdb.Txn objects
-	lmdbCursorPools     []sync.Pool       // pool of lmdb.Cursor objects
+	bucketsCfg          dbutils.BucketsCfg
+	codecs              map[string]*bucketCodec // codecs of the compressed buckets
+	lmdbTxPool          *lmdbpool.TxnPool       // pool of lmdb.Txn objects
+	lmdbCursorPools     []sync.Pool             // pool of lmdb.Cursor objects
 	stopStaleReadsCheck context.CancelFunc
 	wg                  *sync.WaitGroup
 }
@@ -213,7 +250,9 @@ func (db *LmdbKV) DiskSize(_ context.Context) (common.StorageSize, error) {
 }
 
 func (db *LmdbKV) BucketsStat(_ context.Context) (map[string]common.StorageBucketWriteStats, error) {
-	return map[string]common.StorageBucketWriteStats{}, nil
+	res := map[string]common.StorageBucketWriteStats{}
+	codecsStat(db.codecs, res)
+	return res, nil
 }
 
 func (db *LmdbKV) dbi(bucket []byte) lmdb.DBI {
@@ -223,11 +262,18 @@ func (db *LmdbKV) dbi(bucket []byte) lmdb.DBI {
 	panic(fmt.Errorf("unknown bucket: %s. add it to dbutils.Buckets", string(bucket)))
 }
 
+func (db *LmdbKV) AllBuckets() dbutils.BucketsCfg {
+	return db.bucketsCfg
+}
+
 func (db *LmdbKV) IdealBatchSize() int {
 	return 50 * 1024 * 1024 // 50 Mb
 }
 
 func (db *LmdbKV) Get(ctx context.Context, bucket, key []byte) (val []byte, err error) {
+	if _, ok := db.codecs[string(bucket)]; ok {
+		return getCompressed(ctx, db, bucket, key)
+	}
 	err = db.View(ctx, func(tx Tx) error {
 		v, err2 := tx.(*lmdbTx).tx.Get(db.dbi(bucket), key)
 		if err2 != nil {
@@ -249,6 +295,10 @@ func (db *LmdbKV) Get(ctx context.Context, bucket, key []byte) (val []byte, err
 }
 
 func (db *LmdbKV) Has(ctx context.Context, bucket, key []byte) (has bool, err error) {
+	if _, ok := db.codecs[string(bucket)]; ok {
+		v, err := getCompressed(ctx, db, bucket, key)
+		return v != nil, err
+	}
 	err = db.View(ctx, func(tx Tx) error {
 		v, err2 := tx.(*lmdbTx).tx.Get(db.dbi(bucket), key)
 		if err2 != nil {
@@ -302,9 +352,10 @@ type lmdbTx struct {
 }
 
 type lmdbBucket struct {
-	id  int
-	tx  *lmdbTx
-	dbi lmdb.DBI
+	id        int
+	tx        *lmdbTx
+	dbi       lmdb.DBI
+	isDupsort bool
 }
 
 type LmdbCursor struct {
@@ -351,6 +402,7 @@ func (tx *lmdbTx) Bucket(name []byte) Bucket {
 	b.tx = tx
 	b.id = id
 	b.dbi = tx.db.buckets[id]
+	b.isDupsort = tx.db.bucketsCfg[string(name)].Flags&dbutils.DupSort != 0
 
 	// add to auto-close on end of transactions
 	if b.tx.buckets == nil {
@@ -358,6 +410,9 @@ func (tx *lmdbTx) Bucket(name []byte) Bucket {
 	}
 	b.tx.buckets = append(b.tx.buckets, b)
 
+	if codec, ok := tx.db.codecs[string(name)]; ok {
+		return compressedBucket{Bucket: b, codec: codec}
+	}
 	return b
 }
 
@@ -444,6 +499,9 @@ func (b *lmdbBucket) Delete(key []byte) error {
 	default:
 	}
 
+	if b.isDupsort {
+		return b.Cursor().Delete(key)
+	}
 	err := b.tx.tx.Del(b.dbi, key, nil)
 	if err != nil {
 		if lmdb.IsNotFound(err) {
@@ -481,6 +539,13 @@ func (b *lmdbBucket) Cursor() Cursor {
 	return c
 }
 
+func (b *lmdbBucket) CursorDupSort() CursorDupSort {
+	if !b.isDupsort {
+		panic(fmt.Errorf("bucket is not DupSort: %s", dbutils.Buckets[b.id]))
+	}
+	return b.Cursor().(*LmdbCursor)
+}
+
 func (c *LmdbCursor) initCursor() error {
 	if c.cursor != nil {
 		return nil
@@ -568,6 +633,106 @@ func (c *LmdbCursor) Next() (k, v []byte, err error) {
 	return k, v, nil
 }
 
+func (c *LmdbCursor) Last() (k, v []byte, err error) {
+	select {
+	case <-c.ctx.Done():
+		return []byte{}, nil, c.ctx.Err()
+	default:
+	}
+
+	if c.cursor == nil {
+		if err := c.initCursor(); err != nil {
+			return []byte{}, nil, err
+		}
+	}
+
+	k, v, err = c.last()
+	if err != nil {
+		if lmdb.IsNotFound(err) {
+			return nil, nil, nil
+		}
+		return []byte{}, nil, fmt.Errorf("failed LmdbKV cursor.Last(): %w", err)
+	}
+	if c.prefix != nil && !bytes.HasPrefix(k, c.prefix) {
+		k, v = nil, nil
+	}
+
+	return k, v, nil
+}
+
+// last positions the cursor at the last key matching the prefix (if there is any)
+func (c *LmdbCursor) last() (k, v []byte, err error) {
+	if len(c.prefix) == 0 {
+		return c.cursor.Get(nil, nil, lmdb.Last)
+	}
+	next, ok := dbutils.NextSubtree(c.prefix)
+	if !ok {
+		return c.cursor.Get(nil, nil, lmdb.Last)
+	}
+	_, _, err = c.cursor.Get(next, nil, lmdb.SetRange)
+	if err != nil {
+		if lmdb.IsNotFound(err) {
+			return c.cursor.Get(nil, nil, lmdb.Last)
+		}
+		return nil, nil, err
+	}
+	return c.cursor.Get(nil, nil, lmdb.Prev)
+}
+
+func (c *LmdbCursor) Prev() (k, v []byte, err error) {
+	select {
+	case <-c.ctx.Done():
+		return []byte{}, nil, c.ctx.Err()
+	default:
+	}
+
+	if c.cursor == nil {
+		if err := c.initCursor(); err != nil {
+			return []byte{}, nil, err
+		}
+	}
+
+	k, v, err = c.cursor.Get(nil, nil, lmdb.Prev)
+	if err != nil {
+		if lmdb.IsNotFound(err) {
+			return nil, nil, nil
+		}
+		return []byte{}, nil, fmt.Errorf("failed LmdbKV cursor.Prev(): %w", err)
+	}
+	if c.prefix != nil && !bytes.HasPrefix(k, c.prefix) {
+		k, v = nil, nil
+	}
+
+	return k, v, nil
+}
+
+func (c *LmdbCursor) SeekExact(key []byte) (k, v []byte, err error) {
+	select {
+	case <-c.ctx.Done():
+		return []byte{}, nil, c.ctx.Err()
+	default:
+	}
+
+	if c.cursor == nil {
+		if err := c.initCursor(); err != nil {
+			return []byte{}, nil, err
+		}
+	}
+
+	if c.prefix != nil && !bytes.HasPrefix(key, c.prefix) {
+		return nil, nil, nil
+	}
+	k, v, err = c.cursor.Get(key, nil, lmdb.SetKey)
+	if err != nil {
+		if lmdb.IsNotFound(err) {
+			return nil, nil, nil
+		}
+		return []byte{}, nil, fmt.Errorf("failed LmdbKV cursor.SeekExact(): %w, key: %x", err, key)
+	}
+
+	return k, v, nil
+}
+
 func (c *LmdbCursor) Delete(key []byte) error {
 	select {
 	case <-c.ctx.Done():
@@ -589,6 +754,125 @@ func (c *LmdbCursor) Delete(key []byte) error {
 	if !bytes.Equal(k, key) {
 		return nil
 	}
+	if c.bucket.isDupsort {
+		return c.cursor.Del(lmdb.NoDupData) // all values of the key
+	}
+	return c.cursor.Del(0)
+}
+
+func (c *LmdbCursor) SeekBothRange(key, value []byte) ([]byte, []byte, error) {
+	select {
+	case <-c.ctx.Done():
+		return []byte{}, nil, c.ctx.Err()
+	default:
+	}
+
+	if c.cursor == nil {
+		if err := c.initCursor(); err != nil {
+			return []byte{}, nil, err
+		}
+	}
+
+	if c.prefix != nil && !bytes.HasPrefix(key, c.prefix) {
+		return nil, nil, nil
+	}
+	_, v, err := c.cursor.Get(key, value, lmdb.GetBothRange)
+	if err != nil {
+		if lmdb.IsNotFound(err) {
+			return nil, nil, nil
+		}
+		return []byte{}, nil, fmt.Errorf("failed LmdbKV cursor.SeekBothRange(): %w, key: %x", err, key)
+	}
+	return key, v, nil
+}
+
+func (c *LmdbCursor) FirstDup() ([]byte, error) {
+	select {
+	case <-c.ctx.Done():
+		return nil, c.ctx.Err()
+	default:
+	}
+
+	if c.cursor == nil {
+		if err := c.initCursor(); err != nil {
+			return nil, err
+		}
+	}
+
+	// MDB_FIRST_DUP doesn't return the key, position at the first value of the current key instead
+	k, _, err := c.cursor.Get(nil, nil, lmdb.GetCurrent)
+	if err != nil {
+		if lmdb.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed LmdbKV cursor.FirstDup(): %w", err)
+	}
+	_, v, err := c.cursor.Get(k, nil, lmdb.SetKey)
+	if err != nil {
+		if lmdb.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed LmdbKV cursor.FirstDup(): %w", err)
+	}
+	return v, nil
+}
+
+func (c *LmdbCursor) NextDup() ([]byte, []byte, error) {
+	select {
+	case <-c.ctx.Done():
+		return []byte{}, nil, c.ctx.Err()
+	default:
+	}
+
+	if c.cursor == nil {
+		if err := c.initCursor(); err != nil {
+			return []byte{}, nil, err
+		}
+	}
+
+	k, v, err := c.cursor.Get(nil, nil, lmdb.NextDup)
+	if err != nil {
+		if lmdb.IsNotFound(err) {
+			return nil, nil, nil
+		}
+		return []byte{}, nil, fmt.Errorf("failed LmdbKV cursor.NextDup(): %w", err)
+	}
+	return k, v, nil
+}
+
+func (c *LmdbCursor) NextNoDup() ([]byte, []byte, error) {
+	select {
+	case <-c.ctx.Done():
+		return []byte{}, nil, c.ctx.Err()
+	default:
+	}
+
+	if c.cursor == nil {
+		if err := c.initCursor(); err != nil {
+			return []byte{}, nil, err
+		}
+	}
+
+	k, v, err := c.cursor.Get(nil, nil, lmdb.NextNoDup)
+	if err != nil {
+		if lmdb.IsNotFound(err) {
+			return nil, nil, nil
+		}
+		return []byte{}, nil, fmt.Errorf("failed LmdbKV cursor.NextNoDup(): %w", err)
+	}
+	if c.prefix != nil && !bytes.HasPrefix(k, c.prefix) {
+		k, v = nil, nil
+	}
+	return k, v, nil
+}
+
+func (c *LmdbCursor) DeleteCurrent() error {
+	select {
+	case <-c.ctx.Done():
+		return c.ctx.Err()
+	default:
+	}
+
 	return c.cursor.Del(0)
 }
 
@@ -608,7 +892,16 @@ func (c *LmdbCursor) Put(key []byte, value []byte) error {
 		}
 	}
 
-	return c.cursor.Put(key, value, 0)
+	return c.put(key, value, 0)
+}
+
+// put works around lmdb-go, which writes the empty value of Cursor.Put as a zero byte
+func (c *LmdbCursor) put(key, value []byte, flags uint) error {
+	if len(value) == 0 && !c.bucket.isDupsort {
+		_, err := c.cursor.PutReserve(key, 0, flags)
+		return err
+	}
+	return c.cursor.Put(key, value, flags)
 }
 
 // Append - speedy feature of lmdb which is not part of KV interface.
@@ -625,7 +918,7 @@ func (c *LmdbCursor) Append(key []byte, value []byte) error {
 		}
 	}
 
-	return c.cursor.Put(key, value, lmdb.Append)
+	return c.put(key, value, lmdb.Append)
 }
 
 func (c *LmdbCursor) Walk(walker func(k, v []byte) (bool, error)) error {
@@ -644,6 +937,8 @@ func (c *LmdbCursor) Walk(walker func(k, v []byte) (bool, error)) error {
 	return nil
 }
 
+// lmdbNoValuesCursor returns nil key when there are no more keys (as LmdbCursor and the other NoValues cursors do),
+// callers iterating with `k != nil` rely on it
 type lmdbNoValuesCursor struct {
 	*LmdbCursor
 }
@@ -683,7 +978,7 @@ func (c *lmdbNoValuesCursor) Seek(seek []byte) (k []byte, vSize uint32, err erro
 	}
 	if err != nil {
 		if lmdb.IsNotFound(err) {
-			return []byte{}, uint32(len(v)), nil
+			return nil, 0, nil
 		}
 		return []byte{}, 0, err
 	}
@@ -709,7 +1004,7 @@ func (c *lmdbNoValuesCursor) Next() (k []byte, v uint32, err error) {
 	k, val, err = c.cursor.Get(nil, nil, lmdb.Next)
 	if err != nil {
 		if lmdb.IsNotFound(err) {
-			return []byte{}, uint32(len(val)), nil
+			return nil, 0, nil
 		}
 		return []byte{}, 0, err
 	}
@@ -719,3 +1014,21 @@ func (c *lmdbNoValuesCursor) Next() (k []byte, v uint32, err error) {
 
 	return k, uint32(len(val)), err
 }
+
+func (c *lmdbNoValuesCursor) Last() (k []byte, vSize uint32, err error) {
+	var v []byte
+	k, v, err = c.LmdbCursor.Last()
+	return k, uint32(len(v)), err
+}
+
+func (c *lmdbNoValuesCursor) Prev() (k []byte, vSize uint32, err error) {
+	var v []byte
+	k, v, err = c.LmdbCursor.Prev()
+	return k, uint32(len(v)), err
+}
+
+func (c *lmdbNoValuesCursor) SeekExact(key []byte) (k []byte, vSize uint32, err error) {
+	var v []byte
+	k, v, err = c.LmdbCursor.SeekExact(key)
+	return k, uint32(len(v)), err
+}
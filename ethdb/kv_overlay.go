@@ -0,0 +1,484 @@
+package ethdb
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+)
+
+// Values in the overlay are prefixed by the marker, deletions are kept as tombstones hiding the keys of the base database
+const (
+	overlayDeleted byte = 0
+	overlayPut     byte = 1
+)
+
+// OverlayKV - copy-on-write view of another KV, used for dry-runs and speculative execution.
+// Reads see the base database merged with the writes made through the overlay. Writes are buffered
+// in a temporary LMDB and reach the base database only on Flush, the base database is accessed in read-only
+// transactions only. Buckets with dbutils.DupSort flag are not supported.
+type OverlayKV struct {
+	base    KV
+	overlay KV
+}
+
+// NewOverlay creates the overlay on top of the base database. Closing the overlay doesn't close the base database
+func NewOverlay(base KV) *OverlayKV {
+	return &OverlayKV{
+		base:    base,
+		overlay: NewLMDB().InMem().MapSize(1 << 40).MustOpen(),
+	}
+}
+
+type overlayTx struct {
+	base    Tx
+	overlay Tx
+}
+
+type overlayBucket struct {
+	base    Bucket
+	overlay Bucket
+}
+
+// overlayCursor merges the cursors of the base database and of the overlay, overlay takes precedence
+type overlayCursor struct {
+	bucket  *overlayBucket
+	base    Cursor
+	overlay Cursor
+	reverse bool // direction of the last movement
+
+	bk, bv []byte // position of the base cursor
+	ok, ov []byte // position of the overlay cursor, value with the marker
+	k, v   []byte // merged position
+}
+
+type overlayNoValuesCursor struct {
+	*overlayCursor
+}
+
+// Close closes the overlay, discarding the changes which were not flushed
+func (db *OverlayKV) Close() {
+	db.overlay.Close()
+}
+
+func (db *OverlayKV) IdealBatchSize() int {
+	return db.base.IdealBatchSize()
+}
+
+func (db *OverlayKV) AllBuckets() dbutils.BucketsCfg {
+	return db.base.AllBuckets()
+}
+
+func (db *OverlayKV) Begin(ctx context.Context, writable bool) (Tx, error) {
+	base, err := db.base.Begin(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	overlay, err := db.overlay.Begin(ctx, writable)
+	if err != nil {
+		base.Rollback()
+		return nil, err
+	}
+	return &overlayTx{base: base, overlay: overlay}, nil
+}
+
+func (db *OverlayKV) View(ctx context.Context, f func(tx Tx) error) error {
+	return db.base.View(ctx, func(base Tx) error {
+		return db.overlay.View(ctx, func(overlay Tx) error {
+			return f(&overlayTx{base: base, overlay: overlay})
+		})
+	})
+}
+
+func (db *OverlayKV) Update(ctx context.Context, f func(tx Tx) error) error {
+	return db.base.View(ctx, func(base Tx) error {
+		return db.overlay.Update(ctx, func(overlay Tx) error {
+			return f(&overlayTx{base: base, overlay: overlay})
+		})
+	})
+}
+
+// Flush writes the buffered changes into the base database and empties the overlay
+func (db *OverlayKV) Flush(ctx context.Context) error {
+	if err := db.base.Update(ctx, func(baseTx Tx) error {
+		return db.overlay.View(ctx, func(tx Tx) error {
+			for _, name := range dbutils.Buckets {
+				b := baseTx.Bucket(name)
+				if err := tx.Bucket(name).Cursor().Walk(func(k, v []byte) (bool, error) {
+					if v[0] == overlayDeleted {
+						return true, b.Delete(common.CopyBytes(k))
+					}
+					return true, b.Put(common.CopyBytes(k), common.CopyBytes(v[1:]))
+				}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+	return db.Discard(ctx)
+}
+
+// Discard drops the buffered changes
+func (db *OverlayKV) Discard(ctx context.Context) error {
+	return db.overlay.Update(ctx, func(tx Tx) error {
+		for _, name := range dbutils.Buckets {
+			if err := tx.Bucket(name).Clear(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (tx *overlayTx) Bucket(name []byte) Bucket {
+	return &overlayBucket{base: tx.base.Bucket(name), overlay: tx.overlay.Bucket(name)}
+}
+
+func (tx *overlayTx) Commit(ctx context.Context) error {
+	defer tx.base.Rollback()
+	return tx.overlay.Commit(ctx)
+}
+
+func (tx *overlayTx) Rollback() {
+	tx.overlay.Rollback()
+	tx.base.Rollback()
+}
+
+func (b *overlayBucket) Get(key []byte) ([]byte, error) {
+	v, err := b.overlay.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if v != nil {
+		if v[0] == overlayDeleted {
+			return nil, nil
+		}
+		return v[1:], nil
+	}
+	return b.base.Get(key)
+}
+
+func (b *overlayBucket) Put(key []byte, value []byte) error {
+	v := make([]byte, len(value)+1)
+	v[0] = overlayPut
+	copy(v[1:], value)
+	return b.overlay.Put(key, v)
+}
+
+func (b *overlayBucket) Delete(key []byte) error {
+	return b.overlay.Put(key, []byte{overlayDeleted})
+}
+
+// Size - size of the bucket in the base database, adjusted by the sizes of the records written and deleted through the overlay
+func (b *overlayBucket) Size() (uint64, error) {
+	size, err := b.base.Size()
+	if err != nil {
+		return 0, err
+	}
+	var delta int64
+	if err = b.overlay.Cursor().Walk(func(k, v []byte) (bool, error) {
+		baseV, err := b.base.Get(k)
+		if err != nil {
+			return false, err
+		}
+		if baseV != nil {
+			delta -= int64(len(k) + len(baseV))
+		}
+		if v[0] == overlayPut {
+			delta += int64(len(k) + len(v) - 1)
+		}
+		return true, nil
+	}); err != nil {
+		return 0, err
+	}
+	if delta < 0 && uint64(-delta) > size {
+		return 0, nil
+	}
+	return uint64(int64(size) + delta), nil
+}
+
+// Clear hides all the keys of the base database by the tombstones
+func (b *overlayBucket) Clear() error {
+	if err := b.overlay.Clear(); err != nil {
+		return err
+	}
+	return b.base.Cursor().NoValues().Walk(func(k []byte, _ uint32) (bool, error) {
+		return true, b.overlay.Put(common.CopyBytes(k), []byte{overlayDeleted})
+	})
+}
+
+func (b *overlayBucket) Cursor() Cursor {
+	return &overlayCursor{bucket: b, base: b.base.Cursor(), overlay: b.overlay.Cursor()}
+}
+
+func (b *overlayBucket) CursorDupSort() CursorDupSort {
+	panic("not supported")
+}
+
+func (c *overlayCursor) Prefix(v []byte) Cursor {
+	c.base = c.base.Prefix(v)
+	c.overlay = c.overlay.Prefix(v)
+	return c
+}
+
+func (c *overlayCursor) MatchBits(n uint) Cursor {
+	panic("not implemented yet")
+}
+
+func (c *overlayCursor) Prefetch(v uint) Cursor {
+	c.base = c.base.Prefetch(v)
+	c.overlay = c.overlay.Prefetch(v)
+	return c
+}
+
+func (c *overlayCursor) NoValues() NoValuesCursor {
+	return &overlayNoValuesCursor{overlayCursor: c}
+}
+
+// setBase and setOverlay remember the positions of the underlying cursors. Keys are copied, because the buffers of
+// the underlying cursors may be reused, values of the overlay are copied, because the overlay may be written meanwhile
+func (c *overlayCursor) setBase(k, v []byte, err error) error {
+	c.bk, c.bv = common.CopyBytes(k), v
+	return err
+}
+
+func (c *overlayCursor) setOverlay(k, v []byte, err error) error {
+	c.ok, c.ov = common.CopyBytes(k), common.CopyBytes(v)
+	return err
+}
+
+// compareKeys compares the positions of the cursors, nil key is past the end in the direction of the movement
+func (c *overlayCursor) compareKeys(a, b []byte) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return 1
+	case b == nil:
+		return -1
+	}
+	if c.reverse {
+		return bytes.Compare(b, a)
+	}
+	return bytes.Compare(a, b)
+}
+
+func (c *overlayCursor) step(cursor Cursor) ([]byte, []byte, error) {
+	if c.reverse {
+		return cursor.Prev()
+	}
+	return cursor.Next()
+}
+
+// resolve picks the merged position out of the positions of the underlying cursors, skipping the tombstones
+func (c *overlayCursor) resolve() ([]byte, []byte, error) {
+	for {
+		if c.ok == nil && c.bk == nil {
+			c.k, c.v = nil, nil
+			return nil, nil, nil
+		}
+		cmp := c.compareKeys(c.ok, c.bk)
+		if cmp > 0 {
+			c.k, c.v = c.bk, c.bv
+			return c.k, c.v, nil
+		}
+		if c.ov[0] == overlayPut {
+			c.k, c.v = c.ok, c.ov[1:]
+			return c.k, c.v, nil
+		}
+		if cmp == 0 {
+			if err := c.setBase(c.step(c.base)); err != nil {
+				return []byte{}, nil, err
+			}
+		}
+		if err := c.setOverlay(c.step(c.overlay)); err != nil {
+			return []byte{}, nil, err
+		}
+	}
+}
+
+// reposition moves the underlying cursors past the merged position in the new direction
+func (c *overlayCursor) reposition(reverse bool) error {
+	c.reverse = reverse
+	for _, side := range []struct {
+		cursor Cursor
+		set    func(k, v []byte, err error) error
+	}{{c.base, c.setBase}, {c.overlay, c.setOverlay}} {
+		k, v, err := side.cursor.Seek(c.k)
+		if err != nil {
+			return err
+		}
+		switch {
+		case !reverse && bytes.Equal(k, c.k):
+			err = side.set(side.cursor.Next())
+		case !reverse:
+			err = side.set(k, v, nil)
+		case k == nil:
+			err = side.set(side.cursor.Last())
+		default:
+			err = side.set(side.cursor.Prev())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// move advances the underlying cursors which are at the merged position
+func (c *overlayCursor) move(reverse bool) ([]byte, []byte, error) {
+	if c.k == nil {
+		return nil, nil, nil
+	}
+	if c.reverse != reverse {
+		if err := c.reposition(reverse); err != nil {
+			return []byte{}, nil, err
+		}
+		return c.resolve()
+	}
+	if bytes.Equal(c.bk, c.k) {
+		if err := c.setBase(c.step(c.base)); err != nil {
+			return []byte{}, nil, err
+		}
+	}
+	if bytes.Equal(c.ok, c.k) {
+		if err := c.setOverlay(c.step(c.overlay)); err != nil {
+			return []byte{}, nil, err
+		}
+	}
+	return c.resolve()
+}
+
+func (c *overlayCursor) First() ([]byte, []byte, error) {
+	c.reverse = false
+	if err := c.setBase(c.base.First()); err != nil {
+		return []byte{}, nil, err
+	}
+	if err := c.setOverlay(c.overlay.First()); err != nil {
+		return []byte{}, nil, err
+	}
+	return c.resolve()
+}
+
+func (c *overlayCursor) Seek(seek []byte) ([]byte, []byte, error) {
+	c.reverse = false
+	if err := c.setBase(c.base.Seek(seek)); err != nil {
+		return []byte{}, nil, err
+	}
+	if err := c.setOverlay(c.overlay.Seek(seek)); err != nil {
+		return []byte{}, nil, err
+	}
+	return c.resolve()
+}
+
+func (c *overlayCursor) SeekTo(seek []byte) ([]byte, []byte, error) {
+	return c.Seek(seek)
+}
+
+func (c *overlayCursor) SeekExact(key []byte) ([]byte, []byte, error) {
+	k, v, err := c.Seek(key)
+	if err != nil {
+		return []byte{}, nil, err
+	}
+	if !bytes.Equal(k, key) {
+		return nil, nil, nil
+	}
+	return k, v, nil
+}
+
+func (c *overlayCursor) Next() ([]byte, []byte, error) {
+	return c.move(false)
+}
+
+func (c *overlayCursor) Prev() ([]byte, []byte, error) {
+	return c.move(true)
+}
+
+func (c *overlayCursor) Last() ([]byte, []byte, error) {
+	c.reverse = true
+	if err := c.setBase(c.base.Last()); err != nil {
+		return []byte{}, nil, err
+	}
+	if err := c.setOverlay(c.overlay.Last()); err != nil {
+		return []byte{}, nil, err
+	}
+	return c.resolve()
+}
+
+func (c *overlayCursor) Walk(walker func(k, v []byte) (bool, error)) error {
+	for k, v, err := c.First(); k != nil; k, v, err = c.Next() {
+		if err != nil {
+			return err
+		}
+		ok, err := walker(k, v)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (c *overlayCursor) Put(key []byte, value []byte) error {
+	return c.bucket.Put(key, value)
+}
+
+func (c *overlayCursor) Append(key []byte, value []byte) error {
+	return c.bucket.Put(key, value)
+}
+
+func (c *overlayCursor) Delete(key []byte) error {
+	return c.bucket.Delete(key)
+}
+
+func (c *overlayNoValuesCursor) First() ([]byte, uint32, error) {
+	k, v, err := c.overlayCursor.First()
+	return k, uint32(len(v)), err
+}
+
+func (c *overlayNoValuesCursor) Seek(seek []byte) ([]byte, uint32, error) {
+	k, v, err := c.overlayCursor.Seek(seek)
+	return k, uint32(len(v)), err
+}
+
+func (c *overlayNoValuesCursor) SeekExact(key []byte) ([]byte, uint32, error) {
+	k, v, err := c.overlayCursor.SeekExact(key)
+	return k, uint32(len(v)), err
+}
+
+func (c *overlayNoValuesCursor) Next() ([]byte, uint32, error) {
+	k, v, err := c.overlayCursor.Next()
+	return k, uint32(len(v)), err
+}
+
+func (c *overlayNoValuesCursor) Prev() ([]byte, uint32, error) {
+	k, v, err := c.overlayCursor.Prev()
+	return k, uint32(len(v)), err
+}
+
+func (c *overlayNoValuesCursor) Last() ([]byte, uint32, error) {
+	k, v, err := c.overlayCursor.Last()
+	return k, uint32(len(v)), err
+}
+
+func (c *overlayNoValuesCursor) Walk(walker func(k []byte, vSize uint32) (bool, error)) error {
+	for k, vSize, err := c.First(); k != nil; k, vSize, err = c.Next() {
+		if err != nil {
+			return err
+		}
+		ok, err := walker(k, vSize)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+	}
+	return nil
+}
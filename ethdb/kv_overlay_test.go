@@ -0,0 +1,167 @@
+package ethdb_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb/dbtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOverlayCursorSuite(t *testing.T) {
+	base := ethdb.NewLMDB().InMem().MustOpen()
+	defer base.Close()
+	overlay := ethdb.NewOverlay(base)
+	defer overlay.Close()
+	dbtest.TestCursorSuite(t, overlay, overlay)
+}
+
+func TestOverlay(t *testing.T) {
+	ctx := context.Background()
+	bucket := dbutils.Buckets[0]
+	bases := []ethdb.KV{
+		ethdb.NewBolt().InMem().MustOpen(),
+		ethdb.NewBadger().InMem().MustOpen(),
+		ethdb.NewLMDB().InMem().MustOpen(),
+	}
+
+	// collect iterates the bucket in both directions and checks that the orders agree
+	collect := func(t *testing.T, db ethdb.KV) []string {
+		var forward, reverse []string
+		require.NoError(t, db.View(ctx, func(tx ethdb.Tx) error {
+			c := tx.Bucket(bucket).Cursor()
+			for k, v, err := c.First(); k != nil; k, v, err = c.Next() {
+				require.NoError(t, err)
+				forward = append(forward, fmt.Sprintf("%x:%s", k, v))
+			}
+			for k, v, err := c.Last(); k != nil; k, v, err = c.Prev() {
+				require.NoError(t, err)
+				reverse = append([]string{fmt.Sprintf("%x:%s", k, v)}, reverse...)
+			}
+			return nil
+		}))
+		require.Equal(t, forward, reverse)
+		return forward
+	}
+
+	for _, base := range bases {
+		base := base
+		t.Run(fmt.Sprintf("%T", base), func(t *testing.T) {
+			defer base.Close()
+			require.NoError(t, base.Update(ctx, func(tx ethdb.Tx) error {
+				b := tx.Bucket(bucket)
+				for _, k := range []byte{1, 3, 5, 7} {
+					require.NoError(t, b.Put([]byte{k}, []byte("base")))
+				}
+				return nil
+			}))
+
+			overlay := ethdb.NewOverlay(base)
+			defer overlay.Close()
+			require.NoError(t, overlay.Update(ctx, func(tx ethdb.Tx) error {
+				b := tx.Bucket(bucket)
+				require.NoError(t, b.Put([]byte{0}, []byte("new")))
+				require.NoError(t, b.Put([]byte{3}, []byte("new")))
+				require.NoError(t, b.Put([]byte{4}, []byte("new")))
+				require.NoError(t, b.Delete([]byte{5}))
+				require.NoError(t, b.Delete([]byte{7}))
+				return nil
+			}))
+
+			merged := []string{"00:new", "01:base", "03:new", "04:new"}
+			require.Equal(t, merged, collect(t, overlay))
+			require.Equal(t, []string{"01:base", "03:base", "05:base", "07:base"}, collect(t, base))
+
+			require.NoError(t, overlay.View(ctx, func(tx ethdb.Tx) error {
+				b := tx.Bucket(bucket)
+				v, err := b.Get([]byte{3})
+				require.NoError(t, err)
+				require.Equal(t, "new", string(v))
+				v, err = b.Get([]byte{5})
+				require.NoError(t, err)
+				require.Nil(t, v)
+
+				// changes of the direction in the middle of the merged sequence
+				c := b.Cursor()
+				k, _, err := c.Seek([]byte{2})
+				require.NoError(t, err)
+				require.Equal(t, []byte{3}, k)
+				k, _, err = c.Prev()
+				require.NoError(t, err)
+				require.Equal(t, []byte{1}, k)
+				k, _, err = c.Next()
+				require.NoError(t, err)
+				require.Equal(t, []byte{3}, k)
+				k, _, err = c.Next()
+				require.NoError(t, err)
+				require.Equal(t, []byte{4}, k)
+				k, _, err = c.Next()
+				require.NoError(t, err)
+				require.Nil(t, k)
+				return nil
+			}))
+
+			require.NoError(t, overlay.Flush(ctx))
+			require.Equal(t, merged, collect(t, base))
+			require.Equal(t, merged, collect(t, overlay))
+
+			require.NoError(t, overlay.Update(ctx, func(tx ethdb.Tx) error {
+				return tx.Bucket(bucket).Clear()
+			}))
+			require.Empty(t, collect(t, overlay))
+			require.NoError(t, overlay.Discard(ctx))
+			require.Equal(t, merged, collect(t, overlay))
+		})
+	}
+}
+
+func TestOverlaySize(t *testing.T) {
+	ctx := context.Background()
+	bucket := dbutils.Buckets[0]
+	base := ethdb.NewLMDB().InMem().MustOpen()
+	defer base.Close()
+	require.NoError(t, base.Update(ctx, func(tx ethdb.Tx) error {
+		for i := 0; i < 100; i++ {
+			if err := tx.Bucket(bucket).Put([]byte{0, byte(i)}, make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	overlay := ethdb.NewOverlay(base)
+	defer overlay.Close()
+	size := func() uint64 {
+		var size uint64
+		require.NoError(t, overlay.View(ctx, func(tx ethdb.Tx) error {
+			var err error
+			size, err = tx.Bucket(bucket).Size()
+			return err
+		}))
+		return size
+	}
+
+	baseSize := size()
+	require.NotZero(t, baseSize)
+	require.NoError(t, overlay.Update(ctx, func(tx ethdb.Tx) error {
+		for i := 0; i < 100; i++ {
+			if err := tx.Bucket(bucket).Put([]byte{1, byte(i)}, make([]byte, 1000)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	require.Equal(t, baseSize+100*(2+1000), size())
+
+	require.NoError(t, overlay.Update(ctx, func(tx ethdb.Tx) error {
+		for i := 0; i < 100; i++ {
+			if err := tx.Bucket(bucket).Delete([]byte{0, byte(i)}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	require.Equal(t, baseSize+100*(2+1000)-100*(2+100), size())
+}
@@ -0,0 +1,562 @@
+package ethdb
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/log"
+)
+
+// TraceOp - operation recorded by RecorderKV
+type TraceOp byte
+
+const (
+	TraceBegin        TraceOp = iota + 1 // ValueSize is 1 for read-write transactions
+	TraceCommit                          // also recorded at the end of KV.Update
+	TraceRollback                        // also recorded at the end of KV.View and of failed KV.Update
+	TraceCursor                          // new cursor in the bucket
+	TraceGet                             // Bucket.Get
+	TracePut                             // Bucket.Put, ValueSize - size of the value
+	TraceDelete                          // Bucket.Delete
+	TraceFirst                           // Cursor.First
+	TraceSeek                            // Cursor.Seek
+	TraceSeekTo                          // Cursor.SeekTo
+	TraceSeekExact                       // Cursor.SeekExact
+	TraceNext                            // Cursor.Next
+	TracePrev                            // Cursor.Prev
+	TraceLast                            // Cursor.Last
+	TraceWalk                            // Cursor.Walk, ValueSize - number of the records visited
+	TraceCursorPut                       // Cursor.Put, ValueSize - size of the value
+	TraceCursorDelete                    // Cursor.Delete
+	TraceAppend                          // Cursor.Append, ValueSize - size of the value
+	TracePrefix                          // Cursor.Prefix
+	traceBucketName                      // assigns the number to the bucket, Key - name of the bucket, not passed to ReadTrace
+
+	traceOpsCount
+)
+
+var traceOpNames = [traceOpsCount]string{
+	"", "begin", "commit", "rollback", "cursor", "get", "put", "delete",
+	"first", "seek", "seekTo", "seekExact", "next", "prev", "last", "walk", "cursorPut", "cursorDelete", "append", "prefix", "bucketName",
+}
+
+func (op TraceOp) String() string {
+	if op == 0 || op >= traceOpsCount {
+		return fmt.Sprintf("unknown(%d)", byte(op))
+	}
+	return traceOpNames[op]
+}
+
+// TraceMagic - beginning of the files written by RecorderKV
+var TraceMagic = []byte("KVTRACE2")
+
+// noBucket - number of the bucket in the records of the operations of Tx. Other buckets are numbered from 1
+// in the order of their first use, the name of the bucket is written into the trace before its first record,
+// so the trace doesn't depend on the list of the buckets of the build which has recorded it
+const noBucket = 0
+
+// TraceRecord - one operation in the trace of RecorderKV. Values are not recorded, only their sizes
+type TraceRecord struct {
+	Op        TraceOp
+	Tx        uint64 // sequence number of the transaction in the trace
+	Cursor    uint64 // sequence number of the cursor in the transaction, 0 for the operations of Bucket and Tx
+	Bucket    []byte // nil for the operations of Tx
+	Key       []byte
+	ValueSize uint64
+	Duration  time.Duration // time spent in the database
+}
+
+func (r *TraceRecord) encode(buf []byte, bucket uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	buf = append(buf, byte(r.Op))
+	buf = append(buf, tmp[:binary.PutUvarint(tmp[:], r.Tx)]...)
+	buf = append(buf, tmp[:binary.PutUvarint(tmp[:], r.Cursor)]...)
+	buf = append(buf, tmp[:binary.PutUvarint(tmp[:], bucket)]...)
+	buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(len(r.Key)))]...)
+	buf = append(buf, r.Key...)
+	buf = append(buf, tmp[:binary.PutUvarint(tmp[:], r.ValueSize)]...)
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(r.Duration))]...)
+}
+
+// ReadTrace calls f for every record of the trace written by RecorderKV. The record and its key are reused between calls
+func ReadTrace(r io.Reader, f func(rec *TraceRecord) error) error {
+	br := bufio.NewReaderSize(r, 1<<20)
+	magic := make([]byte, len(TraceMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return fmt.Errorf("reading trace header: %w", err)
+	}
+	if string(magic) != string(TraceMagic) {
+		return fmt.Errorf("not a KV trace, header %x", magic)
+	}
+
+	var rec TraceRecord
+	buckets := map[uint64][]byte{}
+	for {
+		op, err := br.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rec.Op = TraceOp(op)
+		if rec.Op == 0 || rec.Op >= traceOpsCount {
+			return fmt.Errorf("unknown operation %d in the trace", op)
+		}
+		if rec.Tx, err = binary.ReadUvarint(br); err != nil {
+			return truncated(err)
+		}
+		if rec.Cursor, err = binary.ReadUvarint(br); err != nil {
+			return truncated(err)
+		}
+		bucket, err := binary.ReadUvarint(br)
+		if err != nil {
+			return truncated(err)
+		}
+		if bucket == noBucket {
+			rec.Bucket = nil
+		} else if rec.Bucket = buckets[bucket]; rec.Bucket == nil && rec.Op != traceBucketName {
+			return fmt.Errorf("unknown bucket %d in the trace", bucket)
+		}
+		keyLen, err := binary.ReadUvarint(br)
+		if err != nil {
+			return truncated(err)
+		}
+		if uint64(cap(rec.Key)) < keyLen {
+			rec.Key = make([]byte, keyLen)
+		}
+		rec.Key = rec.Key[:keyLen]
+		if _, err = io.ReadFull(br, rec.Key); err != nil {
+			return truncated(err)
+		}
+		if rec.ValueSize, err = binary.ReadUvarint(br); err != nil {
+			return truncated(err)
+		}
+		duration, err := binary.ReadUvarint(br)
+		if err != nil {
+			return truncated(err)
+		}
+		rec.Duration = time.Duration(duration)
+		if rec.Op == traceBucketName {
+			if bucket == noBucket || rec.Bucket != nil {
+				return fmt.Errorf("bucket %d is named twice in the trace", bucket)
+			}
+			buckets[bucket] = common.CopyBytes(rec.Key)
+			continue
+		}
+		if err := f(&rec); err != nil {
+			return err
+		}
+	}
+}
+
+func truncated(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// RecorderKV - decorator of KV writing every operation of the transactions, buckets and cursors with its timing into the trace,
+// which can be replayed against other databases by ethdb/kvreplay. NativeGet of the underlying database is not used,
+// so all reads go through the recorded transactions. Cursors of DupSort buckets and NoValues cursors are recorded as plain cursors
+type RecorderKV struct {
+	kv KV
+	w  io.Writer
+
+	txID uint64 // atomic
+
+	lock    sync.Mutex
+	bw      *bufio.Writer
+	buf     []byte
+	buckets map[string]uint64 // numbers of the buckets written into the trace
+	err     error             // first error of writing the trace
+}
+
+type recorderTx struct {
+	tx       Tx
+	db       *RecorderKV
+	id       uint64
+	cursorID uint64
+}
+
+type recorderBucket struct {
+	Bucket
+	tx   *recorderTx
+	name []byte
+}
+
+type recorderCursor struct {
+	c      Cursor
+	bucket *recorderBucket
+	id     uint64
+}
+
+type recorderNoValuesCursor struct {
+	c      NoValuesCursor
+	cursor *recorderCursor
+}
+
+// NewRecorder writes the trace of the operations with kv into w. Close of RecorderKV closes kv, flushes the trace and closes w
+// if it's io.Closer
+func NewRecorder(kv KV, w io.Writer) *RecorderKV {
+	db := &RecorderKV{kv: kv, w: w, bw: bufio.NewWriterSize(w, 1<<20), buckets: map[string]uint64{}}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.write(TraceMagic)
+	return db
+}
+
+// record writes the record, preceded by the name of its bucket if the bucket is met for the first time
+func (db *RecorderKV) record(rec *TraceRecord) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.err != nil {
+		return
+	}
+	bucket := uint64(noBucket)
+	if rec.Bucket != nil {
+		var ok bool
+		if bucket, ok = db.buckets[string(rec.Bucket)]; !ok {
+			bucket = uint64(len(db.buckets) + 1)
+			db.buckets[string(rec.Bucket)] = bucket
+			db.buf = (&TraceRecord{Op: traceBucketName, Key: rec.Bucket}).encode(db.buf[:0], bucket)
+			db.write(db.buf)
+		}
+	}
+	db.buf = rec.encode(db.buf[:0], bucket)
+	db.write(db.buf)
+}
+
+// write must be called with the lock held
+func (db *RecorderKV) write(b []byte) {
+	if db.err != nil {
+		return
+	}
+	if _, err := db.bw.Write(b); err != nil {
+		db.err = err
+		log.Warn("Writing KV trace failed, recording stopped", "err", err)
+	}
+}
+
+// Err returns the error of writing the trace, operations are not recorded after it
+func (db *RecorderKV) Err() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.err
+}
+
+func (db *RecorderKV) Close() {
+	db.kv.Close()
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if err := db.bw.Flush(); err != nil && db.err == nil {
+		db.err = err
+	}
+	if closer, ok := db.w.(io.Closer); ok {
+		if err := closer.Close(); err != nil && db.err == nil {
+			db.err = err
+		}
+	}
+	if db.err != nil {
+		log.Warn("KV trace is incomplete", "err", db.err)
+	}
+}
+
+func (db *RecorderKV) IdealBatchSize() int {
+	return db.kv.IdealBatchSize()
+}
+
+func (db *RecorderKV) AllBuckets() dbutils.BucketsCfg {
+	return db.kv.AllBuckets()
+}
+
+func (db *RecorderKV) DiskSize(ctx context.Context) (common.StorageSize, error) {
+	if casted, ok := db.kv.(HasStats); ok {
+		return casted.DiskSize(ctx)
+	}
+	return 0, nil
+}
+
+func (db *RecorderKV) BucketsStat(ctx context.Context) (map[string]common.StorageBucketWriteStats, error) {
+	if casted, ok := db.kv.(HasStats); ok {
+		return casted.BucketsStat(ctx)
+	}
+	return map[string]common.StorageBucketWriteStats{}, nil
+}
+
+func (db *RecorderKV) newTx(tx Tx, writable bool, duration time.Duration) *recorderTx {
+	t := &recorderTx{tx: tx, db: db, id: atomic.AddUint64(&db.txID, 1)}
+	rec := TraceRecord{Op: TraceBegin, Duration: duration}
+	if writable {
+		rec.ValueSize = 1
+	}
+	t.record(&rec)
+	return t
+}
+
+func (db *RecorderKV) Begin(ctx context.Context, writable bool) (Tx, error) {
+	start := time.Now()
+	tx, err := db.kv.Begin(ctx, writable)
+	if err != nil {
+		return nil, err
+	}
+	return db.newTx(tx, writable, time.Since(start)), nil
+}
+
+func (db *RecorderKV) View(ctx context.Context, f func(tx Tx) error) error {
+	var t *recorderTx
+	start := time.Now()
+	err := db.kv.View(ctx, func(tx Tx) error {
+		t = db.newTx(tx, false, time.Since(start))
+		return f(t)
+	})
+	if t != nil {
+		t.record(&TraceRecord{Op: TraceRollback})
+	}
+	return err
+}
+
+func (db *RecorderKV) Update(ctx context.Context, f func(tx Tx) error) error {
+	var t *recorderTx
+	var commitStart time.Time
+	start := time.Now()
+	err := db.kv.Update(ctx, func(tx Tx) error {
+		t = db.newTx(tx, true, time.Since(start))
+		err := f(t)
+		commitStart = time.Now()
+		return err
+	})
+	if t != nil {
+		if err != nil {
+			t.record(&TraceRecord{Op: TraceRollback})
+		} else {
+			t.record(&TraceRecord{Op: TraceCommit, Duration: time.Since(commitStart)})
+		}
+	}
+	return err
+}
+
+func (tx *recorderTx) record(rec *TraceRecord) {
+	rec.Tx = tx.id
+	tx.db.record(rec)
+}
+
+func (tx *recorderTx) Bucket(name []byte) Bucket {
+	return &recorderBucket{Bucket: tx.tx.Bucket(name), tx: tx, name: name}
+}
+
+func (tx *recorderTx) Commit(ctx context.Context) error {
+	start := time.Now()
+	err := tx.tx.Commit(ctx)
+	tx.record(&TraceRecord{Op: TraceCommit, Duration: time.Since(start)})
+	return err
+}
+
+func (tx *recorderTx) Rollback() {
+	start := time.Now()
+	tx.tx.Rollback()
+	tx.record(&TraceRecord{Op: TraceRollback, Duration: time.Since(start)})
+}
+
+func (b *recorderBucket) Get(key []byte) ([]byte, error) {
+	start := time.Now()
+	v, err := b.Bucket.Get(key)
+	b.tx.record(&TraceRecord{Op: TraceGet, Bucket: b.name, Key: key, ValueSize: uint64(len(v)), Duration: time.Since(start)})
+	return v, err
+}
+
+func (b *recorderBucket) Put(key []byte, value []byte) error {
+	start := time.Now()
+	err := b.Bucket.Put(key, value)
+	b.tx.record(&TraceRecord{Op: TracePut, Bucket: b.name, Key: key, ValueSize: uint64(len(value)), Duration: time.Since(start)})
+	return err
+}
+
+func (b *recorderBucket) Delete(key []byte) error {
+	start := time.Now()
+	err := b.Bucket.Delete(key)
+	b.tx.record(&TraceRecord{Op: TraceDelete, Bucket: b.name, Key: key, Duration: time.Since(start)})
+	return err
+}
+
+func (b *recorderBucket) Cursor() Cursor {
+	start := time.Now()
+	c := &recorderCursor{c: b.Bucket.Cursor(), bucket: b}
+	b.tx.cursorID++
+	c.id = b.tx.cursorID
+	c.record(TraceCursor, nil, 0, time.Since(start))
+	return c
+}
+
+func (c *recorderCursor) record(op TraceOp, key []byte, valueSize uint64, duration time.Duration) {
+	c.bucket.tx.record(&TraceRecord{Op: op, Cursor: c.id, Bucket: c.bucket.name, Key: key, ValueSize: valueSize, Duration: duration})
+}
+
+// move records the movement of the cursor, the key is the key found
+func (c *recorderCursor) move(op TraceOp, seek []byte, start time.Time, k, v []byte, err error) ([]byte, []byte, error) {
+	c.record(op, seek, uint64(len(v)), time.Since(start))
+	return k, v, err
+}
+
+func (c *recorderCursor) Prefix(v []byte) Cursor {
+	c.c = c.c.Prefix(v)
+	c.record(TracePrefix, v, 0, 0)
+	return c
+}
+
+func (c *recorderCursor) MatchBits(n uint) Cursor {
+	c.c = c.c.MatchBits(n)
+	return c
+}
+
+func (c *recorderCursor) Prefetch(v uint) Cursor {
+	c.c = c.c.Prefetch(v)
+	return c
+}
+
+func (c *recorderCursor) NoValues() NoValuesCursor {
+	return &recorderNoValuesCursor{c: c.c.NoValues(), cursor: c}
+}
+
+func (c *recorderCursor) First() ([]byte, []byte, error) {
+	start := time.Now()
+	k, v, err := c.c.First()
+	return c.move(TraceFirst, nil, start, k, v, err)
+}
+
+func (c *recorderCursor) Seek(seek []byte) ([]byte, []byte, error) {
+	start := time.Now()
+	k, v, err := c.c.Seek(seek)
+	return c.move(TraceSeek, seek, start, k, v, err)
+}
+
+func (c *recorderCursor) SeekTo(seek []byte) ([]byte, []byte, error) {
+	start := time.Now()
+	k, v, err := c.c.SeekTo(seek)
+	return c.move(TraceSeekTo, seek, start, k, v, err)
+}
+
+func (c *recorderCursor) Next() ([]byte, []byte, error) {
+	start := time.Now()
+	k, v, err := c.c.Next()
+	return c.move(TraceNext, nil, start, k, v, err)
+}
+
+func (c *recorderCursor) Prev() ([]byte, []byte, error) {
+	start := time.Now()
+	k, v, err := c.c.Prev()
+	return c.move(TracePrev, nil, start, k, v, err)
+}
+
+func (c *recorderCursor) Last() ([]byte, []byte, error) {
+	start := time.Now()
+	k, v, err := c.c.Last()
+	return c.move(TraceLast, nil, start, k, v, err)
+}
+
+func (c *recorderCursor) SeekExact(key []byte) ([]byte, []byte, error) {
+	start := time.Now()
+	k, v, err := c.c.SeekExact(key)
+	return c.move(TraceSeekExact, key, start, k, v, err)
+}
+
+// Walk is recorded as one operation, the time spent by the walker is not included into its duration
+func (c *recorderCursor) Walk(walker func(k, v []byte) (bool, error)) error {
+	var visited uint64
+	var inWalker time.Duration
+	start := time.Now()
+	err := c.c.Walk(func(k, v []byte) (bool, error) {
+		visited++
+		walkerStart := time.Now()
+		defer func() { inWalker += time.Since(walkerStart) }()
+		return walker(k, v)
+	})
+	c.record(TraceWalk, nil, visited, time.Since(start)-inWalker)
+	return err
+}
+
+func (c *recorderCursor) Put(key []byte, value []byte) error {
+	start := time.Now()
+	err := c.c.Put(key, value)
+	c.record(TraceCursorPut, key, uint64(len(value)), time.Since(start))
+	return err
+}
+
+func (c *recorderCursor) Delete(key []byte) error {
+	start := time.Now()
+	err := c.c.Delete(key)
+	c.record(TraceCursorDelete, key, 0, time.Since(start))
+	return err
+}
+
+func (c *recorderCursor) Append(key []byte, value []byte) error {
+	start := time.Now()
+	err := c.c.Append(key, value)
+	c.record(TraceAppend, key, uint64(len(value)), time.Since(start))
+	return err
+}
+
+func (c *recorderNoValuesCursor) move(op TraceOp, seek []byte, start time.Time, k []byte, vSize uint32, err error) ([]byte, uint32, error) {
+	c.cursor.record(op, seek, uint64(vSize), time.Since(start))
+	return k, vSize, err
+}
+
+func (c *recorderNoValuesCursor) First() ([]byte, uint32, error) {
+	start := time.Now()
+	k, vSize, err := c.c.First()
+	return c.move(TraceFirst, nil, start, k, vSize, err)
+}
+
+func (c *recorderNoValuesCursor) Seek(seek []byte) ([]byte, uint32, error) {
+	start := time.Now()
+	k, vSize, err := c.c.Seek(seek)
+	return c.move(TraceSeek, seek, start, k, vSize, err)
+}
+
+func (c *recorderNoValuesCursor) Next() ([]byte, uint32, error) {
+	start := time.Now()
+	k, vSize, err := c.c.Next()
+	return c.move(TraceNext, nil, start, k, vSize, err)
+}
+
+func (c *recorderNoValuesCursor) Prev() ([]byte, uint32, error) {
+	start := time.Now()
+	k, vSize, err := c.c.Prev()
+	return c.move(TracePrev, nil, start, k, vSize, err)
+}
+
+func (c *recorderNoValuesCursor) Last() ([]byte, uint32, error) {
+	start := time.Now()
+	k, vSize, err := c.c.Last()
+	return c.move(TraceLast, nil, start, k, vSize, err)
+}
+
+func (c *recorderNoValuesCursor) SeekExact(key []byte) ([]byte, uint32, error) {
+	start := time.Now()
+	k, vSize, err := c.c.SeekExact(key)
+	return c.move(TraceSeekExact, key, start, k, vSize, err)
+}
+
+func (c *recorderNoValuesCursor) Walk(walker func(k []byte, vSize uint32) (bool, error)) error {
+	var visited uint64
+	var inWalker time.Duration
+	start := time.Now()
+	err := c.c.Walk(func(k []byte, vSize uint32) (bool, error) {
+		visited++
+		walkerStart := time.Now()
+		defer func() { inWalker += time.Since(walkerStart) }()
+		return walker(k, vSize)
+	})
+	c.cursor.record(TraceWalk, nil, visited, time.Since(start)-inWalker)
+	return err
+}
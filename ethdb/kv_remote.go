@@ -7,6 +7,7 @@ import (
 	"sync"
 
 	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
 	"github.com/ledgerwatch/turbo-geth/ethdb/remote"
 	"github.com/ledgerwatch/turbo-geth/log"
 )
@@ -126,6 +127,10 @@ func (db *RemoteKV) BucketsStat(ctx context.Context) (map[string]common.StorageB
 	return db.remote.BucketsStat(ctx)
 }
 
+func (db *RemoteKV) AllBuckets() dbutils.BucketsCfg {
+	return dbutils.DefaultBucketsConfig()
+}
+
 func (db *RemoteKV) IdealBatchSize() int {
 	panic("not supported")
 }
@@ -203,6 +208,10 @@ func (b remoteBucket) Delete(key []byte) error {
 	panic("not supported")
 }
 
+func (b remoteBucket) CursorDupSort() CursorDupSort {
+	panic("not supported")
+}
+
 func (b remoteBucket) Cursor() Cursor {
 	c := &remoteCursor{bucket: b, ctx: b.tx.ctx, remote: b.remote.Cursor()}
 	return c
@@ -249,6 +258,30 @@ func (c *remoteCursor) Next() ([]byte, []byte, error) {
 	return c.k, c.v, c.err
 }
 
+func (c *remoteCursor) Prev() ([]byte, []byte, error) {
+	c.k, c.v, c.err = c.remote.Prev(c.k)
+	if c.err != nil {
+		return []byte{}, c.v, c.err
+	}
+	return c.k, c.v, nil
+}
+
+func (c *remoteCursor) Last() ([]byte, []byte, error) {
+	c.k, c.v, c.err = c.remote.Last()
+	if c.err != nil {
+		return []byte{}, c.v, c.err
+	}
+	return c.k, c.v, nil
+}
+
+func (c *remoteCursor) SeekExact(key []byte) ([]byte, []byte, error) {
+	c.k, c.v, c.err = c.remote.SeekExact(key)
+	if c.err != nil {
+		return []byte{}, c.v, c.err
+	}
+	return c.k, c.v, nil
+}
+
 func (c *remoteCursor) Walk(walker func(k, v []byte) (bool, error)) error {
 	for k, v, err := c.First(); k != nil; k, v, err = c.Next() {
 		if err != nil {
@@ -307,3 +340,30 @@ func (c *remoteNoValuesCursor) Next() ([]byte, uint32, error) {
 	}
 	return c.k, vSize, nil
 }
+
+func (c *remoteNoValuesCursor) Prev() ([]byte, uint32, error) {
+	var vSize uint32
+	c.k, vSize, c.err = c.remote.PrevKey(c.k)
+	if c.err != nil {
+		return []byte{}, vSize, c.err
+	}
+	return c.k, vSize, nil
+}
+
+func (c *remoteNoValuesCursor) Last() ([]byte, uint32, error) {
+	var vSize uint32
+	c.k, vSize, c.err = c.remote.LastKey()
+	if c.err != nil {
+		return []byte{}, vSize, c.err
+	}
+	return c.k, vSize, nil
+}
+
+func (c *remoteNoValuesCursor) SeekExact(key []byte) ([]byte, uint32, error) {
+	var vSize uint32
+	c.k, vSize, c.err = c.remote.SeekExactKey(key)
+	if c.err != nil {
+		return []byte{}, vSize, c.err
+	}
+	return c.k, vSize, nil
+}
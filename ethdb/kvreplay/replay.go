@@ -0,0 +1,191 @@
+// Package kvreplay replays the traces written by ethdb.RecorderKV against any database and reports the latencies of the
+// operations per bucket, to compare the backends and their settings on the real workload
+package kvreplay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"runtime"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+type cursorKey struct {
+	tx, cursor uint64
+}
+
+type replayer struct {
+	ctx     context.Context
+	kv      ethdb.KV
+	report  *Report
+	txs     map[uint64]ethdb.Tx
+	cursors map[cursorKey]ethdb.Cursor
+	values  []byte // source of the values written, the trace keeps only their sizes
+}
+
+// Replay runs the operations of the trace against the database in the order of recording and returns their latencies.
+// Writes of the trace are replayed too, so the database has to be a copy of the recorded one, made before the recording,
+// or results of the reads differ. Values are not recorded, random bytes of the recorded size are written instead
+func Replay(ctx context.Context, trace io.Reader, kv ethdb.KV) (*Report, error) {
+	// transactions of the trace are interleaved, write transactions of LMDB must stay on one thread
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	r := &replayer{
+		ctx:     ctx,
+		kv:      kv,
+		report:  NewReport(),
+		txs:     map[uint64]ethdb.Tx{},
+		cursors: map[cursorKey]ethdb.Cursor{},
+	}
+	defer func() {
+		for _, tx := range r.txs {
+			tx.Rollback()
+		}
+	}()
+
+	var n uint64
+	err := ethdb.ReadTrace(trace, func(rec *ethdb.TraceRecord) error {
+		n++
+		if n%100_000 == 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+		}
+		d, err := r.replay(rec)
+		if err != nil {
+			return fmt.Errorf("record %d (%s of tx %d in %s): %w", n, rec.Op, rec.Tx, rec.Bucket, err)
+		}
+		r.report.Add(rec.Bucket, rec.Op, d)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.report, nil
+}
+
+// value returns the value of the size, it's a copy because databases keep the written values until commit
+func (r *replayer) value(size uint64) []byte {
+	if uint64(len(r.values)) < size {
+		r.values = make([]byte, size)
+		rand.New(rand.NewSource(int64(size))).Read(r.values)
+	}
+	return common.CopyBytes(r.values[:size])
+}
+
+func (r *replayer) cursor(rec *ethdb.TraceRecord) (ethdb.Cursor, error) {
+	c, ok := r.cursors[cursorKey{rec.Tx, rec.Cursor}]
+	if !ok {
+		return nil, errors.New("unknown cursor")
+	}
+	return c, nil
+}
+
+// replay runs the operation and returns its duration
+func (r *replayer) replay(rec *ethdb.TraceRecord) (time.Duration, error) {
+	if rec.Op == ethdb.TraceBegin {
+		start := time.Now()
+		tx, err := r.kv.Begin(r.ctx, rec.ValueSize == 1)
+		if err != nil {
+			return 0, err
+		}
+		r.txs[rec.Tx] = tx
+		return time.Since(start), nil
+	}
+
+	tx, ok := r.txs[rec.Tx]
+	if !ok {
+		return 0, errors.New("unknown transaction")
+	}
+	start := time.Now()
+	switch rec.Op {
+	case ethdb.TraceCommit, ethdb.TraceRollback:
+		var err error
+		if rec.Op == ethdb.TraceCommit {
+			err = tx.Commit(r.ctx)
+		} else {
+			tx.Rollback()
+		}
+		d := time.Since(start)
+		delete(r.txs, rec.Tx)
+		for k := range r.cursors {
+			if k.tx == rec.Tx {
+				delete(r.cursors, k)
+			}
+		}
+		return d, err
+	case ethdb.TraceCursor:
+		c := tx.Bucket(rec.Bucket).Cursor()
+		d := time.Since(start)
+		r.cursors[cursorKey{rec.Tx, rec.Cursor}] = c
+		return d, nil
+	case ethdb.TraceGet:
+		_, err := tx.Bucket(rec.Bucket).Get(rec.Key)
+		if errors.Is(err, ethdb.ErrKeyNotFound) {
+			err = nil
+		}
+		return time.Since(start), err
+	case ethdb.TracePut:
+		k, v := common.CopyBytes(rec.Key), r.value(rec.ValueSize)
+		start = time.Now()
+		err := tx.Bucket(rec.Bucket).Put(k, v)
+		return time.Since(start), err
+	case ethdb.TraceDelete:
+		k := common.CopyBytes(rec.Key)
+		start = time.Now()
+		err := tx.Bucket(rec.Bucket).Delete(k)
+		return time.Since(start), err
+	}
+
+	c, err := r.cursor(rec)
+	if err != nil {
+		return 0, err
+	}
+	switch rec.Op {
+	case ethdb.TracePrefix:
+		c.Prefix(common.CopyBytes(rec.Key))
+	case ethdb.TraceFirst:
+		_, _, err = c.First()
+	case ethdb.TraceSeek:
+		_, _, err = c.Seek(rec.Key)
+	case ethdb.TraceSeekTo:
+		_, _, err = c.SeekTo(rec.Key)
+	case ethdb.TraceSeekExact:
+		_, _, err = c.SeekExact(rec.Key)
+	case ethdb.TraceNext:
+		_, _, err = c.Next()
+	case ethdb.TracePrev:
+		_, _, err = c.Prev()
+	case ethdb.TraceLast:
+		_, _, err = c.Last()
+	case ethdb.TraceWalk:
+		visited := uint64(0)
+		err = c.Walk(func(k, v []byte) (bool, error) {
+			visited++
+			return visited < rec.ValueSize, nil
+		})
+	case ethdb.TraceCursorPut, ethdb.TraceAppend:
+		k, v := common.CopyBytes(rec.Key), r.value(rec.ValueSize)
+		start = time.Now()
+		if rec.Op == ethdb.TraceCursorPut {
+			err = c.Put(k, v)
+		} else {
+			err = c.Append(k, v)
+		}
+	case ethdb.TraceCursorDelete:
+		k := common.CopyBytes(rec.Key)
+		start = time.Now()
+		err = c.Delete(k)
+	default:
+		return 0, fmt.Errorf("unexpected operation %s", rec.Op)
+	}
+	return time.Since(start), err
+}
@@ -0,0 +1,126 @@
+package kvreplay
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	ctx := context.Background()
+	bucket := dbutils.PlainStateBucket
+	var trace bytes.Buffer
+	db := ethdb.NewRecorder(ethdb.NewLMDB().InMem().MustOpen(), &trace)
+
+	require.NoError(t, db.Update(ctx, func(tx ethdb.Tx) error {
+		b := tx.Bucket(bucket)
+		for i := byte(0); i < 10; i++ {
+			if err := b.Put([]byte{i}, bytes.Repeat([]byte{i}, int(i))); err != nil {
+				return err
+			}
+		}
+		return b.Cursor().Append([]byte{0x20}, []byte{1})
+	}))
+	require.NoError(t, db.View(ctx, func(tx ethdb.Tx) error {
+		b := tx.Bucket(bucket)
+		if _, err := b.Get([]byte{3}); err != nil {
+			return err
+		}
+		c := b.Cursor()
+		for k, _, err := c.Seek([]byte{5}); k != nil; k, _, err = c.Next() {
+			if err != nil {
+				return err
+			}
+		}
+		return b.Cursor().Walk(func(k, v []byte) (bool, error) {
+			return k[0] < 4, nil
+		})
+	}))
+	tx, err := db.Begin(ctx, true)
+	require.NoError(t, err)
+	require.NoError(t, tx.Bucket(bucket).Delete([]byte{1}))
+	require.NoError(t, tx.Commit(ctx))
+	db.Close()
+	require.NoError(t, db.Err())
+
+	var ops []string
+	require.NoError(t, ethdb.ReadTrace(bytes.NewReader(trace.Bytes()), func(rec *ethdb.TraceRecord) error {
+		ops = append(ops, rec.Op.String())
+		return nil
+	}))
+	require.Equal(t, strings.Fields(`begin put put put put put put put put put put cursor append commit
+		begin get cursor seek next next next next next next cursor walk rollback
+		begin delete commit`), ops)
+
+	recorded, err := Recorded(bytes.NewReader(trace.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), recorded.Ops[OpKey{string(bucket), ethdb.TracePut}].Count)
+
+	target := ethdb.NewBolt().InMem().MustOpen()
+	defer target.Close()
+	replayed, err := Replay(ctx, bytes.NewReader(trace.Bytes()), target)
+	require.NoError(t, err)
+	require.Equal(t, len(recorded.Ops), len(replayed.Ops))
+	for k, h := range recorded.Ops {
+		require.Equal(t, h.Count, replayed.Ops[k].Count, "%s %s", k.Bucket, k.Op)
+	}
+
+	// writes are replayed with the recorded sizes
+	require.NoError(t, target.View(ctx, func(tx ethdb.Tx) error {
+		b := tx.Bucket(bucket)
+		v, err := b.Get([]byte{7})
+		require.NoError(t, err)
+		require.Len(t, v, 7)
+		v, _ = b.Get([]byte{1})
+		require.Nil(t, v)
+		return nil
+	}))
+
+	var out bytes.Buffer
+	require.NoError(t, replayed.Print(&out))
+	require.Contains(t, out.String(), "seek")
+}
+
+func TestHistogram(t *testing.T) {
+	var h Histogram
+	for i := 1; i <= 100; i++ {
+		h.Add(1000)
+	}
+	h.Add(1 << 20)
+	require.Equal(t, uint64(101), h.Count)
+	require.Equal(t, 1023, int(h.Quantile(0.5)))
+	require.Equal(t, 1<<20, int(h.Quantile(1)))
+	require.Equal(t, 1<<20, int(h.Max))
+}
+
+func TestTraceBucketNames(t *testing.T) {
+	ctx := context.Background()
+	buckets := [][]byte{dbutils.PlainStateBucket, dbutils.HeaderPrefix, dbutils.PlainStateBucket}
+	var trace bytes.Buffer
+	db := ethdb.NewRecorder(ethdb.NewLMDB().InMem().MustOpen(), &trace)
+	require.NoError(t, db.Update(ctx, func(tx ethdb.Tx) error {
+		for i, bucket := range buckets {
+			if err := tx.Bucket(bucket).Put([]byte{byte(i)}, []byte{1}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	db.Close()
+	require.NoError(t, db.Err())
+
+	// the names are written into the trace once, the records refer to them by the numbers
+	var names [][]byte
+	require.NoError(t, ethdb.ReadTrace(bytes.NewReader(trace.Bytes()), func(rec *ethdb.TraceRecord) error {
+		if rec.Op == ethdb.TracePut {
+			names = append(names, rec.Bucket)
+		}
+		return nil
+	}))
+	require.Equal(t, buckets, names)
+}
@@ -0,0 +1,126 @@
+package kvreplay
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// Histogram of the latencies, bucket i counts the durations in [2^(i-1), 2^i) nanoseconds
+type Histogram struct {
+	Count   uint64
+	Total   time.Duration
+	Max     time.Duration
+	Buckets [64]uint64
+}
+
+func (h *Histogram) Add(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	h.Count++
+	h.Total += d
+	if d > h.Max {
+		h.Max = d
+	}
+	h.Buckets[bits.Len64(uint64(d))]++
+}
+
+func (h *Histogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Total / time.Duration(h.Count)
+}
+
+// Quantile returns the upper bound of the bucket containing the quantile q (0 < q <= 1), but not more than Max
+func (h *Histogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(h.Count))
+	if rank == 0 {
+		rank = 1
+	}
+	var seen uint64
+	for i, n := range h.Buckets {
+		seen += n
+		if seen >= rank {
+			upper := time.Duration(uint64(1)<<uint(i)) - 1
+			if upper > h.Max {
+				upper = h.Max
+			}
+			return upper
+		}
+	}
+	return h.Max
+}
+
+// OpKey - the operation in the bucket, Bucket is empty for the operations of the transactions
+type OpKey struct {
+	Bucket string
+	Op     ethdb.TraceOp
+}
+
+// Report - latency histograms of the operations per bucket
+type Report struct {
+	Ops map[OpKey]*Histogram
+}
+
+func NewReport() *Report {
+	return &Report{Ops: map[OpKey]*Histogram{}}
+}
+
+func (r *Report) Add(bucket []byte, op ethdb.TraceOp, d time.Duration) {
+	key := OpKey{Bucket: string(bucket), Op: op}
+	h, ok := r.Ops[key]
+	if !ok {
+		h = &Histogram{}
+		r.Ops[key] = h
+	}
+	h.Add(d)
+}
+
+// Print writes the table of the operations sorted by the bucket and the operation
+func (r *Report) Print(w io.Writer) error {
+	keys := make([]OpKey, 0, len(r.Ops))
+	for k := range r.Ops {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Bucket != keys[j].Bucket {
+			return keys[i].Bucket < keys[j].Bucket
+		}
+		return keys[i].Op < keys[j].Op
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "bucket\top\tcount\ttotal\tmean\tp50\tp90\tp99\tmax\t")
+	for _, k := range keys {
+		h := r.Ops[k]
+		bucket := k.Bucket
+		if bucket == "" {
+			bucket = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%v\t%v\t%v\t%v\t%v\t%v\t\n", bucket, k.Op, h.Count, h.Total, h.Mean(),
+			h.Quantile(0.5), h.Quantile(0.9), h.Quantile(0.99), h.Max)
+	}
+	return tw.Flush()
+}
+
+// Recorded returns the report of the latencies recorded in the trace
+func Recorded(trace io.Reader) (*Report, error) {
+	report := NewReport()
+	if err := ethdb.ReadTrace(trace, func(rec *ethdb.TraceRecord) error {
+		report.Add(rec.Bucket, rec.Op, rec.Duration)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
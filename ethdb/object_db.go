@@ -56,18 +56,60 @@ func MustOpen(path string) *ObjectDatabase {
 // Open - main method to open database. Choosing driver based on path suffix.
 // If env TEST_DB provided - choose driver based on it. Some test using this method to open non-in-memory db
 func Open(path string) (*ObjectDatabase, error) {
+	return open(path, false, false)
+}
+
+// OpenCompressed - Open, which compresses the buckets with a codec in dbutils.BucketsConfigs if they are still empty
+func OpenCompressed(path string) (*ObjectDatabase, error) {
+	return open(path, true, false)
+}
+
+// OpenReadOnly - Open, which doesn't allow any writes to the database
+func OpenReadOnly(path string) (*ObjectDatabase, error) {
+	return open(path, false, true)
+}
+
+func open(path string, compress, readOnly bool) (*ObjectDatabase, error) {
 	var kv KV
 	var err error
 	testDB := debug.TestDB()
 	switch true {
 	case testDB == "lmdb" || strings.HasSuffix(path, "_lmdb"):
-		kv, err = NewLMDB().Path(path).Open()
+		opts := NewLMDB().Path(path)
+		if compress {
+			opts = opts.Compress()
+		}
+		if readOnly {
+			opts = opts.ReadOnly()
+		}
+		kv, err = opts.Open()
 	case testDB == "badger" || strings.HasSuffix(path, "_badger"):
-		kv, err = NewBadger().Path(path).Open()
+		opts := NewBadger().Path(path)
+		if compress {
+			opts = opts.Compress()
+		}
+		if readOnly {
+			opts = opts.ReadOnly()
+		}
+		kv, err = opts.Open()
 	case testDB == "bolt" || strings.HasSuffix(path, "_bolt"):
-		kv, err = NewBolt().Path(path).Open()
+		opts := NewBolt().Path(path)
+		if compress {
+			opts = opts.Compress()
+		}
+		if readOnly {
+			opts = opts.ReadOnly()
+		}
+		kv, err = opts.Open()
 	default:
-		kv, err = NewLMDB().Path(path).Open()
+		opts := NewLMDB().Path(path)
+		if compress {
+			opts = opts.Compress()
+		}
+		if readOnly {
+			opts = opts.ReadOnly()
+		}
+		kv, err = opts.Open()
 	}
 	if err != nil {
 		return nil, err
@@ -386,7 +428,7 @@ func (db *ObjectDatabase) MemCopy() *ObjectDatabase {
 	var mem *ObjectDatabase
 	// Open the db and recover any potential corruptions
 	switch db.kv.(type) {
-	case *LmdbKV:
+	case *LmdbKV, *OverlayKV, *RecorderKV:
 		mem = NewObjectDatabase(NewLMDB().InMem().MustOpen())
 	case *BoltKV:
 		mem = NewObjectDatabase(NewBolt().InMem().MustOpen())
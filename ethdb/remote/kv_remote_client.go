@@ -38,7 +38,7 @@ var (
 
 // Version is the current version of the remote db protocol. If the protocol changes in a non backwards compatible way,
 // this constant needs to be increased
-const Version uint64 = 2
+const Version uint64 = 3
 
 // Command is the type of command in the boltdb remote protocol
 type Command uint8
@@ -107,6 +107,25 @@ const (
 	CmdDBBucketsStat
 	// CmdDBDiskSize (): common.StorageSize
 	CmdDBDiskSize
+
+	// backward iteration and exact lookups
+
+	// CmdCursorLast (cursorHandle): (key, value)
+	// Moves given cursor to the last key of the bucket (or of the prefix)
+	CmdCursorLast
+	// CmdCursorPrev (cursorHandle, currentKey): (key, value)
+	// Moves given cursor to the key preceding currentKey, or to the last key if currentKey is nil.
+	// Current key is sent by the client because the cursor on the server side may be ahead of it, due to prefetching
+	CmdCursorPrev
+	// CmdCursorSeekExact (cursorHandle, seekKey): (key, value)
+	// Moves given cursor to the seekKey, returns nil key if there is no such key
+	CmdCursorSeekExact
+	// CmdCursorLastKey (cursorHandle): (key, valueSize)
+	CmdCursorLastKey
+	// CmdCursorPrevKey (cursorHandle, currentKey): (key, valueSize)
+	CmdCursorPrevKey
+	// CmdCursorSeekExactKey (cursorHandle, seekKey): (key, valueSize)
+	CmdCursorSeekExactKey
 )
 
 const DefaultCursorBatchSize uint = 1
@@ -934,6 +953,94 @@ func (c *Cursor) SeekTo(seek []byte) (key []byte, value []byte, err error) {
 	return key, value, nil
 }
 
+func (c *Cursor) Last() (key []byte, value []byte, err error) {
+	key, _, err = c.move(CmdCursorLast, nil, &value)
+	return key, value, err
+}
+
+// Prev moves the cursor to the key preceding current (the key last returned by the cursor)
+func (c *Cursor) Prev(current []byte) (key []byte, value []byte, err error) {
+	key, _, err = c.move(CmdCursorPrev, current, &value)
+	return key, value, err
+}
+
+func (c *Cursor) SeekExact(seek []byte) (key []byte, value []byte, err error) {
+	key, _, err = c.move(CmdCursorSeekExact, seek, &value)
+	return key, value, err
+}
+
+func (c *Cursor) LastKey() (key []byte, vSize uint32, err error) {
+	return c.move(CmdCursorLastKey, nil, nil)
+}
+
+// PrevKey moves the cursor to the key preceding current (the key last returned by the cursor)
+func (c *Cursor) PrevKey(current []byte) (key []byte, vSize uint32, err error) {
+	return c.move(CmdCursorPrevKey, current, nil)
+}
+
+func (c *Cursor) SeekExactKey(seek []byte) (key []byte, vSize uint32, err error) {
+	return c.move(CmdCursorSeekExactKey, seek, nil)
+}
+
+// move sends one of the commands positioning the cursor at a single key: CmdCursorLast, CmdCursorPrev, CmdCursorSeekExact
+// or their Key counterparts. If value is nil, size of the value is decoded instead of the value
+func (c *Cursor) move(cmd Command, key []byte, value *[]byte) ([]byte, uint32, error) {
+	select {
+	case <-c.ctx.Done():
+		return nil, 0, c.ctx.Err()
+	default:
+	}
+
+	if !c.initialized {
+		if err := c.init(); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	c.cacheLastIdx = 0 // .Next() cache is invalid after the cursor moved
+
+	decoder := codecpool.Decoder(c.in)
+	defer codecpool.Return(decoder)
+	encoder := codecpool.Encoder(c.out)
+	defer codecpool.Return(encoder)
+
+	if err := encoder.Encode(cmd); err != nil {
+		return nil, 0, fmt.Errorf("could not encode command %d: %w", cmd, err)
+	}
+	if err := encoder.Encode(c.cursorHandle); err != nil {
+		return nil, 0, fmt.Errorf("could not encode cursorHandle for cmd %d: %w", cmd, err)
+	}
+	if cmd != CmdCursorLast && cmd != CmdCursorLastKey {
+		if err := encoder.Encode(&key); err != nil {
+			return nil, 0, fmt.Errorf("could not encode key for cmd %d: %w", cmd, err)
+		}
+	}
+
+	var responseCode ResponseCode
+	if err := decoder.Decode(&responseCode); err != nil {
+		return nil, 0, fmt.Errorf("could not decode ResponseCode for cmd %d: %w", cmd, err)
+	}
+
+	if responseCode != ResponseOk {
+		if err := decodeErr(decoder, responseCode); err != nil {
+			return nil, 0, fmt.Errorf("could not decode errorMessage for cmd %d: %w", cmd, err)
+		}
+	}
+
+	var k []byte
+	var vSize uint32
+	if value != nil {
+		if err := decodeKeyValue(decoder, &k, value); err != nil {
+			return nil, 0, fmt.Errorf("could not decode (key, value) for cmd %d: %w", cmd, err)
+		}
+	} else {
+		if err := decodeKey(decoder, &k, &vSize); err != nil {
+			return nil, 0, fmt.Errorf("could not decode (key, vSize) for cmd %d: %w", cmd, err)
+		}
+	}
+	return k, vSize, nil
+}
+
 func (c *Cursor) needFetchNextPage() bool {
 	res := c.cacheLastIdx == 0 || // cache is empty
 		c.cacheIdx == c.cacheLastIdx // all cache read
@@ -19,7 +19,7 @@ import (
 
 // Version is the current version of the remote db protocol. If the protocol changes in a non backwards compatible way,
 // this constant needs to be increased
-const Version uint64 = 2
+const Version uint64 = 3
 
 // Server is to be called as a go-routine, one per every client connection.
 // It runs while the connection is active and keep the entire connection's context
@@ -445,6 +445,47 @@ func Server(ctx context.Context, db ethdb.KV, in io.Reader, out io.Writer, close
 			if err := encodeKey(encoder, k, uint32(len(v))); err != nil {
 				return fmt.Errorf("could not encode (key,vSize) for CmdCursorSeekKey: %w", err)
 			}
+		case remote.CmdCursorLast, remote.CmdCursorPrev, remote.CmdCursorSeekExact,
+			remote.CmdCursorLastKey, remote.CmdCursorPrevKey, remote.CmdCursorSeekExactKey:
+			if err := decoder.Decode(&cursorHandle); err != nil {
+				return fmt.Errorf("could not decode cursorHandle for remote.Command %d: %w", c, err)
+			}
+			if c != remote.CmdCursorLast && c != remote.CmdCursorLastKey {
+				if err := decoder.Decode(&seekKey); err != nil {
+					return fmt.Errorf("could not decode seekKey for remote.Command %d: %w", c, err)
+				}
+			}
+			cursor, ok := cursors[cursorHandle]
+			if !ok {
+				encodeErr(encoder, fmt.Errorf("cursor not found: %d", cursorHandle))
+				continue
+			}
+
+			var k, v []byte
+			var err error
+			switch c {
+			case remote.CmdCursorLast, remote.CmdCursorLastKey:
+				k, v, err = cursor.Last()
+			case remote.CmdCursorPrev, remote.CmdCursorPrevKey:
+				k, v, err = cursorPrev(cursor, seekKey)
+			default:
+				k, v, err = cursor.SeekExact(seekKey)
+			}
+			if err != nil {
+				return fmt.Errorf("in remote.Command %d: %w", c, err)
+			}
+
+			if err := encoder.Encode(remote.ResponseOk); err != nil {
+				return fmt.Errorf("could not encode response for remote.Command %d: %w", c, err)
+			}
+			if c == remote.CmdCursorLastKey || c == remote.CmdCursorPrevKey || c == remote.CmdCursorSeekExactKey {
+				err = encodeKey(encoder, k, uint32(len(v)))
+			} else {
+				err = encodeKeyValue(encoder, k, v)
+			}
+			if err != nil {
+				return fmt.Errorf("could not encode (key,value) in response to remote.Command %d: %w", c, err)
+			}
 		case remote.CmdDBDiskSize:
 			size, err := db.(ethdb.HasStats).DiskSize(ctx)
 			if err != nil {
@@ -480,6 +521,22 @@ const ServerMaxConnections uint64 = 2048
 
 var logger = log.New("database", "remote")
 
+// cursorPrev moves the cursor to the key preceding the current key of the client.
+// The cursor of the server may be ahead of the client, because of prefetching, so it is positioned at the current key first
+func cursorPrev(cursor ethdb.Cursor, current []byte) ([]byte, []byte, error) {
+	if current == nil {
+		return cursor.Last()
+	}
+	k, _, err := cursor.Seek(current)
+	if err != nil {
+		return nil, nil, err
+	}
+	if k == nil {
+		return cursor.Last()
+	}
+	return cursor.Prev()
+}
+
 func encodeKeyValue(encoder *codec.Encoder, key []byte, value []byte) error {
 	if err := encoder.Encode(&key); err != nil {
 		return err
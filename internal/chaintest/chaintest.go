@@ -0,0 +1,48 @@
+// Package chaintest provides the chains with plain state for the tests of the tools reading the staged sync database.
+package chaintest
+
+import (
+	"context"
+
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/consensus/ethash"
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// WritePlainStateChain generates the chain of n blocks on top of the genesis and writes it into db with plain state
+// and its history, the way the staged sync does. Blocks are executed with the given chain context
+func WritePlainStateChain(db *ethdb.ObjectDatabase, gspec *core.Genesis, chainContext core.ChainContext, n int, gen func(int, *core.BlockGen)) ([]*types.Block, error) {
+	engine := ethash.NewFaker()
+	genDb := ethdb.NewMemDatabase()
+	defer genDb.Close()
+	genesis := gspec.MustCommit(genDb)
+	blocks, _, err := core.GenerateChain(gspec.Config, genesis, engine, genDb, n, gen, false /* intermediateHashes */)
+	if err != nil {
+		return nil, err
+	}
+
+	core.UsePlainStateExecution = true
+	defer func() { core.UsePlainStateExecution = false }()
+	gspec.MustCommit(db)
+	for _, block := range blocks {
+		rawdb.WriteBlock(context.Background(), db, block)
+		rawdb.WriteCanonicalHash(db, block.Hash(), block.NumberU64())
+		if _, err = core.ExecuteBlockEphemerally(gspec.Config, &vm.Config{}, chainContext, engine, block,
+			state.NewPlainStateReader(db), state.NewPlainStateWriter(db, block.NumberU64()), nil); err != nil {
+			return nil, err
+		}
+	}
+	ig := core.NewIndexGenerator(db, nil)
+	if err = ig.GenerateIndex(0, uint64(n), dbutils.PlainAccountChangeSetBucket); err != nil {
+		return nil, err
+	}
+	if err = ig.GenerateIndex(0, uint64(n), dbutils.PlainStorageChangeSetBucket); err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
@@ -0,0 +1,142 @@
+package ethapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/hexutil"
+	"github.com/ledgerwatch/turbo-geth/common/math"
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/eth/tracers"
+	"github.com/ledgerwatch/turbo-geth/log"
+	"github.com/ledgerwatch/turbo-geth/rpc"
+)
+
+// BundleCallResult is the result of one call of the simulated bundle.
+type BundleCallResult struct {
+	GasUsed     hexutil.Uint64                               `json:"gasUsed"`
+	ReturnValue hexutil.Bytes                                `json:"returnValue"`
+	Error       string                                       `json:"error,omitempty"`
+	Logs        []*types.Log                                 `json:"logs"`
+	StateDiff   map[common.Address]*tracers.StateDiffAccount `json:"stateDiff"`
+}
+
+// BundleResult is the result of the simulated bundle, the state diff contains
+// the changes made by all of its calls.
+type BundleResult struct {
+	Results   []*BundleCallResult                          `json:"results"`
+	GasUsed   hexutil.Uint64                               `json:"gasUsed"`
+	StateDiff map[common.Address]*tracers.StateDiffAccount `json:"stateDiff"`
+}
+
+// SimulateBundle executes the calls in order on top of the given state, each one
+// sees the changes of the previous ones. The overrides are applied before the
+// first call and are not part of the state diffs. getEVM returns the EVM of the
+// call and the function reporting the errors of the EVM setup, the same way as
+// Backend.GetEVM does. Nothing is committed, the state should be dropped after.
+func SimulateBundle(ctx context.Context, ibs *state.IntraBlockState, calls []CallArgs, overrides *StateOverride,
+	getEVM func(msg core.Message) (*vm.EVM, func() error, error), timeout time.Duration, globalGasCap *big.Int) (*BundleResult, error) {
+	defer func(start time.Time) { log.Debug("Executing EVM bundle finished", "runtime", time.Since(start)) }(time.Now())
+
+	if len(calls) == 0 {
+		return nil, errors.New("empty bundle")
+	}
+	if err := overrides.Apply(ibs); err != nil {
+		return nil, err
+	}
+	// The whole bundle shares the timeout
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	var (
+		result  = &BundleResult{Results: make([]*BundleCallResult, 0, len(calls))}
+		txDiffs = make([][]*state.AccountDiff, 0, len(calls))
+		logs    int
+		started bool
+	)
+	for i, args := range calls {
+		msg := args.ToMessage(globalGasCap)
+		evm, vmError, err := getEVM(msg)
+		if err != nil {
+			return nil, err
+		}
+		chainCtx := evm.ChainConfig().WithEIPsFlags(context.Background(), evm.BlockNumber)
+		if !started {
+			// The overrides become the state before the bundle
+			if err := ibs.FinalizeTx(chainCtx, state.NewNoopWriter()); err != nil {
+				return nil, err
+			}
+			started = true
+		}
+		go func() {
+			<-ctx.Done()
+			evm.Cancel()
+		}()
+		// The calls have no transaction hashes, the logs of all of them are kept under the empty one
+		ibs.Prepare(common.Hash{}, common.Hash{}, i)
+		res, err := core.ApplyMessage(evm, msg, new(core.GasPool).AddGas(math.MaxUint64))
+		if err := vmError(); err != nil {
+			return nil, err
+		}
+		if evm.Cancelled() {
+			return nil, fmt.Errorf("execution aborted (timeout = %v)", timeout)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("call %d: %w", i, err)
+		}
+
+		callResult := &BundleCallResult{
+			GasUsed:     hexutil.Uint64(res.UsedGas),
+			ReturnValue: res.Return(),
+			Logs:        []*types.Log{},
+		}
+		if len(res.Revert()) > 0 {
+			callResult.ReturnValue = res.Revert()
+			callResult.Error = newRevertError(res).Error()
+		} else if res.Err != nil {
+			callResult.Error = res.Err.Error()
+		}
+		if allLogs := ibs.GetLogs(common.Hash{}); len(allLogs) > logs {
+			callResult.Logs = allLogs[logs:]
+			logs = len(allLogs)
+		}
+		txDiff := ibs.TxStateDiff(chainCtx)
+		callResult.StateDiff = tracers.StateDiff(txDiff)
+		txDiffs = append(txDiffs, txDiff)
+		if err := ibs.FinalizeTx(chainCtx, state.NewNoopWriter()); err != nil {
+			return nil, err
+		}
+		result.Results = append(result.Results, callResult)
+		result.GasUsed += callResult.GasUsed
+	}
+	result.StateDiff = tracers.StateDiff(state.MergeAccountDiffs(txDiffs...))
+	return result, nil
+}
+
+// SimulateBundle executes the calls in order on the state of the given block,
+// each one on top of the changes of the previous ones, and returns their
+// results, logs and state changes. The state is overridden before the first call.
+//
+// Note, this function doesn't make any changes in the state/blockchain.
+func (api *PublicDebugAPI) SimulateBundle(ctx context.Context, calls []CallArgs, blockNrOrHash rpc.BlockNumberOrHash, overrides *StateOverride) (*BundleResult, error) {
+	ibs, header, err := api.b.StateAndHeaderByNumberOrHash(ctx, blockNrOrHash)
+	if ibs == nil || err != nil {
+		return nil, err
+	}
+	getEVM := func(msg core.Message) (*vm.EVM, func() error, error) {
+		return api.b.GetEVM(ctx, msg, ibs, header)
+	}
+	return SimulateBundle(ctx, ibs, calls, overrides, getEVM, 5*time.Second, api.b.RPCGasCap())
+}
@@ -428,6 +428,47 @@ web3._extend({
 			params: 2,
 			inputFormatter: [null, null]
 		}),
+		new web3._extend.Method({
+			name: 'startSession',
+			call: 'debug_startSession',
+			params: 1
+		}),
+		new web3._extend.Method({
+			name: 'step',
+			call: 'debug_step',
+			params: 1
+		}),
+		new web3._extend.Method({
+			name: 'continue',
+			call: 'debug_continue',
+			params: 1
+		}),
+		new web3._extend.Method({
+			name: 'breakpoint',
+			call: 'debug_breakpoint',
+			params: 2
+		}),
+		new web3._extend.Method({
+			name: 'clearBreakpoints',
+			call: 'debug_clearBreakpoints',
+			params: 1
+		}),
+		new web3._extend.Method({
+			name: 'inspect',
+			call: 'debug_inspect',
+			params: 2
+		}),
+		new web3._extend.Method({
+			name: 'stopSession',
+			call: 'debug_stopSession',
+			params: 1
+		}),
+		new web3._extend.Method({
+			name: 'simulateBundle',
+			call: 'debug_simulateBundle',
+			params: 3,
+			inputFormatter: [null, web3._extend.formatters.inputBlockNumberFormatter, null]
+		}),
 		new web3._extend.Method({
 			name: 'preimage',
 			call: 'debug_preimage',
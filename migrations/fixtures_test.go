@@ -0,0 +1,239 @@
+package migrations
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// fixture fills the database in the layout expected by the migration, and checks the invariants
+// the database has to satisfy after the migration is applied (up) and after it's rolled back (down)
+type fixture struct {
+	name string
+	fill func(t *testing.T, db ethdb.Database)
+	up   func(t *testing.T, db ethdb.Database)
+	down func(t *testing.T, db ethdb.Database)
+}
+
+// fixtures - every migration in the `migrations` list must have at least one fixture
+var fixtures = map[string][]fixture{
+	historyIndexBitmaps.Name: historyIndexFixtures,
+}
+
+// TestMigrationsOnFixtures applies each migration to its fixtures, applies it once more from the saved progress
+// to check it's idempotent, then rolls it back and applies again
+func TestMigrationsOnFixtures(t *testing.T) {
+	for _, m := range migrations {
+		m := m
+		if len(fixtures[m.Name]) == 0 {
+			t.Errorf("migration %s has no fixtures", m.Name)
+		}
+		for _, f := range fixtures[m.Name] {
+			f := f
+			t.Run(m.Name+"/"+f.name, func(t *testing.T) {
+				db := ethdb.NewMemDatabase()
+				defer db.Close()
+				f.fill(t, db)
+
+				migrator := &Migrator{Migrations: []Migration{m}}
+				if err := migrator.Apply(db, ""); err != nil {
+					t.Fatal(err)
+				}
+				f.up(t, db)
+				after := dumpDatabase(t, db)
+
+				if err := m.Up(db, "", nil, func(ethdb.Putter, []byte, bool) error { return nil }); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(after, dumpDatabase(t, db)) {
+					t.Fatal("applying the migration twice changes the database")
+				}
+
+				if m.Down == nil {
+					return
+				}
+				if err := migrator.Rollback(db, "", m.Name); err != nil {
+					t.Fatal(err)
+				}
+				f.down(t, db)
+				if err := migrator.Apply(db, ""); err != nil {
+					t.Fatal(err)
+				}
+				f.up(t, db)
+			})
+		}
+	}
+}
+
+func dumpDatabase(t *testing.T, db ethdb.Database) map[string]string {
+	res := map[string]string{}
+	for _, bucket := range dbutils.Buckets {
+		if bytes.Equal(bucket, dbutils.DatabaseInfoBucket) {
+			continue
+		}
+		if err := db.Walk(bucket, nil, 0, func(k, v []byte) (bool, error) {
+			res[fmt.Sprintf("%s/%x", bucket, k)] = fmt.Sprintf("%x", v)
+			return true, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return res
+}
+
+type indexChunk struct {
+	bucket  []byte
+	key     []byte
+	numbers []uint64
+	sets    []bool
+}
+
+func accountChunkKey(addr string, block uint64) []byte {
+	return dbutils.IndexChunkKey(common.HexToAddress(addr).Bytes(), block)
+}
+
+func storageChunkKey(addr string, loc string, block uint64) []byte {
+	key := append(common.HexToAddress(addr).Bytes(), make([]byte, common.IncarnationLength)...)
+	return dbutils.IndexChunkKey(append(key, common.HexToHash(loc).Bytes()...), block)
+}
+
+var legacyIndex = []indexChunk{
+	{dbutils.AccountsHistoryBucket, accountChunkKey("0x1", 1000), []uint64{1, 5, 1000}, []bool{true, false, false}},
+	{dbutils.AccountsHistoryBucket, accountChunkKey("0x1", ^uint64(0)), []uint64{1001, 8000000}, []bool{false, false}},
+	{dbutils.AccountsHistoryBucket, accountChunkKey("0x2", ^uint64(0)), []uint64{7}, []bool{true}},
+	{dbutils.StorageHistoryBucket, storageChunkKey("0x1", "0x1", ^uint64(0)), []uint64{3, 4}, []bool{true, false}},
+	{dbutils.StorageHistoryBucket, storageChunkKey("0x1", "0x2", ^uint64(0)), nil, nil},
+}
+
+func putLegacyIndex(t *testing.T, db ethdb.Database, chunks []indexChunk) {
+	for _, c := range chunks {
+		v, err := dbutils.EncodeLegacyHistoryIndex(c.numbers, c.sets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put(c.bucket, c.key, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkIndex checks that all chunks are encoded in the legacy format or not, that the key of every chunk ends with
+// its last block (or ^uint64(0) for the last chunk of the key), and that the chunks of every key together contain
+// the same blocks as the given ones
+func checkIndex(t *testing.T, db ethdb.Database, chunks []indexChunk, legacy bool) {
+	type blocks struct {
+		numbers []uint64
+		sets    []bool
+	}
+	expected := map[string]*blocks{}
+	for _, c := range chunks {
+		prefix := fmt.Sprintf("%s/%x", c.bucket, c.key[:len(c.key)-8])
+		if expected[prefix] == nil {
+			expected[prefix] = &blocks{}
+		}
+		expected[prefix].numbers = append(expected[prefix].numbers, c.numbers...)
+		expected[prefix].sets = append(expected[prefix].sets, c.sets...)
+	}
+
+	got := map[string]*blocks{}
+	for _, bucket := range historyIndexBuckets {
+		var lastPrefix string
+		var lastKey []byte
+		if err := db.Walk(bucket, nil, 0, func(k, v []byte) (bool, error) {
+			if dbutils.IsLegacyHistoryIndex(v) != legacy {
+				return false, fmt.Errorf("chunk %x: unexpected format", k)
+			}
+			var numbers []uint64
+			var sets []bool
+			var err error
+			if legacy {
+				numbers, sets, err = dbutils.LegacyHistoryIndexBytes(v).Decode()
+			} else {
+				numbers, sets, err = dbutils.WrapHistoryIndex(v).Decode()
+			}
+			if err != nil {
+				return false, err
+			}
+			prefix := fmt.Sprintf("%s/%x", bucket, k[:len(k)-8])
+			if lastPrefix != "" && lastPrefix != prefix && binary.BigEndian.Uint64(lastKey[len(lastKey)-8:]) != ^uint64(0) {
+				return false, fmt.Errorf("chunk %x: the last chunk of the key must end with ^uint64(0)", lastKey)
+			}
+			if last := binary.BigEndian.Uint64(k[len(k)-8:]); last != ^uint64(0) && (len(numbers) == 0 || numbers[len(numbers)-1] != last) {
+				return false, fmt.Errorf("chunk %x: must end with block %d, got %v", k, last, numbers)
+			}
+			if got[prefix] == nil {
+				got[prefix] = &blocks{}
+			}
+			got[prefix].numbers = append(got[prefix].numbers, numbers...)
+			got[prefix].sets = append(got[prefix].sets, sets...)
+			lastPrefix, lastKey = prefix, common.CopyBytes(k)
+			return true, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(expected, got) {
+		for prefix := range got {
+			t.Logf("%s: %v %v", prefix, got[prefix].numbers, got[prefix].sets)
+		}
+		t.Fatal("unexpected index")
+	}
+}
+
+var historyIndexFixtures = []fixture{
+	{
+		name: "legacy",
+		fill: func(t *testing.T, db ethdb.Database) { putLegacyIndex(t, db, legacyIndex) },
+		up:   func(t *testing.T, db ethdb.Database) { checkIndex(t, db, legacyIndex, false) },
+		down: func(t *testing.T, db ethdb.Database) { checkIndex(t, db, legacyIndex, true) },
+	},
+	{
+		name: "partially converted",
+		fill: func(t *testing.T, db ethdb.Database) {
+			putLegacyIndex(t, db, legacyIndex[1:])
+			c := legacyIndex[0]
+			index, err := dbutils.EncodeHistoryIndex(c.numbers, c.sets)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Put(c.bucket, c.key, index); err != nil {
+				t.Fatal(err)
+			}
+		},
+		up:   func(t *testing.T, db ethdb.Database) { checkIndex(t, db, legacyIndex, false) },
+		down: func(t *testing.T, db ethdb.Database) { checkIndex(t, db, legacyIndex, true) },
+	},
+	{
+		// chunk written after the migration, spanning more blocks than the legacy format allows
+		name: "wide chunk",
+		fill: func(t *testing.T, db ethdb.Database) {
+			putLegacyIndex(t, db, legacyIndex[:1])
+			index, err := dbutils.EncodeHistoryIndex([]uint64{2000, 3000, 2000 + dbutils.LegacyMaxSpan + 1}, []bool{false, true, false})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Put(dbutils.AccountsHistoryBucket, accountChunkKey("0x1", ^uint64(0)), index); err != nil {
+				t.Fatal(err)
+			}
+		},
+		up: func(t *testing.T, db ethdb.Database) {
+			checkIndex(t, db, []indexChunk{
+				legacyIndex[0],
+				{dbutils.AccountsHistoryBucket, accountChunkKey("0x1", ^uint64(0)), []uint64{2000, 3000, 2000 + dbutils.LegacyMaxSpan + 1}, []bool{false, true, false}},
+			}, false)
+		},
+		down: func(t *testing.T, db ethdb.Database) {
+			checkIndex(t, db, []indexChunk{
+				legacyIndex[0],
+				{dbutils.AccountsHistoryBucket, accountChunkKey("0x1", 3000), []uint64{2000, 3000}, []bool{false, true}},
+				{dbutils.AccountsHistoryBucket, accountChunkKey("0x1", ^uint64(0)), []uint64{2000 + dbutils.LegacyMaxSpan + 1}, []bool{false}},
+			}, true)
+		},
+	},
+}
@@ -0,0 +1,68 @@
+package migrations
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/common/etl"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+var historyIndexBuckets = [][]byte{dbutils.AccountsHistoryBucket, dbutils.StorageHistoryBucket}
+
+// historyIndexBitmaps re-encodes the chunks of the history index into the bitmaps, keys of the chunks stay the same
+var historyIndexBitmaps = Migration{
+	Name: "history_index_bitmaps",
+	Up: func(db ethdb.Database, datadir string, progress []byte, OnLoadCommit etl.LoadCommitHandler) error {
+		return rewriteBuckets(db, datadir, progress, OnLoadCommit, historyIndexBuckets, func(k, v []byte, next etl.ExtractNextFunc) error {
+			if !dbutils.IsLegacyHistoryIndex(v) {
+				return nil
+			}
+			index, err := dbutils.ConvertLegacyHistoryIndex(v)
+			if err != nil {
+				return fmt.Errorf("chunk %x: %w", k, err)
+			}
+			return next(k, k, index)
+		})
+	},
+	// Down re-encodes the chunks back into the legacy format. The legacy chunk can't span more than
+	// dbutils.LegacyMaxSpan blocks, so the bitmap chunks written after the migration may be split:
+	// all the parts except the last one get the keys ending with their last block
+	Down: func(db ethdb.Database, datadir string, progress []byte, OnLoadCommit etl.LoadCommitHandler) error {
+		return rewriteBuckets(db, datadir, progress, OnLoadCommit, historyIndexBuckets, func(k, v []byte, next etl.ExtractNextFunc) error {
+			if dbutils.IsLegacyHistoryIndex(v) {
+				return nil
+			}
+			numbers, sets, err := dbutils.WrapHistoryIndex(v).Decode()
+			if err != nil {
+				return fmt.Errorf("chunk %x: %w", k, err)
+			}
+			if len(numbers) == 0 {
+				return next(k, k, dbutils.LegacyHistoryIndexBytes(make([]byte, 8)))
+			}
+			for len(numbers) > 0 {
+				n := 1
+				for n < len(numbers) && numbers[n]-numbers[0] <= dbutils.LegacyMaxSpan {
+					n++
+				}
+				chunk, err := dbutils.EncodeLegacyHistoryIndex(numbers[:n], sets[:n])
+				if err != nil {
+					return fmt.Errorf("chunk %x: %w", k, err)
+				}
+				chunkKey := k
+				if n < len(numbers) {
+					chunkKey = make([]byte, len(k))
+					copy(chunkKey, k[:len(k)-common.BlockNumberLength])
+					binary.BigEndian.PutUint64(chunkKey[len(k)-common.BlockNumberLength:], numbers[n-1])
+				}
+				if err := next(k, chunkKey, chunk); err != nil {
+					return err
+				}
+				numbers, sets = numbers[n:], sets[n:]
+			}
+			return nil
+		})
+	},
+}
@@ -1,16 +1,34 @@
 package migrations
 
 import (
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
 	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/common/etl"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
 	"github.com/ledgerwatch/turbo-geth/log"
 )
 
+// MigrationFunc changes the database in batches. Before each commit it must call OnLoadCommit with the batch and
+// the last key processed - the key is saved as the progress of the migration in the same batch. If the migration is
+// interrupted, it's restarted with the saved progress (nil when started from scratch), so it can skip the work already
+// committed. Passing OnLoadCommit to etl.TransformArgs satisfies the contract, see rewriteBuckets
+type MigrationFunc func(db ethdb.Database, datadir string, progress []byte, OnLoadCommit etl.LoadCommitHandler) error
+
+// Migration - one-time change of the database layout.
+// Up is applied once, Down reverts the changes of Up and can be nil if the migration is irreversible
 type Migration struct {
 	Name string
-	Up   func(db ethdb.Database, history, receipts, txIndex, preImages bool) error
+	Up   MigrationFunc
+	Down MigrationFunc
 }
 
+const (
+	directionUp   byte = 0
+	directionDown byte = 1
+)
+
 func NewMigrator() *Migrator {
 	return &Migrator{
 		Migrations: migrations,
@@ -21,32 +39,75 @@ type Migrator struct {
 	Migrations []Migration
 }
 
-func (m *Migrator) Apply(db ethdb.Database, history, receipts, txIndex, preImages bool) error {
+// lastApplied returns the index of the last applied migration in m.Migrations, -1 if none of them is applied
+func (m *Migrator) lastApplied(db ethdb.Getter) (int, error) {
+	lastApplied, err := db.Get(dbutils.DatabaseInfoBucket, dbutils.LastAppliedMigration)
+	if err != nil && err != ethdb.ErrKeyNotFound {
+		return 0, err
+	}
+	if lastApplied == nil {
+		return -1, nil
+	}
+	for i := len(m.Migrations) - 1; i >= 0; i-- {
+		if m.Migrations[i].Name == string(lastApplied) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("last applied migration %q is unknown", lastApplied)
+}
+
+// PendingMigrations returns the migrations which are going to be applied by Apply, in the order of applying
+func (m *Migrator) PendingMigrations(db ethdb.Getter) ([]Migration, error) {
+	i, err := m.lastApplied(db)
+	if err != nil {
+		return nil, err
+	}
+	return m.Migrations[i+1:], nil
+}
+
+// Progress returns the progress saved by the unfinished run of the migration and whether it was Down,
+// progress is nil if the migration isn't in progress
+func (m *Migrator) Progress(db ethdb.Getter, name string) (progress []byte, down bool, err error) {
+	v, err := db.Get(dbutils.DatabaseInfoBucket, progressKey(name))
+	if err != nil && err != ethdb.ErrKeyNotFound {
+		return nil, false, err
+	}
+	if len(v) == 0 {
+		return nil, false, nil
+	}
+	return v[1:], v[0] == directionDown, nil
+}
+
+func (m *Migrator) Apply(db ethdb.Database, datadir string) error {
 	if len(m.Migrations) == 0 {
 		return nil
 	}
 
-	lastApplied, err := db.Get(dbutils.DatabaseInfoBucket, dbutils.LastAppliedMigration)
-	if err != nil && err != ethdb.ErrKeyNotFound {
+	i, err := m.lastApplied(db)
+	if err != nil {
 		return err
 	}
-
-	i := len(m.Migrations) - 1
-	for ; i >= 0; i-- {
-		if m.Migrations[i].Name == string(lastApplied) {
-			break
+	if i >= 0 {
+		if _, down, err := m.Progress(db, m.Migrations[i].Name); err != nil {
+			return err
+		} else if down {
+			return fmt.Errorf("rollback of migration %s was interrupted, it has to be finished first", m.Migrations[i].Name)
 		}
 	}
 
-	m.Migrations = m.Migrations[i+1:]
-	for _, v := range m.Migrations {
+	for _, v := range m.Migrations[i+1:] {
 		log.Warn("Apply migration", "name", v.Name)
-		err := v.Up(db, history, receipts, txIndex, preImages)
-		if err != nil {
+		if err := m.run(db, datadir, v.Name, v.Up, directionUp); err != nil {
+			return fmt.Errorf("migration %s: %w", v.Name, err)
+		}
+		batch := db.NewBatch()
+		if err := batch.Put(dbutils.DatabaseInfoBucket, dbutils.LastAppliedMigration, []byte(v.Name)); err != nil {
 			return err
 		}
-		err = db.Put(dbutils.DatabaseInfoBucket, dbutils.LastAppliedMigration, []byte(v.Name))
-		if err != nil {
+		if err := batch.Delete(dbutils.DatabaseInfoBucket, progressKey(v.Name)); err != nil {
+			return err
+		}
+		if _, err := batch.Commit(); err != nil {
 			return err
 		}
 		log.Warn("Applied migration", "name", v.Name)
@@ -54,4 +115,80 @@ func (m *Migrator) Apply(db ethdb.Database, history, receipts, txIndex, preImage
 	return nil
 }
 
-var migrations = []Migration{}
+// Rollback reverts the migration with the given name and all the migrations applied after it, the last one first.
+// The interrupted rollback is finished by calling Rollback again
+func (m *Migrator) Rollback(db ethdb.Database, datadir string, name string) error {
+	last, err := m.lastApplied(db)
+	if err != nil {
+		return err
+	}
+	target := -1
+	for i := 0; i <= last; i++ {
+		if m.Migrations[i].Name == name {
+			target = i
+		}
+	}
+	if target < 0 {
+		return fmt.Errorf("migration %q is not applied", name)
+	}
+	for i := last; i >= target; i-- {
+		if m.Migrations[i].Down == nil {
+			return fmt.Errorf("migration %s is irreversible", m.Migrations[i].Name)
+		}
+	}
+
+	for i := last; i >= target; i-- {
+		v := m.Migrations[i]
+		log.Warn("Rollback migration", "name", v.Name)
+		if err := m.run(db, datadir, v.Name, v.Down, directionDown); err != nil {
+			return fmt.Errorf("rollback of migration %s: %w", v.Name, err)
+		}
+		batch := db.NewBatch()
+		if i > 0 {
+			err = batch.Put(dbutils.DatabaseInfoBucket, dbutils.LastAppliedMigration, []byte(m.Migrations[i-1].Name))
+		} else {
+			err = batch.Delete(dbutils.DatabaseInfoBucket, dbutils.LastAppliedMigration)
+		}
+		if err != nil {
+			return err
+		}
+		if err := batch.Delete(dbutils.DatabaseInfoBucket, progressKey(v.Name)); err != nil {
+			return err
+		}
+		if _, err := batch.Commit(); err != nil {
+			return err
+		}
+		log.Warn("Rolled back migration", "name", v.Name)
+	}
+	return nil
+}
+
+// run calls the migration func with the progress of its previous run in the same direction,
+// the progress of the other direction is meaningless and dropped
+func (m *Migrator) run(db ethdb.Database, datadir string, name string, f MigrationFunc, direction byte) error {
+	progress, down, err := m.Progress(db, name)
+	if err != nil {
+		return err
+	}
+	if progress != nil && down != (direction == directionDown) {
+		progress = nil
+	}
+	if progress != nil {
+		log.Info("Resuming migration", "name", name, "progress", fmt.Sprintf("%x", progress))
+	}
+	return f(db, datadir, progress, func(putter ethdb.Putter, key []byte, isDone bool) error {
+		if isDone {
+			return nil
+		}
+		log.Info("Migration progress", "name", name, "key", fmt.Sprintf("%x", key))
+		return putter.Put(dbutils.DatabaseInfoBucket, progressKey(name), append([]byte{direction}, key...))
+	})
+}
+
+func progressKey(name string) []byte {
+	return append(common.CopyBytes(dbutils.MigrationProgressPrefix), name...)
+}
+
+var migrations = []Migration{
+	historyIndexBitmaps,
+}
@@ -1,31 +1,26 @@
 package migrations
 
 import (
+	"errors"
+	"testing"
+
 	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/common/etl"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
-	"testing"
 )
 
+func noop(db ethdb.Database, datadir string, progress []byte, OnLoadCommit etl.LoadCommitHandler) error {
+	return nil
+}
+
 func TestApplyWithInit(t *testing.T) {
 	db := ethdb.NewMemDatabase()
-	migrations = []Migration{
-		{
-			"one",
-			func(db ethdb.Database, history, receipts, txIndex, preImages bool) error {
-				return nil
-			},
-		},
-		{
-			"two",
-			func(db ethdb.Database, history, receipts, txIndex, preImages bool) error {
-				return nil
-			},
-		},
-	}
-
 	migrator := NewMigrator()
-	migrator.Migrations = migrations
-	err := migrator.Apply(db, false, false, false, false)
+	migrator.Migrations = []Migration{
+		{Name: "one", Up: noop},
+		{Name: "two", Up: noop},
+	}
+	err := migrator.Apply(db, "")
 	if err != nil {
 		t.Fatal()
 	}
@@ -33,36 +28,30 @@ func TestApplyWithInit(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if string(v) != migrations[1].Name {
+	if string(v) != migrator.Migrations[1].Name {
 		t.Fatal()
 	}
 }
 
 func TestApplyWithoutInit(t *testing.T) {
 	db := ethdb.NewMemDatabase()
-	migrations = []Migration{
+	migrator := NewMigrator()
+	migrator.Migrations = []Migration{
 		{
-			"one",
-			func(db ethdb.Database, history, receipts, txIndex, preImages bool) error {
+			Name: "one",
+			Up: func(db ethdb.Database, datadir string, progress []byte, OnLoadCommit etl.LoadCommitHandler) error {
 				t.Fatal("shouldn't been executed")
 				return nil
 			},
 		},
-		{
-			"two",
-			func(db ethdb.Database, history, receipts, txIndex, preImages bool) error {
-				return nil
-			},
-		},
+		{Name: "two", Up: noop},
 	}
-	err := db.Put(dbutils.DatabaseInfoBucket, dbutils.LastAppliedMigration, []byte(migrations[0].Name))
+	err := db.Put(dbutils.DatabaseInfoBucket, dbutils.LastAppliedMigration, []byte(migrator.Migrations[0].Name))
 	if err != nil {
 		t.Fatal()
 	}
 
-	migrator := NewMigrator()
-	migrator.Migrations = migrations
-	err = migrator.Apply(db, false, false, false, false)
+	err = migrator.Apply(db, "")
 	if err != nil {
 		t.Fatal()
 	}
@@ -70,7 +59,156 @@ func TestApplyWithoutInit(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if string(v) != migrations[1].Name {
+	if string(v) != migrator.Migrations[1].Name {
 		t.Fatal()
 	}
 }
+
+// writeKeys puts the keys one by one and commits a batch after each of them, failing after failAfter commits
+func writeKeys(bucket []byte, keys []string, failAfter int, started *[]string) MigrationFunc {
+	return func(db ethdb.Database, datadir string, progress []byte, OnLoadCommit etl.LoadCommitHandler) error {
+		*started = append(*started, string(progress))
+		commits := 0
+		for _, k := range keys {
+			if progress != nil && k <= string(progress) {
+				continue
+			}
+			if commits == failAfter {
+				return errors.New("interrupted")
+			}
+			batch := db.NewBatch()
+			if err := batch.Put(bucket, []byte(k), []byte(k)); err != nil {
+				return err
+			}
+			if err := OnLoadCommit(batch, []byte(k), false); err != nil {
+				return err
+			}
+			if _, err := batch.Commit(); err != nil {
+				return err
+			}
+			commits++
+		}
+		return OnLoadCommit(db, nil, true)
+	}
+}
+
+func TestApplyResumesInterrupted(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	var started []string
+	keys := []string{"a", "b", "c", "d"}
+	migrator := NewMigrator()
+	migrator.Migrations = []Migration{{Name: "one", Up: writeKeys(dbutils.CurrentStateBucket, keys, 2, &started)}}
+	if err := migrator.Apply(db, ""); err == nil {
+		t.Fatal("expected the migration to be interrupted")
+	}
+	pending, err := migrator.PendingMigrations(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 {
+		t.Fatal("migration must stay pending")
+	}
+	progress, down, err := migrator.Progress(db, "one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(progress) != "b" || down {
+		t.Fatalf("unexpected progress %q, down %t", progress, down)
+	}
+
+	migrator.Migrations[0].Up = writeKeys(dbutils.CurrentStateBucket, keys, -1, &started)
+	if err := migrator.Apply(db, ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(started) != 2 || started[0] != "" || started[1] != "b" {
+		t.Fatalf("unexpected runs %q", started)
+	}
+	for _, k := range keys {
+		if v, err := db.Get(dbutils.CurrentStateBucket, []byte(k)); err != nil || string(v) != k {
+			t.Fatalf("key %s is not written: %v", k, err)
+		}
+	}
+	if progress, _, err = migrator.Progress(db, "one"); err != nil || progress != nil {
+		t.Fatalf("progress must be removed, got %q, %v", progress, err)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	var order []string
+	migration := func(name string) Migration {
+		return Migration{
+			Name: name,
+			Up: func(db ethdb.Database, datadir string, progress []byte, OnLoadCommit etl.LoadCommitHandler) error {
+				order = append(order, "up "+name)
+				return nil
+			},
+			Down: func(db ethdb.Database, datadir string, progress []byte, OnLoadCommit etl.LoadCommitHandler) error {
+				order = append(order, "down "+name)
+				return nil
+			},
+		}
+	}
+	migrator := NewMigrator()
+	migrator.Migrations = []Migration{migration("one"), migration("two"), migration("three")}
+	if err := migrator.Apply(db, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.Rollback(db, "", "two"); err != nil {
+		t.Fatal(err)
+	}
+	v, err := db.Get(dbutils.DatabaseInfoBucket, dbutils.LastAppliedMigration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "one" {
+		t.Fatalf("last applied must be one, got %s", v)
+	}
+	if err := migrator.Apply(db, ""); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"up one", "up two", "up three", "down three", "down two", "up two", "up three"}
+	if len(order) != len(expected) {
+		t.Fatalf("unexpected order %q", order)
+	}
+	for i := range order {
+		if order[i] != expected[i] {
+			t.Fatalf("unexpected order %q", order)
+		}
+	}
+
+	migrator.Migrations[1].Down = nil
+	if err := migrator.Rollback(db, "", "one"); err == nil {
+		t.Fatal("irreversible migration must not be rolled back")
+	}
+}
+
+func TestApplyAfterInterruptedRollback(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	var started []string
+	migrator := NewMigrator()
+	migrator.Migrations = []Migration{{
+		Name: "one",
+		Up:   noop,
+		Down: writeKeys(dbutils.CurrentStateBucket, []string{"a", "b"}, 1, &started),
+	}}
+	if err := migrator.Apply(db, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.Rollback(db, "", "one"); err == nil {
+		t.Fatal("expected the rollback to be interrupted")
+	}
+	if err := migrator.Apply(db, ""); err == nil {
+		t.Fatal("apply must fail until the rollback is finished")
+	}
+	migrator.Migrations[0].Down = writeKeys(dbutils.CurrentStateBucket, []string{"a", "b"}, -1, &started)
+	if err := migrator.Rollback(db, "", "one"); err != nil {
+		t.Fatal(err)
+	}
+	if len(started) != 2 || started[1] != "a" {
+		t.Fatalf("unexpected runs %q", started)
+	}
+	if _, err := db.Get(dbutils.DatabaseInfoBucket, dbutils.LastAppliedMigration); err != ethdb.ErrKeyNotFound {
+		t.Fatal("no migrations must be applied", err)
+	}
+}
@@ -0,0 +1,46 @@
+package migrations
+
+import (
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/etl"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// rewriteBuckets rewrites the records of the buckets in place, one bucket after another, using the etl:
+// the records emitted by extractFunc are collected into the files in datadir and loaded back into the bucket,
+// an empty value deletes the record. extractFunc skips the records which don't need to be changed.
+// The progress is the index of the bucket followed by the last key loaded into it, so a restarted
+// migration extracts only the keys after that one
+func rewriteBuckets(db ethdb.Database, datadir string, progress []byte, OnLoadCommit etl.LoadCommitHandler, buckets [][]byte, extractFunc etl.ExtractFunc) error {
+	for i, bucket := range buckets {
+		var startKey, loadStartKey []byte
+		if len(progress) > 0 {
+			if int(progress[0]) > i {
+				continue
+			}
+			if int(progress[0]) == i && len(progress) > 1 {
+				startKey = common.CopyBytes(progress[1:])
+				// the key itself is loaded already
+				loadStartKey = append(common.CopyBytes(startKey), 0)
+			}
+		}
+		bucketIdx := byte(i)
+		isLast := i == len(buckets)-1
+		if err := etl.Transform(db, bucket, bucket, datadir, extractFunc, etl.IdentityLoadFunc, etl.TransformArgs{
+			ExtractStartKey: startKey,
+			LoadStartKey:    loadStartKey,
+			OnLoadCommit: func(putter ethdb.Putter, key []byte, isDone bool) error {
+				if isDone {
+					if isLast {
+						return OnLoadCommit(putter, nil, true)
+					}
+					return OnLoadCommit(putter, []byte{bucketIdx + 1}, false)
+				}
+				return OnLoadCommit(putter, append([]byte{bucketIdx}, key...), false)
+			},
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
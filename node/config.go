@@ -193,6 +193,12 @@ type Config struct {
 	LMDB     bool
 	Bolt     bool
 
+	// Whether to compress the block bodies, receipts and changesets of a new database.
+	DatabaseCompression bool
+
+	// File to record all the operations with the chaindata into, to replay them by the integration replay_kv command.
+	DatabaseTrace string `toml:",omitempty"`
+
 	// Address to listen to when launchig listener for remote database access
 	// empty string means not to start the listener
 	RemoteDbListenAddress string
@@ -653,16 +653,37 @@ func (n *Node) OpenDatabase(name string) (ethdb.Database, error) {
 
 	if n.config.BadgerDB {
 		log.Info("Opening Database (Badger)")
-		return ethdb.Open(n.config.ResolvePath(name + "_badger"))
+		return openDatabase(n.config, name, n.config.ResolvePath(name+"_badger"))
 	}
 
 	if n.config.Bolt {
 		log.Info("Opening Database (Bolt)")
-		return ethdb.Open(n.config.ResolvePath(name + "_bolt"))
+		return openDatabase(n.config, name, n.config.ResolvePath(name+"_bolt"))
 	}
 
 	log.Info("Opening Database (LMDB)")
-	return ethdb.Open(n.config.ResolvePath(name))
+	return openDatabase(n.config, name, n.config.ResolvePath(name))
+}
+
+func openDatabase(config *Config, name, path string) (*ethdb.ObjectDatabase, error) {
+	var db *ethdb.ObjectDatabase
+	var err error
+	if config.DatabaseCompression {
+		db, err = ethdb.OpenCompressed(path)
+	} else {
+		db, err = ethdb.Open(path)
+	}
+	if err != nil || config.DatabaseTrace == "" || name != "chaindata" {
+		return db, err
+	}
+	f, err := os.Create(config.DatabaseTrace)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	log.Info("Recording KV trace", "file", config.DatabaseTrace)
+	// closing the database closes the recorder, which flushes the trace
+	return ethdb.NewObjectDatabase(ethdb.NewRecorder(db.KV(), f)), nil
 }
 
 // ResolvePath returns the absolute path of a resource in the instance directory.
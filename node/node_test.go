@@ -17,15 +17,19 @@
 package node
 
 import (
+	"bytes"
 	"errors"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"time"
 
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
 	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
 	"github.com/ledgerwatch/turbo-geth/p2p"
 	"github.com/ledgerwatch/turbo-geth/rpc"
 
@@ -112,6 +116,48 @@ func TestNodeUsedDataDir(t *testing.T) {
 	}
 }
 
+// Tests that the operations with the chaindata are recorded into the trace.
+func TestNodeDatabaseTrace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary data directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	stack, err := New(&Config{DataDir: dir, DatabaseTrace: filepath.Join(dir, "trace")})
+	if err != nil {
+		t.Fatalf("failed to create protocol stack: %v", err)
+	}
+	defer stack.Close()
+
+	db, err := stack.OpenDatabase("chaindata")
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	if err = db.Put(dbutils.PlainStateBucket, []byte{1}, []byte{2}); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	db.Close()
+
+	f, err := os.Open(filepath.Join(dir, "trace"))
+	if err != nil {
+		t.Fatalf("failed to open the trace: %v", err)
+	}
+	defer f.Close()
+	var puts int
+	if err = ethdb.ReadTrace(f, func(rec *ethdb.TraceRecord) error {
+		if rec.Op == ethdb.TracePut && bytes.Equal(rec.Bucket, dbutils.PlainStateBucket) {
+			puts++
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to read the trace: %v", err)
+	}
+	if puts != 1 {
+		t.Fatalf("trace has %d puts, want 1", puts)
+	}
+}
+
 // Tests whether services can be registered and duplicates caught.
 func TestServiceRegistry(t *testing.T) {
 	stack, err := New(testNodeConfig())
@@ -53,16 +53,16 @@ func (ctx *ServiceContext) OpenDatabase(name string) (*ethdb.ObjectDatabase, err
 
 	if ctx.Config.BadgerDB {
 		log.Info("Opening Database (Badger)")
-		return ethdb.Open(ctx.Config.ResolvePath(name + "_badger"))
+		return openDatabase(&ctx.Config, name, ctx.Config.ResolvePath(name+"_badger"))
 	}
 
 	if ctx.Config.Bolt {
 		log.Info("Opening Database (Bolt)")
-		return ethdb.Open(ctx.Config.ResolvePath(name + "_bolt"))
+		return openDatabase(&ctx.Config, name, ctx.Config.ResolvePath(name+"_bolt"))
 	}
 
 	log.Info("Opening Database (LMDB)")
-	return ethdb.Open(ctx.Config.ResolvePath(name))
+	return openDatabase(&ctx.Config, name, ctx.Config.ResolvePath(name))
 	/*
 		if err != nil {
 			return nil, err
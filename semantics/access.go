@@ -0,0 +1,731 @@
+package semantics
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+)
+
+// State is the part of the state of the block read by the analysis
+type State interface {
+	GetCode(addr common.Address) []byte
+	GetState(addr common.Address, key *common.Hash, value *uint256.Int)
+}
+
+// Config of the access set analysis, the zero limits are replaced with the defaults.
+type Config struct {
+	// Input is the calldata of the transaction. If it's nil, the calldata and the value of the
+	// transaction are unknown, and the access set covers all of them.
+	Input []byte
+	// SymbolicStorage makes the storage values unknown instead of reading them from the state, the access
+	// set covers the changes of the state by the previous transactions then.
+	SymbolicStorage bool
+
+	MaxSteps      int  // instructions executed over all the paths
+	MaxDepth      int  // depth of the calls
+	MaxLoops      int  // feasible branches depending on the inputs taken by a path at the same instruction
+	SolverTimeout uint // milliseconds given to z3 to decide whether a branch is feasible
+}
+
+// StorageAccess lists the storage slots of a contract the transaction can read and write, the slots
+// which depend on the inputs are expressions, see Term.
+type StorageAccess struct {
+	Reads  []string `json:"reads"`
+	Writes []string `json:"writes"`
+}
+
+// AccessSet is the result of the analysis: the accounts and the storage slots the transaction can touch.
+// The set is complete unless Incomplete lists the paths of the execution that weren't explored.
+type AccessSet struct {
+	Accounts           []common.Address                  `json:"accounts"`
+	Storage            map[common.Address]*StorageAccess `json:"storage"`
+	UnresolvedAccounts []string                          `json:"unresolvedAccounts,omitempty"` // addresses depending on the inputs
+	Incomplete         []string                          `json:"incomplete,omitempty"`
+}
+
+// callInput is the calldata of a frame: unknown, or the bytes of the memory of the caller
+type callInput struct {
+	bytes []memByte // nil if the calldata is unknown
+	size  *Term
+}
+
+func (in *callInput) load(offset *Term) *Term {
+	if in.bytes == nil {
+		return leafTerm("calldata", offset)
+	}
+	o, ok := offset.Uint64()
+	if !ok {
+		return leafTerm("calldata", offset)
+	}
+	bs := make([]memByte, 32)
+	for i := uint64(0); i < 32; i++ {
+		if o+i < uint64(len(in.bytes)) {
+			bs[i] = in.bytes[o+i]
+		}
+	}
+	return wordTerm(bs, leafTerm("calldata", offset))
+}
+
+func (in *callInput) byteAt(offset, i uint64, word *Term) memByte {
+	if in.bytes != nil {
+		if offset+i < uint64(len(in.bytes)) {
+			return in.bytes[offset+i]
+		}
+		return memByte{}
+	}
+	return termBytes(word)[i%32]
+}
+
+// frame is the code executed in a call
+type frame struct {
+	code        []byte
+	jumpdests   map[uint64]bool
+	codeAddr    common.Address
+	storageAddr common.Address
+	caller      common.Address
+	value       *Term
+	input       *callInput
+	depth       int
+}
+
+// storedSlot is a slot written by a path
+type storedSlot struct {
+	key, value *Term
+}
+
+// storageView is the storage known by a path, the values written by it
+type storageView struct {
+	written  map[common.Address]map[string]storedSlot
+	havoc    map[common.Address]bool // written at unknown slots, the values which weren't written are unknown
+	havocAll bool                    // changed by a call
+}
+
+func newStorageView() *storageView {
+	return &storageView{written: make(map[common.Address]map[string]storedSlot), havoc: make(map[common.Address]bool)}
+}
+
+func (s *storageView) copy() *storageView {
+	c := &storageView{written: make(map[common.Address]map[string]storedSlot, len(s.written)), havoc: make(map[common.Address]bool, len(s.havoc)), havocAll: s.havocAll}
+	for addr, slots := range s.written {
+		cs := make(map[string]storedSlot, len(slots))
+		for k, v := range slots {
+			cs[k] = v
+		}
+		c.written[addr] = cs
+	}
+	for addr, h := range s.havoc {
+		c.havoc[addr] = h
+	}
+	return c
+}
+
+// path is a state of the execution of a frame
+type path struct {
+	pc      uint64
+	stack   []*Term
+	mem     *memory
+	storage *storageView
+	conds   []condition     // branches depending on the inputs taken by the path
+	visits  map[uint64]int  // unknown branches taken at the instruction
+	seen    map[uint64]bool // jump destinations reached
+}
+
+func (p *path) fork() *path {
+	c := &path{
+		pc:      p.pc,
+		stack:   append([]*Term(nil), p.stack...),
+		mem:     p.mem.copy(),
+		storage: p.storage.copy(),
+		conds:   append([]condition(nil), p.conds...),
+		visits:  make(map[uint64]int, len(p.visits)),
+		seen:    make(map[uint64]bool, len(p.seen)),
+	}
+	for k, v := range p.visits {
+		c.visits[k] = v
+	}
+	for k, v := range p.seen {
+		c.seen[k] = v
+	}
+	return c
+}
+
+func (p *path) pop() *Term {
+	t := p.stack[len(p.stack)-1]
+	p.stack = p.stack[:len(p.stack)-1]
+	return t
+}
+
+func (p *path) push(t *Term) {
+	p.stack = append(p.stack, t)
+}
+
+// analysis is the state of Analyse
+type analysis struct {
+	st          State
+	cfg         Config
+	header      *types.Header
+	chainID     *big.Int
+	origin      common.Address
+	steps       int
+	accounts    map[common.Address]struct{}
+	reads       map[common.Address]map[string]struct{}
+	writes      map[common.Address]map[string]struct{}
+	unresolved  map[string]struct{}
+	incomplete  map[string]struct{}
+	precompiles map[common.Address]vm.PrecompiledContract
+}
+
+// semMu guards the z3 context and the term sequence of libevmsem, which are global
+var semMu sync.Mutex
+
+// Analyse executes the transaction symbolically on the state with the given root, every branch depending
+// on the values unknown before the execution which z3 finds feasible is explored, and returns the accounts
+// and the storage slots which can be touched. The balance of the coinbase isn't included. The contracts
+// created by the transaction aren't analysed, and neither are the subroutines.
+func Analyse(st State, stateRoot common.Hash, chainID *big.Int, header *types.Header, msg types.Message, cfg Config) (*AccessSet, error) {
+	if msg.Value().BitLen() > 128 {
+		return nil, fmt.Errorf("value %d doesn't fit into 128 bits", msg.Value())
+	}
+	// __uint128_t is little endian
+	var value [16]byte
+	for i, b := range msg.Value().Bytes() {
+		value[len(msg.Value().Bytes())-1-i] = b
+	}
+	var to common.Address
+	if msg.To() != nil {
+		to = *msg.To()
+	}
+	semMu.Lock()
+	defer semMu.Unlock()
+	Init()
+	defer Destroy()
+	if result := Initialise(stateRoot, msg.From(), to, msg.To() != nil, value, msg.Data(), msg.GasPrice().Uint64(), msg.Gas()); result != 0 {
+		return nil, fmt.Errorf("could not initialise the term sequence: %d", result)
+	}
+	defer Cleanup()
+
+	if cfg.MaxSteps == 0 {
+		cfg.MaxSteps = 1 << 20
+	}
+	if cfg.MaxDepth == 0 {
+		cfg.MaxDepth = 8
+	}
+	if cfg.MaxLoops == 0 {
+		cfg.MaxLoops = 4
+	}
+	if cfg.SolverTimeout == 0 {
+		cfg.SolverTimeout = 1000
+	}
+	a := &analysis{
+		st:          st,
+		cfg:         cfg,
+		header:      header,
+		chainID:     chainID,
+		origin:      msg.From(),
+		accounts:    make(map[common.Address]struct{}),
+		reads:       make(map[common.Address]map[string]struct{}),
+		writes:      make(map[common.Address]map[string]struct{}),
+		unresolved:  make(map[string]struct{}),
+		incomplete:  make(map[string]struct{}),
+		precompiles: vm.PrecompiledContractsIstanbul,
+	}
+	a.accounts[msg.From()] = struct{}{}
+
+	callValue := leafTerm("callvalue")
+	input := &callInput{size: leafTerm("calldatasize")}
+	if cfg.Input != nil {
+		callValue = constTerm(msg.Value())
+		input = &callInput{bytes: make([]memByte, len(cfg.Input)), size: uint64Term(uint64(len(cfg.Input)))}
+		for i, b := range cfg.Input {
+			input.bytes[i] = memByte{b: b}
+		}
+	}
+	f := &frame{caller: msg.From(), value: callValue, input: input}
+	if to := msg.To(); to != nil {
+		f.codeAddr, f.storageAddr = *to, *to
+		f.code = st.GetCode(*to)
+	} else {
+		// Contract creation, the data is the code
+		f.codeAddr = crypto.CreateAddress(msg.From(), msg.Nonce())
+		f.storageAddr = f.codeAddr
+		f.code = msg.Data()
+		f.input = &callInput{bytes: []memByte{}, size: uint64Term(0)}
+	}
+	a.accounts[f.codeAddr] = struct{}{}
+	if len(f.code) > 0 && a.precompiles[f.codeAddr] == nil {
+		a.run(f, newStorageView(), nil)
+	}
+	return a.result(), nil
+}
+
+func (a *analysis) result() *AccessSet {
+	set := &AccessSet{Accounts: make([]common.Address, 0, len(a.accounts)), Storage: make(map[common.Address]*StorageAccess)}
+	for addr := range a.accounts {
+		set.Accounts = append(set.Accounts, addr)
+	}
+	sort.Slice(set.Accounts, func(i, j int) bool { return bytes.Compare(set.Accounts[i][:], set.Accounts[j][:]) < 0 })
+	sortedKeys := func(m map[string]struct{}) []string {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	access := func(addr common.Address) *StorageAccess {
+		s, ok := set.Storage[addr]
+		if !ok {
+			s = &StorageAccess{Reads: []string{}, Writes: []string{}}
+			set.Storage[addr] = s
+		}
+		return s
+	}
+	for addr, slots := range a.reads {
+		access(addr).Reads = sortedKeys(slots)
+	}
+	for addr, slots := range a.writes {
+		access(addr).Writes = sortedKeys(slots)
+	}
+	if len(a.unresolved) > 0 {
+		set.UnresolvedAccounts = sortedKeys(a.unresolved)
+	}
+	if len(a.incomplete) > 0 {
+		set.Incomplete = sortedKeys(a.incomplete)
+	}
+	return set
+}
+
+func (a *analysis) addSlot(m map[common.Address]map[string]struct{}, addr common.Address, slot *Term) {
+	slots, ok := m[addr]
+	if !ok {
+		slots = make(map[string]struct{})
+		m[addr] = slots
+	}
+	slots[slot.String()] = struct{}{}
+}
+
+// account records the account touched by the frame, and returns its address if it's known
+func (a *analysis) account(addr *Term) (common.Address, bool) {
+	if !addr.IsConst() {
+		a.unresolved[addr.String()] = struct{}{}
+		return common.Address{}, false
+	}
+	address := common.Address(addr.value.Bytes20())
+	a.accounts[address] = struct{}{}
+	return address, true
+}
+
+func (a *analysis) stop(f *frame, pc uint64, reason string) {
+	a.incomplete[fmt.Sprintf("%s at %x:%d", reason, f.codeAddr, pc)] = struct{}{}
+}
+
+// jumpdests finds the JUMPDEST instructions of the code
+func jumpdests(code []byte) map[uint64]bool {
+	dests := make(map[uint64]bool)
+	for pc := 0; pc < len(code); pc++ {
+		op := vm.OpCode(code[pc])
+		if op == vm.JUMPDEST {
+			dests[uint64(pc)] = true
+		} else if op >= vm.PUSH1 && op <= vm.PUSH32 {
+			pc += int(op - vm.PUSH1 + 1)
+		}
+	}
+	return dests
+}
+
+// binaryOps are the opcodes evaluated by binaryOp
+var binaryOps = map[vm.OpCode]string{
+	vm.ADD: "add", vm.MUL: "mul", vm.SUB: "sub", vm.DIV: "div", vm.SDIV: "sdiv", vm.MOD: "mod", vm.SMOD: "smod",
+	vm.EXP: "exp", vm.SIGNEXTEND: "signextend", vm.LT: "lt", vm.GT: "gt", vm.SLT: "slt", vm.SGT: "sgt",
+	vm.EQ: "eq", vm.AND: "and", vm.OR: "or", vm.XOR: "xor", vm.BYTE: "byte", vm.SHL: "shl", vm.SHR: "shr",
+	vm.SAR: "sar",
+}
+
+// run explores the paths of the frame, which is reached under the conditions
+func (a *analysis) run(f *frame, storage *storageView, conds []condition) {
+	f.jumpdests = jumpdests(f.code)
+	paths := []*path{{mem: newMemory(), storage: storage, conds: conds, visits: make(map[uint64]int), seen: make(map[uint64]bool)}}
+	for len(paths) > 0 {
+		p := paths[len(paths)-1]
+		paths = paths[:len(paths)-1]
+		paths = append(paths, a.step(f, p)...)
+	}
+}
+
+// step executes the path until it ends or forks, and returns the paths to continue
+func (a *analysis) step(f *frame, p *path) []*path {
+	for {
+		if p.pc >= uint64(len(f.code)) {
+			return nil
+		}
+		if a.steps >= a.cfg.MaxSteps {
+			a.stop(f, p.pc, "step limit")
+			return nil
+		}
+		a.steps++
+		op := vm.OpCode(f.code[p.pc])
+		pc := p.pc
+		p.pc++
+
+		// Stack underflows end the path the same way as in the EVM
+		if op >= vm.PUSH1 && op <= vm.PUSH32 {
+			n := uint64(op - vm.PUSH1 + 1)
+			data := make([]byte, n)
+			if pc+1 < uint64(len(f.code)) {
+				copy(data, f.code[pc+1:])
+			}
+			p.push(bytesTerm(data))
+			p.pc += n
+			continue
+		}
+		if op >= vm.DUP1 && op <= vm.DUP16 {
+			n := int(op - vm.DUP1 + 1)
+			if len(p.stack) < n {
+				return nil
+			}
+			p.push(p.stack[len(p.stack)-n])
+			continue
+		}
+		if op >= vm.SWAP1 && op <= vm.SWAP16 {
+			n := int(op - vm.SWAP1 + 1)
+			if len(p.stack) < n+1 {
+				return nil
+			}
+			top := len(p.stack) - 1
+			p.stack[top], p.stack[top-n] = p.stack[top-n], p.stack[top]
+			continue
+		}
+		if op >= vm.LOG0 && op <= vm.LOG4 {
+			if len(p.stack) < int(op-vm.LOG0)+2 {
+				return nil
+			}
+			p.stack = p.stack[:len(p.stack)-int(op-vm.LOG0)-2]
+			continue
+		}
+		if name, ok := binaryOps[op]; ok {
+			if len(p.stack) < 2 {
+				return nil
+			}
+			x := p.pop()
+			y := p.pop()
+			p.push(binaryOp(name, x, y))
+			continue
+		}
+		if len(p.stack) < stackArgs[op] {
+			return nil
+		}
+
+		switch op {
+		case vm.STOP, vm.RETURN, vm.REVERT:
+			return nil
+		case vm.SELFDESTRUCT:
+			a.account(p.pop())
+			return nil
+		case vm.ADDMOD, vm.MULMOD:
+			x, y, z := p.pop(), p.pop(), p.pop()
+			p.push(ternaryOp(map[vm.OpCode]string{vm.ADDMOD: "addmod", vm.MULMOD: "mulmod"}[op], x, y, z))
+		case vm.ISZERO:
+			p.push(unaryOp("iszero", p.pop()))
+		case vm.NOT:
+			p.push(unaryOp("not", p.pop()))
+		case vm.SHA3:
+			offset, size := p.pop(), p.pop()
+			p.push(p.mem.keccak(offset, size))
+		case vm.ADDRESS:
+			p.push(bytesTerm(f.storageAddr[:]))
+		case vm.BALANCE, vm.EXTCODEHASH:
+			addr := p.pop()
+			a.account(addr)
+			p.push(leafTerm(map[vm.OpCode]string{vm.BALANCE: "balance", vm.EXTCODEHASH: "extcodehash"}[op], addr))
+		case vm.EXTCODESIZE:
+			addr := p.pop()
+			if address, ok := a.account(addr); ok {
+				p.push(uint64Term(uint64(len(a.st.GetCode(address)))))
+			} else {
+				p.push(leafTerm("extcodesize", addr))
+			}
+		case vm.EXTCODECOPY:
+			if address, ok := a.account(p.pop()); ok {
+				code := a.st.GetCode(address)
+				memOffset, codeOffset, size := p.pop(), p.pop(), p.pop()
+				p.mem.copyBytes(memOffset, size, codeBytes(code, codeOffset))
+			} else {
+				memOffset, _, size := p.pop(), p.pop(), p.pop()
+				p.mem.forget(memOffset, size)
+			}
+		case vm.ORIGIN:
+			p.push(bytesTerm(a.origin[:]))
+		case vm.CALLER:
+			p.push(bytesTerm(f.caller[:]))
+		case vm.CALLVALUE:
+			p.push(f.value)
+		case vm.CALLDATALOAD:
+			p.push(f.input.load(p.pop()))
+		case vm.CALLDATASIZE:
+			p.push(f.input.size)
+		case vm.CALLDATACOPY:
+			memOffset, dataOffset, size := p.pop(), p.pop(), p.pop()
+			if o, ok := dataOffset.Uint64(); ok {
+				var word *Term
+				p.mem.copyBytes(memOffset, size, func(i uint64) memByte {
+					if i%32 == 0 || word == nil {
+						word = f.input.load(uint64Term(o + i - i%32))
+					}
+					return f.input.byteAt(o, i, word)
+				})
+			} else {
+				p.mem.forget(memOffset, size)
+			}
+		case vm.CODESIZE:
+			p.push(uint64Term(uint64(len(f.code))))
+		case vm.CODECOPY:
+			memOffset, codeOffset, size := p.pop(), p.pop(), p.pop()
+			p.mem.copyBytes(memOffset, size, codeBytes(f.code, codeOffset))
+		case vm.RETURNDATACOPY:
+			memOffset, _, size := p.pop(), p.pop(), p.pop()
+			p.mem.forget(memOffset, size)
+		case vm.BLOCKHASH:
+			p.push(leafTerm("blockhash", p.pop()))
+		case vm.COINBASE:
+			p.push(bytesTerm(a.header.Coinbase[:]))
+		case vm.TIMESTAMP:
+			p.push(uint64Term(a.header.Time))
+		case vm.NUMBER:
+			p.push(constTerm(uint256.NewInt().SetBytes(a.header.Number.Bytes())))
+		case vm.DIFFICULTY:
+			p.push(constTerm(uint256.NewInt().SetBytes(a.header.Difficulty.Bytes())))
+		case vm.GASLIMIT:
+			p.push(uint64Term(a.header.GasLimit))
+		case vm.CHAINID:
+			p.push(constTerm(uint256.NewInt().SetBytes(a.chainID.Bytes())))
+		case vm.GASPRICE, vm.RETURNDATASIZE, vm.SELFBALANCE, vm.GAS, vm.MSIZE:
+			p.push(leafTerm(map[vm.OpCode]string{vm.GASPRICE: "gasprice", vm.RETURNDATASIZE: "returndatasize",
+				vm.SELFBALANCE: "selfbalance", vm.GAS: "gas", vm.MSIZE: "msize"}[op]))
+		case vm.PC:
+			p.push(uint64Term(pc))
+		case vm.POP:
+			p.pop()
+		case vm.MLOAD:
+			p.push(p.mem.load(p.pop()))
+		case vm.MSTORE:
+			offset, value := p.pop(), p.pop()
+			p.mem.store(offset, value)
+		case vm.MSTORE8:
+			offset, value := p.pop(), p.pop()
+			p.mem.store8(offset, value)
+		case vm.SLOAD:
+			p.push(a.sload(f, p, p.pop()))
+		case vm.SSTORE:
+			key, value := p.pop(), p.pop()
+			a.sstore(f, p, key, value)
+		case vm.JUMPDEST:
+		case vm.JUMP:
+			dest, ok := p.pop().Uint64()
+			if !ok {
+				a.stop(f, pc, "unknown jump destination")
+				return nil
+			}
+			if !f.jumpdests[dest] {
+				return nil
+			}
+			p.pc = dest
+			p.seen[dest] = true
+		case vm.JUMPI:
+			destTerm, cond := p.pop(), p.pop()
+			return a.jumpi(f, p, pc, destTerm, cond)
+		case vm.CALL, vm.CALLCODE, vm.DELEGATECALL, vm.STATICCALL:
+			a.call(f, p, op)
+		case vm.CREATE, vm.CREATE2:
+			p.stack = p.stack[:len(p.stack)-stackArgs[op]]
+			p.push(leafTerm("create"))
+			a.stop(f, pc, "contract creation")
+		default:
+			// Subroutines and undefined opcodes
+			if _, ok := stackArgs[op]; !ok {
+				return nil
+			}
+			a.stop(f, pc, op.String())
+			return nil
+		}
+	}
+}
+
+// codeBytes returns the bytes of the code from the offset, the ones beyond the code are zeroes
+func codeBytes(code []byte, offset *Term) func(i uint64) memByte {
+	o, ok := offset.Uint64()
+	return func(i uint64) memByte {
+		if !ok {
+			return memByte{unknown: true, term: leafTerm("code"), idx: uint8(i % 32)}
+		}
+		if o+i < uint64(len(code)) {
+			return memByte{b: code[o+i]}
+		}
+		return memByte{}
+	}
+}
+
+func (a *analysis) jumpi(f *frame, p *path, pc uint64, destTerm, cond *Term) []*path {
+	var taken, notTaken bool
+	if cond.IsConst() {
+		taken = !cond.value.IsZero()
+		notTaken = !taken
+	} else if cond.known != 0 && !cond.value.IsZero() {
+		taken = true
+	} else {
+		taken, notTaken = true, true
+	}
+	dest, ok := destTerm.Uint64()
+	if taken && !ok {
+		a.stop(f, pc, "unknown jump destination")
+		taken = false
+	}
+	if taken && !f.jumpdests[dest] {
+		taken = false
+	}
+	if taken && notTaken {
+		taken = a.feasible(p, condition{cond, true})
+		notTaken = a.feasible(p, condition{cond, false})
+	}
+	if taken && notTaken {
+		// Unrolling the loops depending on the inputs, after the limit only the new code is explored
+		p.visits[pc]++
+		if p.visits[pc] > a.cfg.MaxLoops {
+			a.stop(f, pc, "loop limit")
+			taken = !p.seen[dest]
+			notTaken = !p.seen[p.pc]
+		}
+	}
+	var paths []*path
+	if notTaken {
+		fall := p
+		if taken {
+			fall = p.fork()
+		}
+		if !cond.IsConst() {
+			fall.conds = append(fall.conds, condition{cond, false})
+		}
+		fall.seen[fall.pc] = true
+		paths = append(paths, fall)
+	}
+	if taken {
+		if !cond.IsConst() {
+			p.conds = append(p.conds, condition{cond, true})
+		}
+		p.pc = dest
+		p.seen[dest] = true
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+// feasible asks z3 whether the path can take the branch
+func (a *analysis) feasible(p *path, c condition) bool {
+	script := newSmtScript()
+	for _, pc := range p.conds {
+		script.assert(pc)
+	}
+	script.assert(c)
+	return Satisfiable(script.String(), a.cfg.SolverTimeout)
+}
+
+func (a *analysis) sload(f *frame, p *path, key *Term) *Term {
+	a.addSlot(a.reads, f.storageAddr, key)
+	if slot, ok := p.storage.written[f.storageAddr][key.String()]; ok {
+		return slot.value
+	}
+	if !key.IsConst() || a.cfg.SymbolicStorage || p.storage.havocAll || p.storage.havoc[f.storageAddr] {
+		return leafTerm("sload", bytesTerm(f.storageAddr[:]), key)
+	}
+	hash := common.Hash(key.value.Bytes32())
+	var value uint256.Int
+	a.st.GetState(f.storageAddr, &hash, &value)
+	return constTerm(&value)
+}
+
+func (a *analysis) sstore(f *frame, p *path, key, value *Term) {
+	a.addSlot(a.writes, f.storageAddr, key)
+	slots, ok := p.storage.written[f.storageAddr]
+	if !ok {
+		slots = make(map[string]storedSlot)
+		p.storage.written[f.storageAddr] = slots
+	}
+	// The slots which can be the same as the written one are forgotten
+	k := key.String()
+	if !key.IsConst() {
+		p.storage.havoc[f.storageAddr] = true
+	}
+	for k2, slot := range slots {
+		if k2 != k && (!key.IsConst() || !slot.key.IsConst()) {
+			delete(slots, k2)
+		}
+	}
+	slots[k] = storedSlot{key, value}
+}
+
+// call analyses the callee with the input from the memory of the caller, the results of the call are unknown
+func (a *analysis) call(f *frame, p *path, op vm.OpCode) {
+	p.pop() // gas
+	addr := p.pop()
+	value := f.value
+	if op == vm.CALL || op == vm.CALLCODE {
+		value = p.pop()
+	}
+	inOffset, inSize, outOffset, outSize := p.pop(), p.pop(), p.pop(), p.pop()
+	p.push(leafTerm("success"))
+	p.mem.forget(outOffset, outSize)
+
+	target, ok := a.account(addr)
+	if !ok || a.precompiles[target] != nil {
+		if !ok {
+			// The callee can change any storage
+			p.storage.havocAll = true
+		}
+		return
+	}
+	code := a.st.GetCode(target)
+	if len(code) == 0 {
+		return
+	}
+	if f.depth+1 >= a.cfg.MaxDepth {
+		a.stop(f, p.pc-1, "call depth limit")
+		p.storage.havocAll = true
+		return
+	}
+	callee := &frame{code: code, codeAddr: target, storageAddr: target, caller: f.storageAddr, value: value, depth: f.depth + 1}
+	switch op {
+	case vm.CALLCODE:
+		callee.storageAddr = f.storageAddr
+	case vm.DELEGATECALL:
+		callee.storageAddr = f.storageAddr
+		callee.caller = f.caller
+	}
+	callee.input = &callInput{size: inSize}
+	if o, s, ok := region(inOffset, inSize); ok {
+		callee.input.bytes = p.mem.slice(o, s)
+	}
+	a.run(callee, p.storage.copy(), append([]condition(nil), p.conds...))
+	p.storage.havocAll = true
+}
+
+// stackArgs is the number of the stack items taken by the opcodes, the subroutine opcodes are known
+// but not supported
+var stackArgs = map[vm.OpCode]int{
+	vm.STOP: 0, vm.RETURN: 2, vm.REVERT: 2, vm.SELFDESTRUCT: 1,
+	vm.ADDMOD: 3, vm.MULMOD: 3, vm.ISZERO: 1, vm.NOT: 1, vm.SHA3: 2,
+	vm.ADDRESS: 0, vm.BALANCE: 1, vm.ORIGIN: 0, vm.CALLER: 0, vm.CALLVALUE: 0, vm.CALLDATALOAD: 1,
+	vm.CALLDATASIZE: 0, vm.CALLDATACOPY: 3, vm.CODESIZE: 0, vm.CODECOPY: 3, vm.GASPRICE: 0,
+	vm.EXTCODESIZE: 1, vm.EXTCODECOPY: 4, vm.RETURNDATASIZE: 0, vm.RETURNDATACOPY: 3, vm.EXTCODEHASH: 1,
+	vm.BLOCKHASH: 1, vm.COINBASE: 0, vm.TIMESTAMP: 0, vm.NUMBER: 0, vm.DIFFICULTY: 0, vm.GASLIMIT: 0,
+	vm.CHAINID: 0, vm.SELFBALANCE: 0,
+	vm.POP: 1, vm.MLOAD: 1, vm.MSTORE: 2, vm.MSTORE8: 2, vm.SLOAD: 1, vm.SSTORE: 2, vm.JUMP: 1, vm.JUMPI: 2,
+	vm.PC: 0, vm.MSIZE: 0, vm.GAS: 0, vm.JUMPDEST: 0, vm.BEGINSUB: 0, vm.JUMPSUB: 1, vm.RETURNSUB: 0,
+	vm.CREATE: 3, vm.CALL: 7, vm.CALLCODE: 7, vm.DELEGATECALL: 6, vm.CREATE2: 4, vm.STATICCALL: 6,
+}
@@ -0,0 +1,210 @@
+package semantics
+
+import (
+	"bytes"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/hexutil"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+)
+
+type testState map[common.Address][]byte
+
+func (s testState) GetCode(addr common.Address) []byte {
+	return s[addr]
+}
+
+func (s testState) GetState(addr common.Address, key *common.Hash, value *uint256.Int) {
+	value.Clear()
+}
+
+// asm assembles the opcodes, the byte slices are pushed with the PUSH of their length
+func asm(items ...interface{}) []byte {
+	var code []byte
+	for _, item := range items {
+		switch v := item.(type) {
+		case vm.OpCode:
+			code = append(code, byte(v))
+		case []byte:
+			code = append(code, byte(vm.PUSH1)+byte(len(v)-1))
+			code = append(code, v...)
+		case int:
+			code = append(code, byte(vm.PUSH1), byte(v))
+		}
+	}
+	return code
+}
+
+var (
+	testFrom  = common.HexToAddress("0x0100")
+	testToken = common.HexToAddress("0x1000")
+	testHook  = common.HexToAddress("0x2000")
+	testTo    = common.HexToAddress("0x3000")
+)
+
+// testTokenCode is transfer(to, amount) moving the balances keyed by keccak256(address, 0), and calling the
+// hook with the selector 0x12345678. All the other calls read the slot 1.
+var testTokenCode = asm(
+	0, vm.CALLDATALOAD, 0xe0, vm.SHR, hexutil.MustDecode("0xa9059cbb"), vm.EQ, 20, vm.JUMPI, // 0
+	1, vm.SLOAD, vm.POP, vm.STOP, // 15
+	vm.JUMPDEST, // 20
+	vm.CALLER, 0, vm.MSTORE, 0, 0x20, vm.MSTORE, 0x40, 0, vm.SHA3,
+	vm.DUP1, vm.SLOAD, 0x24, vm.CALLDATALOAD, vm.SWAP1, vm.SUB, vm.SWAP1, vm.SSTORE,
+	4, vm.CALLDATALOAD, 0, vm.MSTORE, 0x40, 0, vm.SHA3,
+	vm.DUP1, vm.SLOAD, 0x24, vm.CALLDATALOAD, vm.ADD, vm.SWAP1, vm.SSTORE,
+	hexutil.MustDecode("0x12345678"), 0xe0, vm.SHL, 0, vm.MSTORE,
+	0, 0, 4, 0, 0, testHook[18:], vm.GAS, vm.CALL, vm.POP,
+	vm.STOP,
+)
+
+// testHookCode writes 7 into the slot 5 if it's called with the selector 0x12345678, and into the slot 6 otherwise
+var testHookCode = asm(
+	0, vm.CALLDATALOAD, 0xe0, vm.SHR, hexutil.MustDecode("0x12345678"), vm.EQ, 21, vm.JUMPI, // 0
+	7, 6, vm.SSTORE, vm.STOP, // 15
+	vm.JUMPDEST, 7, 5, vm.SSTORE, vm.STOP, // 21
+)
+
+func testAnalyse(t *testing.T, st testState, to common.Address, data []byte, cfg Config) *AccessSet {
+	t.Helper()
+	header := &types.Header{Number: big.NewInt(1), Difficulty: big.NewInt(1), GasLimit: 1000000}
+	msg := types.NewMessage(testFrom, &to, 0, uint256.NewInt(), 1000000, uint256.NewInt(), data, false)
+	set, err := Analyse(st, common.Hash{}, big.NewInt(1), header, msg, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return set
+}
+
+func balanceSlot(addr common.Address) string {
+	return hexutil.EncodeBig(new(big.Int).SetBytes(crypto.Keccak256(common.LeftPadBytes(addr[:], 32), make([]byte, 32))))
+}
+
+func TestAnalyseAllInputs(t *testing.T) {
+	st := testState{testToken: testTokenCode, testHook: testHookCode}
+	set := testAnalyse(t, st, testToken, nil, Config{})
+
+	if !reflect.DeepEqual(set.Accounts, []common.Address{testFrom, testToken, testHook}) {
+		t.Errorf("accounts %x", set.Accounts)
+	}
+	toSlot := "keccak256(calldata(0x4), 0x0)"
+	expected := map[common.Address]*StorageAccess{
+		testToken: {
+			Reads:  []string{"0x1", balanceSlot(testFrom), toSlot},
+			Writes: []string{balanceSlot(testFrom), toSlot},
+		},
+		testHook: {Reads: []string{}, Writes: []string{"0x5"}},
+	}
+	for addr, access := range expected {
+		if !reflect.DeepEqual(set.Storage[addr], access) {
+			t.Errorf("storage of %x is %+v, expected %+v", addr, set.Storage[addr], access)
+		}
+	}
+	if len(set.Storage) != len(expected) || len(set.UnresolvedAccounts) != 0 || len(set.Incomplete) != 0 {
+		t.Errorf("unexpected access set %+v", set)
+	}
+}
+
+func TestAnalyseInput(t *testing.T) {
+	st := testState{testToken: testTokenCode, testHook: testHookCode}
+	data := append(hexutil.MustDecode("0xa9059cbb"), common.LeftPadBytes(testTo[:], 32)...)
+	data = append(data, common.LeftPadBytes([]byte{5}, 32)...)
+	set := testAnalyse(t, st, testToken, data, Config{Input: data})
+
+	expected := &StorageAccess{
+		Reads:  []string{balanceSlot(testFrom), balanceSlot(testTo)},
+		Writes: []string{balanceSlot(testFrom), balanceSlot(testTo)},
+	}
+	if len(expected.Reads) == 2 && expected.Reads[0] > expected.Reads[1] {
+		expected.Reads[0], expected.Reads[1] = expected.Reads[1], expected.Reads[0]
+		expected.Writes[0], expected.Writes[1] = expected.Writes[1], expected.Writes[0]
+	}
+	if !reflect.DeepEqual(set.Storage[testToken], expected) {
+		t.Errorf("storage of the token is %+v, expected %+v", set.Storage[testToken], expected)
+	}
+}
+
+func TestAnalyseUnknownTarget(t *testing.T) {
+	// Calls the address from the calldata
+	code := asm(0, 0, 0, 0, 0, 4, vm.CALLDATALOAD, vm.GAS, vm.CALL, vm.POP, 1, vm.SLOAD, vm.STOP)
+	set := testAnalyse(t, testState{testToken: code}, testToken, nil, Config{})
+	if !reflect.DeepEqual(set.UnresolvedAccounts, []string{"calldata(0x4)"}) {
+		t.Errorf("unresolved accounts %v", set.UnresolvedAccounts)
+	}
+	if !reflect.DeepEqual(set.Storage[testToken].Reads, []string{"0x1"}) {
+		t.Errorf("reads %v", set.Storage[testToken].Reads)
+	}
+}
+
+func TestAnalyseLoop(t *testing.T) {
+	// for i := 0; i < calldata(0x4); i++ { sstore(i, 1) }
+	code := asm(
+		0,                                                                        // 0
+		vm.JUMPDEST, vm.DUP1, 4, vm.CALLDATALOAD, vm.GT, vm.ISZERO, 22, vm.JUMPI, // 2
+		1, vm.DUP2, vm.SSTORE, 1, vm.ADD, 2, vm.JUMP, // 12
+		vm.JUMPDEST, vm.STOP, // 22
+	)
+	set := testAnalyse(t, testState{testToken: code}, testToken, nil, Config{MaxLoops: 3})
+	if !reflect.DeepEqual(set.Storage[testToken].Writes, []string{"0x0", "0x1", "0x2"}) {
+		t.Errorf("writes %v", set.Storage[testToken].Writes)
+	}
+	if len(set.Incomplete) != 1 || !strings.HasPrefix(set.Incomplete[0], "loop limit") {
+		t.Errorf("incomplete %v", set.Incomplete)
+	}
+}
+
+func TestAnalyseInfeasibleBranches(t *testing.T) {
+	// for i := 0; i < calldata(0x4) & 3; i++ { sstore(i, 1) }; if calldata(0x4) & 3 > 3 { sstore(9, 1) }
+	code := asm(
+		0,                                                                                   // 0
+		vm.JUMPDEST, vm.DUP1, 3, 4, vm.CALLDATALOAD, vm.AND, vm.GT, vm.ISZERO, 25, vm.JUMPI, // 2
+		1, vm.DUP2, vm.SSTORE, 1, vm.ADD, 2, vm.JUMP, // 15
+		vm.JUMPDEST, 3, 3, 4, vm.CALLDATALOAD, vm.AND, vm.GT, vm.ISZERO, 44, vm.JUMPI, // 25
+		1, 9, vm.SSTORE, // 39
+		vm.JUMPDEST, vm.STOP, // 44
+	)
+	set := testAnalyse(t, testState{testToken: code}, testToken, nil, Config{})
+	if !reflect.DeepEqual(set.Storage[testToken].Writes, []string{"0x0", "0x1", "0x2"}) {
+		t.Errorf("writes %v, expected the ones of the feasible paths", set.Storage[testToken].Writes)
+	}
+	if len(set.Incomplete) != 0 {
+		t.Errorf("incomplete %v", set.Incomplete)
+	}
+}
+
+func TestTerms(t *testing.T) {
+	selector := binaryOp("shr", uint64Term(0xe0), leafTerm("calldata", uint64Term(0)))
+	if selector.IsConst() || selector.String() != "shr(0xe0, calldata(0x0))" {
+		t.Errorf("selector %v", selector)
+	}
+	if eq := binaryOp("eq", selector, uint64Term(1<<32)); !eq.IsConst() || !eq.value.IsZero() {
+		t.Errorf("selector can't have 5 bytes, got %v", eq)
+	}
+	address := binaryOp("and", bytesTerm(bytes.Repeat([]byte{0xff}, 20)), leafTerm("calldata", uint64Term(4)))
+	if shifted := binaryOp("shr", uint64Term(160), address); !shifted.IsConst() || !shifted.value.IsZero() {
+		t.Errorf("the high bytes of the address aren't known: %v", shifted)
+	}
+	if sum := binaryOp("add", uint64Term(1), uint64Term(2)); sum.String() != "0x3" {
+		t.Errorf("sum %v", sum)
+	}
+
+	m := newMemory()
+	m.store(uint64Term(0), binaryOp("shl", uint64Term(0xe0), uint64Term(0x12345678)))
+	m.store(uint64Term(4), address)
+	word := m.load(uint64Term(0))
+	if word.known != 0xffff || word.String() != "mload(0x0)" {
+		t.Errorf("word %v known %x", word, word.known)
+	}
+	if sel := binaryOp("shr", uint64Term(0xe0), word); sel.String() != "0x12345678" {
+		t.Errorf("selector from the memory %v", sel)
+	}
+	if loaded := m.load(uint64Term(4)); loaded != address {
+		t.Errorf("loaded %v, expected %v", loaded, address)
+	}
+}
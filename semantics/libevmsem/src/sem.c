@@ -55,6 +55,8 @@ void init() {
     cfg = Z3_mk_config();
     ctx = Z3_mk_context(cfg);
     Z3_del_config(cfg);
+    // Errors are reported by Z3_get_error_code instead of aborting the process
+    Z3_set_error_handler(ctx, NULL);
     int_sort = Z3_mk_int_sort(ctx);
     contract_storage_sort = Z3_mk_array_sort(ctx, int_sort, int_sort);
     contract_code_sort = Z3_mk_array_sort(ctx, int_sort, int_sort);
@@ -141,6 +143,29 @@ void cleanup() {
     }
 }
 
+// Checks whether the assertions of the SMT-LIB2 script are satisfiable, giving up after timeout milliseconds
+int check_sat(char* smtlib2, unsigned timeout) {
+    Z3_ast_vector assertions = Z3_parse_smtlib2_string(ctx, smtlib2, 0, NULL, NULL, 0, NULL, NULL);
+    if (Z3_get_error_code(ctx) != Z3_OK) {
+        return SAT_UNKNOWN;
+    }
+    Z3_ast_vector_inc_ref(ctx, assertions);
+    Z3_solver solver = Z3_mk_solver(ctx);
+    Z3_solver_inc_ref(ctx, solver);
+    Z3_params params = Z3_mk_params(ctx);
+    Z3_params_inc_ref(ctx, params);
+    Z3_params_set_uint(ctx, params, Z3_mk_string_symbol(ctx, "timeout"), timeout);
+    Z3_solver_set_params(ctx, solver, params);
+    for (unsigned i = 0; i < Z3_ast_vector_size(ctx, assertions); i++) {
+        Z3_solver_assert(ctx, solver, Z3_ast_vector_get(ctx, assertions, i));
+    }
+    int result = Z3_solver_check(ctx, solver);
+    Z3_params_dec_ref(ctx, params);
+    Z3_solver_dec_ref(ctx, solver);
+    Z3_ast_vector_dec_ref(ctx, assertions);
+    return result;
+}
+
 void destroy() {
     Z3_del_context(ctx);
 }
\ No newline at end of file
@@ -9,6 +9,11 @@ extern "C" {
 
 #define ERR_TX_DATA_TOO_LONG 1
 
+// Results of check_sat, the same as Z3_lbool
+#define SAT_FALSE -1
+#define SAT_UNKNOWN 0
+#define SAT_TRUE 1
+
 // Create z3 context and necessary sorts and datatypes
 void init();
 // Deletes z3 context and all sorts and datatypes
@@ -22,6 +27,10 @@ int initialise(void* state_root, void *from_address, void *to_address, __uint128
 // Free any memory allocated during initialisation and semantic execution
 void clean();
 
+// Checks whether the assertions of the SMT-LIB2 script are satisfiable, giving up after timeout milliseconds
+// Returns SAT_TRUE, SAT_FALSE, or SAT_UNKNOWN if the solver gave up or the script could not be parsed
+int check_sat(char* smtlib2, unsigned timeout);
+
 # ifdef __cplusplus
 }
 # endif
@@ -0,0 +1,206 @@
+package semantics
+
+import (
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+)
+
+// maxMemory is the highest memory offset tracked by the analysis, the writes above it make the memory unknown
+const maxMemory = 1 << 20
+
+// memByte is a byte of memory, the zero value is a known zero
+type memByte struct {
+	unknown bool
+	b       byte
+	term    *Term // the term the byte was written from, if any
+	idx     uint8 // index of the byte in the big endian representation of the term
+}
+
+func termBytes(t *Term) [32]memByte {
+	var bs [32]memByte
+	value := t.value.Bytes32()
+	for i := 0; i < 32; i++ {
+		bs[i] = memByte{unknown: t.known&(1<<uint(i)) == 0, b: value[i], term: t, idx: uint8(i)}
+	}
+	return bs
+}
+
+// memory of a path of the execution, the bytes which were never written are zeroes unless the memory
+// was written at an unknown offset
+type memory struct {
+	bytes map[uint64]memByte
+	havoc bool
+}
+
+func newMemory() *memory {
+	return &memory{bytes: make(map[uint64]memByte)}
+}
+
+func (m *memory) copy() *memory {
+	c := &memory{bytes: make(map[uint64]memByte, len(m.bytes)), havoc: m.havoc}
+	for k, v := range m.bytes {
+		c.bytes[k] = v
+	}
+	return c
+}
+
+// region returns the offset and the size of the memory region if they are known and not too large
+func region(offset, size *Term) (uint64, uint64, bool) {
+	s, ok := size.Uint64()
+	if !ok || s > maxMemory {
+		return 0, 0, false
+	}
+	if s == 0 {
+		return 0, 0, true
+	}
+	o, ok := offset.Uint64()
+	if !ok || o > maxMemory {
+		return 0, 0, false
+	}
+	return o, s, true
+}
+
+// forget makes the region unknown, the whole memory if the region is unknown
+func (m *memory) forget(offset, size *Term) {
+	o, s, ok := region(offset, size)
+	if !ok {
+		m.havoc = true
+		m.bytes = make(map[uint64]memByte)
+		return
+	}
+	leaf := leafTerm("unknown")
+	for i := uint64(0); i < s; i++ {
+		m.bytes[o+i] = memByte{unknown: true, term: leaf, idx: uint8(i % 32)}
+	}
+}
+
+func (m *memory) get(offset uint64) (memByte, bool) {
+	if b, ok := m.bytes[offset]; ok {
+		return b, true
+	}
+	if m.havoc {
+		return memByte{}, false
+	}
+	return memByte{}, true
+}
+
+func (m *memory) store(offset *Term, value *Term) {
+	o, ok := offset.Uint64()
+	if !ok || o > maxMemory {
+		m.forget(offset, uint64Term(32))
+		return
+	}
+	bs := termBytes(value)
+	for i := uint64(0); i < 32; i++ {
+		m.bytes[o+i] = bs[i]
+	}
+}
+
+func (m *memory) store8(offset *Term, value *Term) {
+	o, ok := offset.Uint64()
+	if !ok || o > maxMemory {
+		m.forget(offset, uint64Term(1))
+		return
+	}
+	m.bytes[o] = termBytes(value)[31]
+}
+
+// copyBytes writes the bytes into the memory region
+func (m *memory) copyBytes(offset, size *Term, bytes func(i uint64) memByte) {
+	o, s, ok := region(offset, size)
+	if !ok {
+		m.forget(offset, size)
+		return
+	}
+	for i := uint64(0); i < s; i++ {
+		m.bytes[o+i] = bytes(i)
+	}
+}
+
+// load reads the word: the term written there if the word is entirely one term, or the word with
+// the known bytes otherwise.
+func (m *memory) load(offset *Term) *Term {
+	o, ok := offset.Uint64()
+	if !ok || o > maxMemory {
+		return leafTerm("mload", offset)
+	}
+	bs := make([]memByte, 32)
+	for i := uint64(0); i < 32; i++ {
+		b, ok := m.get(o + i)
+		if !ok {
+			return leafTerm("mload", offset)
+		}
+		bs[i] = b
+	}
+	return wordTerm(bs, leafTerm("mload", offset))
+}
+
+// wordTerm assembles the word from the bytes, expr is the expression of the word which isn't one term
+func wordTerm(bs []memByte, expr *Term) *Term {
+	if t := bs[0].term; t != nil {
+		same := true
+		for i, b := range bs {
+			if b.term != t || int(b.idx) != i {
+				same = false
+				break
+			}
+		}
+		if same {
+			return t
+		}
+	}
+	var value [32]byte
+	var known uint32
+	for i, b := range bs {
+		if !b.unknown {
+			value[i] = b.b
+			known |= 1 << uint(i)
+		}
+	}
+	var v uint256.Int
+	v.SetBytes(value[:])
+	return withKnown(expr, known, &v)
+}
+
+// keccak hashes the memory region, the hash is an expression over the words of the region if some of
+// its bytes are unknown
+func (m *memory) keccak(offset, size *Term) *Term {
+	o, s, ok := region(offset, size)
+	if !ok {
+		return leafTerm("keccak256", leafTerm("mload", offset), size)
+	}
+	data := make([]byte, s)
+	known := true
+	for i := uint64(0); i < s; i++ {
+		b, ok := m.get(o + i)
+		if !ok || b.unknown {
+			known = false
+			break
+		}
+		data[i] = b.b
+	}
+	if known {
+		return bytesTerm(crypto.Keccak256(data))
+	}
+	args := make([]*Term, 0, (s+31)/32+1)
+	for i := uint64(0); i < s; i += 32 {
+		args = append(args, m.load(uint64Term(o+i)))
+	}
+	if s%32 != 0 {
+		args = append(args, size)
+	}
+	return exprTerm("keccak256", args...)
+}
+
+// slice returns the bytes of the region, the region has to be known
+func (m *memory) slice(o, s uint64) []memByte {
+	bs := make([]memByte, s)
+	for i := uint64(0); i < s; i++ {
+		if b, ok := m.get(o + i); ok {
+			bs[i] = b
+		} else {
+			bs[i] = memByte{unknown: true, term: leafTerm("unknown"), idx: uint8(i % 32)}
+		}
+	}
+	return bs
+}
@@ -39,6 +39,15 @@ func Cleanup() {
 	C.cleanup()
 }
 
+// Satisfiable checks whether the assertions of the SMT-LIB2 script can hold, giving up after the timeout
+// in milliseconds. The scripts the solver gave up on are reported as satisfiable.
+func Satisfiable(smtlib2 string, timeout uint) bool {
+	smtlib2Ptr := C.CString(smtlib2)
+	result := int(C.check_sat(smtlib2Ptr, C.uint(timeout)))
+	C.free(unsafe.Pointer(smtlib2Ptr))
+	return result != C.SAT_FALSE
+}
+
 // Init creates z3 context, sorts and datatypes
 func Init() {
 	C.init()
@@ -0,0 +1,119 @@
+package semantics
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/holiman/uint256"
+)
+
+// condition is a branch taken by a path: the term is non-zero if nonZero is set, and zero otherwise
+type condition struct {
+	term    *Term
+	nonZero bool
+}
+
+// smtOps are the operations of the terms translated into the bit-vector operations, the others are
+// uninterpreted: the terms with the same expression are the same variable
+var smtOps = map[string]string{
+	"add": "bvadd", "mul": "bvmul", "sub": "bvsub", "and": "bvand", "or": "bvor", "xor": "bvxor", "not": "bvnot",
+	"div": "bvudiv", "sdiv": "bvsdiv", "mod": "bvurem", "smod": "bvsrem",
+	"lt": "bvult", "gt": "bvugt", "slt": "bvslt", "sgt": "bvsgt", "eq": "=", "iszero": "=",
+	"shl": "bvshl", "shr": "bvlshr", "sar": "bvashr",
+}
+
+const (
+	smtZero = "(_ bv0 256)"
+	smtOne  = "(_ bv1 256)"
+)
+
+// smtScript builds the SMT-LIB2 script of the conditions over 256-bit vectors
+type smtScript struct {
+	decls   strings.Builder
+	asserts strings.Builder
+	vars    map[string]string // the expressions of the uninterpreted terms
+	anon    map[*Term]string  // the terms without an expression, each of them is a variable
+}
+
+func newSmtScript() *smtScript {
+	return &smtScript{vars: make(map[string]string), anon: make(map[*Term]string)}
+}
+
+func smtConst(v *uint256.Int) string {
+	b := v.Bytes32()
+	return fmt.Sprintf("#x%x", b[:])
+}
+
+// variable declares a new variable for the term, the bytes of it which are known are asserted
+func (s *smtScript) variable(t *Term) string {
+	name := fmt.Sprintf("v%d", len(s.vars)+len(s.anon))
+	fmt.Fprintf(&s.decls, "(declare-const %s (_ BitVec 256))\n", name)
+	if t.known != 0 {
+		var mask uint256.Int
+		for i := 0; i < 32; i++ {
+			if t.known&(1<<uint(i)) != 0 {
+				mask.Or(&mask, new(uint256.Int).Lsh(uint256.NewInt().SetUint64(0xff), uint(8*(31-i))))
+			}
+		}
+		fmt.Fprintf(&s.asserts, "(assert (= (bvand %s %s) %s))\n", name, smtConst(&mask), smtConst(&t.value))
+	}
+	return name
+}
+
+// expr translates the term
+func (s *smtScript) expr(t *Term) string {
+	if t.IsConst() {
+		return smtConst(&t.value)
+	}
+	if t.op == "" || t.op == "unknown" {
+		if name, ok := s.anon[t]; ok {
+			return name
+		}
+		name := s.variable(t)
+		s.anon[t] = name
+		return name
+	}
+	op, ok := smtOps[t.op]
+	if !ok || (len(t.args) != 2 && t.op != "not" && t.op != "iszero") {
+		key := t.String()
+		if name, ok := s.vars[key]; ok {
+			return name
+		}
+		name := s.variable(t)
+		s.vars[key] = name
+		return name
+	}
+	args := make([]string, len(t.args))
+	for i, arg := range t.args {
+		args[i] = s.expr(arg)
+	}
+	switch t.op {
+	case "not":
+		return fmt.Sprintf("(%s %s)", op, args[0])
+	case "iszero":
+		return fmt.Sprintf("(ite (= %s %s) %s %s)", args[0], smtZero, smtOne, smtZero)
+	case "div", "sdiv", "mod", "smod":
+		// The division by zero is zero in the EVM
+		return fmt.Sprintf("(ite (= %s %s) %s (%s %s %s))", args[1], smtZero, smtZero, op, args[0], args[1])
+	case "lt", "gt", "slt", "sgt", "eq":
+		return fmt.Sprintf("(ite (%s %s %s) %s %s)", op, args[0], args[1], smtOne, smtZero)
+	case "shl", "shr", "sar":
+		// The shift is the first argument, the value is the second one
+		return fmt.Sprintf("(%s %s %s)", op, args[1], args[0])
+	}
+	return fmt.Sprintf("(%s %s %s)", op, args[0], args[1])
+}
+
+// assert adds the condition to the script
+func (s *smtScript) assert(c condition) {
+	e := s.expr(c.term)
+	if c.nonZero {
+		fmt.Fprintf(&s.asserts, "(assert (not (= %s %s)))\n", e, smtZero)
+	} else {
+		fmt.Fprintf(&s.asserts, "(assert (= %s %s))\n", e, smtZero)
+	}
+}
+
+func (s *smtScript) String() string {
+	return s.decls.String() + s.asserts.String()
+}
@@ -0,0 +1,293 @@
+package semantics
+
+import (
+	"strings"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/common/hexutil"
+)
+
+const (
+	allKnown     = uint32(0xffffffff)
+	maxTermDepth = 12
+)
+
+// Term is a 256-bit value computed by the analysed code: a constant, or an expression over the inputs
+// of the transaction and the values which aren't known before the execution. Some bytes of the
+// expressions can be known, for example the ones cleared by a mask or shifted in.
+type Term struct {
+	known uint32      // bit i is set if the byte i of the big endian representation is known
+	value uint256.Int // the known bytes, the unknown ones are zero
+	op    string      // operation or the name of the input, empty for the constants
+	args  []*Term
+	depth int
+}
+
+func constTerm(v *uint256.Int) *Term {
+	t := &Term{known: allKnown}
+	t.value.Set(v)
+	return t
+}
+
+func uint64Term(v uint64) *Term {
+	t := &Term{known: allKnown}
+	t.value.SetUint64(v)
+	return t
+}
+
+func bytesTerm(b []byte) *Term {
+	t := &Term{known: allKnown}
+	t.value.SetBytes(b)
+	return t
+}
+
+// leafTerm is an unknown input, like calldata(0x4) or sload(...)
+func leafTerm(name string, args ...*Term) *Term {
+	return exprTerm(name, args...)
+}
+
+func exprTerm(op string, args ...*Term) *Term {
+	t := &Term{op: op, args: args}
+	for _, arg := range args {
+		if arg.depth+1 > t.depth {
+			t.depth = arg.depth + 1
+		}
+	}
+	if t.depth > maxTermDepth {
+		// Too deep to be useful, the bytes known so far are kept by the callers
+		return &Term{op: "unknown"}
+	}
+	return t
+}
+
+// IsConst reports whether the value of the term is known.
+func (t *Term) IsConst() bool {
+	return t.known == allKnown
+}
+
+// Uint64 returns the value of the constant term, and false if it's unknown or doesn't fit into uint64.
+func (t *Term) Uint64() (uint64, bool) {
+	if !t.IsConst() || !t.value.IsUint64() {
+		return 0, false
+	}
+	return t.value.Uint64(), true
+}
+
+// String formats the constants as hex numbers, and the expressions as op(args...). The partially known
+// values without an expression show the unknown bytes as "??".
+func (t *Term) String() string {
+	if t.IsConst() {
+		return hexutil.EncodeBig(t.value.ToBig())
+	}
+	if t.op != "" {
+		args := make([]string, len(t.args))
+		for i, arg := range t.args {
+			args[i] = arg.String()
+		}
+		return t.op + "(" + strings.Join(args, ", ") + ")"
+	}
+	var sb strings.Builder
+	sb.WriteString("0x")
+	b := t.value.Bytes32()
+	for i := 0; i < 32; i++ {
+		if t.known&(1<<uint(i)) == 0 {
+			sb.WriteString("??")
+		} else {
+			sb.WriteString(hexutil.Encode(b[i : i+1])[2:])
+		}
+	}
+	return sb.String()
+}
+
+// withKnown returns the expression carrying the known bytes, or the constant if all of them are known
+func withKnown(t *Term, known uint32, value *uint256.Int) *Term {
+	if known == allKnown {
+		return constTerm(value)
+	}
+	r := *t
+	r.known = known
+	r.value.Set(value)
+	return &r
+}
+
+// shiftRightBytes shifts the term right by n bytes, the bytes shifted in are known zeroes
+func shiftRightBytes(t *Term, n uint, expr *Term) *Term {
+	if n >= 32 {
+		return uint64Term(0)
+	}
+	var v uint256.Int
+	v.Rsh(&t.value, 8*n)
+	known := (t.known << n) | (uint32(1)<<n - 1)
+	return withKnown(expr, known, &v)
+}
+
+// shiftLeftBytes shifts the term left by n bytes, the bytes shifted in are known zeroes
+func shiftLeftBytes(t *Term, n uint, expr *Term) *Term {
+	if n >= 32 {
+		return uint64Term(0)
+	}
+	var v uint256.Int
+	v.Lsh(&t.value, 8*n)
+	known := (t.known >> n) | ^(allKnown >> n)
+	return withKnown(expr, known, &v)
+}
+
+// andTerms computes x & y, the bytes cleared by a constant byte of either of them are known
+func andTerms(x, y, expr *Term) *Term {
+	var v uint256.Int
+	v.And(&x.value, &y.value)
+	bx, by := x.value.Bytes32(), y.value.Bytes32()
+	known := x.known & y.known
+	for i := 0; i < 32; i++ {
+		bit := uint32(1) << uint(i)
+		if (x.known&bit != 0 && bx[i] == 0) || (y.known&bit != 0 && by[i] == 0) {
+			known |= bit
+		}
+	}
+	return withKnown(expr, known, &v)
+}
+
+// powerOf256 returns n if the term is the constant 256^n
+func powerOf256(t *Term) (uint, bool) {
+	if !t.IsConst() || t.value.IsZero() {
+		return 0, false
+	}
+	bits := t.value.BitLen() - 1
+	var p uint256.Int
+	p.Lsh(uint256.NewInt().SetOne(), uint(bits))
+	if !p.Eq(&t.value) || bits%8 != 0 {
+		return 0, false
+	}
+	return uint(bits / 8), true
+}
+
+// unaryOp evaluates the opcode with one argument
+func unaryOp(name string, x *Term) *Term {
+	if !x.IsConst() {
+		return exprTerm(name, x)
+	}
+	var v uint256.Int
+	switch name {
+	case "iszero":
+		if x.value.IsZero() {
+			v.SetOne()
+		}
+	case "not":
+		v.Not(&x.value)
+	}
+	return constTerm(&v)
+}
+
+// binaryOp evaluates the opcode with two arguments, x is the top of the stack
+func binaryOp(name string, x, y *Term) *Term {
+	expr := exprTerm(name, x, y)
+	switch name {
+	case "and":
+		return andTerms(x, y, expr)
+	case "div":
+		if n, ok := powerOf256(y); ok {
+			return shiftRightBytes(x, n, expr)
+		}
+	case "shr":
+		if s, ok := x.Uint64(); ok && s%8 == 0 {
+			return shiftRightBytes(y, uint(s/8), expr)
+		}
+	case "shl":
+		if s, ok := x.Uint64(); ok && s%8 == 0 {
+			return shiftLeftBytes(y, uint(s/8), expr)
+		}
+	case "eq":
+		// The values differing in the known bytes aren't equal
+		bx, by := x.value.Bytes32(), y.value.Bytes32()
+		for i := 0; i < 32; i++ {
+			bit := uint32(1) << uint(i)
+			if x.known&y.known&bit != 0 && bx[i] != by[i] {
+				return uint64Term(0)
+			}
+		}
+	}
+	if !x.IsConst() || !y.IsConst() {
+		return expr
+	}
+	a, b := &x.value, &y.value
+	var v uint256.Int
+	switch name {
+	case "add":
+		v.Add(a, b)
+	case "mul":
+		v.Mul(a, b)
+	case "sub":
+		v.Sub(a, b)
+	case "div":
+		v.Div(a, b)
+	case "sdiv":
+		v.SDiv(a, b)
+	case "mod":
+		v.Mod(a, b)
+	case "smod":
+		v.SMod(a, b)
+	case "exp":
+		v.Exp(a, b)
+	case "signextend":
+		v.ExtendSign(b, a)
+	case "lt":
+		if a.Lt(b) {
+			v.SetOne()
+		}
+	case "gt":
+		if a.Gt(b) {
+			v.SetOne()
+		}
+	case "slt":
+		if a.Slt(b) {
+			v.SetOne()
+		}
+	case "sgt":
+		if a.Sgt(b) {
+			v.SetOne()
+		}
+	case "eq":
+		if a.Eq(b) {
+			v.SetOne()
+		}
+	case "or":
+		v.Or(a, b)
+	case "xor":
+		v.Xor(a, b)
+	case "byte":
+		v.Set(b)
+		v.Byte(a)
+	case "shl":
+		if a.LtUint64(256) {
+			v.Lsh(b, uint(a.Uint64()))
+		}
+	case "shr":
+		if a.LtUint64(256) {
+			v.Rsh(b, uint(a.Uint64()))
+		}
+	case "sar":
+		if a.LtUint64(256) {
+			v.SRsh(b, uint(a.Uint64()))
+		} else if b.Sign() < 0 {
+			v.SetAllOne()
+		}
+	default:
+		return expr
+	}
+	return constTerm(&v)
+}
+
+// ternaryOp evaluates addmod and mulmod
+func ternaryOp(name string, x, y, z *Term) *Term {
+	if !x.IsConst() || !y.IsConst() || !z.IsConst() {
+		return exprTerm(name, x, y, z)
+	}
+	var v uint256.Int
+	switch name {
+	case "addmod":
+		v.AddMod(&x.value, &y.value, &z.value)
+	case "mulmod":
+		v.MulMod(&x.value, &y.value, &z.value)
+	}
+	return constTerm(&v)
+}
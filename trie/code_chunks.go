@@ -0,0 +1,308 @@
+package trie
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+)
+
+// CodeChunkSize is the number of bytecode bytes in a single code chunk
+const CodeChunkSize = 32
+
+const (
+	opPush1  = 0x60
+	opPush32 = 0x7f
+)
+
+// CodeChunk is a fixed-size piece of contract bytecode together with the offset of the first
+// instruction that starts inside it (bytes before that offset are the tail of the PUSH data
+// of the previous chunk)
+type CodeChunk struct {
+	Index                  uint32
+	FirstInstructionOffset uint8
+	Code                   []byte
+}
+
+// Hash returns the leaf hash of the chunk in the code merkle tree
+func (c *CodeChunk) Hash() common.Hash {
+	return crypto.Keccak256Hash([]byte{c.FirstInstructionOffset}, c.Code)
+}
+
+// CodeChunkIndex returns index of the chunk that contains the byte at the given offset
+func CodeChunkIndex(offset uint64) uint32 {
+	return uint32(offset / CodeChunkSize)
+}
+
+// CodeChunksCount returns number of chunks that the code of given size is split into
+func CodeChunksCount(codeSize int) int {
+	return (codeSize + CodeChunkSize - 1) / CodeChunkSize
+}
+
+// ChunkifyCode splits the bytecode into fixed-size chunks, computing the first instruction offset for each of them
+func ChunkifyCode(code []byte) []CodeChunk {
+	chunks := make([]CodeChunk, CodeChunksCount(len(code)))
+	// pushDataEnd is the first position after the PUSH data of the last seen PUSH instruction
+	pushDataEnd := 0
+	for i := range chunks {
+		start := i * CodeChunkSize
+		end := start + CodeChunkSize
+		if end > len(code) {
+			end = len(code)
+		}
+		fio := 0
+		if pushDataEnd > start {
+			fio = pushDataEnd - start
+			if fio > CodeChunkSize {
+				fio = CodeChunkSize
+			}
+		}
+		chunks[i] = CodeChunk{Index: uint32(i), FirstInstructionOffset: uint8(fio), Code: code[start:end]}
+		for pc := start + fio; pc < end; pc++ {
+			if op := code[pc]; op >= opPush1 && op <= opPush32 {
+				pc += int(op - opPush1 + 1)
+				pushDataEnd = pc + 1
+			}
+		}
+	}
+	return chunks
+}
+
+// codeMerkleLayers builds all layers of the binary merkle tree over the chunk hashes.
+// The number of leaves is padded to the power of two with empty hashes.
+// layers[0] are leaves, the last layer contains only the root
+func codeMerkleLayers(chunks []CodeChunk) [][]common.Hash {
+	width := 1
+	for width < len(chunks) {
+		width <<= 1
+	}
+	leaves := make([]common.Hash, width)
+	for i := range chunks {
+		leaves[i] = chunks[i].Hash()
+	}
+	layers := [][]common.Hash{leaves}
+	for layer := leaves; len(layer) > 1; {
+		next := make([]common.Hash, len(layer)/2)
+		for i := range next {
+			next[i] = crypto.Keccak256Hash(layer[2*i][:], layer[2*i+1][:])
+		}
+		layers = append(layers, next)
+		layer = next
+	}
+	return layers
+}
+
+// codeRoot combines the root of the merkle tree over the chunks with the code size, so that the size of the code
+// assembled from the chunks is authenticated too
+func codeRoot(codeSize int, treeRoot common.Hash) common.Hash {
+	var size [8]byte
+	binary.BigEndian.PutUint64(size[:], uint64(codeSize))
+	return crypto.Keccak256Hash(size[:], treeRoot[:])
+}
+
+// CodeMerkleRoot computes the root of the code merkle tree ("code trie") of given bytecode
+func CodeMerkleRoot(code []byte) common.Hash {
+	if len(code) == 0 {
+		return EmptyCodeHash
+	}
+	layers := codeMerkleLayers(ChunkifyCode(code))
+	return codeRoot(len(code), layers[len(layers)-1][0])
+}
+
+// CodeRoots maps the hashes of contract codes to their code merkle roots. The state trie authenticates only the code
+// hashes, so the roots are computed from the full bytecodes, and the chunks of a code are verified against its root
+// registered here, not against the root they come with
+type CodeRoots map[common.Hash]common.Hash
+
+// AddCode registers the code merkle root of the full bytecode
+func (cr CodeRoots) AddCode(code []byte) {
+	if len(code) == 0 {
+		return
+	}
+	cr[crypto.Keccak256Hash(code)] = CodeMerkleRoot(code)
+}
+
+// ProveCodeChunks returns the chunks with given indices and the multiproof for them, which consists of the hashes
+// of the sibling subtrees that cannot be computed from the chunks themselves, ordered bottom-up, left to right.
+// Without chunks, the proof is the root of the merkle tree over the chunks. Indices that are out of range are ignored
+func ProveCodeChunks(code []byte, indices []uint32) (common.Hash, []CodeChunk, []common.Hash) {
+	if len(code) == 0 {
+		return EmptyCodeHash, nil, nil
+	}
+	allChunks := ChunkifyCode(code)
+	layers := codeMerkleLayers(allChunks)
+
+	known := make([]uint32, 0, len(indices))
+	for _, idx := range indices {
+		if int(idx) < len(allChunks) {
+			known = append(known, idx)
+		}
+	}
+	known = sortUniqueIndices(known)
+
+	chunks := make([]CodeChunk, len(known))
+	for i, idx := range known {
+		chunks[i] = allChunks[idx]
+	}
+
+	treeRoot := layers[len(layers)-1][0]
+	root := codeRoot(len(code), treeRoot)
+	if len(known) == 0 {
+		return root, nil, []common.Hash{treeRoot}
+	}
+	var proof []common.Hash
+	for _, layer := range layers[:len(layers)-1] {
+		known = walkCodeMerkleLayer(known, func(sibling uint32) {
+			proof = append(proof, layer[sibling])
+		})
+	}
+	return root, chunks, proof
+}
+
+// VerifyCodeChunks checks that the chunks, together with the multiproof produced by ProveCodeChunks,
+// hash up to the expected code merkle root of the code of given size
+func VerifyCodeChunks(root common.Hash, codeSize int, chunks []CodeChunk, proof []common.Hash) error {
+	if codeSize == 0 {
+		if root != EmptyCodeHash || len(chunks) > 0 {
+			return fmt.Errorf("chunks or non-empty root provided for empty code")
+		}
+		return nil
+	}
+	count := CodeChunksCount(codeSize)
+	width := 1
+	for width < count {
+		width <<= 1
+	}
+
+	hashes := make(map[uint32]common.Hash, len(chunks))
+	known := make([]uint32, 0, len(chunks))
+	for i := range chunks {
+		c := &chunks[i]
+		if int(c.Index) >= count {
+			return fmt.Errorf("chunk index %d out of range, code has %d chunks", c.Index, count)
+		}
+		expectedLen := CodeChunkSize
+		if int(c.Index) == count-1 {
+			expectedLen = codeSize - int(c.Index)*CodeChunkSize
+		}
+		if len(c.Code) != expectedLen {
+			return fmt.Errorf("chunk %d has length %d, expected %d", c.Index, len(c.Code), expectedLen)
+		}
+		if _, ok := hashes[c.Index]; ok {
+			return fmt.Errorf("duplicate chunk %d", c.Index)
+		}
+		hashes[c.Index] = c.Hash()
+		known = append(known, c.Index)
+	}
+	known = sortUniqueIndices(known)
+	if len(known) == 0 {
+		// No chunks, the proof must consist of the tree root only
+		if len(proof) != 1 {
+			return fmt.Errorf("code proof without chunks must contain only the root")
+		}
+		if computed := codeRoot(codeSize, proof[0]); computed != root {
+			return fmt.Errorf("code root mismatch: computed %x, expected %x", computed, root)
+		}
+		return nil
+	}
+
+	pos := 0
+	for ; width > 1; width >>= 1 {
+		var err error
+		next := make(map[uint32]common.Hash, len(known))
+		known = walkCodeMerkleLayer(known, func(sibling uint32) {
+			if pos >= len(proof) {
+				err = fmt.Errorf("code proof is too short")
+				return
+			}
+			hashes[sibling] = proof[pos]
+			pos++
+		})
+		if err != nil {
+			return err
+		}
+		for _, idx := range known {
+			left, right := hashes[2*idx], hashes[2*idx+1]
+			next[idx] = crypto.Keccak256Hash(left[:], right[:])
+		}
+		hashes = next
+	}
+	if pos != len(proof) {
+		return fmt.Errorf("code proof has %d unused hashes", len(proof)-pos)
+	}
+	if computed := codeRoot(codeSize, hashes[0]); computed != root {
+		return fmt.Errorf("code root mismatch: computed %x, expected %x", computed, root)
+	}
+	return nil
+}
+
+// walkCodeMerkleLayer calls onSibling for every sibling of the known nodes (given as sorted indices)
+// which is not known itself, and returns sorted indices of the known nodes on the next layer up
+func walkCodeMerkleLayer(known []uint32, onSibling func(uint32)) []uint32 {
+	var parents []uint32
+	for i := 0; i < len(known); i++ {
+		idx := known[i]
+		if idx&1 == 0 && i+1 < len(known) && known[i+1] == idx+1 {
+			i++ // both children are known
+		} else {
+			onSibling(idx ^ 1)
+		}
+		parents = append(parents, idx/2)
+	}
+	return parents
+}
+
+// PartialCode is a contract bytecode assembled from some of its chunks
+type PartialCode struct {
+	Code    []byte
+	present map[uint32]struct{}
+}
+
+// AssembleCode puts the chunks at their places in the bytecode of given size. The bytes of the missing chunks
+// are zeroes, except when the next chunk starts with PUSH data; in that case the missing chunk ends with the PUSH
+// instruction of the corresponding size, so that the jumpdest analysis of the assembled code is the same as of
+// the original one for all present chunks. The missing chunks must not be executed, see PartialCode.Check
+func AssembleCode(codeSize int, chunks []CodeChunk) *PartialCode {
+	code := make([]byte, codeSize)
+	present := make(map[uint32]struct{}, len(chunks))
+	for _, c := range chunks {
+		copy(code[int(c.Index)*CodeChunkSize:], c.Code)
+		present[c.Index] = struct{}{}
+	}
+	for _, c := range chunks {
+		if c.Index == 0 || c.FirstInstructionOffset == 0 {
+			continue
+		}
+		if _, ok := present[c.Index-1]; ok {
+			continue
+		}
+		code[int(c.Index)*CodeChunkSize-1] = opPush1 + c.FirstInstructionOffset - 1
+	}
+	return &PartialCode{Code: code, present: present}
+}
+
+// Check returns an error if the range of the code is not covered by the present chunks
+func (p *PartialCode) Check(offset, length uint64) error {
+	if length == 0 || offset >= uint64(len(p.Code)) {
+		return nil
+	}
+	for idx := CodeChunkIndex(offset); idx <= CodeChunkIndex(offset+length-1) && int(idx) < CodeChunksCount(len(p.Code)); idx++ {
+		if _, ok := p.present[idx]; !ok {
+			return fmt.Errorf("code chunk %d is missing", idx)
+		}
+	}
+	return nil
+}
+
+func sortUniqueIndices(indices []uint32) []uint32 {
+	sort.Slice(indices, func(i, j int) bool { return indices[i] < indices[j] })
+	unique := indices[:0]
+	for i, idx := range indices {
+		if i == 0 || idx != indices[i-1] {
+			unique = append(unique, idx)
+		}
+	}
+	return unique
+}
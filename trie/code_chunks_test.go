@@ -0,0 +1,202 @@
+package trie
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+)
+
+// testCode builds a bytecode of 5 chunks, where PUSH data crosses the boundaries of chunks 1-2 and 2-3
+func testCode() []byte {
+	code := make([]byte, 4*CodeChunkSize+7)
+	for i := range code {
+		code[i] = 0x5b // JUMPDEST
+	}
+	code[CodeChunkSize+30] = 0x62                           // PUSH3, data goes 2 bytes into chunk 2
+	code[2*CodeChunkSize+31] = opPush32                     // PUSH32, data takes the whole chunk 3
+	code[4*CodeChunkSize] = 0x60                            // PUSH1
+	code[4*CodeChunkSize+1] = 0x5b                          // PUSH data that looks like JUMPDEST
+	code[4*CodeChunkSize+2] = 0x56                          // JUMP
+	code[4*CodeChunkSize+3], code[4*CodeChunkSize+4] = 0, 0 // STOP
+	return code
+}
+
+func TestChunkifyCode(t *testing.T) {
+	chunks := ChunkifyCode(testCode())
+	if len(chunks) != 5 {
+		t.Fatalf("expected 5 chunks, got %d", len(chunks))
+	}
+	expectedFio := []uint8{0, 0, 2, 32, 0}
+	for i, chunk := range chunks {
+		if chunk.Index != uint32(i) {
+			t.Errorf("chunk %d has index %d", i, chunk.Index)
+		}
+		if chunk.FirstInstructionOffset != expectedFio[i] {
+			t.Errorf("chunk %d: expected first instruction offset %d, got %d", i, expectedFio[i], chunk.FirstInstructionOffset)
+		}
+	}
+	if len(chunks[4].Code) != 7 {
+		t.Errorf("expected last chunk of length 7, got %d", len(chunks[4].Code))
+	}
+}
+
+func TestCodeChunksProof(t *testing.T) {
+	code := testCode()
+	root := CodeMerkleRoot(code)
+	for _, indices := range [][]uint32{nil, {0}, {4}, {1, 2}, {0, 3, 4}, {4, 0, 0, 2}, {0, 1, 2, 3, 4}, {100}} {
+		proofRoot, chunks, proof := ProveCodeChunks(code, indices)
+		if proofRoot != root {
+			t.Fatalf("%v: root mismatch %x != %x", indices, proofRoot, root)
+		}
+		if err := VerifyCodeChunks(root, len(code), chunks, proof); err != nil {
+			t.Errorf("%v: valid proof rejected: %v", indices, err)
+		}
+		if err := VerifyCodeChunks(common.HexToHash("0x01"), len(code), chunks, proof); err == nil {
+			t.Errorf("%v: proof accepted against wrong root", indices)
+		}
+		if err := VerifyCodeChunks(root, len(code)+1, chunks, proof); err == nil {
+			t.Errorf("%v: proof accepted for wrong code size", indices)
+		}
+		if len(chunks) > 0 {
+			tampered := make([]CodeChunk, len(chunks))
+			copy(tampered, chunks)
+			tampered[0].Code = common.CopyBytes(tampered[0].Code)
+			tampered[0].Code[0] ^= 0xff
+			if err := VerifyCodeChunks(root, len(code), tampered, proof); err == nil {
+				t.Errorf("%v: tampered chunk accepted", indices)
+			}
+		}
+	}
+}
+
+func TestAssembleCode(t *testing.T) {
+	code := testCode()
+	_, chunks, _ := ProveCodeChunks(code, []uint32{2, 4})
+	partial := AssembleCode(len(code), chunks)
+	assembled := partial.Code
+	if len(assembled) != len(code) {
+		t.Fatalf("expected length %d, got %d", len(code), len(assembled))
+	}
+	for _, c := range chunks {
+		start := int(c.Index) * CodeChunkSize
+		if !bytes.Equal(assembled[start:start+len(c.Code)], code[start:start+len(c.Code)]) {
+			t.Errorf("chunk %d is not in place", c.Index)
+		}
+	}
+	// Chunk 1 is missing, and chunk 2 starts with 2 bytes of PUSH data
+	if assembled[2*CodeChunkSize-1] != 0x61 {
+		t.Errorf("expected PUSH2 before chunk 2, got %x", assembled[2*CodeChunkSize-1])
+	}
+	// Chunk 3 is missing, and chunk 4 starts with an instruction
+	if assembled[4*CodeChunkSize-1] != 0 {
+		t.Errorf("expected STOP before chunk 4, got %x", assembled[4*CodeChunkSize-1])
+	}
+	// Only the accesses to the present chunks are allowed
+	if err := partial.Check(2*CodeChunkSize, CodeChunkSize); err != nil {
+		t.Errorf("access to chunk 2 rejected: %v", err)
+	}
+	if err := partial.Check(4*CodeChunkSize+5, 100); err != nil {
+		t.Errorf("access to the end of chunk 4 rejected: %v", err)
+	}
+	if err := partial.Check(2*CodeChunkSize-1, 2); err == nil {
+		t.Errorf("access to missing chunk 1 accepted")
+	}
+	if err := partial.Check(3*CodeChunkSize, 1); err == nil {
+		t.Errorf("access to missing chunk 3 accepted")
+	}
+	// The chunks fully assembled give the original code
+	_, allChunks, _ := ProveCodeChunks(code, []uint32{0, 1, 2, 3, 4})
+	if !bytes.Equal(AssembleCode(len(code), allChunks).Code, code) {
+		t.Errorf("code assembled from all chunks does not match the original")
+	}
+}
+
+func TestCodeChunksWitnessSerialization(t *testing.T) {
+	code := testCode()
+	op := &OperatorCodeChunks{CodeHash: common.HexToHash("0xc0de"), CodeSize: uint64(len(code))}
+	op.CodeRoot, op.Chunks, op.Proof = ProveCodeChunks(code, []uint32{1, 3})
+	witness := NewWitness([]WitnessOperator{op, &OperatorEmptyRoot{}})
+
+	var buffer bytes.Buffer
+	if _, err := witness.WriteTo(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := NewWitnessFromReader(&buffer, false /* trace */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !witnessesEqual(witness, decoded) {
+		t.Fatalf("witnesses not equal: expected %+v; got %+v", witness, decoded)
+	}
+	decodedOp := decoded.Operators[0].(*OperatorCodeChunks)
+	if err := decodedOp.Verify(CodeRoots{op.CodeHash: CodeMerkleRoot(code)}); err != nil {
+		t.Errorf("decoded chunks failed verification: %v", err)
+	}
+}
+
+func TestCodeChunksVerifiedAgainstKnownRoot(t *testing.T) {
+	code := testCode()
+	codeHash := crypto.Keccak256Hash(code)
+	codeRoots := make(CodeRoots)
+	op := &OperatorCodeChunks{CodeHash: codeHash, CodeSize: uint64(len(code))}
+	op.CodeRoot, op.Chunks, op.Proof = ProveCodeChunks(code, []uint32{1, 3})
+	if err := op.Verify(codeRoots); err == nil {
+		t.Errorf("chunks accepted without the known code root")
+	}
+	codeRoots.AddCode(code)
+	if err := op.Verify(codeRoots); err != nil {
+		t.Errorf("valid chunks rejected: %v", err)
+	}
+	// The chunks of another code, with the root matching them, claimed under the same code hash
+	forged := common.CopyBytes(code)
+	forged[CodeChunkSize] ^= 0xff
+	forgedOp := &OperatorCodeChunks{CodeHash: codeHash, CodeSize: uint64(len(forged))}
+	forgedOp.CodeRoot, forgedOp.Chunks, forgedOp.Proof = ProveCodeChunks(forged, []uint32{1, 3})
+	if err := VerifyCodeChunks(forgedOp.CodeRoot, len(forged), forgedOp.Chunks, forgedOp.Proof); err != nil {
+		t.Fatalf("forged chunks do not match their own root: %v", err)
+	}
+	if err := forgedOp.Verify(codeRoots); err == nil {
+		t.Errorf("forged chunks accepted")
+	}
+}
+
+func TestWitnessWithCodeChunks(t *testing.T) {
+	code := testCode()
+	codeHash := crypto.Keccak256Hash(code)
+	rl := NewRetainList(0)
+	rl.AddCodeTouch(codeHash)
+	rl.EnableCodeChunks(make(map[common.Hash]struct{}))
+	rl.AddCodeChunkTouch(codeHash, 2)
+
+	acc := &accountNode{code: code}
+	acc.CodeHash = codeHash
+	acc.Root = EmptyRoot
+	// The code goes into the first witness in full
+	full := NewWitnessBuilder(nil, false)
+	if _, err := full.processAccountCode(acc, rl); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := full.operands[0].(*OperatorCode); !ok {
+		t.Fatalf("expected OperatorCode for the code seen first time, got %T", full.operands[0])
+	}
+
+	b := NewWitnessBuilder(nil, false)
+	if _, err := b.processAccountCode(acc, rl); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.operands) != 1 {
+		t.Fatalf("expected 1 operand, got %d", len(b.operands))
+	}
+	op, ok := b.operands[0].(*OperatorCodeChunks)
+	if !ok {
+		t.Fatalf("expected OperatorCodeChunks, got %T", b.operands[0])
+	}
+	if len(op.Chunks) != 1 || op.Chunks[0].Index != 2 {
+		t.Errorf("expected only chunk 2, got %+v", op.Chunks)
+	}
+	if op.CodeRoot != CodeMerkleRoot(code) {
+		t.Errorf("unexpected code root %x", op.CodeRoot)
+	}
+}
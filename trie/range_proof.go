@@ -0,0 +1,446 @@
+package trie
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/rlp"
+)
+
+// ProveRange constructs a proof for the range of leaves between firstKey and lastKey (both inclusive).
+// The proof consists of the merkle proofs of both boundary keys, nodes shared by the two paths are included once.
+// Together with all the leaves of the range it can be checked against the root by VerifyRangeProof.
+// The boundary keys do not need to be present in the trie. fromLevel and storage have the same meaning as for Prove
+func (t *Trie) ProveRange(firstKey, lastKey []byte, fromLevel int, storage bool) ([][]byte, error) {
+	proof, err := t.Prove(firstKey, fromLevel, storage)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(firstKey, lastKey) {
+		return proof, nil
+	}
+	lastProof, err := t.Prove(lastKey, fromLevel, storage)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]struct{}, len(proof))
+	for _, enc := range proof {
+		seen[string(enc)] = struct{}{}
+	}
+	for _, enc := range lastProof {
+		if _, ok := seen[string(enc)]; !ok {
+			proof = append(proof, enc)
+		}
+	}
+	return proof, nil
+}
+
+// VerifyRangeProof checks that the keys and values are all the leaves of the trie with given root
+// that lie between firstKey and lastKey (both inclusive, neither needs to be present in the trie).
+// Keys must be sorted in ascending order, values are the RLP-encoded leaf values as they appear in the trie nodes
+// (RLP of the storage values, or account RLP encoding for hashing). The proof is the one produced by ProveRange
+// for firstKey and lastKey. If the proof is empty, the keys and values are expected to be the whole content of the trie.
+// Returns true if there are more leaves in the trie to the right of lastKey
+func VerifyRangeProof(rootHash common.Hash, firstKey, lastKey []byte, keys [][]byte, values [][]byte, proof [][]byte) (bool, error) {
+	if len(keys) != len(values) {
+		return false, fmt.Errorf("inconsistent range proof data, keys: %d, values: %d", len(keys), len(values))
+	}
+	if len(firstKey) != len(lastKey) || bytes.Compare(firstKey, lastKey) > 0 {
+		return false, fmt.Errorf("invalid range boundaries %x - %x", firstKey, lastKey)
+	}
+	for i := range keys {
+		if i > 0 && bytes.Compare(keys[i-1], keys[i]) >= 0 {
+			return false, fmt.Errorf("range keys are not sorted: %x after %x", keys[i], keys[i-1])
+		}
+		if len(keys[i]) != len(firstKey) {
+			return false, fmt.Errorf("key %x has different length than the range boundaries", keys[i])
+		}
+		if len(values[i]) == 0 {
+			return false, fmt.Errorf("empty value for key %x", keys[i])
+		}
+	}
+	if len(keys) > 0 && (bytes.Compare(firstKey, keys[0]) > 0 || bytes.Compare(keys[len(keys)-1], lastKey) > 0) {
+		return false, fmt.Errorf("leaves %x - %x are outside of the range %x - %x", keys[0], keys[len(keys)-1], firstKey, lastKey)
+	}
+	// No proof, the range must be the whole trie
+	if len(proof) == 0 {
+		tr := NewTestRLPTrie(common.Hash{})
+		for i, key := range keys {
+			tr.Update(key, values[i])
+		}
+		if h := tr.Hash(); h != rootHash {
+			return false, fmt.Errorf("invalid range, expected root %x, got %x", rootHash, h)
+		}
+		return false, nil
+	}
+	nodes := make(rangeProofNodes, len(proof))
+	for _, enc := range proof {
+		nodes[crypto.Keccak256Hash(enc)] = enc
+	}
+	var root node = hashNode{hash: common.CopyBytes(rootHash[:])}
+	// Range of a single key, only one path is proven
+	if bytes.Equal(firstKey, lastKey) {
+		root, val, err := nodes.resolvePath(root, firstKey)
+		if err != nil {
+			return false, err
+		}
+		if len(keys) == 0 && val != nil {
+			return false, fmt.Errorf("leaf %x is missing from the range", firstKey)
+		}
+		if len(keys) == 1 && !bytes.Equal(val, values[0]) {
+			return false, fmt.Errorf("value of the leaf %x does not match the proof", firstKey)
+		}
+		return hasRightElement(root, lastKey), nil
+	}
+	// Resolve both boundary paths, so that the part of the trie outside of the range is only present as hashes
+	root, _, err := nodes.resolvePath(root, firstKey)
+	if err != nil {
+		return false, err
+	}
+	if root, _, err = nodes.resolvePath(root, lastKey); err != nil {
+		return false, err
+	}
+	// Remove everything inside of the range, it gets reconstructed from the leaves
+	empty, err := unsetRangeInternal(root, firstKey, lastKey)
+	if err != nil {
+		return false, err
+	}
+	tr := NewTestRLPTrie(common.Hash{})
+	if !empty {
+		tr.root = root
+	}
+	for i, key := range keys {
+		if reachesHashNode(tr.root, keybytesToHex(key)) {
+			return false, fmt.Errorf("leaf %x is outside of the proven range", key)
+		}
+		tr.Update(key, values[i])
+	}
+	if h := tr.Hash(); h != rootHash {
+		return false, fmt.Errorf("invalid range proof, expected root %x, got %x", rootHash, h)
+	}
+	return hasRightElement(tr.root, lastKey), nil
+}
+
+// rangeProofNodes maps hashes of the proof nodes to their RLP encodings
+type rangeProofNodes map[common.Hash][]byte
+
+func (rp rangeProofNodes) resolve(h hashNode) (node, error) {
+	enc, ok := rp[common.BytesToHash(h.hash)]
+	if !ok {
+		return nil, fmt.Errorf("proof node %x is missing", h.hash)
+	}
+	return decodeProofNode(enc)
+}
+
+// resolvePath replaces hash nodes on the path to the key with the decoded proof nodes.
+// Returns the (possibly replaced) root and the value at the key, if the key is present in the trie
+func (rp rangeProofNodes) resolvePath(root node, key []byte) (node, valueNode, error) {
+	if h, ok := root.(hashNode); ok {
+		resolved, err := rp.resolve(h)
+		if err != nil {
+			return nil, nil, err
+		}
+		root = resolved
+	}
+	hex := keybytesToHex(key)
+	pos := 0
+	nd := root
+	for {
+		switch n := nd.(type) {
+		case nil:
+			return root, nil, nil
+		case *shortNode:
+			if len(hex)-pos < len(n.Key) || !bytes.Equal(n.Key, hex[pos:pos+len(n.Key)]) {
+				// The key is not present
+				return root, nil, nil
+			}
+			pos += len(n.Key)
+			if h, ok := n.Val.(hashNode); ok {
+				resolved, err := rp.resolve(h)
+				if err != nil {
+					return nil, nil, err
+				}
+				n.Val = resolved
+			}
+			nd = n.Val
+		case *fullNode:
+			if pos >= len(hex) {
+				return nil, nil, fmt.Errorf("invalid proof, branch node at the end of the key %x", key)
+			}
+			child := n.Children[hex[pos]]
+			if h, ok := child.(hashNode); ok {
+				resolved, err := rp.resolve(h)
+				if err != nil {
+					return nil, nil, err
+				}
+				n.Children[hex[pos]] = resolved
+				child = resolved
+			}
+			pos++
+			nd = child
+		case valueNode:
+			if pos != len(hex) {
+				return nil, nil, fmt.Errorf("invalid proof, value node before the end of the key %x", key)
+			}
+			return root, n, nil
+		default:
+			return nil, nil, fmt.Errorf("unexpected node type in proof: %T", nd)
+		}
+	}
+}
+
+// decodeProofNode decodes RLP of a branch, extension or leaf node. Branch nodes are always decoded as full nodes
+func decodeProofNode(enc []byte) (node, error) {
+	elems, _, err := rlp.SplitList(enc)
+	if err != nil {
+		return nil, fmt.Errorf("decoding proof node: %v", err)
+	}
+	count, err := rlp.CountValues(elems)
+	if err != nil {
+		return nil, fmt.Errorf("decoding proof node: %v", err)
+	}
+	switch count {
+	case 2:
+		compactKey, rest, err := rlp.SplitString(elems)
+		if err != nil {
+			return nil, fmt.Errorf("decoding key of short node: %v", err)
+		}
+		key := compactToHex(compactKey)
+		if hasTerm(key) {
+			val, _, err := rlp.SplitString(rest)
+			if err != nil {
+				return nil, fmt.Errorf("decoding value of leaf node: %v", err)
+			}
+			return NewShortNode(key, valueNode(common.CopyBytes(val))), nil
+		}
+		child, _, err := decodeProofRef(rest)
+		if err != nil {
+			return nil, err
+		}
+		return NewShortNode(key, child), nil
+	case 17:
+		n := &fullNode{}
+		for i := 0; i < 16; i++ {
+			var child node
+			if child, elems, err = decodeProofRef(elems); err != nil {
+				return nil, err
+			}
+			n.Children[i] = child
+		}
+		return n, nil
+	default:
+		return nil, fmt.Errorf("invalid number of list elements in proof node: %d", count)
+	}
+}
+
+func decodeProofRef(buf []byte) (node, []byte, error) {
+	kind, val, rest, err := rlp.Split(buf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decoding child reference: %v", err)
+	}
+	switch {
+	case kind == rlp.List:
+		// Embedded node
+		n, err := decodeProofNode(buf[:len(buf)-len(rest)])
+		return n, rest, err
+	case kind == rlp.String && len(val) == 0:
+		return nil, rest, nil
+	case kind == rlp.String && len(val) == common.HashLength:
+		return hashNode{hash: common.CopyBytes(val)}, rest, nil
+	default:
+		return nil, nil, fmt.Errorf("invalid child reference of size %d", len(val))
+	}
+}
+
+// unsetRangeInternal removes all the nodes between the paths of the left and right keys, as well as
+// the leaves at these keys. The paths need to be resolved. Returns true if the whole trie needs to be removed
+func unsetRangeInternal(n node, left []byte, right []byte) (bool, error) {
+	left, right = keybytesToHex(left), keybytesToHex(right)
+	// Step down to the point where the paths fork. It is either a short node which does not match
+	// at least one of the keys, or a branch node where the paths take different children
+	var (
+		pos    = 0
+		parent node
+		// -1 if the key is less than the key of the short node, 1 if greater, 0 if it matches
+		shortForkLeft, shortForkRight int
+	)
+findFork:
+	for {
+		switch rn := n.(type) {
+		case *shortNode:
+			shortForkLeft = compareShortKey(left[pos:], rn.Key)
+			shortForkRight = compareShortKey(right[pos:], rn.Key)
+			if shortForkLeft != 0 || shortForkRight != 0 {
+				break findFork
+			}
+			parent = n
+			n, pos = rn.Val, pos+len(rn.Key)
+		case *fullNode:
+			if left[pos] != right[pos] || rn.Children[left[pos]] == nil {
+				break findFork
+			}
+			parent = n
+			n, pos = rn.Children[left[pos]], pos+1
+		default:
+			return false, fmt.Errorf("invalid range proof, unexpected %T on the common path", n)
+		}
+	}
+	switch rn := n.(type) {
+	case *shortNode:
+		if shortForkLeft == -1 && shortForkRight == -1 || shortForkLeft == 1 && shortForkRight == 1 {
+			// The node is outside of the range, nothing to remove
+			return false, nil
+		}
+		// Whole short node is inside of the range
+		removeWhole := shortForkLeft != 0 && shortForkRight != 0
+		if !removeWhole {
+			if _, ok := rn.Val.(valueNode); ok {
+				removeWhole = true
+			}
+		}
+		if removeWhole {
+			if parent == nil {
+				return true, nil
+			}
+			fn, ok := parent.(*fullNode)
+			if !ok {
+				return false, errors.New("invalid range proof, short node is not a child of a branch node")
+			}
+			fn.Children[left[pos-1]] = nil
+			return false, nil
+		}
+		if shortForkRight != 0 {
+			// Right key is greater, only the left path goes through the node
+			return false, unsetRangeEdge(rn, rn.Val, left, pos+len(rn.Key), false)
+		}
+		return false, unsetRangeEdge(rn, rn.Val, right, pos+len(rn.Key), true)
+	case *fullNode:
+		for i := left[pos] + 1; i < right[pos]; i++ {
+			rn.Children[i] = nil
+		}
+		if err := unsetRangeEdge(rn, rn.Children[left[pos]], left, pos+1, false); err != nil {
+			return false, err
+		}
+		return false, unsetRangeEdge(rn, rn.Children[right[pos]], right, pos+1, true)
+	default:
+		return false, fmt.Errorf("invalid range proof, unexpected %T at the fork point", n)
+	}
+}
+
+// unsetRangeEdge removes the nodes on one side of the path of the key (left side if removeLeft is true,
+// right side otherwise), as well as the leaf at the key itself
+func unsetRangeEdge(parent node, child node, key []byte, pos int, removeLeft bool) error {
+	switch cld := child.(type) {
+	case *fullNode:
+		if removeLeft {
+			for i := 0; i < int(key[pos]); i++ {
+				cld.Children[i] = nil
+			}
+		} else {
+			for i := key[pos] + 1; i < 16; i++ {
+				cld.Children[i] = nil
+			}
+		}
+		return unsetRangeEdge(cld, cld.Children[key[pos]], key, pos+1, removeLeft)
+	case *shortNode:
+		fn, ok := parent.(*fullNode)
+		if !ok {
+			return errors.New("invalid range proof, short node is not a child of a branch node")
+		}
+		if cmp := compareShortKey(key[pos:], cld.Key); cmp != 0 {
+			// The path does not go through the node, it is removed if it lies inside of the range
+			if removeLeft && cmp > 0 || !removeLeft && cmp < 0 {
+				fn.Children[key[pos-1]] = nil
+			}
+			return nil
+		}
+		if _, ok := cld.Val.(valueNode); ok {
+			fn.Children[key[pos-1]] = nil
+			return nil
+		}
+		return unsetRangeEdge(cld, cld.Val, key, pos+len(cld.Key), removeLeft)
+	case nil:
+		// Non-existent branch
+		return nil
+	default:
+		return fmt.Errorf("invalid range proof, unexpected %T on the edge path", child)
+	}
+}
+
+// compareShortKey compares the remainder of the key with the key of a short node (only up to the length of the latter)
+func compareShortKey(key []byte, nodeKey []byte) int {
+	if len(key) < len(nodeKey) {
+		return bytes.Compare(key, nodeKey)
+	}
+	return bytes.Compare(key[:len(nodeKey)], nodeKey)
+}
+
+// hasRightElement returns true if the resolved trie contains any leaves to the right of the key
+func hasRightElement(nd node, key []byte) bool {
+	hex := keybytesToHex(key)
+	pos := 0
+	for nd != nil && pos < len(hex) {
+		switch n := nd.(type) {
+		case *fullNode:
+			for i := hex[pos] + 1; i < 16; i++ {
+				if n.Children[i] != nil {
+					return true
+				}
+			}
+			nd, pos = n.Children[hex[pos]], pos+1
+		case *duoNode:
+			_, i2 := n.childrenIdx()
+			switch {
+			case hex[pos] < i2:
+				return true
+			case hex[pos] == i2:
+				nd, pos = n.child2, pos+1
+			default:
+				return false
+			}
+		case *shortNode:
+			if cmp := compareShortKey(hex[pos:], n.Key); cmp != 0 {
+				return cmp < 0
+			}
+			nd, pos = n.Val, pos+len(n.Key)
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// reachesHashNode returns true if the path to the key in the trie goes through a hash node
+func reachesHashNode(nd node, hex []byte) bool {
+	pos := 0
+	for pos < len(hex) {
+		switch n := nd.(type) {
+		case hashNode:
+			return true
+		case *fullNode:
+			nd, pos = n.Children[hex[pos]], pos+1
+		case *duoNode:
+			i1, i2 := n.childrenIdx()
+			switch hex[pos] {
+			case i1:
+				nd = n.child1
+			case i2:
+				nd = n.child2
+			default:
+				return false
+			}
+			pos++
+		case *shortNode:
+			if compareShortKey(hex[pos:], n.Key) != 0 {
+				return false
+			}
+			nd, pos = n.Val, pos+len(n.Key)
+		default:
+			return false
+		}
+	}
+	return false
+}
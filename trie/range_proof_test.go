@@ -0,0 +1,165 @@
+package trie
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/rlp"
+)
+
+func genRangeProofTestTrie(t *testing.T, n int) (*Trie, [][]byte, [][]byte) {
+	tr := New(common.Hash{})
+	var keys [][]byte
+	for i := 0; i < n; i++ {
+		key := crypto.Keccak256([]byte(fmt.Sprintf("key%d", i)))
+		keys = append(keys, key)
+		tr.Update(key, []byte(fmt.Sprintf("value%d", i)))
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		v, _ := tr.Get(key)
+		enc, err := rlp.EncodeToBytes(v)
+		require.NoError(t, err)
+		values[i] = enc
+	}
+	return tr, keys, values
+}
+
+func TestRangeProof(t *testing.T) {
+	tr, keys, values := genRangeProofTestTrie(t, 500)
+	root := tr.Hash()
+	for _, r := range [][2]int{{0, 0}, {0, 1}, {0, 100}, {10, 20}, {250, 251}, {100, 499}, {0, 499}, {499, 499}} {
+		first, last := r[0], r[1]
+		proof, err := tr.ProveRange(keys[first], keys[last], 0, false)
+		require.NoError(t, err)
+		more, err := VerifyRangeProof(root, keys[first], keys[last], keys[first:last+1], values[first:last+1], proof)
+		require.NoError(t, err, "range %d-%d", first, last)
+		assert.Equal(t, last < len(keys)-1, more, "range %d-%d", first, last)
+	}
+}
+
+func TestRangeProofNonExistentBoundaries(t *testing.T) {
+	tr, keys, values := genRangeProofTestTrie(t, 500)
+	root := tr.Hash()
+	firstKey := common.CopyBytes(keys[100])
+	firstKey[len(firstKey)-1]--
+	proof, err := tr.ProveRange(firstKey, keys[200], 0, false)
+	require.NoError(t, err)
+	more, err := VerifyRangeProof(root, firstKey, keys[200], keys[100:201], values[100:201], proof)
+	require.NoError(t, err)
+	assert.True(t, more)
+
+	// Leading leaf is not in the range
+	_, err = VerifyRangeProof(root, firstKey, keys[200], keys[101:201], values[101:201], proof)
+	assert.Error(t, err)
+
+	// Empty range after the last key
+	maxKey := bytes.Repeat([]byte{0xff}, common.HashLength)
+	lastKey := common.CopyBytes(keys[len(keys)-1])
+	lastKey[len(lastKey)-1]++
+	proof, err = tr.ProveRange(lastKey, maxKey, 0, false)
+	require.NoError(t, err)
+	more, err = VerifyRangeProof(root, lastKey, maxKey, nil, nil, proof)
+	require.NoError(t, err)
+	assert.False(t, more)
+
+	// Range which is not terminated by a leaf
+	proof, err = tr.ProveRange(keys[400], maxKey, 0, false)
+	require.NoError(t, err)
+	_, err = VerifyRangeProof(root, keys[400], maxKey, keys[400:], values[400:], proof)
+	require.NoError(t, err)
+	_, err = VerifyRangeProof(root, keys[400], maxKey, keys[400:499], values[400:499], proof)
+	assert.Error(t, err)
+
+	// Empty range is not accepted if there are leaves in it
+	proof, err = tr.ProveRange(firstKey, keys[100], 0, false)
+	require.NoError(t, err)
+	_, err = VerifyRangeProof(root, firstKey, keys[100], nil, nil, proof)
+	assert.Error(t, err)
+	proof, err = tr.ProveRange(keys[100], keys[100], 0, false)
+	require.NoError(t, err)
+	_, err = VerifyRangeProof(root, keys[100], keys[100], nil, nil, proof)
+	assert.Error(t, err)
+}
+
+func TestRangeProofBadRange(t *testing.T) {
+	tr, keys, values := genRangeProofTestTrie(t, 500)
+	root := tr.Hash()
+	first, last := 50, 150
+	proof, err := tr.ProveRange(keys[first], keys[last], 0, false)
+	require.NoError(t, err)
+	rangeKeys, rangeValues := keys[first:last+1], values[first:last+1]
+
+	// Missing leaf in the middle
+	gapKeys := append(append([][]byte{}, rangeKeys[:50]...), rangeKeys[51:]...)
+	gapValues := append(append([][]byte{}, rangeValues[:50]...), rangeValues[51:]...)
+	_, err = VerifyRangeProof(root, keys[first], keys[last], gapKeys, gapValues, proof)
+	assert.Error(t, err)
+
+	// Modified value
+	badValues := append([][]byte{}, rangeValues...)
+	badValues[30] = []byte{0x01}
+	_, err = VerifyRangeProof(root, keys[first], keys[last], rangeKeys, badValues, proof)
+	assert.Error(t, err)
+
+	// Last leaf removed
+	_, err = VerifyRangeProof(root, keys[first], keys[last], rangeKeys[:len(rangeKeys)-1], rangeValues[:len(rangeValues)-1], proof)
+	assert.Error(t, err)
+
+	// Missing proof node
+	_, err = VerifyRangeProof(root, keys[first], keys[last], rangeKeys, rangeValues, proof[1:])
+	assert.Error(t, err)
+
+	// Unsorted keys
+	swapped := append([][]byte{}, rangeKeys...)
+	swapped[1], swapped[2] = swapped[2], swapped[1]
+	_, err = VerifyRangeProof(root, keys[first], keys[last], swapped, rangeValues, proof)
+	assert.Error(t, err)
+}
+
+func TestRangeProofWholeTrie(t *testing.T) {
+	tr, keys, values := genRangeProofTestTrie(t, 100)
+	more, err := VerifyRangeProof(tr.Hash(), keys[0], keys[len(keys)-1], keys, values, nil)
+	require.NoError(t, err)
+	assert.False(t, more)
+	_, err = VerifyRangeProof(tr.Hash(), keys[0], keys[len(keys)-1], keys[1:], values[1:], nil)
+	assert.Error(t, err)
+}
+
+func TestRangeProofAccounts(t *testing.T) {
+	tr := New(common.Hash{})
+	var keys [][]byte
+	accs := make(map[string]*accounts.Account)
+	for i := 0; i < 200; i++ {
+		addrHash := crypto.Keccak256([]byte(fmt.Sprintf("account%d", i)))
+		acc := accounts.NewAccount()
+		acc.Nonce = uint64(i)
+		acc.Balance = *uint256.NewInt().SetUint64(uint64(i * 1000))
+		tr.UpdateAccount(addrHash, &acc)
+		keys = append(keys, addrHash)
+		accs[string(addrHash)] = &acc
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		acc := accs[string(key)]
+		values[i] = make([]byte, acc.EncodingLengthForHashing())
+		acc.EncodeForHashing(values[i])
+	}
+	root := tr.Hash()
+	proof, err := tr.ProveRange(keys[20], keys[80], 0, false)
+	require.NoError(t, err)
+	more, err := VerifyRangeProof(root, keys[20], keys[80], keys[20:81], values[20:81], proof)
+	require.NoError(t, err)
+	assert.True(t, more)
+}
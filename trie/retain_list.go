@@ -29,6 +29,14 @@ type RetainDecider interface {
 	IsCodeTouched(common.Hash) bool
 }
 
+// CodeChunkDecider is implemented by retain deciders which allow to put only the touched chunks of
+// contract code into the witness, instead of the full bytecode
+type CodeChunkDecider interface {
+	// CodeChunksTouched returns indices of the touched chunks of the code, and false if the code should not be chunked.
+	// It is called for every code which goes into the witness
+	CodeChunksTouched(common.Hash) ([]uint32, bool)
+}
+
 // RetainList encapsulates the list of keys that are required to be fully available, or loaded
 // (by using `BRANCH` opcode instead of `HASHER`) after processing of the sequence of key-value
 // pairs
@@ -40,6 +48,10 @@ type RetainList struct {
 	lteIndex    int  // Index of the "LTE" key in the keys slice. Next one is "GT"
 	hexes       sortable
 	codeTouches map[common.Hash]struct{}
+
+	chunkCode        bool // if true, only touched chunks of the contract codes are retained
+	codeChunkTouches map[common.Hash][]uint32
+	knownCodes       map[common.Hash]struct{} // Contract codes put into the earlier witnesses in full
 }
 
 // NewRetainList creates new RetainList
@@ -80,6 +92,33 @@ func (rl *RetainList) IsCodeTouched(codeHash common.Hash) bool {
 	return ok
 }
 
+// EnableCodeChunks switches the list to retaining only touched chunks of contract codes. The codes which are not
+// in knownCodes yet go into the witness in full, and are added there, because the reader of the witness can verify
+// the chunks only against the code merkle root computed from the full code
+func (rl *RetainList) EnableCodeChunks(knownCodes map[common.Hash]struct{}) {
+	rl.chunkCode = true
+	rl.knownCodes = knownCodes
+	if rl.codeChunkTouches == nil {
+		rl.codeChunkTouches = make(map[common.Hash][]uint32)
+	}
+}
+
+// AddCodeChunkTouch adds a touch of the code chunk with given index into the resolve set
+func (rl *RetainList) AddCodeChunkTouch(codeHash common.Hash, index uint32) {
+	rl.codeChunkTouches[codeHash] = append(rl.codeChunkTouches[codeHash], index)
+}
+
+func (rl *RetainList) CodeChunksTouched(codeHash common.Hash) ([]uint32, bool) {
+	if !rl.chunkCode {
+		return nil, false
+	}
+	if _, ok := rl.knownCodes[codeHash]; !ok {
+		rl.knownCodes[codeHash] = struct{}{}
+		return nil, false
+	}
+	return rl.codeChunkTouches[codeHash], true
+}
+
 func (rl *RetainList) ensureInited() {
 	if rl.inited {
 		return
@@ -10,6 +10,10 @@ type RetainListBuilder struct {
 	storageTouches [][]byte                 // Read/change set of storage keys (account hashes concatenated with storage key hashes)
 	proofCodes     map[common.Hash]struct{} // Contract codes that have been accessed (codeHash)
 	createdCodes   map[common.Hash]struct{} // Contract codes that were created (deployed) (codeHash)
+
+	chunkCode  bool                                // Whether only touched chunks of contract codes go into witnesses
+	codeChunks map[common.Hash]map[uint32]struct{} // Chunks of contract codes that have been accessed by the interpreter
+	knownCodes map[common.Hash]struct{}            // Contract codes that went into the earlier witnesses in full
 }
 
 // NewRetainListBuilder creates new ProofGenerator and initialised its maps
@@ -17,6 +21,29 @@ func NewRetainListBuilder() *RetainListBuilder {
 	return &RetainListBuilder{
 		proofCodes:   make(map[common.Hash]struct{}),
 		createdCodes: make(map[common.Hash]struct{}),
+		codeChunks:   make(map[common.Hash]map[uint32]struct{}),
+		knownCodes:   make(map[common.Hash]struct{}),
+	}
+}
+
+// EnableCodeChunks makes the built retain lists put only the touched chunks of contract codes into witnesses
+func (rlb *RetainListBuilder) EnableCodeChunks(enable bool) {
+	rlb.chunkCode = enable
+}
+
+// TouchCode registers that the range of bytes of given contract code has been accessed by the interpreter.
+// The range is expected to be within the code
+func (rlb *RetainListBuilder) TouchCode(codeHash common.Hash, offset, length uint64) {
+	if !rlb.chunkCode || length == 0 {
+		return
+	}
+	chunks, ok := rlb.codeChunks[codeHash]
+	if !ok {
+		chunks = make(map[uint32]struct{})
+		rlb.codeChunks[codeHash] = chunks
+	}
+	for idx := CodeChunkIndex(offset); idx <= CodeChunkIndex(offset+length-1); idx++ {
+		chunks[idx] = struct{}{}
 	}
 }
 
@@ -48,6 +75,13 @@ func (rlb *RetainListBuilder) extractCodeTouches() map[common.Hash]struct{} {
 	return proofCodes
 }
 
+// extractCodeChunkTouches returns the touched chunks of contract codes and clears them for the next block's execution
+func (rlb *RetainListBuilder) extractCodeChunkTouches() map[common.Hash]map[uint32]struct{} {
+	codeChunks := rlb.codeChunks
+	rlb.codeChunks = make(map[common.Hash]map[uint32]struct{})
+	return codeChunks
+}
+
 // ReadCode registers that given contract code has been accessed during current block's execution
 func (rlb *RetainListBuilder) ReadCode(codeHash common.Hash) {
 	if _, ok := rlb.proofCodes[codeHash]; !ok {
@@ -83,5 +117,15 @@ func (rlb *RetainListBuilder) Build(isBinary bool) *RetainList {
 		rl.AddCodeTouch(codeHash)
 	}
 
+	codeChunkTouches := rlb.extractCodeChunkTouches()
+	if rlb.chunkCode {
+		rl.EnableCodeChunks(rlb.knownCodes)
+		for codeHash, chunks := range codeChunkTouches {
+			for idx := range chunks {
+				rl.AddCodeChunkTouch(codeHash, idx)
+			}
+		}
+	}
+
 	return rl
 }
@@ -1339,6 +1339,29 @@ func (t *Trie) GetNodeByHash(hash common.Hash) []byte {
 	return common.CopyBytes(rlp)
 }
 
+// GetNodeByPath gets the RLP of the node starting exactly at the given nibble path, the path goes on into
+// the storage of the account after the 64 nibbles of the account key. Returns nil if there is no such node
+// (for example if the path ends in the middle of an extension), or if the node is not loaded
+func (t *Trie) GetNodeByPath(hex []byte) ([]byte, error) {
+	nd, _, ok, _ := t.getNode(hex, false)
+	if !ok {
+		return nil, nil
+	}
+	switch nd.(type) {
+	case nil, hashNode, valueNode, *accountNode:
+		return nil, nil
+	}
+
+	h := t.getHasher()
+	defer returnHasherToPool(h)
+
+	rlp, err := h.hashChildren(nd, 0)
+	if err != nil {
+		return nil, err
+	}
+	return common.CopyBytes(rlp), nil
+}
+
 func (t *Trie) evictNodeFromHashMap(nd node) {
 	if !debug.IsGetNodeData() || nd == nil {
 		return
@@ -311,6 +311,30 @@ func (tp *Eviction) EvictToFitSize(
 	return evictList(evicter, keys)
 }
 
+// HotKeys returns the keys of the nodes from the most recent generations, such that their total size
+// does not exceed the given limit
+func (tp *Eviction) HotKeys(maxSize uint64) [][]byte {
+	blockNums := make([]uint64, 0, len(tp.generations.blockNumToGeneration))
+	for blockNum := range tp.generations.blockNumToGeneration {
+		blockNums = append(blockNums, blockNum)
+	}
+	sort.Slice(blockNums, func(i, j int) bool { return blockNums[i] > blockNums[j] })
+
+	var keys [][]byte
+	var size uint64
+	for _, blockNum := range blockNums {
+		generation := tp.generations.blockNumToGeneration[blockNum]
+		if size+uint64(generation.totalSize) > maxSize {
+			break
+		}
+		size += uint64(generation.totalSize)
+		for _, k := range generation.keys() {
+			keys = append(keys, []byte(k))
+		}
+	}
+	return keys
+}
+
 func (tp *Eviction) TotalSize() uint64 {
 	return uint64(tp.generations.totalSize)
 }
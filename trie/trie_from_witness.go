@@ -51,6 +51,15 @@ func BuildTrieFromWitness(witness *Witness, isBinary bool, trace bool) (*Trie, e
 				return nil, err
 			}
 
+		case *OperatorCodeChunks:
+			if trace {
+				fmt.Printf("CODECHUNKS(%d) ", len(op.Chunks))
+			}
+			// Only the code hash goes into the trie, the chunks are verified and assembled by the reader of the code
+			if err := hb.hash(op.CodeHash[:]); err != nil {
+				return nil, err
+			}
+
 		case *OperatorLeafAccount:
 			if trace {
 				fmt.Printf("ACCOUNTLEAF(code=%v storage=%v) ", op.HasCode, op.HasStorage)
@@ -0,0 +1,319 @@
+package trie
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+)
+
+// TrieSnapshotVersion is the version of the format of the resident trie snapshot.
+// In case of incompatible changes it should be updated, snapshots of other versions are rejected on load
+const TrieSnapshotVersion = uint8(1)
+
+// Tags of the nodes in the trie snapshot
+const (
+	snapshotNil = iota
+	snapshotHash
+	snapshotShort
+	snapshotDuo
+	snapshotFull
+	snapshotValue
+	snapshotAccount
+)
+
+// WriteSnapshot serialises the resident part of the trie, so that it can be loaded back with LoadSnapshot
+// after restart. Branch nodes for which the retain decider returns false are written as hashes.
+// Contract codes are not written, only their sizes
+func (t *Trie) WriteSnapshot(w io.Writer, rd RetainDecider) error {
+	root := t.Hash()
+	bw := bufio.NewWriter(w)
+	if err := bw.WriteByte(TrieSnapshotVersion); err != nil {
+		return err
+	}
+	if _, err := bw.Write(root[:]); err != nil {
+		return err
+	}
+	sw := &snapshotWriter{w: bw, rd: rd}
+	if err := sw.writeNode(t.root, []byte{}); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// LoadSnapshot reads the snapshot written by WriteSnapshot and hooks it as the root of the trie.
+// The snapshot is only accepted if its root matches the root of the trie, and the trie is not yet loaded
+func (t *Trie) LoadSnapshot(r io.Reader) error {
+	if _, ok := t.root.(hashNode); !ok {
+		return fmt.Errorf("trie is already loaded")
+	}
+	br := bufio.NewReader(r)
+	version, err := br.ReadByte()
+	if err != nil {
+		return err
+	}
+	if version != TrieSnapshotVersion {
+		return fmt.Errorf("unexpected trie snapshot version: expected %d, got %d", TrieSnapshotVersion, version)
+	}
+	var root common.Hash
+	if _, err = io.ReadFull(br, root[:]); err != nil {
+		return err
+	}
+	if expected := t.Hash(); root != expected {
+		return fmt.Errorf("trie snapshot is for root %x, expected %x", root, expected)
+	}
+	h := newHasher(false)
+	defer returnHasherToPool(h)
+	sr := &snapshotReader{r: br, h: h}
+	n, err := sr.readNode()
+	if err != nil {
+		return err
+	}
+	loaded := New(common.Hash{})
+	loaded.root = n
+	if h := loaded.Hash(); h != root {
+		return fmt.Errorf("trie snapshot content hashes to %x, expected %x", h, root)
+	}
+	return t.hook([]byte{}, n, root[:])
+}
+
+type snapshotWriter struct {
+	w   *bufio.Writer
+	rd  RetainDecider
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (sw *snapshotWriter) writeUvarint(v uint64) error {
+	n := binary.PutUvarint(sw.buf[:], v)
+	_, err := sw.w.Write(sw.buf[:n])
+	return err
+}
+
+func (sw *snapshotWriter) writeBytes(b []byte) error {
+	if err := sw.writeUvarint(uint64(len(b))); err != nil {
+		return err
+	}
+	_, err := sw.w.Write(b)
+	return err
+}
+
+func (sw *snapshotWriter) writeHash(hash []byte) error {
+	if err := sw.w.WriteByte(snapshotHash); err != nil {
+		return err
+	}
+	_, err := sw.w.Write(hash)
+	return err
+}
+
+// hashOnly decides whether the branch node at the given prefix can be written as its hash.
+// Nodes which are embedded into their parents (RLP shorter than 32 bytes) are always written in full
+func (sw *snapshotWriter) hashOnly(n node, hex []byte) bool {
+	return sw.rd != nil && !sw.rd.Retain(hex) && len(n.reference()) == common.HashLength
+}
+
+func (sw *snapshotWriter) writeNode(nd node, hex []byte) error {
+	switch n := nd.(type) {
+	case nil:
+		return sw.w.WriteByte(snapshotNil)
+	case hashNode:
+		return sw.writeHash(n.hash)
+	case valueNode:
+		if err := sw.w.WriteByte(snapshotValue); err != nil {
+			return err
+		}
+		return sw.writeBytes(n)
+	case *shortNode:
+		if err := sw.w.WriteByte(snapshotShort); err != nil {
+			return err
+		}
+		if err := sw.writeBytes(n.Key); err != nil {
+			return err
+		}
+		h := n.Key
+		// Remove terminator
+		if h[len(h)-1] == 16 {
+			h = h[:len(h)-1]
+		}
+		return sw.writeNode(n.Val, concat(hex, h...))
+	case *duoNode:
+		if sw.hashOnly(n, hex) {
+			return sw.writeHash(n.reference())
+		}
+		if err := sw.w.WriteByte(snapshotDuo); err != nil {
+			return err
+		}
+		if err := sw.writeUvarint(uint64(n.mask)); err != nil {
+			return err
+		}
+		i1, i2 := n.childrenIdx()
+		if err := sw.writeNode(n.child1, expandKeyHex(hex, i1)); err != nil {
+			return err
+		}
+		return sw.writeNode(n.child2, expandKeyHex(hex, i2))
+	case *fullNode:
+		if sw.hashOnly(n, hex) {
+			return sw.writeHash(n.reference())
+		}
+		if err := sw.w.WriteByte(snapshotFull); err != nil {
+			return err
+		}
+		var mask uint32
+		for i, child := range n.Children {
+			if child != nil {
+				mask |= uint32(1) << uint(i)
+			}
+		}
+		if err := sw.writeUvarint(uint64(mask)); err != nil {
+			return err
+		}
+		for i, child := range n.Children {
+			if child != nil {
+				if err := sw.writeNode(child, expandKeyHex(hex, byte(i))); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	case *accountNode:
+		if err := sw.w.WriteByte(snapshotAccount); err != nil {
+			return err
+		}
+		enc := make([]byte, n.EncodingLengthForStorage())
+		n.EncodeForStorage(enc)
+		if err := sw.writeBytes(enc); err != nil {
+			return err
+		}
+		// Storage encoding of the account does not include the storage root
+		if _, err := sw.w.Write(n.Root[:]); err != nil {
+			return err
+		}
+		codeSize := n.codeSize
+		if n.code != nil {
+			codeSize = len(n.code)
+		}
+		nb := binary.PutVarint(sw.buf[:], int64(codeSize))
+		if _, err := sw.w.Write(sw.buf[:nb]); err != nil {
+			return err
+		}
+		return sw.writeNode(n.storage, hex)
+	default:
+		return fmt.Errorf("unexpected node type in trie snapshot: %T", nd)
+	}
+}
+
+type snapshotReader struct {
+	r *bufio.Reader
+	h *hasher
+}
+
+func (sr *snapshotReader) readBytes() ([]byte, error) {
+	l, err := binary.ReadUvarint(sr.r)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, l)
+	if _, err = io.ReadFull(sr.r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (sr *snapshotReader) readNode() (node, error) {
+	r := sr.r
+	tag, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch tag {
+	case snapshotNil:
+		return nil, nil
+	case snapshotHash:
+		hash := make([]byte, common.HashLength)
+		if _, err = io.ReadFull(r, hash); err != nil {
+			return nil, err
+		}
+		return hashNode{hash: hash}, nil
+	case snapshotValue:
+		value, err := sr.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		return valueNode(value), nil
+	case snapshotShort:
+		key, err := sr.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		if len(key) == 0 {
+			return nil, fmt.Errorf("empty key of short node in trie snapshot")
+		}
+		val, err := sr.readNode()
+		if err != nil {
+			return nil, err
+		}
+		return NewShortNode(key, val), nil
+	case snapshotDuo:
+		mask, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		n := &duoNode{mask: uint32(mask)}
+		if n.child1, err = sr.readNode(); err != nil {
+			return nil, err
+		}
+		if n.child2, err = sr.readNode(); err != nil {
+			return nil, err
+		}
+		return n, nil
+	case snapshotFull:
+		mask, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		n := &fullNode{}
+		for i := range n.Children {
+			if mask&(uint64(1)<<uint(i)) != 0 {
+				if n.Children[i], err = sr.readNode(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return n, nil
+	case snapshotAccount:
+		enc, err := sr.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		n := &accountNode{}
+		if err = n.DecodeForStorage(enc); err != nil {
+			return nil, err
+		}
+		if _, err = io.ReadFull(r, n.Root[:]); err != nil {
+			return nil, err
+		}
+		codeSize, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, err
+		}
+		n.codeSize = int(codeSize)
+		if n.storage, err = sr.readNode(); err != nil {
+			return nil, err
+		}
+		// The storage root is part of the account encoding, so the storage needs to be checked separately
+		storageRoot := EmptyRoot
+		if n.storage != nil {
+			if _, err = sr.h.hash(n.storage, true, storageRoot[:]); err != nil {
+				return nil, err
+			}
+		}
+		if storageRoot != n.Root {
+			return nil, fmt.Errorf("storage in trie snapshot hashes to %x, expected %x", storageRoot, n.Root)
+		}
+		n.rootCorrect = true
+		return n, nil
+	default:
+		return nil, fmt.Errorf("unexpected node tag in trie snapshot: %d", tag)
+	}
+}
@@ -0,0 +1,113 @@
+package trie
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+)
+
+func genSnapshotTestTrie(t *testing.T) (*Trie, []common.Hash) {
+	tr := New(common.Hash{})
+	var addrHashes []common.Hash
+	for i := 0; i < 100; i++ {
+		addrHash := crypto.Keccak256Hash([]byte(fmt.Sprintf("account%d", i)))
+		addrHashes = append(addrHashes, addrHash)
+		acc := accounts.NewAccount()
+		acc.Nonce = uint64(i)
+		acc.Balance = *uint256.NewInt().SetUint64(uint64(i * 1000))
+		acc.Incarnation = uint64(i % 3)
+		tr.UpdateAccount(addrHash[:], &acc)
+		if i%10 == 0 {
+			for j := 0; j < 5; j++ {
+				storageKey := crypto.Keccak256Hash([]byte(fmt.Sprintf("slot%d", j)))
+				tr.Update(append(common.CopyBytes(addrHash[:]), storageKey[:]...), []byte{byte(i), byte(j + 1)})
+			}
+			_, root := tr.DeepHash(addrHash[:])
+			acc.Root = root
+			tr.UpdateAccount(addrHash[:], &acc)
+		}
+	}
+	tr.Hash()
+	return tr, addrHashes
+}
+
+func TestTrieSnapshotFull(t *testing.T) {
+	tr, addrHashes := genSnapshotTestTrie(t)
+	root := tr.Hash()
+
+	var buf bytes.Buffer
+	require.NoError(t, tr.WriteSnapshot(&buf, nil))
+
+	loaded := New(root)
+	eviction := NewEviction()
+	loaded.AddObserver(eviction)
+	require.NoError(t, loaded.LoadSnapshot(&buf))
+	assert.Equal(t, root, loaded.Hash())
+	assert.True(t, eviction.NumberOf() > 0, "loaded branch nodes should be registered for eviction")
+
+	for i, addrHash := range addrHashes {
+		acc, ok := loaded.GetAccount(addrHash[:])
+		require.True(t, ok, "account %d", i)
+		assert.Equal(t, uint64(i), acc.Nonce)
+		assert.Equal(t, uint64(i%3), acc.Incarnation)
+	}
+	storageKey := crypto.Keccak256Hash([]byte("slot2"))
+	v, ok := loaded.Get(append(common.CopyBytes(addrHashes[10][:]), storageKey[:]...))
+	require.True(t, ok)
+	assert.Equal(t, []byte{10, 3}, v)
+}
+
+func TestTrieSnapshotPartial(t *testing.T) {
+	tr, addrHashes := genSnapshotTestTrie(t)
+	root := tr.Hash()
+
+	// Keep only the root and the path to one account
+	rl := NewRetainList(0)
+	rl.AddKey(addrHashes[20][:])
+	var buf bytes.Buffer
+	require.NoError(t, tr.WriteSnapshot(&buf, NewRetainLevels(rl, 0)))
+
+	var fullBuf bytes.Buffer
+	require.NoError(t, tr.WriteSnapshot(&fullBuf, nil))
+	assert.True(t, buf.Len() < fullBuf.Len(), "partial snapshot should be smaller than full")
+
+	loaded := New(root)
+	require.NoError(t, loaded.LoadSnapshot(&buf))
+	assert.Equal(t, root, loaded.Hash())
+
+	_, ok := loaded.GetAccount(addrHashes[20][:])
+	assert.True(t, ok, "retained account should be resident")
+	for _, addrHash := range addrHashes {
+		if addrHash[0]>>4 != addrHashes[20][0]>>4 {
+			_, ok = loaded.GetAccount(addrHash[:])
+			assert.False(t, ok, "not retained account should be hashed")
+			break
+		}
+	}
+}
+
+func TestTrieSnapshotWrongRoot(t *testing.T) {
+	tr, _ := genSnapshotTestTrie(t)
+	var buf bytes.Buffer
+	require.NoError(t, tr.WriteSnapshot(&buf, nil))
+
+	loaded := New(common.HexToHash("0x01"))
+	assert.Error(t, loaded.LoadSnapshot(&buf))
+
+	// Corrupt the content, keeping the header
+	tr2, _ := genSnapshotTestTrie(t)
+	buf.Reset()
+	require.NoError(t, tr2.WriteSnapshot(&buf, nil))
+	data := buf.Bytes()
+	data[len(data)-1] ^= 0xff
+	loaded = New(tr2.Hash())
+	assert.Error(t, loaded.LoadSnapshot(bytes.NewReader(data)))
+}
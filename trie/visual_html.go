@@ -0,0 +1,323 @@
+package trie
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+)
+
+// HTMLVisualOpts contains configuration options of the VisualHTML function
+type HTMLVisualOpts struct {
+	Title   string              // Title of the page
+	Prefix  []byte              // Path (in nibbles) of the subtree being visualised, the drawing starts at the node at this path
+	Touched map[string]struct{} // References of the nodes to be highlighted, see NodeReferences
+}
+
+// htmlVisualNode is the description of a node passed to the script drawing the trie
+type htmlVisualNode struct {
+	Kind     string            `json:"kind"`            // full, duo, short, leaf, account, storage, hash
+	Path     string            `json:"path"`            // path of the node from the root, in nibbles
+	Key      string            `json:"key,omitempty"`   // key of the short node, in nibbles
+	Size     int               `json:"size"`            // size of the RLP encoding of the node
+	Hash     string            `json:"hash,omitempty"`  // hash of the node, if it is not embedded into the parent
+	Label    string            `json:"label,omitempty"` // description of the value or the account
+	Touched  bool              `json:"touched,omitempty"`
+	Children []*htmlVisualNode `json:"children,omitempty"`
+}
+
+// NodeReferences returns the references of all the nodes present in the trie, not counting the hash nodes.
+// The reference of a node is its hash, or its RLP encoding if that is shorter than 32 bytes
+func (t *Trie) NodeReferences() map[string]struct{} {
+	refs := make(map[string]struct{})
+	if t.root == nil {
+		return refs
+	}
+	t.Hash()
+	nodeReferences(t.root, refs)
+	return refs
+}
+
+func nodeReferences(nd node, refs map[string]struct{}) {
+	switch n := nd.(type) {
+	case *shortNode:
+		refs[string(n.reference())] = struct{}{}
+		nodeReferences(n.Val, refs)
+	case *duoNode:
+		refs[string(n.reference())] = struct{}{}
+		nodeReferences(n.child1, refs)
+		nodeReferences(n.child2, refs)
+	case *fullNode:
+		refs[string(n.reference())] = struct{}{}
+		for _, child := range n.Children {
+			nodeReferences(child, refs)
+		}
+	case *accountNode:
+		nodeReferences(n.storage, refs)
+	}
+}
+
+// VisualHTML writes a self-contained HTML page with an interactive SVG drawing of the trie.
+// Branches can be collapsed by clicking on the nodes, the sizes of the circles reflect the sizes of the nodes
+func VisualHTML(t *Trie, w io.Writer, opts *HTMLVisualOpts) error {
+	t.Hash()
+	h := newHasher(false)
+	defer returnHasherToPool(h)
+	nd, hex := subtrieAt(t.root, opts.Prefix)
+	root, err := visualHTMLNode(h, nd, hex, opts)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(root)
+	if err != nil {
+		return err
+	}
+	return visualHTMLTemplate.Execute(w, struct {
+		Title string
+		Data  template.JS
+	}{Title: opts.Title, Data: template.JS(data)})
+}
+
+// subtrieAt returns the node at the path given by the prefix, and its path. If the prefix ends in the middle of
+// the key of a short node, the short node is returned with its own (shorter) path. The nil node is returned
+// if there are no nodes under the prefix
+func subtrieAt(nd node, prefix []byte) (node, []byte) {
+	var hex []byte
+	for len(hex) < len(prefix) {
+		switch n := nd.(type) {
+		case *shortNode:
+			rest := prefix[len(hex):]
+			matchlen := prefixLen(rest, n.Key)
+			if matchlen == len(rest) {
+				return n, hex
+			}
+			if matchlen < len(n.Key) {
+				return nil, nil
+			}
+			if _, ok := n.Val.(*accountNode); ok {
+				return n, hex
+			}
+			hex = concat(hex, n.Key...)
+			nd = n.Val
+		case *duoNode:
+			i1, i2 := n.childrenIdx()
+			switch prefix[len(hex)] {
+			case i1:
+				nd = n.child1
+			case i2:
+				nd = n.child2
+			default:
+				return nil, nil
+			}
+			hex = concat(hex, prefix[len(hex)])
+		case *fullNode:
+			nd = n.Children[prefix[len(hex)]]
+			hex = concat(hex, prefix[len(hex)])
+		default:
+			// The subtree under the hash node is not loaded
+			return nd, hex
+		}
+		if nd == nil {
+			return nil, nil
+		}
+	}
+	return nd, hex
+}
+
+func visualHTMLNode(h *hasher, nd node, hex []byte, opts *HTMLVisualOpts) (*htmlVisualNode, error) {
+	if nd == nil {
+		return nil, nil
+	}
+	vn := &htmlVisualNode{Path: nibblesToString(hex)}
+	if hn, ok := nd.(hashNode); ok {
+		vn.Kind = "hash"
+		vn.Size = common.HashLength
+		vn.Hash = fmt.Sprintf("%x", hn.hash)
+		return vn, nil
+	}
+	if an, ok := nd.(*accountNode); ok {
+		// Root of the storage trie of the account
+		vn, err := visualHTMLNode(h, an.storage, hex, opts)
+		if vn != nil && vn.Kind != "hash" {
+			vn.Label = "storage"
+		}
+		return vn, err
+	}
+	rlp, err := h.hashChildren(nd, 0)
+	if err != nil {
+		return nil, err
+	}
+	vn.Size = len(rlp)
+	ref := nd.reference()
+	if len(ref) == common.HashLength {
+		vn.Hash = fmt.Sprintf("%x", ref)
+	}
+	_, vn.Touched = opts.Touched[string(ref)]
+
+	addChild := func(child node, childHex []byte) error {
+		c, err := visualHTMLNode(h, child, childHex, opts)
+		if err != nil {
+			return err
+		}
+		if c != nil {
+			vn.Children = append(vn.Children, c)
+		}
+		return nil
+	}
+	switch n := nd.(type) {
+	case *shortNode:
+		vn.Kind = "short"
+		vn.Key = nibblesToString(n.Key)
+		switch v := n.Val.(type) {
+		case valueNode:
+			vn.Kind = "leaf"
+			vn.Label = fmt.Sprintf("value %x", []byte(v))
+		case *accountNode:
+			vn.Kind = "account"
+			vn.Label = fmt.Sprintf("nonce %d, balance %s", v.Nonce, v.Balance.ToBig())
+			if !v.IsEmptyRoot() {
+				if err := addChild(v, concat(hex, n.Key[:len(n.Key)-1]...)); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			if err := addChild(n.Val, concat(hex, n.Key...)); err != nil {
+				return nil, err
+			}
+		}
+	case *duoNode:
+		vn.Kind = "duo"
+		i1, i2 := n.childrenIdx()
+		if err := addChild(n.child1, concat(hex, i1)); err != nil {
+			return nil, err
+		}
+		if err := addChild(n.child2, concat(hex, i2)); err != nil {
+			return nil, err
+		}
+	case *fullNode:
+		vn.Kind = "full"
+		for i, child := range n.Children {
+			if err := addChild(child, concat(hex, byte(i))); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unexpected node type %T", nd)
+	}
+	return vn, nil
+}
+
+// nibblesToString prints the nibbles as hex digits, omitting the terminator
+func nibblesToString(nibbles []byte) string {
+	const digits = "0123456789abcdef"
+	s := make([]byte, 0, len(nibbles))
+	for _, n := range nibbles {
+		if n < 16 {
+			s = append(s, digits[n])
+		}
+	}
+	return string(s)
+}
+
+var visualHTMLTemplate = template.Must(template.New("trie").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: monospace; margin: 0; }
+header { padding: 8px; border-bottom: 1px solid #ccc; }
+#info { padding: 8px; white-space: pre; min-height: 4em; }
+circle { cursor: pointer; stroke: #333; stroke-width: 1; }
+circle.touched { stroke: #e15759; stroke-width: 4; }
+circle.collapsed { stroke-dasharray: 3,2; }
+line { stroke: #999; }
+text { font-size: 10px; pointer-events: none; }
+.full { fill: #4e79a7; } .duo { fill: #a0cbe8; } .short { fill: #f28e2b; }
+.leaf { fill: #76b7b2; } .account { fill: #59a14f; } .hash { fill: #bab0ab; }
+</style>
+</head>
+<body>
+<header><b>{{.Title}}</b> &mdash; click a node to collapse or expand it, hover to see the details.
+Highlighted nodes are touched by the witness.</header>
+<div id="info"></div>
+<svg id="trie" xmlns="http://www.w3.org/2000/svg"></svg>
+<script>
+const root = {{.Data}};
+const svg = document.getElementById("trie");
+const info = document.getElementById("info");
+const dx = 24, dy = 70, ns = "http://www.w3.org/2000/svg";
+
+function radius(n) { return Math.min(4 + Math.sqrt(n.size) / 2, 20); }
+
+function layout(n, depth, next) {
+	n.y = 30 + depth * dy;
+	const children = (!n.collapsed && n.children) || [];
+	if (children.length === 0) {
+		n.x = next.x;
+		next.x += dx;
+		return;
+	}
+	children.forEach(c => layout(c, depth + 1, next));
+	n.x = (children[0].x + children[children.length - 1].x) / 2;
+}
+
+function el(name, attrs, parent) {
+	const e = document.createElementNS(ns, name);
+	for (const k in attrs) e.setAttribute(k, attrs[k]);
+	parent.appendChild(e);
+	return e;
+}
+
+function describe(n) {
+	let s = n.kind + " node, path " + (n.path || "(root)") + ", size " + n.size + " bytes";
+	if (n.key) s += "\nkey " + n.key;
+	if (n.hash) s += "\nhash " + n.hash;
+	if (n.label) s += "\n" + n.label;
+	if (n.touched) s += "\ntouched by the witness";
+	return s;
+}
+
+function draw(n, parent) {
+	const children = (!n.collapsed && n.children) || [];
+	children.forEach(c => {
+		el("line", {x1: n.x, y1: n.y, x2: c.x, y2: c.y}, parent);
+		draw(c, parent);
+	});
+	let cls = n.kind;
+	if (n.touched) cls += " touched";
+	if (n.collapsed) cls += " collapsed";
+	const c = el("circle", {cx: n.x, cy: n.y, r: radius(n), "class": cls}, parent);
+	el("title", {}, c).textContent = describe(n);
+	c.addEventListener("mouseover", () => { info.textContent = describe(n); });
+	c.addEventListener("click", () => {
+		if (n.children) {
+			n.collapsed = !n.collapsed;
+			render();
+		}
+	});
+	if (n.key) {
+		const key = n.key.length > 8 ? n.key.substring(0, 8) + "…" : n.key;
+		el("text", {x: n.x + radius(n) + 2, y: n.y + 3}, parent).textContent = key;
+	}
+}
+
+function render() {
+	while (svg.firstChild) svg.removeChild(svg.firstChild);
+	if (!root) return;
+	const next = {x: 30};
+	layout(root, 0, next);
+	let maxY = 0;
+	(function depth(n) { maxY = Math.max(maxY, n.y); if (!n.collapsed && n.children) n.children.forEach(depth); })(root);
+	svg.setAttribute("width", next.x + 200);
+	svg.setAttribute("height", maxY + 40);
+	draw(root, el("g", {}, svg));
+}
+
+render();
+</script>
+</body>
+</html>
+`))
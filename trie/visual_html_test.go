@@ -0,0 +1,119 @@
+package trie
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+)
+
+func TestVisualHTML(t *testing.T) {
+	tr := New(common.Hash{})
+	var keys [][]byte
+	for i := 0; i < 50; i++ {
+		addrHash := crypto.Keccak256([]byte(fmt.Sprintf("account%d", i)))
+		acc := accounts.NewAccount()
+		acc.Nonce = uint64(i)
+		acc.Balance = *uint256.NewInt().SetUint64(uint64(i))
+		tr.UpdateAccount(addrHash, &acc)
+		keys = append(keys, addrHash)
+	}
+	all := tr.NodeReferences()
+
+	// Witness touching a single account
+	rl := NewRetainList(0)
+	rl.AddKey(keybytesToHex(keys[7])[:2*common.HashLength])
+	witness, err := tr.ExtractWitness(false, rl)
+	require.NoError(t, err)
+	wt, err := BuildTrieFromWitness(witness, false, false)
+	require.NoError(t, err)
+	touched := wt.NodeReferences()
+	require.NotEmpty(t, touched)
+	assert.Less(t, len(touched), len(all))
+	for ref := range touched {
+		assert.Contains(t, all, ref)
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, VisualHTML(tr, &buf, &HTMLVisualOpts{Title: "test", Touched: touched}))
+	out := buf.String()
+	assert.True(t, strings.HasPrefix(out, "<!DOCTYPE html>"))
+	assert.Contains(t, out, `"kind":"account"`)
+	assert.Contains(t, out, `"touched":true`)
+	assert.Contains(t, out, fmt.Sprintf(`"hash":"%x"`, tr.Hash()))
+}
+
+func TestVisualHTMLPrefix(t *testing.T) {
+	tr := New(common.Hash{})
+	var keys [][]byte
+	for i := 0; i < 50; i++ {
+		addrHash := crypto.Keccak256([]byte(fmt.Sprintf("account%d", i)))
+		acc := accounts.NewAccount()
+		acc.Nonce = uint64(i)
+		tr.UpdateAccount(addrHash, &acc)
+		keys = append(keys, addrHash)
+	}
+
+	// visualHTMLData returns the accounts drawn, by their full paths, and the path of the root
+	visualHTMLData := func(prefix []byte) (map[string]struct{}, string) {
+		var buf bytes.Buffer
+		require.NoError(t, VisualHTML(tr, &buf, &HTMLVisualOpts{Title: "test", Prefix: prefix}))
+		out := buf.String()
+		start := strings.Index(out, "const root = ") + len("const root = ")
+		end := start + strings.Index(out[start:], ";\n")
+		var root *htmlVisualNode
+		require.NoError(t, json.Unmarshal([]byte(out[start:end]), &root))
+		drawn := make(map[string]struct{})
+		if root == nil {
+			return drawn, ""
+		}
+		var walk func(n *htmlVisualNode)
+		walk = func(n *htmlVisualNode) {
+			if n.Kind == "account" {
+				drawn[n.Path+n.Key] = struct{}{}
+			}
+			for _, c := range n.Children {
+				walk(c)
+			}
+		}
+		walk(root)
+		return drawn, root.Path
+	}
+
+	for _, prefix := range [][]byte{keybytesToHex(keys[3])[:1], keybytesToHex(keys[3])[:2], keybytesToHex(keys[3])[:10]} {
+		expected := make(map[string]struct{})
+		for _, key := range keys {
+			if hex := keybytesToHex(key); bytes.HasPrefix(hex, prefix) {
+				expected[nibblesToString(hex)] = struct{}{}
+			}
+		}
+		drawn, rootPath := visualHTMLData(prefix)
+		assert.Equal(t, expected, drawn, "prefix %x", prefix)
+		assert.True(t, strings.HasPrefix(nibblesToString(prefix), rootPath), "root path %s, prefix %x", rootPath, prefix)
+	}
+	// No accounts under the prefix
+	for nibble := byte(0); nibble < 16; nibble++ {
+		prefix := []byte{keybytesToHex(keys[3])[0], nibble}
+		empty := true
+		for _, key := range keys {
+			if bytes.HasPrefix(keybytesToHex(key), prefix) {
+				empty = false
+			}
+		}
+		if empty {
+			drawn, rootPath := visualHTMLData(prefix)
+			assert.Empty(t, drawn)
+			assert.Empty(t, rootPath)
+			return
+		}
+	}
+}
@@ -106,6 +106,8 @@ func NewWitnessFromReader(input io.Reader, trace bool) (*Witness, error) {
 			op = &OperatorEmptyRoot{}
 		case OpExtension:
 			op = &OperatorExtension{}
+		case OpCodeChunks:
+			op = &OperatorCodeChunks{}
 		case OpNewTrie:
 			/* end of the current trie, end the function */
 			break
@@ -186,6 +188,18 @@ func (w *Witness) WriteDiff(w2 *Witness, output io.Writer) {
 			if !bytes.Equal(o1.Code, o2.Code) {
 				fmt.Fprintf(output, "o1[%d].Code = %x; o2[%d].Code = %x\n", i, o1.Code, i, o2.Code)
 			}
+		case *OperatorCodeChunks:
+			o2, ok := w2.Operators[i].(*OperatorCodeChunks)
+			if !ok {
+				fmt.Fprintf(output, "o1[%d] = %T %+v; o2[%d] = %T %+v\n", i, o1, o1, i, o2, o2)
+				continue
+			}
+			if o1.CodeHash != o2.CodeHash || o1.CodeRoot != o2.CodeRoot || o1.CodeSize != o2.CodeSize {
+				fmt.Fprintf(output, "codeChunks o1[%d] = %x %x %d; o2[%d] = %x %x %d\n", i, o1.CodeHash, o1.CodeRoot, o1.CodeSize, i, o2.CodeHash, o2.CodeRoot, o2.CodeSize)
+			}
+			if len(o1.Chunks) != len(o2.Chunks) || len(o1.Proof) != len(o2.Proof) {
+				fmt.Fprintf(output, "codeChunks o1[%d] chunks %d proof %d; o2[%d] chunks %d proof %d\n", i, len(o1.Chunks), len(o1.Proof), i, len(o2.Chunks), len(o2.Proof))
+			}
 		case *OperatorEmptyRoot:
 			o2, ok := w2.Operators[i].(*OperatorEmptyRoot)
 			if !ok {
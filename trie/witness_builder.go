@@ -141,6 +141,25 @@ func (b *WitnessBuilder) addCodeOp(code []byte) error {
 	return nil
 }
 
+func (b *WitnessBuilder) addCodeChunksOp(codeHash common.Hash, code []byte, indices []uint32) error {
+	if b.trace {
+		fmt.Printf("CODECHUNKS: len=%d chunks=%v\n", len(code), indices)
+	}
+
+	var op OperatorCodeChunks
+	op.CodeHash = codeHash
+	op.CodeSize = uint64(len(code))
+	var chunks []CodeChunk
+	op.CodeRoot, chunks, op.Proof = ProveCodeChunks(code, indices)
+	op.Chunks = make([]CodeChunk, len(chunks))
+	for i, chunk := range chunks {
+		op.Chunks[i] = CodeChunk{Index: chunk.Index, FirstInstructionOffset: chunk.FirstInstructionOffset, Code: common.CopyBytes(chunk.Code)}
+	}
+
+	b.operands = append(b.operands, &op)
+	return nil
+}
+
 func (b *WitnessBuilder) addEmptyRoot() error {
 	if b.trace {
 		fmt.Printf("EMPTY ROOT\n")
@@ -163,6 +182,12 @@ func (b *WitnessBuilder) processAccountCode(n *accountNode, retainDec RetainDeci
 		return codeSize, b.addHashOp(hashNode{hash: n.CodeHash[:]})
 	}
 
+	if chunkDec, ok := retainDec.(CodeChunkDecider); ok {
+		if indices, chunked := chunkDec.CodeChunksTouched(n.CodeHash); chunked {
+			return len(n.code), b.addCodeChunksOp(n.CodeHash, n.code, indices)
+		}
+	}
+
 	return len(n.code), b.addCodeOp(n.code)
 }
 
@@ -1,6 +1,7 @@
 package trie
 
 import (
+	"fmt"
 	"math/big"
 
 	"github.com/ledgerwatch/turbo-geth/common"
@@ -34,6 +35,9 @@ const (
 	OpAccountLeaf
 	// OpEmptyRoot places nil onto the node stack, and empty root hash onto the hash stack.
 	OpEmptyRoot
+	// OpCodeChunks carries only the chunks of the contract code touched during the block execution, together with
+	// the proof for them against the code merkle root. It places nil onto the node stack, and code hash onto the hash stack.
+	OpCodeChunks
 
 	// OpNewTrie stops the processing, because another trie is encoded into the witness.
 	OpNewTrie = OperatorKindCode(0xBB)
@@ -281,3 +285,107 @@ func (o *OperatorExtension) LoadFrom(loader *OperatorUnmarshaller) error {
 
 	return nil
 }
+
+type OperatorCodeChunks struct {
+	CodeHash common.Hash
+	CodeRoot common.Hash
+	CodeSize uint64
+	Chunks   []CodeChunk
+	Proof    []common.Hash
+}
+
+func (o *OperatorCodeChunks) WriteTo(output *OperatorMarshaller) error {
+	if err := output.WriteOpCode(OpCodeChunks); err != nil {
+		return err
+	}
+	if err := output.WriteHash(o.CodeHash); err != nil {
+		return err
+	}
+	if err := output.WriteHash(o.CodeRoot); err != nil {
+		return err
+	}
+
+	encoder := codec.NewEncoder(output.WithColumn(ColumnStructure), &cbor)
+	if err := encoder.Encode(o.CodeSize); err != nil {
+		return err
+	}
+	if err := encoder.Encode(uint32(len(o.Chunks))); err != nil {
+		return err
+	}
+	for _, chunk := range o.Chunks {
+		if err := encoder.Encode(chunk.Index); err != nil {
+			return err
+		}
+		if _, err := output.WithColumn(ColumnCodes).Write([]byte{chunk.FirstInstructionOffset}); err != nil {
+			return err
+		}
+		if err := output.WriteCode(chunk.Code); err != nil {
+			return err
+		}
+		output.WithColumn(ColumnStructure)
+	}
+	if err := encoder.Encode(uint32(len(o.Proof))); err != nil {
+		return err
+	}
+	for _, hash := range o.Proof {
+		if err := output.WriteHash(hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *OperatorCodeChunks) LoadFrom(loader *OperatorUnmarshaller) error {
+	var err error
+	if o.CodeHash, err = loader.ReadHash(); err != nil {
+		return err
+	}
+	if o.CodeRoot, err = loader.ReadHash(); err != nil {
+		return err
+	}
+	if o.CodeSize, err = loader.ReadUInt64(); err != nil {
+		return err
+	}
+
+	chunksCount, err := loader.ReadUint32()
+	if err != nil {
+		return err
+	}
+	o.Chunks = make([]CodeChunk, chunksCount)
+	for i := range o.Chunks {
+		if o.Chunks[i].Index, err = loader.ReadUint32(); err != nil {
+			return err
+		}
+		if o.Chunks[i].FirstInstructionOffset, err = loader.ReadByte(); err != nil {
+			return err
+		}
+		if o.Chunks[i].Code, err = loader.ReadByteArray(); err != nil {
+			return err
+		}
+	}
+
+	proofLen, err := loader.ReadUint32()
+	if err != nil {
+		return err
+	}
+	o.Proof = make([]common.Hash, proofLen)
+	for i := range o.Proof {
+		if o.Proof[i], err = loader.ReadHash(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Verify checks the chunks against the code merkle root registered for the code hash. The root carried by the
+// operator is not trusted, because nothing but the code hash is authenticated by the state trie
+func (o *OperatorCodeChunks) Verify(codeRoots CodeRoots) error {
+	root, ok := codeRoots[o.CodeHash]
+	if !ok {
+		return fmt.Errorf("code root of %x is unknown", o.CodeHash)
+	}
+	if o.CodeRoot != root {
+		return fmt.Errorf("code root of %x is %x, expected %x", o.CodeHash, o.CodeRoot, root)
+	}
+	return VerifyCodeChunks(root, int(o.CodeSize), o.Chunks, o.Proof)
+}